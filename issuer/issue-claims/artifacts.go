@@ -0,0 +1,305 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The kinds of artifacts that proving and verifying with a circuit take, and the files they are installed as
+const (
+	artifactWasm            = "wasm"
+	artifactZkey            = "zkey"
+	artifactVerificationKey = "verificationKey"
+)
+
+var artifactKinds = []string{artifactWasm, artifactZkey, artifactVerificationKey}
+
+var artifactFiles = map[string]string{
+	artifactWasm:            "circuit.wasm",
+	artifactZkey:            "circuit_final.zkey",
+	artifactVerificationKey: "verification_key.json",
+}
+
+// pinnedArtifact is where an artifact is downloaded from, and the SHA-256 checksum that it must have
+type pinnedArtifact struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// circuitsConfig is the "circuits" section of the artifacts config: the artifacts of each circuit by kind
+type circuitsConfig struct {
+	Circuits map[string]map[string]*pinnedArtifact `json:"circuits"`
+}
+
+// circuitArtifacts resolves the artifacts that the proofs are generated and verified with. An artifact is
+// given by path or installed with circuits fetch, and is only used if its checksum matches the one pinned in
+// the config, unless insecure artifacts are allowed.
+type circuitArtifacts struct {
+	config   string
+	dir      string
+	insecure bool
+}
+
+// artifacts are the artifacts of the command, configured by its options
+var artifacts = &circuitArtifacts{config: defaultCircuitsConfigPath(), dir: defaultCircuitsDir()}
+
+func defaultCircuitsConfigPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_circuits.json")
+}
+
+func defaultCircuitsDir() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_circuits")
+}
+
+// register adds the options that configure the artifacts to the options of a command
+func (a *circuitArtifacts) register(fs *flag.FlagSet) {
+	fs.StringVar(&a.config, "circuits-config", a.config, "path of the config of the circuit artifacts, with their URLs and pinned SHA-256 checksums")
+	fs.StringVar(&a.dir, "circuits-dir", a.dir, "directory that circuits fetch installs the circuit artifacts in")
+	fs.BoolVar(&a.insecure, "insecure-artifacts", a.insecure, "use circuit artifacts whose checksum is not pinned or doesn't match, for development only")
+}
+
+func (a *circuitArtifacts) readConfig() (*circuitsConfig, error) {
+	b, err := os.ReadFile(a.config)
+	if os.IsNotExist(err) {
+		return &circuitsConfig{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var config circuitsConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid circuits config %s: %s", a.config, err))
+	}
+	for circuit, kinds := range config.Circuits {
+		for kind, pin := range kinds {
+			if _, ok := artifactFiles[kind]; !ok {
+				return nil, withCode(errCodeInvalidInput, fmt.Errorf("unknown artifact %q of %s in %s, must be one of %s", kind, circuit, a.config, strings.Join(artifactKinds, ", ")))
+			}
+			if pin == nil || pin.URL == "" || len(pin.SHA256) != sha256.Size*2 {
+				return nil, withCode(errCodeInvalidInput, fmt.Errorf("the %s of %s in %s needs a url and a hex sha256", kind, circuit, a.config))
+			}
+		}
+	}
+	return &config, nil
+}
+
+// installedPath is the path that circuits fetch installs an artifact at
+func (a *circuitArtifacts) installedPath(circuit, kind string) string {
+	return filepath.Join(a.dir, circuit, artifactFiles[kind])
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// check verifies the checksum of an artifact against the one pinned in the config
+func (a *circuitArtifacts) check(config *circuitsConfig, circuit, kind, path string) error {
+	pin := config.Circuits[circuit][kind]
+	if pin == nil {
+		return fmt.Errorf("no checksum of the %s of %s is pinned in %s", kind, circuit, a.config)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, pin.SHA256) {
+		return fmt.Errorf("the checksum of %s is %s, the %s of %s is pinned to %s", path, sum, kind, circuit, pin.SHA256)
+	}
+	return nil
+}
+
+// resolve returns the path of an artifact to use, either the given path or the installed artifact, after
+// verifying its checksum. It returns an empty path if no path is given and the artifact is not installed.
+func (a *circuitArtifacts) resolve(circuit, kind, path string) (string, error) {
+	if path == "" {
+		path = a.installedPath(circuit, kind)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return "", nil
+		}
+	}
+	config, err := a.readConfig()
+	if err != nil {
+		return "", err
+	}
+	if err := a.check(config, circuit, kind, path); err != nil {
+		if !a.insecure {
+			return "", withCode(errCodeVerificationFailed, fmt.Errorf("%s, fetch the artifact with circuits fetch, or pass --insecure-artifacts to use it anyway", err), "circuit", circuit, "artifact", kind)
+		}
+		fmt.Printf("-> Using the unverified %s of %s: %s\n", kind, circuit, err)
+		return path, nil
+	}
+	fmt.Printf("-> Using the %s of %s at %s, its checksum matches\n", kind, circuit, path)
+	return path, nil
+}
+
+// fetch downloads an artifact and installs it once its checksum matches, through a temporary file so that
+// a failed download leaves the installed artifact in place
+func (a *circuitArtifacts) fetch(ctx context.Context, circuit, kind string, pin *pinnedArtifact) error {
+	path := a.installedPath(circuit, kind)
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	var src io.ReadCloser
+	if strings.HasPrefix(pin.URL, "http://") || strings.HasPrefix(pin.URL, "https://") {
+		// the zkeys run into the hundreds of megabytes, so the timeout is generous
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, pin.URL, nil)
+		if err != nil {
+			return withCode(errCodeInvalidInput, err, "url", pin.URL)
+		}
+		client := &http.Client{Timeout: 30 * time.Minute}
+		res, err := client.Do(req)
+		if err != nil {
+			return withCode(errCodeUnavailable, err, "url", pin.URL)
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return withCode(errCodeUnavailable, fmt.Errorf("%s responded with %s", pin.URL, res.Status), "url", pin.URL)
+		}
+		src = res.Body
+	} else {
+		f, err := os.Open(pin.URL)
+		if err != nil {
+			return err
+		}
+		src = f
+	}
+	defer src.Close()
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), src); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, pin.SHA256) {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the checksum of the %s of %s downloaded from %s is %s, it is pinned to %s", kind, circuit, pin.URL, sum, pin.SHA256), "circuit", circuit, "artifact", kind)
+	}
+	return os.Rename(tmp, path)
+}
+
+// circuitsCommand handles the "circuits" subcommands, that install the circuit artifacts of the config and
+// show whether the installed ones match their checksums
+func circuitsCommand(args []string) error {
+	usage := usageError("usage: circuits fetch [<circuit>...] | circuits list")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("circuits "+args[0], flag.ExitOnError)
+	artifacts.register(fs)
+	readOnly.register(fs, args[0] == "list")
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args[1:])
+	config, err := artifacts.readConfig()
+	if err != nil {
+		return err
+	}
+	var circuits []string
+	for circuit := range config.Circuits {
+		circuits = append(circuits, circuit)
+	}
+	sort.Strings(circuits)
+
+	switch args[0] {
+	case "fetch":
+		if _, err := operators.authorize(roleAdmin); err != nil {
+			return fmt.Errorf("not authorized to fetch the circuit artifacts: %w", err)
+		}
+		if fs.NArg() > 0 {
+			circuits = fs.Args()
+		}
+		if len(circuits) == 0 {
+			return withCode(errCodeNotFound, fmt.Errorf("no circuits are configured in %s", artifacts.config))
+		}
+		ctx, cancel := newCommandContext(0)
+		defer cancel()
+		for _, circuit := range circuits {
+			kinds, ok := config.Circuits[circuit]
+			if !ok {
+				return withCode(errCodeNotFound, fmt.Errorf("the circuit %s is not configured in %s", circuit, artifacts.config), "circuit", circuit)
+			}
+			for _, kind := range artifactKinds {
+				pin := kinds[kind]
+				if pin == nil {
+					continue
+				}
+				if artifacts.check(config, circuit, kind, artifacts.installedPath(circuit, kind)) == nil {
+					fmt.Printf("-> The %s of %s is already installed\n", kind, circuit)
+					continue
+				}
+				if err := artifacts.fetch(ctx, circuit, kind, pin); err != nil {
+					return err
+				}
+				fmt.Printf("-> Installed the %s of %s from %s at %s\n", kind, circuit, pin.URL, artifacts.installedPath(circuit, kind))
+			}
+		}
+	case "list":
+		for _, circuit := range circuits {
+			for _, kind := range artifactKinds {
+				if config.Circuits[circuit][kind] == nil {
+					continue
+				}
+				path := artifacts.installedPath(circuit, kind)
+				status := "verified"
+				if _, err := os.Stat(path); os.IsNotExist(err) {
+					status = "not installed"
+				} else if err := artifacts.check(config, circuit, kind, path); err != nil {
+					status = "checksum mismatch"
+				}
+				fmt.Printf("%s\t%s\t%s\t%s\n", circuit, kind, status, path)
+			}
+		}
+	default:
+		return usage
+	}
+	return nil
+}
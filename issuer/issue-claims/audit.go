@@ -0,0 +1,486 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	merkletree "github.com/iden3/go-merkletree-sql"
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+const (
+	auditCompleted = "completed"
+	auditAborted   = "aborted"
+)
+
+// auditEntryVersion is the version of the entries that are written. From version 2, an entry is hashed with
+// its sensitive params replaced by their hashes, so that erase can scrub the params without breaking the
+// chain of hashes.
+const auditEntryVersion = 2
+
+// sensitiveAuditParams are the params that hold personal data, when the audit log records them in plaintext
+var sensitiveAuditParams = []string{"subject", "claim"}
+
+// auditEntry records a state-changing operation of an issuer. Every entry carries the hash of the
+// entry before it, so that removing or modifying an entry breaks the chain of hashes.
+type auditEntry struct {
+	Version   int               `json:"version,omitempty"`
+	Seq       int               `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Operation string            `json:"operation"`
+	Status    string            `json:"status"`
+	Params    map[string]string `json:"params,omitempty"`
+	Operator  string            `json:"operator,omitempty"`
+	OldState  string            `json:"oldState,omitempty"`
+	NewState  string            `json:"newState,omitempty"`
+	PrevHash  string            `json:"prevHash"`
+	Hash      string            `json:"hash"`
+	// Erased marks an entry whose sensitive params were scrubbed by erase, which is not hashed
+	Erased bool `json:"erased,omitempty"`
+}
+
+// calculateHash hashes the entry with every field but the hash itself and the erased mark
+func (e auditEntry) calculateHash() string {
+	return e.hash(e.Version >= 2)
+}
+
+// scrubbedHash hashes the entry like calculateHash, but with the sensitive params replaced by their hashes
+// whatever its version. The erase entry records it for the entries written before version 2 that it
+// erases, as their own hash can't be calculated anymore.
+func (e auditEntry) scrubbedHash() string {
+	return e.hash(true)
+}
+
+func (e auditEntry) hash(scrub bool) string {
+	e.Hash = ""
+	e.Erased = false
+	if scrub {
+		e.Params = scrubbedParams(e.Params)
+	}
+	b, _ := json.Marshal(e)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// scrubbedParams returns a copy of the params with the sensitive params that are in plaintext replaced by
+// their hashes
+func scrubbedParams(params map[string]string) map[string]string {
+	scrubbed := make(map[string]string, len(params))
+	for k, v := range params {
+		scrubbed[k] = v
+	}
+	for _, k := range sensitiveAuditParams {
+		if v, ok := scrubbed[k]; ok && !strings.HasPrefix(v, "sha256:") {
+			scrubbed[k] = hashOf(v)
+		}
+	}
+	return scrubbed
+}
+
+// auditLog is an append-only file with one JSON entry per line. In a dry run, the entries are
+// chained as usual but not written. The entries record the operator that was authorized to run them.
+// The subjects and the data of the claims are recorded as their hashes, unless plaintext is set.
+type auditLog struct {
+	path      string
+	seq       int
+	prevHash  string
+	dryRun    bool
+	operator  string
+	plaintext bool
+	// signatures counts the signatures of the issuer key so far, each entry records those made since the
+	// entry before it, so that the count is written along with the operation
+	signatures func() int
+	counted    int
+}
+
+func defaultAuditLogPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_audit.log")
+}
+
+func readAuditLog(path string) ([]*auditEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*auditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d of the audit log is not a valid entry: %s", line, err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, scanner.Err()
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	entries, err := readAuditLog(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &auditLog{path: path}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		l.seq = last.Seq
+		l.prevHash = last.Hash
+	}
+	return l, nil
+}
+
+func (l *auditLog) record(operation, status string, params map[string]string, oldState, newState *merkletree.Hash) error {
+	signed := 0
+	if l.signatures != nil {
+		signed = l.signatures() - l.counted
+	}
+	if signed > 0 {
+		if params == nil {
+			params = map[string]string{}
+		}
+		params["signatures"] = strconv.Itoa(signed)
+	}
+	e := auditEntry{
+		Version:   auditEntryVersion,
+		Seq:       l.seq + 1,
+		Time:      now().UTC(),
+		Operation: operation,
+		Status:    status,
+		Params:    params,
+		Operator:  l.operator,
+		PrevHash:  l.prevHash,
+	}
+	if oldState != nil {
+		e.OldState = oldState.BigInt().String()
+	}
+	if newState != nil {
+		e.NewState = newState.BigInt().String()
+	}
+	e.Hash = e.calculateHash()
+	if l.dryRun {
+		l.seq = e.Seq
+		l.prevHash = e.Hash
+		l.counted += signed
+		return nil
+	}
+
+	if err := readOnly.check(l.path); err != nil {
+		return err
+	}
+	line, _ := json.Marshal(e)
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	l.seq = e.Seq
+	l.prevHash = e.Hash
+	l.counted += signed
+	return nil
+}
+
+// recordClaim records the addition of a claim to the claims tree. An operation that failed after it
+// started changing the trees is recorded as aborted, along with the error. The hashes of the subject
+// and the claim still let an auditor check the entry against a claim they were given.
+func (l *auditLog) recordClaim(operation string, issuer *core.ID, claim *core.Claim, oldState, newState *merkletree.Hash, opErr error) error {
+	sHashText, _ := claim.GetSchemaHash().MarshalText()
+	params := map[string]string{
+		"issuer":          issuer.String(),
+		"schemaHash":      string(sHashText),
+		"subject":         "self",
+		"revocationNonce": strconv.FormatUint(claim.GetRevocationNonce(), 10),
+		"version":         strconv.FormatUint(uint64(claim.GetVersion()), 10),
+	}
+	if id, err := claim.GetID(); err == nil {
+		params["subject"] = l.sensitive((&core.DID{ID: id}).String())
+	}
+	if h, err := claimToHex(claim); err == nil {
+		params["claim"] = l.sensitive(h)
+	}
+	if leaf, err := claimLeaf(claim); err == nil {
+		params["leaf"] = leaf
+	}
+	status := auditCompleted
+	if opErr != nil {
+		status = auditAborted
+		params["error"] = opErr.Error()
+	}
+	return l.record(operation, status, params, oldState, newState)
+}
+
+// claimLeaf is the leaf of a claim in the claims tree, "<hIndex>:<hValue>", which replay rebuilds the trees
+// from. Like the tombstone of an erased claim, it doesn't reveal the data of the claim.
+func claimLeaf(claim *core.Claim) (string, error) {
+	hIndex, hValue, err := claim.HiHv()
+	if err != nil {
+		return "", err
+	}
+	return hIndex.String() + ":" + hValue.String(), nil
+}
+
+// recordedAuthClaim returns the auth claim that the creation of an issuer recorded, or nil for an issuer
+// that was not created in this audit log, or was created before its auth claim was recorded
+func recordedAuthClaim(entries []*auditEntry, issuerID string) (*core.Claim, error) {
+	for _, e := range entries {
+		if e.Operation != "create-identity" || e.Params["issuer"] != issuerID || e.Params["authClaim"] == "" {
+			continue
+		}
+		claim, err := claimFromHex(e.Params["authClaim"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth claim recorded for %s: %s", issuerID, err)
+		}
+		return claim, nil
+	}
+	return nil, nil
+}
+
+// recordedAuthNonce returns the revocation nonce of the auth claim that the latest creation of an issuer
+// with the public key recorded, so that a later run with the same key creates the same identity
+func recordedAuthNonce(entries []*auditEntry, pubKey *babyjub.PublicKey) (uint64, bool) {
+	var nonce uint64
+	found := false
+	for _, e := range entries {
+		if e.Operation != "create-identity" || e.Params["authClaim"] == "" {
+			continue
+		}
+		claim, err := claimFromHex(e.Params["authClaim"])
+		if err != nil {
+			continue
+		}
+		if key, err := issuer.AuthClaimKey(claim); err == nil && key.X.Cmp(pubKey.X) == 0 && key.Y.Cmp(pubKey.Y) == 0 {
+			nonce, found = claim.GetRevocationNonce(), true
+		}
+	}
+	return nonce, found
+}
+
+func (l *auditLog) sensitive(s string) string {
+	if l.plaintext {
+		return s
+	}
+	return hashOf(s)
+}
+
+// writeAuditLog replaces the audit log with the entries, which only erase does
+func writeAuditLog(path string, entries []*auditEntry) error {
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		line, _ := json.Marshal(e)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// verifyAuditChain checks the hash of every entry, and that it chains to the entry before it. An entry
+// written before version 2 that was erased can't be hashed as it was written anymore, so it is checked
+// against the hash of its scrubbed fields that a later erase entry recorded.
+func verifyAuditChain(entries []*auditEntry) error {
+	erasedHashes := map[int]string{}
+	for _, e := range entries {
+		if e.Operation != "erase" || e.Params["erasedHashes"] == "" {
+			continue
+		}
+		for _, pair := range strings.Split(e.Params["erasedHashes"], ",") {
+			seq, hash, _ := strings.Cut(pair, ":")
+			if n, err := strconv.Atoi(seq); err == nil {
+				erasedHashes[n] = hash
+			}
+		}
+	}
+	prevHash := ""
+	for i, e := range entries {
+		if e.Seq != i+1 {
+			return fmt.Errorf("entry %d has the sequence number %d, entries were removed or reordered", i+1, e.Seq)
+		}
+		if e.PrevHash != prevHash {
+			return fmt.Errorf("entry %d doesn't chain to the entry before it", e.Seq)
+		}
+		if e.Erased && e.Version < 2 {
+			recorded, ok := erasedHashes[e.Seq]
+			if !ok {
+				return fmt.Errorf("entry %d is marked as erased, but no erase entry recorded its hash", e.Seq)
+			}
+			if e.scrubbedHash() != recorded {
+				return fmt.Errorf("entry %d doesn't match the hash recorded when it was erased, the entry was modified", e.Seq)
+			}
+		} else if e.calculateHash() != e.Hash {
+			return fmt.Errorf("entry %d doesn't match its hash, the entry was modified", e.Seq)
+		}
+		prevHash = e.Hash
+	}
+	return nil
+}
+
+// auditTimeRange is the range of times that the entries are listed or exported from, the zero times leave
+// the range open
+type auditTimeRange struct {
+	from, to time.Time
+}
+
+func parseAuditTimeRange(from, to string) (r auditTimeRange, err error) {
+	if from != "" {
+		if r.from, err = time.Parse(time.RFC3339, from); err != nil {
+			return r, usageError("invalid --from time: %s", err)
+		}
+	}
+	if to != "" {
+		if r.to, err = time.Parse(time.RFC3339, to); err != nil {
+			return r, usageError("invalid --to time: %s", err)
+		}
+	}
+	return r, nil
+}
+
+func (r auditTimeRange) contains(t time.Time) bool {
+	return (r.from.IsZero() || !t.Before(r.from)) && (r.to.IsZero() || t.Before(r.to))
+}
+
+// exportAuditLog streams the entries of the audit log in the time range to the export, one entry at a time,
+// so that a log of any length can be exported
+func exportAuditLog(path string, timeRange auditTimeRange, w *exportWriter) error {
+	err := scanJSONLines(path, func(line int, b []byte) error {
+		var e auditEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return fmt.Errorf("line %d of the audit log is not a valid entry: %s", line, err)
+		}
+		if !timeRange.contains(e.Time) {
+			return nil
+		}
+		return w.write(&e)
+	})
+	if flushErr := w.flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// auditCommand handles the "audit" subcommands that inspect the audit log
+func auditCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "verify" && args[0] != "export") {
+		return usageError("usage: audit list [--from <time>] [--to <time>] [--json] | audit export [--format csv|json] [--columns <c1,c2,...>] [--from <time>] [--to <time>] | audit verify")
+	}
+
+	fs := flag.NewFlagSet("audit "+args[0], flag.ExitOnError)
+	pathFlag := fs.String("audit-log", defaultAuditLogPath(), "path of the audit log")
+	fromFlag := fs.String("from", "", "only list the entries recorded at or after this time, in RFC 3339 format")
+	toFlag := fs.String("to", "", "only list the entries recorded before this time, in RFC 3339 format")
+	jsonFlag := fs.Bool("json", false, "print the entries as JSON lines")
+	formatFlag := fs.String("format", exportCSV, "the format of the export: csv (RFC 4180 with a header row) or json (JSON lines)")
+	columnsFlag := fs.String("columns", "", "comma separated columns to export, in order, all of them by default")
+	readOnly.register(fs, true)
+	fs.Parse(args[1:])
+
+	timeRange, err := parseAuditTimeRange(*fromFlag, *toFlag)
+	if err != nil {
+		return err
+	}
+	if args[0] == "export" {
+		if *formatFlag != exportCSV && *formatFlag != exportJSON {
+			return fmt.Errorf("the format must be %s or %s, got %q", exportCSV, exportJSON, *formatFlag)
+		}
+		columns, err := selectColumns(auditColumns, *columnsFlag)
+		if err != nil {
+			return err
+		}
+		w, err := newExportWriter(os.Stdout, *formatFlag, columns)
+		if err != nil {
+			return err
+		}
+		return exportAuditLog(*pathFlag, timeRange, w)
+	}
+
+	entries, err := readAuditLog(*pathFlag)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "verify" {
+		if err := verifyAuditChain(entries); err != nil {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("the audit log failed verification: %s", err))
+		}
+		fmt.Printf("Verified the hash chain of the %d entries in %s\n", len(entries), *pathFlag)
+		return nil
+	}
+
+	for _, e := range entries {
+		if !timeRange.contains(e.Time) {
+			continue
+		}
+		if *jsonFlag {
+			line, _ := json.Marshal(e)
+			fmt.Println(string(line))
+			continue
+		}
+		fmt.Printf("%d %s %s (%s)\n", e.Seq, e.Time.Format(time.RFC3339), e.Operation, e.Status)
+		if e.Operator != "" {
+			fmt.Printf("   -> Operator: %s\n", e.Operator)
+		}
+		if e.OldState != "" {
+			fmt.Printf("   -> Old state: %s\n", e.OldState)
+		}
+		if e.NewState != "" {
+			fmt.Printf("   -> New state: %s\n", e.NewState)
+		}
+		for _, k := range []string{"issuer", "subject", "schemaHash", "revocationNonce", "version", "error"} {
+			if v, ok := e.Params[k]; ok {
+				fmt.Printf("   -> %s: %s\n", k, v)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupVersion is the version of the format of the backup archives
+const backupVersion = 1
+
+// backupArchive is a copy of the registries of the issuer, which are the whole of its state: the trees are
+// rebuilt from the stored identities, and the issuer's private key is never stored, it is injected into
+// each command. The data keys that encrypt the receipts are included.
+type backupArchive struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Files   []*backupFile `json:"files"`
+	// States are the states that the stored identities were at when backed up
+	States map[string]string `json:"states,omitempty"`
+}
+
+type backupFile struct {
+	Name    string `json:"name"`
+	SHA256  string `json:"sha256"`
+	Content []byte `json:"content"`
+}
+
+// backupFiles are the registries of the issuer, by their name in the data directory
+func backupFiles() []string {
+	var names []string
+	for _, path := range []string{
+		defaultIdentitiesPath(), defaultTransitionsPath(), defaultReceiptsPath(), defaultAuditLogPath(),
+		defaultSchemasPath(), defaultClaimRequestsPath(), defaultDataKeysPath(), defaultHoldersPath(),
+		defaultOperatorsPath(), defaultProofRequestsPath(), defaultCircuitsConfigPath(),
+	} {
+		names = append(names, filepath.Base(path))
+	}
+	return names
+}
+
+func defaultDataDir() string {
+	homedir, _ := os.UserHomeDir()
+	return homedir
+}
+
+// verifyIdentities rebuilds the trees of each stored identity in the identities file, and checks that they
+// make up the recorded state
+func verifyIdentities(ctx context.Context, content []byte) (map[string]string, error) {
+	states := map[string]string{}
+	for n, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var s storedIdentity
+		if err := json.Unmarshal(line, &s); err != nil {
+			return nil, withCode(errCodeInvalidInput, fmt.Errorf("line %d of the identities is not a stored identity: %s", n+1, err))
+		}
+		state, err := s.rebuild(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if got := state.BigInt().String(); got != s.State {
+			return nil, withCode(errCodeVerificationFailed, fmt.Errorf("the trees of %s rebuild to the state %s, not the recorded %s", s.ID, got, s.State), "issuer", s.ID)
+		}
+		states[s.ID] = s.State
+	}
+	return states, nil
+}
+
+// backupCommand handles the "backup" command, that writes an archive of the registries of the issuer
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	outFlag := fs.String("out", "", "path of the archive to write")
+	dirFlag := fs.String("dir", defaultDataDir(), "the directory that the registries are in")
+	timeoutFlag := fs.Duration("timeout", 0, "give up on the command after this long, for example 30s (no timeout by default)")
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	if *outFlag == "" {
+		return usageError("usage: backup --out <file> [--dir <data directory>]")
+	}
+	if _, err := operators.authorize(roleAdmin); err != nil {
+		return fmt.Errorf("not authorized to back up the issuer: %w", err)
+	}
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+
+	archive := &backupArchive{Version: backupVersion, Created: now().UTC()}
+	for _, name := range backupFiles() {
+		// the registries are replaced by a rename, so each file is read as of one write
+		content, err := os.ReadFile(filepath.Join(*dirFlag, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		archive.Files = append(archive.Files, &backupFile{Name: name, SHA256: hex.EncodeToString(sum[:]), Content: content})
+		fmt.Printf("-> Backed up %s (%d bytes)\n", name, len(content))
+		if name == filepath.Base(defaultIdentitiesPath()) {
+			if archive.States, err = verifyIdentities(ctx, content); err != nil {
+				return fmt.Errorf("not backing up an inconsistent identity: %w", err)
+			}
+			for id, state := range archive.States {
+				fmt.Printf("   -> The trees of %s make up the recorded state %s\n", id, state)
+			}
+		}
+	}
+	if len(archive.Files) == 0 {
+		return withCode(errCodeNotFound, fmt.Errorf("no registries of the issuer in %s", *dirFlag))
+	}
+	b, _ := json.MarshalIndent(archive, "", "  ")
+	if err := os.WriteFile(*outFlag, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	fmt.Printf("-> Backup of %d files written to the file: %s\n", len(archive.Files), *outFlag)
+	return nil
+}
+
+// restoreCommand handles the "restore" command, that validates an archive and replaces the registries in
+// the data directory with its files. The files that the archive doesn't have are left as they are.
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	readOnly.register(fs, false)
+	inFlag := fs.String("in", "", "path of the archive to restore")
+	dirFlag := fs.String("dir", defaultDataDir(), "the directory to restore the registries to")
+	forceFlag := fs.Bool("force", false, "replace the registries in the directory, including the stored identities")
+	timeoutFlag := fs.Duration("timeout", 0, "give up on the command after this long, for example 30s (no timeout by default)")
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	if *inFlag == "" {
+		return usageError("usage: restore --in <file> [--dir <data directory>] [--force]")
+	}
+	if _, err := operators.authorize(roleAdmin); err != nil {
+		return fmt.Errorf("not authorized to restore the issuer: %w", err)
+	}
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+
+	b, err := os.ReadFile(*inFlag)
+	if err != nil {
+		return err
+	}
+	var archive backupArchive
+	if err := json.Unmarshal(b, &archive); err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid backup archive: %s", err))
+	}
+	if archive.Version != backupVersion {
+		return withCode(errCodeInvalidInput, fmt.Errorf("unsupported version %d of the backup archive", archive.Version))
+	}
+	known := map[string]bool{}
+	for _, name := range backupFiles() {
+		known[name] = true
+	}
+	var existing []string
+	for _, f := range archive.Files {
+		if !known[f.Name] {
+			return withCode(errCodeInvalidInput, fmt.Errorf("the archive has the unknown file %q", f.Name))
+		}
+		if sum := sha256.Sum256(f.Content); hex.EncodeToString(sum[:]) != f.SHA256 {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("the checksum of %s doesn't match its content", f.Name), "file", f.Name)
+		}
+		if f.Name == filepath.Base(defaultIdentitiesPath()) {
+			states, err := verifyIdentities(ctx, f.Content)
+			if err != nil {
+				return fmt.Errorf("not restoring an inconsistent identity: %w", err)
+			}
+			for id, state := range states {
+				if archive.States[id] != state {
+					return withCode(errCodeVerificationFailed, fmt.Errorf("the identity %s is at the state %s, the archive recorded %s", id, state, archive.States[id]), "issuer", id)
+				}
+				fmt.Printf("-> The trees of %s make up the recorded state %s\n", id, state)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(*dirFlag, f.Name)); err == nil {
+			existing = append(existing, f.Name)
+		}
+	}
+	fmt.Printf("-> Verified the checksums of the %d files of the backup of %s\n", len(archive.Files), archive.Created.Format(time.RFC3339))
+	if len(existing) > 0 && !*forceFlag {
+		return withCode(errCodeConflict, fmt.Errorf("%s already has %s, --force replaces them", *dirFlag, strings.Join(existing, ", ")))
+	}
+
+	for _, f := range archive.Files {
+		path := filepath.Join(*dirFlag, f.Name)
+		if err := readOnly.check(path); err != nil {
+			return err
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, f.Content, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+		fmt.Printf("-> Restored %s\n", path)
+	}
+	return nil
+}
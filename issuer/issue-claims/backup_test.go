@@ -0,0 +1,119 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupRestoreContinuesIssuing(t *testing.T) {
+	home := testHome(t)
+	key := strings.Repeat("06", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+	captureOutput(t, func() {
+		if err := transitionCommand([]string{"published", "--issuer", id, "--tx", "0x01"}); err != nil {
+			t.Fatalf("failed to mark the transition published: %s", err)
+		}
+	})
+	stored, err := findIdentity(filepath.Join(home, "iden3_identities.json"), id)
+	if err != nil || stored == nil {
+		t.Fatalf("expected the stored identity, got %v", err)
+	}
+	published := stored.Published[len(stored.Published)-1].State
+
+	archive := filepath.Join(t.TempDir(), "backup.json")
+	captureOutput(t, func() {
+		if err := backupCommand([]string{"--out", archive}); err != nil {
+			t.Fatalf("failed to back up: %s", err)
+		}
+	})
+
+	// over the existing registries, the restore needs --force
+	var restoreErr error
+	captureOutput(t, func() { restoreErr = restoreCommand([]string{"--in", archive}) })
+	if restoreErr == nil || classifyError(restoreErr).code != errCodeConflict {
+		t.Errorf("expected the restore over the identity to need --force, got %v", restoreErr)
+	}
+
+	restored := t.TempDir()
+	captureOutput(t, func() {
+		if err := restoreCommand([]string{"--in", archive, "--dir", restored}); err != nil {
+			t.Fatalf("failed to restore: %s", err)
+		}
+	})
+	for _, name := range []string{"iden3_identities.json", "iden3_transitions.json", "iden3_receipts.json", "iden3_audit.log"} {
+		original, _ := os.ReadFile(filepath.Join(home, name))
+		copied, err := os.ReadFile(filepath.Join(restored, name))
+		if err != nil || !bytes.Equal(original, copied) {
+			t.Errorf("expected %s restored as it was backed up, got %v", name, err)
+		}
+	}
+
+	// the restored issuer continues from the published state
+	t.Setenv("HOME", restored)
+	t.Setenv(issuerKeyEnv, key)
+	printed = captureOutput(t, func() {
+		if err := revokeCommand([]string{"--nonce", "2", "--issuer", id}); err != nil {
+			t.Fatalf("failed to revoke with the restored issuer: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "-> Inputs of the transition from "+published+" to ") {
+		t.Errorf("expected the transition from the published state %s, got: %s", published, printed)
+	}
+}
+
+func TestRestoreRefusesTamperedArchive(t *testing.T) {
+	testHome(t)
+	t.Setenv(issuerKeyEnv, strings.Repeat("07", 32))
+	if code, printed := runWalkthrough(t); code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	archive := filepath.Join(t.TempDir(), "backup.json")
+	captureOutput(t, func() {
+		if err := backupCommand([]string{"--out", archive}); err != nil {
+			t.Fatalf("failed to back up: %s", err)
+		}
+	})
+	b, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip a byte of the first file's base64 content
+	i := bytes.Index(b, []byte(`"content": "`)) + len(`"content": "`)
+	if b[i] == 'A' {
+		b[i] = 'B'
+	} else {
+		b[i] = 'A'
+	}
+	if err := os.WriteFile(archive, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var restoreErr error
+	captureOutput(t, func() { restoreErr = restoreCommand([]string{"--in", archive, "--dir", t.TempDir()}) })
+	if restoreErr == nil || classifyError(restoreErr).code != errCodeVerificationFailed {
+		t.Errorf("expected the tampered archive to fail the checksum, got %v", restoreErr)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+)
+
+// The canonical hex encoding of a claim is the 8 slots of 32 bytes each, index slots first,
+// with every slot in little-endian byte order
+const claimHexLen = 8 * 32 * 2
+
+func claimToHex(c *core.Claim) (string, error) {
+	b, err := c.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func claimFromHex(s string) (*core.Claim, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	if len(s) != claimHexLen {
+		return nil, fmt.Errorf("a claim is %d hex characters long, got %d", claimHexLen, len(s))
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %s", err)
+	}
+	var c core.Claim
+	if err := c.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// printClaimHex prints the hex encoding of a claim, which other iden3 tools can ingest
+func printClaimHex(indent string, c *core.Claim) {
+	h, err := claimToHex(c)
+	if err != nil {
+		fmt.Printf("%s-> Failed to encode the claim: %s\n", indent, err)
+		return
+	}
+	fmt.Printf("%s-> Hex: %s\n", indent, sensitive.claimHex(c, h))
+}
+
+// decodedClaim is the human readable breakdown of the fields packed into the claim slots. The merklized root
+// of a V2 credential is in the slot i_2 or v_2, which the V2 circuits call the position index or value.
+type decodedClaim struct {
+	SchemaHash            string            `json:"schemaHash"`
+	Subject               string            `json:"subject"`
+	SubjectPosition       string            `json:"subjectPosition"`
+	RevocationNonce       uint64            `json:"revocationNonce"`
+	Expiration            *time.Time        `json:"expiration,omitempty"`
+	Version               uint32            `json:"version"`
+	Updatable             bool              `json:"updatable"`
+	MerklizedRoot         string            `json:"merklizedRoot,omitempty"`
+	MerklizedRootPosition string            `json:"merklizedRootPosition,omitempty"`
+	Index                 [4]string         `json:"index"`
+	Value                 [4]string         `json:"value"`
+	Typed                 map[string]string `json:"typed,omitempty"`
+	Fields                map[string]string `json:"fields,omitempty"`
+}
+
+func decodeClaim(c *core.Claim) (*decodedClaim, error) {
+	sHashText, _ := c.GetSchemaHash().MarshalText()
+	d := &decodedClaim{
+		SchemaHash:      string(sHashText),
+		RevocationNonce: c.GetRevocationNonce(),
+		Version:         c.GetVersion(),
+		Updatable:       c.GetFlagUpdatable(),
+	}
+
+	position, err := c.GetIDPosition()
+	if err != nil {
+		return nil, err
+	}
+	switch position {
+	case core.IDPositionNone:
+		d.SubjectPosition = "self"
+	case core.IDPositionIndex:
+		d.SubjectPosition = "index"
+	case core.IDPositionValue:
+		d.SubjectPosition = "value"
+	}
+	if position != core.IDPositionNone {
+		id, err := c.GetID()
+		if err != nil {
+			return nil, err
+		}
+		d.Subject = id.String()
+	}
+
+	if expiration, ok := c.GetExpirationDate(); ok {
+		d.Expiration = &expiration
+	}
+
+	slot, _, err := merklizedRoot(c)
+	if err != nil {
+		return nil, err
+	}
+	if slot != "" {
+		d.MerklizedRoot = slot
+		d.MerklizedRootPosition = "index"
+		if merklizedSlots[slot] == merklizedPositionValue {
+			d.MerklizedRootPosition = "value"
+		}
+	}
+
+	slots := c.RawSlotsAsInts()
+	for i := 0; i < 4; i++ {
+		d.Index[i] = slots[i].String()
+		d.Value[i] = slots[i+4].String()
+	}
+	return d, nil
+}
+
+func (d *decodedClaim) print() {
+	fmt.Println("Schema hash:", d.SchemaHash)
+	if d.SubjectPosition == "self" {
+		fmt.Println("Subject: self (the issuer)")
+	} else {
+		fmt.Printf("Subject: %s (in the %s slots)\n", sensitive.id(d.Subject), d.SubjectPosition)
+	}
+	fmt.Println("Revocation nonce:", d.RevocationNonce)
+	if d.Expiration != nil {
+		fmt.Println("Expiration:", d.Expiration.UTC().Format(time.RFC3339))
+	} else {
+		fmt.Println("Expiration: none")
+	}
+	fmt.Printf("Version: %d (updatable: %t)\n", d.Version, d.Updatable)
+	if d.MerklizedRoot != "" {
+		fmt.Printf("Merklized root: in %s (position %s)\n", d.MerklizedRoot, d.MerklizedRootPosition)
+	}
+	kept := keptSlots(d.SchemaHash)
+	for i, v := range d.Index {
+		d.printSlot(fmt.Sprintf("i_%d", i), v, !kept[i])
+	}
+	for i, v := range d.Value {
+		d.printSlot(fmt.Sprintf("v_%d", i), v, !kept[i+4])
+	}
+}
+
+func (d *decodedClaim) printSlot(name, value string, mask bool) {
+	if mask {
+		value = sensitive.value(value)
+	}
+	label := name
+	if field, ok := d.Fields[name]; ok {
+		label = fmt.Sprintf("%s %s", name, field)
+	}
+	if typed, ok := d.Typed[name]; ok {
+		if mask {
+			typed = sensitive.value(typed)
+		}
+		fmt.Printf("%s: %s (%s)\n", label, value, typed)
+	} else {
+		fmt.Printf("%s: %s\n", label, value)
+	}
+}
+
+// decodeSlotTypes renders the data slots that were given a type in their typed form
+func (d *decodedClaim) decodeSlotTypes(c *core.Claim, types slotTypes) error {
+	slots := c.RawSlotsAsInts()
+	for name, slotType := range types {
+		typed, err := formatSlotValue(slots[dataSlotIndexes[name]], slotType)
+		if err != nil {
+			return fmt.Errorf("slot %s: %s", name, err)
+		}
+		if d.Typed == nil {
+			d.Typed = map[string]string{}
+		}
+		d.Typed[name] = slotType + " " + typed
+	}
+	return nil
+}
+
+// claimCommand handles the "claim" subcommands that work on claims issued elsewhere
+func claimCommand(args []string) error {
+	if len(args) == 0 || args[0] != "decode" {
+		return usageError("usage: claim decode --hex <claim> [--as <slot>=<type>] [--schema <name|file> [--type <credential type>]] [--json]")
+	}
+
+	fs := flag.NewFlagSet("claim decode", flag.ExitOnError)
+	hexFlag := fs.String("hex", "", "the claim in the canonical hex encoding")
+	jsonFlag := fs.Bool("json", false, "print the decoded claim as JSON")
+	types := slotTypes{}
+	fs.Var(types, "as", "decode a data slot as a typed value, as <slot>=<type> with the type one of date, timestamp (repeatable)")
+	schemaFlag := fs.String("schema", "", "a registered schema, or the path of a schema document, to name the fields of the data slots")
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file that the registered schemas are kept in")
+	typeFlag := fs.String("type", "", "the credential type in the schema document, implied by a registered schema")
+	contexts.register(fs)
+	sensitive.register(fs)
+	fs.Parse(args[1:])
+	if *hexFlag == "" {
+		return usageError("the --hex option is required")
+	}
+
+	c, err := claimFromHex(*hexFlag)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("failed to decode the claim: %s", err))
+	}
+	d, err := decodeClaim(c)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("failed to decode the claim: %s", err))
+	}
+	if err := d.decodeSlotTypes(c, types); err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("failed to decode the claim: %s", err))
+	}
+	if *schemaFlag != "" {
+		schemaBytes, credentialType, err := resolveSchema(*schemasFlag, *schemaFlag, *typeFlag)
+		if err != nil {
+			return fmt.Errorf("failed to load the schema: %s", err)
+		}
+		if credentialType == "" {
+			return usageError("the --type option is required with a schema document")
+		}
+		// the fields only describe the claim if it was issued for the credential type
+		sHashText, _ := schemaHash(schemaBytes, credentialType).MarshalText()
+		if string(sHashText) != d.SchemaHash {
+			return fmt.Errorf("the claim has the schema hash %s, '%s' has %s", d.SchemaHash, credentialType, sHashText)
+		}
+		if d.Fields, err = schemaFields(schemaBytes, credentialType); err != nil {
+			return err
+		}
+	}
+	if *jsonFlag {
+		out, _ := json.MarshalIndent(d, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		d.print()
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+func TestClaimDecodeRoundTrip(t *testing.T) {
+	subject, err := core.IDFromString(testHolderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	claim, err := core.NewClaim(schemaHash([]byte("{}"), "RoundTrip"),
+		core.WithIndexID(subject),
+		core.WithIndexDataInts(big.NewInt(20000101), big.NewInt(840)),
+		core.WithValueDataInts(big.NewInt(1234), big.NewInt(5678)),
+		core.WithRevocationNonce(1<<40+7),
+		core.WithExpirationDate(expiration),
+		core.WithFlagUpdatable(true),
+		core.WithVersion(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimHex, err := claimToHex(claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	printed := captureOutput(t, func() {
+		if err := claimCommand([]string{"decode", "--hex", claimHex, "--json"}); err != nil {
+			t.Fatalf("failed to decode the claim: %s", err)
+		}
+	})
+	var d decodedClaim
+	if err := json.Unmarshal([]byte(printed), &d); err != nil {
+		t.Fatalf("invalid JSON output: %s\n%s", err, printed)
+	}
+	if d.Subject != testHolderID || d.SubjectPosition != "index" {
+		t.Errorf("expected the subject %s in the index, got %s in the %s", testHolderID, d.Subject, d.SubjectPosition)
+	}
+	if d.RevocationNonce != 1<<40+7 {
+		t.Errorf("expected the revocation nonce %d, got %d", uint64(1<<40+7), d.RevocationNonce)
+	}
+	if d.Expiration == nil || !d.Expiration.Equal(expiration) {
+		t.Errorf("expected the expiration %s, got %v", expiration, d.Expiration)
+	}
+	if d.Version != 3 || !d.Updatable {
+		t.Errorf("expected the updatable version 3, got the version %d (updatable: %t)", d.Version, d.Updatable)
+	}
+
+	// the 8 decoded slots encode the same claim again
+	slots := claim.RawSlotsAsInts()
+	for i := 0; i < 4; i++ {
+		if d.Index[i] != slots[i].String() {
+			t.Errorf("slot i_%d: expected %s, got %s", i, slots[i], d.Index[i])
+		}
+		if d.Value[i] != slots[i+4].String() {
+			t.Errorf("slot v_%d: expected %s, got %s", i, slots[i+4], d.Value[i])
+		}
+	}
+	slotsJSON, _ := json.Marshal(append(d.Index[:], d.Value[:]...))
+	var decoded core.Claim
+	if err := decoded.UnmarshalJSON(slotsJSON); err != nil {
+		t.Fatal(err)
+	}
+	if reencoded, _ := claimToHex(&decoded); reencoded != claimHex {
+		t.Errorf("expected the decoded slots to encode %s, got %s", claimHex, reencoded)
+	}
+}
+
+func TestRedactionKeepsThePublicKeyOfTheAuthClaim(t *testing.T) {
+	defer func(show bool) { sensitive.show = show }(sensitive.show)
+	sensitive.show = false
+
+	authSchemaHash, err := core.NewSchemaHashFromHex(issuer.AuthSchemaHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authClaim, err := core.NewClaim(authSchemaHash, core.WithIndexDataInts(big.NewInt(1111), big.NewInt(2222)), core.WithRevocationNonce(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := core.IDFromString(testHolderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjectClaim, err := core.NewClaim(schemaHash([]byte("{}"), "Redaction"), core.WithIndexID(subject), core.WithIndexDataInts(big.NewInt(1111), big.NewInt(2222)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		claim   *core.Claim
+		visible bool
+	}{
+		{"auth claim", authClaim, true},
+		{"subject's claim", subjectClaim, false},
+	} {
+		var slots []string
+		if err := json.Unmarshal([]byte(sensitive.claimJSON(c.claim)), &slots); err != nil {
+			t.Fatal(err)
+		}
+		if visible := slots[2] == "1111" && slots[3] == "2222"; visible != c.visible {
+			t.Errorf("%s: expected the slots i_2 and i_3 to be visible: %t, got %v", c.name, c.visible, slots)
+		}
+		if slots[1] != redactedValue || slots[5] != redactedValue {
+			t.Errorf("%s: expected the slots i_1 and v_1 to be masked, got %v", c.name, slots)
+		}
+		h, _ := claimToHex(c.claim)
+		if full := sensitive.claimHex(c.claim, h) == h; full != c.visible {
+			t.Errorf("%s: expected the hex to be printed in full: %t", c.name, c.visible)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The statuses of a claim request. A request is issued at most once, and a rejected request is kept with
+// its descriptor for the audit. An approved request that failed to issue too many times is failed, until
+// it is retried with queue retry.
+const (
+	requestPending  = "pending"
+	requestApproved = "approved"
+	requestRejected = "rejected"
+	requestIssued   = "issued"
+	requestFailed   = "failed"
+)
+
+// requireApprovalEnv gates the issuance of claims on approved requests, when set to "true". The issuance
+// then refuses --from-file, and only issues described claims with --from-request.
+const requireApprovalEnv = "IDEN3_REQUIRE_APPROVAL"
+
+// claimRequest is a request for a claim, recorded by a requester without touching the trees, and issued
+// once an approver approves it
+type claimRequest struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"`
+	Requester  string          `json:"requester"`
+	Descriptor json.RawMessage `json:"descriptor"`
+	Created    time.Time       `json:"created"`
+	Approver   string          `json:"approver,omitempty"`
+	Decided    *time.Time      `json:"decided,omitempty"`
+	Reason     string          `json:"reason,omitempty"`
+	Issuer     string          `json:"issuer,omitempty"`
+	Claim      string          `json:"claim,omitempty"`
+	Issued     *time.Time      `json:"issued,omitempty"`
+	Attempts   int             `json:"attempts,omitempty"`
+	Attempted  *time.Time      `json:"attempted,omitempty"`
+	Supersedes *issuedClaimRef `json:"supersedes,omitempty"`
+}
+
+func defaultClaimRequestsPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_claim_requests.json")
+}
+
+func approvalRequired() bool {
+	return os.Getenv(requireApprovalEnv) == "true"
+}
+
+func readClaimRequests(path string) ([]*claimRequest, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []*claimRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r claimRequest
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.ID == "" {
+			return nil, fmt.Errorf("line %d of the claim requests file is not a valid request: %v", line, err)
+		}
+		requests = append(requests, &r)
+	}
+	return requests, scanner.Err()
+}
+
+// writeClaimRequests replaces the claim requests file, through a temporary file so that an interrupted
+// write leaves the previous file in place
+func writeClaimRequests(path string, requests []*claimRequest) error {
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, r := range requests {
+		line, _ := json.Marshal(r)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// updateClaimRequest applies a change to a request and saves it, the change fails if the request is not
+// in the expected status
+func updateClaimRequest(path, id, status string, change func(r *claimRequest)) (*claimRequest, error) {
+	requests, err := readClaimRequests(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range requests {
+		if r.ID != id {
+			continue
+		}
+		if r.Status != status {
+			return nil, withCode(errCodeConflict, fmt.Errorf("the claim request %s is %s, not %s", id, r.Status, status), "request", id, "status", r.Status)
+		}
+		change(r)
+		return r, writeClaimRequests(path, requests)
+	}
+	return nil, withCode(errCodeNotFound, fmt.Errorf("no claim request %s is recorded", id), "request", id)
+}
+
+// approvedClaimRequest looks up a request to issue, which must be approved
+func approvedClaimRequest(path, id string) (*claimRequest, error) {
+	requests, err := readClaimRequests(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range requests {
+		if r.ID == id {
+			if r.Status != requestApproved {
+				return nil, withCode(errCodeConflict, fmt.Errorf("the claim request %s is %s, only approved requests are issued", id, r.Status), "request", id, "status", r.Status)
+			}
+			return r, nil
+		}
+	}
+	return nil, withCode(errCodeNotFound, fmt.Errorf("no claim request %s is recorded", id), "request", id)
+}
+
+// requestCommand handles the "request" subcommands, that record claim requests for an approver to approve
+// or reject before they are issued
+func requestCommand(args []string) error {
+	usage := usageError("usage: request create --descriptor <file> --requester <name> | request list [--pending] [--json] | request approve [--approver <name>] <id> | request reject [--approver <name>] --reason <reason> <id>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("request "+args[0], flag.ExitOnError)
+	requestsFlag := fs.String("requests", defaultClaimRequestsPath(), "path of the file that the claim requests are recorded in")
+	readOnly.register(fs, args[0] == "list")
+	var operators operatorFlags
+	operators.register(fs)
+	switch args[0] {
+	case "create":
+		descriptorFlag := fs.String("descriptor", "", "path of a JSON descriptor of the requested claim, as issued with --from-file")
+		requesterFlag := fs.String("requester", "", "who requests the claim")
+		schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file of the registered schemas, that the descriptor can name")
+		contexts.register(fs)
+		fs.Parse(args[1:])
+		if *descriptorFlag == "" || *requesterFlag == "" {
+			return usage
+		}
+		b, err := os.ReadFile(*descriptorFlag)
+		if err != nil {
+			return err
+		}
+		// the request is validated now, so that an approver only sees requests that can be issued
+		if _, err := parseClaimDescriptor(b, *schemasFlag); err != nil {
+			return withCode(errCodeInvalidInput, fmt.Errorf("invalid claim descriptor %s", err))
+		}
+		var compact json.RawMessage
+		json.Unmarshal(b, &compact)
+		id, err := newUUID(rand.Reader)
+		if err != nil {
+			return err
+		}
+		r := &claimRequest{
+			ID:         id,
+			Status:     requestPending,
+			Requester:  *requesterFlag,
+			Descriptor: compact,
+			Created:    now().UTC(),
+		}
+		requests, err := readClaimRequests(*requestsFlag)
+		if err != nil {
+			return err
+		}
+		if err := writeClaimRequests(*requestsFlag, append(requests, r)); err != nil {
+			return err
+		}
+		fmt.Printf("Recorded the claim request %s, pending approval\n", r.ID)
+	case "list":
+		pendingFlag := fs.Bool("pending", false, "only list the requests that are pending approval")
+		jsonFlag := fs.Bool("json", false, "print the requests as JSON lines, with their descriptors")
+		fs.Parse(args[1:])
+		requests, err := readClaimRequests(*requestsFlag)
+		if err != nil {
+			return err
+		}
+		for _, r := range requests {
+			if *pendingFlag && r.Status != requestPending {
+				continue
+			}
+			if *jsonFlag {
+				line, _ := json.Marshal(r)
+				fmt.Println(string(line))
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\t%s", r.ID, r.Status, r.Created.Format(time.RFC3339), r.Requester)
+			if r.Status == requestRejected {
+				fmt.Printf("\trejected by %s", r.Approver)
+			} else if r.Approver != "" {
+				fmt.Printf("\tapproved by %s", r.Approver)
+			}
+			if r.Reason != "" {
+				fmt.Printf(": %s", r.Reason)
+			}
+			fmt.Println()
+		}
+	case "approve", "reject":
+		approverFlag := fs.String("approver", "", "who approves or rejects the request, the operator by default")
+		reasonFlag := fs.String("reason", "", "why the request is rejected")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 || (args[0] == "reject" && *reasonFlag == "") {
+			return usage
+		}
+		operator, err := operators.authorize(roleIssue)
+		if err != nil {
+			return fmt.Errorf("not authorized to %s the request: %w", args[0], err)
+		}
+		if config, _ := readOperatorsConfig(operators.config); config != nil && *approverFlag != "" && *approverFlag != operator {
+			// with operators configured, the approver is the operator that was authorized
+			return withCode(errCodeUnauthorized, fmt.Errorf("the approver is the operator %s, --approver can't name someone else", operator), "operator", operator)
+		}
+		if *approverFlag == "" {
+			*approverFlag = operator
+		}
+		decided := now().UTC()
+		r, err := updateClaimRequest(*requestsFlag, fs.Arg(0), requestPending, func(r *claimRequest) {
+			r.Status = requestApproved
+			if args[0] == "reject" {
+				r.Status = requestRejected
+			}
+			r.Approver = *approverFlag
+			r.Decided = &decided
+			r.Reason = *reasonFlag
+		})
+		if err != nil {
+			return err
+		}
+		if r.Status == requestApproved {
+			fmt.Printf("Approved the claim request %s, issue it with: --from-request %s\n", r.ID, r.ID)
+		} else {
+			fmt.Printf("Rejected the claim request %s\n", r.ID)
+		}
+	default:
+		return usage
+	}
+	return nil
+}
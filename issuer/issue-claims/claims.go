@@ -0,0 +1,55 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	core "github.com/iden3/go-iden3-core"
+)
+
+// withSubject addresses a claim to the given subject. A nil subject produces a self claim, which
+// doesn't carry an ID since the subject is the issuer itself.
+func withSubject(subject *core.ID) core.Option {
+	return func(c *core.Claim) error {
+		if subject != nil {
+			c.SetIndexID(*subject)
+		}
+		return nil
+	}
+}
+
+// updateClaim builds the next version of a claim that was issued with the "updatable" flag. The new
+// version keeps the revocation nonce of the previous one, but since the version is part of the index
+// slots it is added to the claims tree as a new leaf. Note that revoking the nonce revokes all the versions.
+func updateClaim(prev *core.Claim, options ...core.Option) (*core.Claim, error) {
+	if !prev.GetFlagUpdatable() {
+		return nil, fmt.Errorf("claim was not issued as updatable")
+	}
+
+	next := prev.Clone()
+	next.SetVersion(prev.GetVersion() + 1)
+	for _, option := range options {
+		if err := option(next); err != nil {
+			return nil, err
+		}
+	}
+	if next.GetRevocationNonce() != prev.GetRevocationNonce() {
+		return nil, fmt.Errorf("updated claim must keep the revocation nonce of the previous version")
+	}
+	return next, nil
+}
@@ -0,0 +1,100 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// contextCache resolves the JSON-LD contexts that schema documents reference by URL from a local directory,
+// so that schemas can be parsed without network access. A context is fetched from its URL only when network
+// contexts are allowed, and is then kept in the cache.
+type contextCache struct {
+	dir          string
+	allowNetwork bool
+	gateway      string
+}
+
+// contexts is the cache that schema documents are parsed with, configured by the options of the command
+var contexts = &contextCache{dir: defaultContextsDir(), gateway: defaultIPFSGateway()}
+
+func defaultContextsDir() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_contexts")
+}
+
+// register adds the options that configure the cache to the options of a command
+func (c *contextCache) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.dir, "contexts", c.dir, "directory of the cached JSON-LD contexts that schema documents reference by URL")
+	fs.BoolVar(&c.allowNetwork, "allow-network-contexts", c.allowNetwork, "fetch the JSON-LD contexts that are not cached from their URLs, and cache them")
+}
+
+// path is the file that the context of a URL is cached in, named by the hash of the URL
+func (c *contextCache) path(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:])+".json-ld")
+}
+
+func (c *contextCache) load(url string) ([]byte, error) {
+	b, err := os.ReadFile(c.path(url))
+	if err == nil {
+		return b, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !c.allowNetwork {
+		return nil, fmt.Errorf("the JSON-LD context %s is not cached, cache it with: schema cache-context %s", url, url)
+	}
+	// contexts are loaded while a schema is parsed, which doesn't take the context of the command, so the
+	// fetch stops on an interrupt by itself
+	ctx, cancel := newCommandContext(0)
+	defer cancel()
+	return c.fetch(ctx, url)
+}
+
+// fetch fetches the context of a URL and caches it
+func (c *contextCache) fetch(ctx context.Context, url string) ([]byte, error) {
+	b, err := fetchSchema(ctx, url, c.gateway)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the JSON-LD context %s: %w", url, err)
+	}
+	if readOnly.skip("the JSON-LD context " + url) {
+		return b, nil
+	}
+	return b, c.store(url, b)
+}
+
+// store caches the context of a URL, which must be a JSON document
+func (c *contextCache) store(url string, b []byte) error {
+	if !json.Valid(b) {
+		return fmt.Errorf("the JSON-LD context %s is not a JSON document", url)
+	}
+	if err := readOnly.check(c.path(url)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(url), b, 0644)
+}
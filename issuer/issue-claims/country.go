@@ -0,0 +1,62 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/iden3/go-iden3-crypto/poseidon"
+)
+
+// countryCode encodes an ISO 3166-1 alpha-2 country code the way the claim slots store bytes, which is as
+// a little-endian integer, so "US" is 21333. Queries over the country slot compare against this encoding.
+func countryCode(code string) (*big.Int, error) {
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return nil, fmt.Errorf("country must be a 2 letter ISO 3166-1 code in upper case, e.g. US, got %q", code)
+	}
+	return new(big.Int).SetBytes([]byte{code[1], code[0]}), nil
+}
+
+// countrySlots builds the data of a KYCCountryOfResidenceCredential claim: the country code, the type of
+// the document that proves the residence, and the Poseidon hash of that document. Without a document the
+// hash is left as zero.
+func countrySlots(code string, documentType int64, documentPath string) (slotValues, error) {
+	c, err := countryCode(code)
+	if err != nil {
+		return nil, err
+	}
+	slots := slotValues{
+		"i_2": c,
+		"i_3": big.NewInt(documentType),
+		"v_2": big.NewInt(0),
+	}
+	if err := checkSlotValue("i_3", slots["i_3"]); err != nil {
+		return nil, fmt.Errorf("invalid document type: %s", err)
+	}
+	if documentPath != "" {
+		document, err := os.ReadFile(documentPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the document: %s", err)
+		}
+		if slots["v_2"], err = poseidon.HashBytes(document); err != nil {
+			return nil, err
+		}
+	}
+	return slots, nil
+}
@@ -0,0 +1,321 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The claim and the subject of a receipt can be encrypted at rest with AES-256-GCM under a data key. The
+// encryption key and the key of the HMAC index of the subject are the SHA-256 hashes of their label and
+// the data key, and every encrypted value is bound to its field, issuer and revocation nonce.
+const (
+	dataKeyEncryptionLabel = "iden3-tutorial-receipts-v1"
+	dataKeyIndexLabel      = "iden3-tutorial-receipts-index-v1"
+	encryptedPrefix        = "enc:"
+	subjectIndexPrefix     = "hmac-sha256:"
+)
+
+// dataKeyring holds the data keys by their IDs. New receipts are encrypted with the current key, the
+// others are only kept while rekey-registry moves the receipts over to a new key.
+type dataKeyring struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// dataKeys is the keyring file that encrypts the receipts. The receipts are only encrypted once the file
+// exists, which rekey-registry creates.
+type dataKeys struct {
+	path    string
+	keyring *dataKeyring
+	loaded  bool
+}
+
+var receiptKeys = &dataKeys{path: defaultDataKeysPath()}
+
+func defaultDataKeysPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_data_keys.json")
+}
+
+func (k *dataKeys) register(fs *flag.FlagSet) {
+	fs.StringVar(&k.path, "data-keys", k.path, "path of the data keys that encrypt the claims and the subjects in the receipts, once it exists")
+}
+
+// load reads the keyring, which is nil if the file doesn't exist
+func (k *dataKeys) load() (*dataKeyring, error) {
+	if k.loaded {
+		return k.keyring, nil
+	}
+	b, err := os.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		k.loaded = true
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keyring dataKeyring
+	if err := json.Unmarshal(b, &keyring); err != nil {
+		return nil, fmt.Errorf("invalid data keys file %s: %s", k.path, err)
+	}
+	if _, ok := keyring.Keys[keyring.Current]; !ok {
+		return nil, fmt.Errorf("invalid data keys file %s: the current key %q is not in the keys", k.path, keyring.Current)
+	}
+	k.keyring, k.loaded = &keyring, true
+	return k.keyring, nil
+}
+
+func (k *dataKeys) save(keyring *dataKeyring) error {
+	if err := readOnly.check(k.path); err != nil {
+		return err
+	}
+	b, _ := json.MarshalIndent(keyring, "", "  ")
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		return err
+	}
+	k.keyring, k.loaded = keyring, true
+	return nil
+}
+
+// derive returns the cipher and the index key of a data key
+func (keyring *dataKeyring) derive(keyID string) (cipher.AEAD, []byte, error) {
+	key, err := hex.DecodeString(keyring.Keys[keyID])
+	if err != nil || len(key) != 32 {
+		return nil, nil, withCode(errCodeNotFound, fmt.Errorf("the data key %s is missing or isn't 32 bytes of hex", keyID), "dataKey", keyID)
+	}
+	encKey := sha256.Sum256(append([]byte(dataKeyEncryptionLabel), key...))
+	indexKey := sha256.Sum256(append([]byte(dataKeyIndexLabel), key...))
+	block, err := aes.NewCipher(encKey[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, indexKey[:], nil
+}
+
+// subjectIndex is the HMAC of the subject, which finds the receipts of a subject without decrypting them
+func subjectIndex(indexKey []byte, subject string) string {
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(subject))
+	return subjectIndexPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func receiptAAD(field string, r *issuanceReceipt) []byte {
+	return []byte(fmt.Sprintf("%s/%s/%d", field, r.Issuer, r.RevocationNonce))
+}
+
+// seal returns a copy of the receipt with the claim and the subject encrypted with the current key, or
+// the receipt itself if there are no data keys or the claim was erased. The nonces are always read from
+// the system's secure source of randomness, even in the deterministic mode, as a nonce that repeats
+// under the same key gives the plaintexts away.
+func (k *dataKeys) seal(r *issuanceReceipt) (*issuanceReceipt, error) {
+	keyring, err := k.load()
+	if err != nil || keyring == nil || r.erased() {
+		return r, err
+	}
+	aead, indexKey, err := keyring.derive(keyring.Current)
+	if err != nil {
+		return nil, err
+	}
+	sealed := *r
+	sealed.SubjectIndex = subjectIndex(indexKey, r.Subject)
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{{"claim", &sealed.Claim}, {"subject", &sealed.Subject}} {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		ciphertext := aead.Seal(nonce, nonce, []byte(*f.value), receiptAAD(f.name, r))
+		*f.value = encryptedPrefix + keyring.Current + ":" + base64.StdEncoding.EncodeToString(ciphertext)
+	}
+	return &sealed, nil
+}
+
+// encryptedKeyID returns the ID of the data key that a value is encrypted with, if it is encrypted
+func encryptedKeyID(value string) (string, bool) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return "", false
+	}
+	keyID := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)[0]
+	return keyID, true
+}
+
+// open decrypts the claim and the subject of a receipt in place, if they are encrypted
+func (k *dataKeys) open(r *issuanceReceipt) error {
+	keyID, encrypted := encryptedKeyID(r.Claim)
+	if !encrypted {
+		return nil
+	}
+	keyring, err := k.load()
+	if err != nil {
+		return err
+	}
+	if keyring == nil || keyring.Keys[keyID] == "" {
+		return withCode(errCodeNotFound, fmt.Errorf("the receipt is encrypted with the data key %s, which is not in %s", keyID, k.path), "dataKey", keyID)
+	}
+	aead, _, err := keyring.derive(keyID)
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{{"claim", &r.Claim}, {"subject", &r.Subject}} {
+		encoded := strings.TrimPrefix(*f.value, encryptedPrefix+keyID+":")
+		ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(ciphertext) < aead.NonceSize() {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("the encrypted %s of the receipt is malformed", f.name))
+		}
+		plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], receiptAAD(f.name, r))
+		if err != nil {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("the %s of the receipt doesn't decrypt with the data key %s", f.name, keyID))
+		}
+		*f.value = string(plaintext)
+	}
+	r.SubjectIndex = ""
+	return nil
+}
+
+// matchesSubject tells if the receipt is for the subject DID, by the HMAC index of an encrypted receipt
+func (k *dataKeys) matchesSubject(r *issuanceReceipt, subject string) (bool, error) {
+	keyID, encrypted := encryptedKeyID(r.Subject)
+	if !encrypted {
+		return r.Subject == subject, nil
+	}
+	keyring, err := k.load()
+	if err != nil {
+		return false, err
+	}
+	if keyring == nil || keyring.Keys[keyID] == "" {
+		return false, withCode(errCodeNotFound, fmt.Errorf("the receipt is encrypted with the data key %s, which is not in %s", keyID, k.path), "dataKey", keyID)
+	}
+	_, indexKey, err := keyring.derive(keyID)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal([]byte(r.SubjectIndex), []byte(subjectIndex(indexKey, subject))), nil
+}
+
+// rekeyRegistryCommand handles the "rekey-registry" command, which encrypts the receipts with a new data
+// key. The first run creates the data keys and encrypts the receipts that were written in plaintext.
+func rekeyRegistryCommand(args []string) error {
+	fs := flag.NewFlagSet("rekey-registry", flag.ExitOnError)
+	readOnly.register(fs, false)
+	receiptsFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file")
+	receiptKeys.register(fs)
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+
+	if _, err := operators.authorize(roleAdmin); err != nil {
+		return err
+	}
+	old, err := receiptKeys.load()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	keyHash := sha256.Sum256(key)
+	keyring := &dataKeyring{Current: hex.EncodeToString(keyHash[:4]), Keys: map[string]string{}}
+	if old != nil {
+		for id, k := range old.Keys {
+			keyring.Keys[id] = k
+		}
+	}
+	keyring.Keys[keyring.Current] = hex.EncodeToString(key)
+
+	// the new key is saved along with the old ones before any receipt is encrypted with it, so that a
+	// rekey that fails half way can be run again
+	fmt.Printf("Rotate the data key of the receipts in %s\n", *receiptsFlag)
+	if err := receiptKeys.save(keyring); err != nil {
+		return fmt.Errorf("failed to save the data keys: %s", err)
+	}
+	fmt.Printf("-> New data key %s saved to %s\n", keyring.Current, receiptKeys.path)
+
+	tmp := *receiptsFlag + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	count := 0
+	err = scanJSONLines(*receiptsFlag, func(line int, b []byte) error {
+		var r issuanceReceipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("line %d of the receipts file is not a valid receipt: %s", line, err)
+		}
+		if err := receiptKeys.open(&r); err != nil {
+			return fmt.Errorf("line %d of the receipts file: %w", line, err)
+		}
+		sealed, err := receiptKeys.seal(&r)
+		if err != nil {
+			return err
+		}
+		out, _ := json.Marshal(sealed)
+		if _, err := f.Write(append(out, '\n')); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, *receiptsFlag)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Printf("-> Encrypted the claims and the subjects of %d receipts with the data key %s\n", count, keyring.Current)
+
+	retired := len(keyring.Keys) - 1
+	keyring.Keys = map[string]string{keyring.Current: keyring.Keys[keyring.Current]}
+	if err := receiptKeys.save(keyring); err != nil {
+		return fmt.Errorf("failed to remove the old data keys: %s", err)
+	}
+	fmt.Printf("-> Removed %d old data keys\n", retired)
+	return nil
+}
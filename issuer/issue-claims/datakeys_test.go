@@ -0,0 +1,66 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSealTwiceUsesDifferentNonces(t *testing.T) {
+	home := testHome(t)
+	keys := &dataKeys{path: filepath.Join(home, "iden3_data_keys.json")}
+	if err := keys.save(&dataKeyring{Current: "k1", Keys: map[string]string{"k1": strings.Repeat("01", 32)}}); err != nil {
+		t.Fatal(err)
+	}
+	r := &issuanceReceipt{Issuer: "issuer", RevocationNonce: 2, Claim: "claim", Subject: testHolderID}
+
+	var nonces [][]byte
+	for i := 0; i < 2; i++ {
+		sealed, err := keys.seal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range []string{sealed.Claim, sealed.Subject} {
+			parts := strings.SplitN(value, ":", 3)
+			if len(parts) != 3 || parts[0]+":" != encryptedPrefix || parts[1] != "k1" {
+				t.Fatalf("expected a value encrypted with the key k1, got %q", value)
+			}
+			ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonces = append(nonces, ciphertext[:12])
+		}
+		if err := keys.open(sealed); err != nil {
+			t.Fatal(err)
+		}
+		if sealed.Claim != r.Claim || sealed.Subject != r.Subject {
+			t.Errorf("expected the sealed receipt to open to the claim and the subject, got %q and %q", sealed.Claim, sealed.Subject)
+		}
+	}
+	for i := range nonces {
+		for j := i + 1; j < len(nonces); j++ {
+			if bytes.Equal(nonces[i], nonces[j]) {
+				t.Errorf("the values %d and %d are sealed with the same nonce %x", i, j, nonces[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Dates are stored in the slots as the integer YYYYMMDD, as the KYC schemas do for the birthday, so that
+// a query can compare them directly: "born before 2004-01-01" is "less than 20040101". Timestamps are
+// stored as unix seconds.
+const (
+	slotTypeDate      = "date"
+	slotTypeTimestamp = "timestamp"
+)
+
+// The birthday and document type of the default KYC age claim
+const (
+	defaultBirthday     = 19960424
+	defaultDocumentType = 2
+)
+
+// minAgeCutoff returns the date as YYYYMMDD that a birthday must be before for the age to be at least
+// minAge on the given day: the day after the same date minAge years before. On the 29th of February, the
+// same date in a year that isn't a leap year is taken as the 28th.
+func minAgeCutoff(day time.Time, minAge int) *big.Int {
+	y, m, d := day.Date()
+	last := time.Date(y-minAge, m, d, 0, 0, 0, 0, time.UTC)
+	if last.Month() != m {
+		last = last.AddDate(0, 0, -last.Day())
+	}
+	cutoff := last.AddDate(0, 0, 1)
+	return big.NewInt(int64(cutoff.Year()*10000 + int(cutoff.Month())*100 + cutoff.Day()))
+}
+
+// parseSlotValue parses an integer, or a typed value given as date:YYYY-MM-DD or timestamp:<RFC 3339 time>
+func parseSlotValue(s string) (*big.Int, error) {
+	if date := strings.TrimPrefix(s, slotTypeDate+":"); date != s {
+		t, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+		}
+		return big.NewInt(int64(t.Year()*10000 + int(t.Month())*100 + t.Day())), nil
+	}
+	if ts := strings.TrimPrefix(s, slotTypeTimestamp+":"); ts != s {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q, expected an RFC 3339 time", ts)
+		}
+		return big.NewInt(t.Unix()), nil
+	}
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("%q is not an integer, a date:YYYY-MM-DD or a timestamp:<RFC 3339 time>", s)
+	}
+	return v, nil
+}
+
+// formatSlotValue renders the integer stored in a slot as the given type
+func formatSlotValue(v *big.Int, slotType string) (string, error) {
+	switch slotType {
+	case slotTypeDate:
+		if !v.IsInt64() {
+			return "", fmt.Errorf("%s is not a date", v)
+		}
+		n := v.Int64()
+		t := time.Date(int(n/10000), time.Month(n/100%100), int(n%100), 0, 0, 0, 0, time.UTC)
+		if n < 0 || t.Year() != int(n/10000) || int(t.Month()) != int(n/100%100) || t.Day() != int(n%100) {
+			return "", fmt.Errorf("%s is not a date", v)
+		}
+		return t.Format("2006-01-02"), nil
+	case slotTypeTimestamp:
+		if !v.IsInt64() {
+			return "", fmt.Errorf("%s is not a timestamp", v)
+		}
+		return time.Unix(v.Int64(), 0).UTC().Format(time.RFC3339), nil
+	default:
+		return "", fmt.Errorf("unknown slot type %q, must be %s or %s", slotType, slotTypeDate, slotTypeTimestamp)
+	}
+}
+
+// slotTypes collects the types to decode slots as, from repeated "--as slot=type" options
+type slotTypes map[string]string
+
+func (s slotTypes) String() string {
+	pairs := make([]string, 0, len(s))
+	for slot, t := range s {
+		pairs = append(pairs, slot+"="+t)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (s slotTypes) Set(arg string) error {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected <slot>=<type>, e.g. i_2=date")
+	}
+	slot, slotType := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if _, ok := dataSlotIndexes[slot]; !ok {
+		return fmt.Errorf("unknown slot %s, must be one of i_2, i_3, v_2, v_3", slot)
+	}
+	if slotType != slotTypeDate && slotType != slotTypeTimestamp {
+		return fmt.Errorf("unknown slot type %q, must be %s or %s", slotType, slotTypeDate, slotTypeTimestamp)
+	}
+	s[slot] = slotType
+	return nil
+}
@@ -0,0 +1,326 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+
+	"kaleido.io/iden3-tutorial/holder"
+	"kaleido.io/iden3-tutorial/issuer"
+	"kaleido.io/iden3-tutorial/verifier"
+)
+
+// snarkjs runs the snarkjs CLI to generate and verify the proofs of the credentialAtomicQuerySig circuit
+type snarkjs struct {
+	bin             string
+	dir             string
+	wasm            string
+	zkey            string
+	verificationKey string
+	// timeout bounds each run of snarkjs, 0 for no bound other than the context's
+	timeout time.Duration
+	// stopped is the error of the last run that was stopped by the timeout or the context, which
+	// the verifier reports as a failed check
+	stopped error
+}
+
+// run runs snarkjs until it exits, or kills it when the timeout elapses or the context is done, in which
+// case the error tells which of them stopped it
+func (s *snarkjs) run(ctx context.Context, args ...string) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(s.bin, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := startGroup(cmd); err != nil {
+		return fmt.Errorf("snarkjs %s failed: %s", args[0], err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killGroup(cmd)
+		case <-exited:
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		s.stopped = withCode(errCodeTimeout, fmt.Errorf("snarkjs %s didn't complete in time and was stopped", args[0]))
+		return s.stopped
+	case ctx.Err() != nil:
+		s.stopped = fmt.Errorf("snarkjs %s was stopped: interrupted", args[0])
+		return s.stopped
+	}
+	return fmt.Errorf("snarkjs %s failed: %s\n%s", args[0], err, out.Bytes())
+}
+
+// prove calculates the witness of the inputs and generates the proof, returning the proof and the
+// public signals
+func (s *snarkjs) prove(ctx context.Context, inputs []byte) ([]byte, []byte, error) {
+	inputsPath := filepath.Join(s.dir, "inputs.json")
+	witnessPath := filepath.Join(s.dir, "witness.wtns")
+	proofPath := filepath.Join(s.dir, "proof.json")
+	publicPath := filepath.Join(s.dir, "public.json")
+	if err := os.WriteFile(inputsPath, inputs, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := s.run(ctx, "wtns", "calculate", s.wasm, inputsPath, witnessPath); err != nil {
+		return nil, nil, err
+	}
+	if err := s.run(ctx, "groth16", "prove", s.zkey, witnessPath, proofPath, publicPath); err != nil {
+		return nil, nil, err
+	}
+	proof, err := os.ReadFile(proofPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubSignals, err := os.ReadFile(publicPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proof, pubSignals, nil
+}
+
+// VerifyProof implements verifier.ProofVerifier
+func (s *snarkjs) VerifyProof(ctx context.Context, proof, pubSignals []byte) error {
+	proofPath := filepath.Join(s.dir, "verify-proof.json")
+	publicPath := filepath.Join(s.dir, "verify-public.json")
+	if err := os.WriteFile(proofPath, proof, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(publicPath, pubSignals, 0600); err != nil {
+		return err
+	}
+	return s.run(ctx, "groth16", "verify", s.verificationKey, publicPath, proofPath)
+}
+
+// queryPubSignals lists the public signals that the credentialAtomicQuerySig circuit outputs for the inputs,
+// in the order of the circuit, which is what the verifier checks when no proof is generated
+func queryPubSignals(inputs *circuits.AtomicQuerySigInputs) ([]byte, error) {
+	signals := []string{
+		inputs.SignatureProof.IssuerTreeState.State.BigInt().String(),
+		inputs.ID.BigInt().String(),
+		inputs.AuthClaim.TreeState.State.BigInt().String(),
+		inputs.Challenge.String(),
+		inputs.IssuerID.BigInt().String(),
+		inputs.Claim.NonRevProof.TreeState.State.BigInt().String(),
+		strconv.FormatInt(inputs.CurrentTimeStamp, 10),
+		inputs.Claim.Claim.GetSchemaHash().BigInt().String(),
+		strconv.Itoa(inputs.SlotIndex),
+		strconv.Itoa(inputs.Operator),
+	}
+	values, err := circuits.PrepareCircuitArrayValues(inputs.Values, inputs.GetValueArrSize())
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		signals = append(signals, v.String())
+	}
+	return json.Marshal(signals)
+}
+
+// demoCommand handles the "demo" command, which runs the flow from the issuance of a KYC age claim to the
+// verification of a proof of the holder's age in one process, with in-memory trees
+func demoCommand(args []string) error {
+	fs := flag.NewFlagSet("demo", flag.ExitOnError)
+	readOnly.register(fs, false)
+	wasmFlag := fs.String("circuit-wasm", "", "path of the wasm of the credentialAtomicQuerySig circuit, to generate a proof")
+	zkeyFlag := fs.String("circuit-zkey", "", "path of the zkey of the credentialAtomicQuerySig circuit, to generate a proof")
+	vkeyFlag := fs.String("verification-key", "", "path of the verification key of the credentialAtomicQuerySig circuit, to verify the proof")
+	snarkjsFlag := fs.String("snarkjs", "snarkjs", "the snarkjs command")
+	timeoutFlag := fs.Duration("timeout", 0, "abort the demo after this long, 0 for no timeout")
+	proofTimeoutFlag := fs.Duration("proof-timeout", 0, "stop each run of snarkjs after this long, 0 for no timeout")
+	artifacts.register(fs)
+	sensitive.register(fs)
+	fs.Parse(args)
+	if given := *wasmFlag != "" || *zkeyFlag != "" || *vkeyFlag != ""; given && (*wasmFlag == "" || *zkeyFlag == "" || *vkeyFlag == "") {
+		return usageError("the --circuit-wasm, --circuit-zkey and --verification-key options must be given together")
+	}
+	// the artifacts are taken from the paths given, or else from the ones installed with circuits fetch
+	circuit := string(circuits.AtomicQuerySigCircuitID)
+	for _, a := range []struct {
+		kind string
+		path *string
+	}{{artifactWasm, wasmFlag}, {artifactZkey, zkeyFlag}, {artifactVerificationKey, vkeyFlag}} {
+		resolved, err := artifacts.resolve(circuit, a.kind, *a.path)
+		if err != nil {
+			return err
+		}
+		*a.path = resolved
+	}
+	withProof := *wasmFlag != "" && *zkeyFlag != "" && *vkeyFlag != ""
+
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "iden3-demo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Println("Create the issuer identity")
+	issuerKey := babyjub.NewRandPrivKey()
+	identity, err := issuer.New(ctx, issuer.NewMemoryStorage(), &issuerKey)
+	if err != nil {
+		return fmt.Errorf("failed to create the issuer identity: %s", err)
+	}
+	fmt.Println("-> Issuer ID:", identity.ID)
+	fmt.Println("-> Genesis state:", identity.GenesisState.BigInt())
+
+	fmt.Println("\nCreate the holder wallet")
+	holderKey := babyjub.NewRandPrivKey()
+	wallet, err := holder.New(ctx, issuer.NewMemoryStorage(), &holderKey)
+	if err != nil {
+		return fmt.Errorf("failed to create the holder wallet: %s", err)
+	}
+	fmt.Println("-> Holder ID:", sensitive.id(wallet.ID().String()))
+
+	fmt.Println("\nIssue a KYC age claim to the holder")
+	schemaBytes, err := os.ReadFile("./schemas/test.json-ld")
+	if err != nil {
+		return fmt.Errorf("failed to load the schema file: %s", err)
+	}
+	kycAgeSchema := schemaHash(schemaBytes, "KYCAgeCredential")
+	ageClaim, err := core.NewClaim(kycAgeSchema, withSubject(wallet.ID()), core.WithRevocationNonce(2), core.WithIndexDataInts(big.NewInt(defaultBirthday), big.NewInt(defaultDocumentType)))
+	if err != nil {
+		return fmt.Errorf("failed to create the claim: %s", err)
+	}
+	printClaimHex("   ", ageClaim)
+	issued, err := identity.IssueClaim(ctx, ageClaim)
+	if err != nil {
+		return fmt.Errorf("failed to issue the claim: %s", err)
+	}
+	fmt.Println("-> New issuer state:", issued.NewState.BigInt())
+
+	fmt.Println("\nHand the claim to the holder as a credential")
+	credential, err := identity.Credential(ctx, ageClaim)
+	if err != nil {
+		return fmt.Errorf("failed to sign the credential: %s", err)
+	}
+	stored, err := wallet.AddCredential(credential)
+	if err != nil {
+		return fmt.Errorf("the holder rejected the credential: %s", err)
+	}
+	fmt.Println("-> Credential ID:", stored.ID)
+	issuerState, _ := json.Marshal(stored.IssuerState)
+	fmt.Println("-> Issuer state of the proofs:", string(issuerState))
+
+	fmt.Println("\nGenerate the inputs of a proof that the holder is at least 18, from the birthday in the claim")
+	// the birthday must be before the cutoff date of today, as an age in the claim would go stale
+	query := circuits.Query{SlotIndex: 2, Values: []*big.Int{minAgeCutoff(now().UTC(), 18)}, Operator: circuits.LT}
+	challenge := big.NewInt(12345)
+	inputs, err := wallet.ProofInputs(ctx, stored.ID, query, challenge)
+	if err != nil {
+		return fmt.Errorf("failed to generate the proof inputs: %s", err)
+	}
+	inputsJSON, err := inputs.InputsMarshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal the proof inputs: %s", err)
+	}
+	fmt.Println(string(inputsJSON))
+
+	// the holder discloses the revocation nonce of the claim, for the verifier to check its current status
+	revNonce := ageClaim.GetRevocationNonce()
+	statuses := verifier.NewRevocationStatusCache(identity)
+	// the statuses of the issuer's active claims are generated ahead of the requests, as an issuer does after
+	// a revocation or a state transition
+	var precomputed verifier.PrecomputeProgress
+	if err := statuses.Precompute(ctx, identity.ID, func(p verifier.PrecomputeProgress) { precomputed = p }); err != nil {
+		return fmt.Errorf("failed to precompute the revocation statuses: %s", err)
+	}
+	fmt.Printf("-> Precomputed the revocation statuses of %d/%d active claims\n", precomputed.Done, precomputed.Total)
+	options := verifier.Options{
+		States:          verifier.LocalStateResolver{identity},
+		Challenge:       challenge,
+		Schema:          &kycAgeSchema,
+		Revocation:      statuses,
+		RevocationNonce: &revNonce,
+	}
+	var proof, pubSignals []byte
+	var prover *snarkjs
+	if withProof {
+		fmt.Println("\nGenerate the proof with snarkjs")
+		prover = &snarkjs{bin: *snarkjsFlag, dir: dir, wasm: *wasmFlag, zkey: *zkeyFlag, verificationKey: *vkeyFlag, timeout: *proofTimeoutFlag}
+		if proof, pubSignals, err = prover.prove(ctx, inputsJSON); err != nil {
+			return fmt.Errorf("failed to generate the proof: %w", err)
+		}
+		fmt.Println(string(proof))
+		options.Proof = prover
+	} else {
+		fmt.Println("\nNo circuit artifacts are configured, skip the proof and take the public signals from the inputs")
+		options.Optional = []string{"proof"}
+		if pubSignals, err = queryPubSignals(inputs); err != nil {
+			return fmt.Errorf("failed to list the public signals: %s", err)
+		}
+	}
+	fmt.Println("-> Public signals:", string(pubSignals))
+
+	fmt.Println("\nVerify the proof")
+	result, err := verifier.Verify(ctx, proof, pubSignals, query, options)
+	if err != nil {
+		return fmt.Errorf("failed to verify the proof: %s", err)
+	}
+	for _, c := range result.Checks {
+		switch {
+		case c.Skipped && c.Optional:
+			fmt.Printf("-> %s: skipped\n", c.Name)
+		case c.Skipped:
+			fmt.Printf("-> %s: skipped, and required\n", c.Name)
+		case c.Unavailable:
+			fmt.Printf("-> %s: unavailable, %s\n", c.Name, c.Error)
+		case c.Passed:
+			fmt.Printf("-> %s: passed\n", c.Name)
+		default:
+			fmt.Printf("-> %s: failed, %s\n", c.Name, c.Error)
+		}
+	}
+	hits, misses := statuses.Stats()
+	fmt.Printf("-> Revocation status cache: %d hits, %d misses\n", hits, misses)
+	if prover != nil && prover.stopped != nil {
+		return fmt.Errorf("failed to verify the proof: %w", prover.stopped)
+	}
+	if !result.Passed() {
+		return fmt.Errorf("the verification of the proof failed")
+	}
+	fmt.Println("\nThe demo completed")
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	core "github.com/iden3/go-iden3-core"
+)
+
+// maxDescriptorBytes caps the size of a claim descriptor, which is a few slots and names. Descriptors come
+// from the requesters of claims, so a larger one is refused before it is parsed.
+const maxDescriptorBytes = 64 * 1024
+
+// claimDescriptor describes a claim to issue in a JSON file, so that claims of any credential type can be
+// issued without a dedicated option for each type
+type claimDescriptor struct {
+	Schema          string                    `json:"schema"`
+	Type            string                    `json:"type"`
+	Subject         string                    `json:"subject,omitempty"`
+	SubjectPosition string                    `json:"subjectPosition,omitempty"`
+	Slots           map[string]slotDescriptor `json:"slots"`
+	RevocationNonce string                    `json:"revocationNonce,omitempty"`
+	Expiration      string                    `json:"expiration,omitempty"`
+	Updatable       bool                      `json:"updatable,omitempty"`
+
+	schemaBytes []byte
+	slots       slotValues
+	subject     *core.ID
+	expiration  time.Time
+	// merklizedSlot is the slot of the merklized root of the credentialSubject, which is nil in the
+	// descriptor of an externally merklized document until --merklized-root gives it
+	merklizedSlot string
+	merklizedRoot *big.Int
+}
+
+// slotDescriptor is the typed data for a slot, the value is given as a JSON string or number. The value of a
+// merklized root can be left out, to be given with --merklized-root.
+type slotDescriptor struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// loadClaimDescriptor reads and validates a claim descriptor. The errors refer to the offending
+// part of the descriptor by its JSON path. The schema is a registered schema or the path of a document.
+func loadClaimDescriptor(path, schemasPath string) (*claimDescriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxDescriptorBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	return parseClaimDescriptor(b, schemasPath)
+}
+
+// parseClaimDescriptor parses a descriptor, failing with the invalid-input error code, or the code of the
+// part that is invalid, such as the holder ID of the subject
+func parseClaimDescriptor(b []byte, schemasPath string) (*claimDescriptor, error) {
+	d, err := decodeClaimDescriptor(b, schemasPath)
+	if err != nil && classifyError(err).code == errCodeInternal {
+		err = withCode(errCodeInvalidInput, err)
+	}
+	return d, err
+}
+
+func decodeClaimDescriptor(b []byte, schemasPath string) (*claimDescriptor, error) {
+	if len(b) > maxDescriptorBytes {
+		return nil, fmt.Errorf("$: the descriptor is larger than %d bytes", maxDescriptorBytes)
+	}
+	// the JSON decoder would replace the invalid bytes in the strings rather than fail
+	if !utf8.Valid(b) {
+		return nil, fmt.Errorf("$: the descriptor is not valid UTF-8")
+	}
+	var err error
+	d := &claimDescriptor{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(d); err != nil {
+		return nil, fmt.Errorf("$: %s", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("$: unexpected data after the descriptor")
+	}
+
+	if d.Schema == "" {
+		return nil, fmt.Errorf("$.schema: the schema document is required")
+	}
+	if d.schemaBytes, d.Type, err = resolveSchema(schemasPath, d.Schema, d.Type); err != nil {
+		return nil, fmt.Errorf("$.schema: %s", err)
+	}
+	if d.Type == "" {
+		return nil, fmt.Errorf("$.type: the credential type is required, unless the schema is registered")
+	}
+
+	if d.Subject != "" {
+		if d.subject, err = parseHolderID(d.Subject); err != nil {
+			return nil, fmt.Errorf("$.subject: %w", err)
+		}
+	}
+	switch d.SubjectPosition {
+	case "", "index", "value":
+	default:
+		return nil, fmt.Errorf("$.subjectPosition: must be \"index\" or \"value\", got %q", d.SubjectPosition)
+	}
+	if d.SubjectPosition != "" && d.subject == nil {
+		return nil, fmt.Errorf("$.subjectPosition: a self claim has no subject to position")
+	}
+
+	if len(d.Slots) == 0 {
+		return nil, fmt.Errorf("$.slots: at least one slot is required")
+	}
+	d.slots = slotValues{}
+	for name, slot := range d.Slots {
+		if _, ok := dataSlotIndexes[name]; !ok {
+			return nil, fmt.Errorf("$.slots.%s: unknown slot, must be one of i_2, i_3, v_2, v_3", name)
+		}
+		if slot.Type == slotTypeMerklized {
+			if _, ok := merklizedSlots[name]; !ok {
+				return nil, fmt.Errorf("$.slots.%s: a merklized root is carried in i_2 or v_2", name)
+			}
+			if d.merklizedSlot != "" {
+				return nil, fmt.Errorf("$.slots.%s: the merklized root is carried in %s already", name, d.merklizedSlot)
+			}
+			d.merklizedSlot = name
+			if len(slot.Value) > 0 && string(slot.Value) != "null" {
+				var text string
+				if err := json.Unmarshal(slot.Value, &text); err != nil {
+					text = string(slot.Value)
+				}
+				if d.merklizedRoot, err = parseMerklizedRoot(text); err != nil {
+					return nil, fmt.Errorf("$.slots.%s.value: %s", name, err)
+				}
+			}
+			continue
+		}
+		v, err := slot.decode()
+		if err == nil {
+			err = checkSlotValue(name, v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("$.slots.%s.value: %s", name, err)
+		}
+		d.slots[name] = v
+	}
+
+	switch d.RevocationNonce {
+	case "", "next", "random":
+	default:
+		if _, err := strconv.ParseUint(d.RevocationNonce, 10, 64); err != nil {
+			return nil, fmt.Errorf("$.revocationNonce: must be \"next\", \"random\" or an integer between 0 and %d, got %q", uint64(1<<64-1), d.RevocationNonce)
+		}
+	}
+
+	if d.Expiration != "" {
+		if d.expiration, err = time.Parse(time.RFC3339, d.Expiration); err != nil {
+			return nil, fmt.Errorf("$.expiration: %s", err)
+		}
+	}
+	return d, nil
+}
+
+// decode converts the typed value of a slot to the integer stored in the slot. Strings are stored as
+// their bytes in little-endian order, the same as the core library stores byte data.
+func (s slotDescriptor) decode() (*big.Int, error) {
+	var text string
+	if err := json.Unmarshal(s.Value, &text); err != nil {
+		// a number is kept as written, to not lose the precision of large integers
+		text = strings.TrimSpace(string(s.Value))
+	}
+	switch s.Type {
+	case "int":
+		v, ok := new(big.Int).SetString(text, 10)
+		if !ok {
+			return nil, fmt.Errorf("%q is not an integer", text)
+		}
+		return v, nil
+	case "string":
+		if len(text) > 31 {
+			return nil, fmt.Errorf("a string slot holds at most 31 bytes, got %d", len(text))
+		}
+		b := []byte(text)
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return new(big.Int).SetBytes(b), nil
+	case slotTypeDate, slotTypeTimestamp:
+		return parseSlotValue(s.Type + ":" + text)
+	default:
+		return nil, fmt.Errorf("unknown type %q, must be one of int, string, date, timestamp, merklized", s.Type)
+	}
+}
+
+// useMerklizedRoot gives the root of an externally merklized document to the descriptor, which must declare
+// the slot of the root without a value
+func (d *claimDescriptor) useMerklizedRoot(root *big.Int) error {
+	if d.merklizedSlot == "" {
+		return fmt.Errorf("$.slots: the descriptor declares no slot of type merklized to carry the root in")
+	}
+	if d.merklizedRoot != nil {
+		return fmt.Errorf("$.slots.%s.value: the descriptor gives a merklized root already", d.merklizedSlot)
+	}
+	d.merklizedRoot = root
+	return nil
+}
+
+// options returns the claim options for the subject, slots, expiration and flags of the descriptor,
+// the revocation nonce is allocated separately
+func (d *claimDescriptor) options() []core.Option {
+	options := d.slots.options()
+	if d.subject != nil {
+		position := core.IDPositionIndex
+		if d.SubjectPosition == "value" {
+			position = core.IDPositionValue
+		}
+		options = append(options, core.WithID(*d.subject, position))
+	}
+	if !d.expiration.IsZero() {
+		options = append(options, core.WithExpirationDate(d.expiration))
+	}
+	if d.Updatable {
+		options = append(options, core.WithFlagUpdatable(true))
+	}
+	if d.merklizedRoot != nil {
+		options = append(options, withMerklizedRoot(d.merklizedSlot, d.merklizedRoot))
+	}
+	return options
+}
@@ -0,0 +1,51 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func FuzzParseClaimDescriptor(f *testing.F) {
+	for _, seed := range []string{
+		`{"schema": "./schemas/test.json-ld", "type": "KYCAgeCredential", "subject": "` + testHolderID + `", "subjectPosition": "index",
+		  "slots": {"i_2": {"type": "int", "value": 19960424}, "i_3": {"type": "int", "value": "2"}}, "revocationNonce": "random", "expiration": "2030-01-01T00:00:00Z"}`,
+		`{"schema": "./schemas/test.json-ld", "type": "KYCCountryOfResidenceCredential", "slots": {"i_2": {"type": "string", "value": "US"}}}`,
+		`{"schema": "./schemas/test.json-ld", "type": "KYCAgeCredential", "slots": {"i_2": {"type": "date", "value": "1996-04-24"}}} {}`,
+		`{"schema": "./schemas/test.json-ld", "type": "KYCAgeCredential", "unknown": 1, "slots": {}}`,
+		`{"schema": "./schemas/test.json-ld", "type": "KYCAgeCredential", "subject": "did:iden3:x", "slots": {"v_9": {"type": "timestamp", "value": "x"}}}`,
+		"{\"schema\": \"\xff\"}",
+		`[]`,
+	} {
+		f.Add([]byte(seed))
+	}
+	schemasPath := filepath.Join(f.TempDir(), "schemas.json")
+	f.Fuzz(func(t *testing.T, b []byte) {
+		d, err := parseClaimDescriptor(b, schemasPath)
+		if err != nil {
+			// an invalid descriptor is always reported as an invalid input, never as an internal failure
+			if code := classifyError(err).code; code != errCodeInvalidInput && code != errCodeInvalidHolderID {
+				t.Errorf("expected the invalid-input or invalid-holder-id code, got %s: %s", code.Code, err)
+			}
+			return
+		}
+		if len(b) > maxDescriptorBytes || len(d.slots) == 0 || d.Type == "" {
+			t.Errorf("expected %q to be refused", b)
+		}
+	})
+}
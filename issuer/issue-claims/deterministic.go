@@ -0,0 +1,79 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+// The seed of the deterministic mode must be at least 128 bits
+const minSeedLen = 16
+
+// now is the clock of the timestamps in the audit log and the receipts, which the deterministic mode fixes
+var now = time.Now
+
+// seededReader is a deterministic random bit generator, that produces the SHA-256 hashes of the seed
+// followed by a block counter. It is only for reproducible demos: anyone who knows the seed knows the keys.
+type seededReader struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func newSeededReader(seedHex string) (*seededReader, error) {
+	seed, err := hex.DecodeString(strings.TrimPrefix(seedHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("the seed must be hex: %s", err)
+	}
+	if len(seed) < minSeedLen {
+		return nil, fmt.Errorf("the seed must be at least %d bytes, got %d", minSeedLen, len(seed))
+	}
+	return &seededReader{seed: seed}, nil
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		if len(r.buf) == 0 {
+			var counter [8]byte
+			binary.BigEndian.PutUint64(counter[:], r.counter)
+			block := sha256.Sum256(append(append([]byte{}, r.seed...), counter[:]...))
+			r.buf = block[:]
+			r.counter++
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return len(p), nil
+}
+
+// newPrivKey reads a babyjubjub private key from the source of randomness
+func newPrivKey(rand io.Reader) (babyjub.PrivateKey, error) {
+	var k babyjub.PrivateKey
+	if _, err := io.ReadFull(rand, k[:]); err != nil {
+		return k, err
+	}
+	return k, nil
+}
@@ -0,0 +1,128 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+// didDocument is the DID document that verifiers resolve the issuer DID to
+type didDocument struct {
+	Context            []string                `json:"@context"`
+	ID                 string                  `json:"id"`
+	VerificationMethod []didVerificationMethod `json:"verificationMethod"`
+	Authentication     []string                `json:"authentication"`
+	Service            []didService            `json:"service,omitempty"`
+}
+
+// didVerificationMethod is a babyjubjub public key of the issuer, given by the coordinates of the curve
+// point as they are stored in the issuer's auth claim
+type didVerificationMethod struct {
+	ID                  string `json:"id"`
+	Type                string `json:"type"`
+	Controller          string `json:"controller"`
+	PublicKeyCompressed string `json:"publicKeyCompressed"`
+	X                   string `json:"x"`
+	Y                   string `json:"y"`
+}
+
+type didService struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// newDIDDocument renders the DID document of an issuer with the given public keys, and the service endpoints
+// that are set
+func newDIDDocument(issuer *core.ID, pubKeys []string, revocationEndpoint, agentEndpoint string) (*didDocument, error) {
+	did := (&core.DID{ID: *issuer}).String()
+	doc := &didDocument{
+		Context: []string{"https://www.w3.org/ns/did/v1"},
+		ID:      did,
+	}
+	for i, k := range pubKeys {
+		var pubKey babyjub.PublicKey
+		if err := pubKey.UnmarshalText([]byte(k)); err != nil {
+			return nil, fmt.Errorf("invalid public key %s: %s", k, err)
+		}
+		method := didVerificationMethod{
+			ID:                  fmt.Sprintf("%s#key-%d", did, i+1),
+			Type:                "BJJVerificationKey2021",
+			Controller:          did,
+			PublicKeyCompressed: k,
+			X:                   pubKey.X.String(),
+			Y:                   pubKey.Y.String(),
+		}
+		doc.VerificationMethod = append(doc.VerificationMethod, method)
+		doc.Authentication = append(doc.Authentication, method.ID)
+	}
+	if revocationEndpoint != "" {
+		doc.Service = append(doc.Service, didService{ID: did + "#revocation", Type: "Iden3RevocationStatusService", ServiceEndpoint: revocationEndpoint})
+	}
+	if agentEndpoint != "" {
+		doc.Service = append(doc.Service, didService{ID: did + "#iden3comm", Type: "Iden3CommServiceV1", ServiceEndpoint: agentEndpoint})
+	}
+	return doc, nil
+}
+
+// didDocumentCommand handles the "did-document" command. The issuer's keys are taken from the receipts it
+// signed, as a new key signs the receipts after a key rotation.
+func didDocumentCommand(args []string) error {
+	fs := flag.NewFlagSet("did-document", flag.ExitOnError)
+	pathFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file")
+	issuerFlag := fs.String("issuer", "", "ID of the issuer, the issuer of the latest receipt by default")
+	revocationFlag := fs.String("revocation-endpoint", "", "URL of the revocation status service of the issuer")
+	agentFlag := fs.String("agent-endpoint", "", "URL of the iden3comm agent of the issuer")
+	fs.Parse(args)
+
+	receipts, err := readReceipts(*pathFlag)
+	if err != nil {
+		return err
+	}
+	issuer := *issuerFlag
+	if issuer == "" && len(receipts) > 0 {
+		issuer = receipts[len(receipts)-1].Issuer
+	}
+	var pubKeys []string
+	seen := map[string]bool{}
+	for _, r := range receipts {
+		if r.Issuer == issuer && !seen[r.IssuerPublicKey] {
+			seen[r.IssuerPublicKey] = true
+			pubKeys = append(pubKeys, r.IssuerPublicKey)
+		}
+	}
+	if len(pubKeys) == 0 {
+		return fmt.Errorf("no receipts of the issuer %q in %s", issuer, *pathFlag)
+	}
+
+	id, err := core.IDFromString(issuer)
+	if err != nil {
+		return fmt.Errorf("invalid issuer ID: %s", err)
+	}
+	doc, err := newDIDDocument(&id, pubKeys, *revocationFlag, *agentFlag)
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(doc, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,361 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// doctorCheck is one check of the setup. A check that finds nothing to check passes with a note. A failed
+// critical check makes the command fail, a failed check that isn't critical is a warning.
+type doctorCheck struct {
+	name     string
+	critical bool
+	run      func() (string, error)
+	// remedy is what to do about a failure
+	remedy string
+}
+
+// writableDir checks that a file can be created in the directory of path, which is where the file is
+// replaced through a temporary file
+func writableDir(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".iden3-doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// replayIssuers rebuilds the trees of every issuer whose creation or import is in the audit log, and returns the
+// issuers that were replayed and those that were recorded without their leaves
+func replayIssuers(ctx context.Context, entries []*auditEntry, levels int) (replayed, unrecorded []string, err error) {
+	replayers := map[string]*replayer{}
+	for _, e := range entries {
+		id := e.Params["issuer"]
+		starts := e.Operation == "create-identity" || e.Operation == "import-claim" || e.Operation == "import-state"
+		if starts && id != "" && replayers[id] == nil {
+			if _, ok := e.Params["leaf"]; !ok && e.Operation == "create-identity" {
+				unrecorded = append(unrecorded, id)
+				continue
+			}
+			replayers[id] = &replayer{levels: levels}
+		}
+		r := replayers[id]
+		if r == nil {
+			continue
+		}
+		if err := r.replay(ctx, e); err != nil {
+			return nil, nil, fmt.Errorf("the trees of %s: %w", id, err)
+		}
+	}
+	for id := range replayers {
+		replayed = append(replayed, id)
+	}
+	sort.Strings(replayed)
+	return replayed, unrecorded, nil
+}
+
+// doctorCommand handles the "doctor" command, that checks the files of the issuer, the issuer key and the
+// circuit artifacts for the problems that commonly break a setup, and suggests what to do about each
+func doctorCommand(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	auditLogFlag := fs.String("audit-log", defaultAuditLogPath(), "path of the audit log")
+	transitionsFlag := fs.String("transitions", defaultTransitionsPath(), "path of the file that the state transitions are recorded in")
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file of the registered schemas")
+	receiptsFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file")
+	issuerFlag := fs.String("issuer", "", "base58 ID of the issuer that the injected key must be the key of")
+	keyStdinFlag := fs.Bool("key-stdin", false, "read the issuer's private key to check from stdin, rather than "+issuerKeyEnv)
+	treeDepthFlag := fs.Int("tree-depth", 32, "depth of the trees to rebuild from the audit log")
+	staleFlag := fs.Duration("stale-after", 24*time.Hour, "how long a transition may be pending before it is reported as stale")
+	uploadDirFlag := fs.String("upload-claims", filepath.Join("..", "upload-claims"), "path of the hardhat project of the state contract")
+	timeoutFlag := fs.Duration("timeout", 0, "give up on the command after this long, for example 30s (no timeout by default)")
+	artifacts.register(fs)
+	receiptKeys.register(fs)
+	fs.Parse(args)
+	if *treeDepthFlag < 1 || *treeDepthFlag > issuer.MaxTreeDepth {
+		return usageError("--tree-depth must be between 1 and %d", issuer.MaxTreeDepth)
+	}
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+
+	checks := []doctorCheck{
+		{
+			name:     "data directories writable",
+			critical: true,
+			run: func() (string, error) {
+				dirs := map[string]bool{}
+				for _, path := range []string{*auditLogFlag, *transitionsFlag, *schemasFlag, *receiptsFlag, receiptKeys.path} {
+					dir := filepath.Dir(path)
+					if dirs[dir] {
+						continue
+					}
+					dirs[dir] = true
+					if err := writableDir(path); err != nil {
+						return "", err
+					}
+				}
+				return fmt.Sprintf("%d directories", len(dirs)), nil
+			},
+			remedy: "create the directory, or give the user running the issuer write access to it",
+		},
+		{
+			name:     "audit log",
+			critical: true,
+			run: func() (string, error) {
+				entries, err := readAuditLog(*auditLogFlag)
+				if err != nil {
+					return "", err
+				}
+				if err := verifyAuditChain(entries); err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%d entries, the hash chain verifies", len(entries)), nil
+			},
+			remedy: "restore the audit log from a backup, the entries after a broken link can't be trusted",
+		},
+		{
+			name:     "issuer trees",
+			critical: true,
+			run: func() (string, error) {
+				entries, err := readAuditLog(*auditLogFlag)
+				if err != nil {
+					return "", err
+				}
+				replayed, unrecorded, err := replayIssuers(ctx, entries, *treeDepthFlag)
+				if err != nil {
+					return "", err
+				}
+				detail := fmt.Sprintf("the trees of %d issuers match every recorded state", len(replayed))
+				if len(unrecorded) > 0 {
+					detail += fmt.Sprintf(", %d issuers were recorded without their leaves and can't be rebuilt", len(unrecorded))
+				}
+				return detail, nil
+			},
+			remedy: "run replay --issuer <id> for the details, and compare --tree-depth with the depth the issuer was run with",
+		},
+		{
+			name:     "issuer key",
+			critical: true,
+			run: func() (string, error) {
+				if _, ok := os.LookupEnv(issuerKeyEnv); !ok && !*keyStdinFlag {
+					return "no key injected, skipped", nil
+				}
+				signer, source, err := injectedKeySigner(*keyStdinFlag)
+				if err != nil {
+					return "", err
+				}
+				defer signer.Close()
+				if *issuerFlag == "" {
+					return fmt.Sprintf("the key from %s loads", source), nil
+				}
+				// the auth claim recorded at the creation of the issuer has its revocation nonce, an issuer
+				// created before it was recorded has the default nonce
+				entries, err := readAuditLog(*auditLogFlag)
+				if err != nil {
+					return "", err
+				}
+				authClaim, err := recordedAuthClaim(entries, *issuerFlag)
+				if err != nil {
+					return "", err
+				}
+				var genesis *issuer.Genesis
+				if authClaim == nil {
+					genesis, err = issuer.NewGenesis(ctx, signer.Public())
+				} else {
+					authKey, keyErr := issuer.AuthClaimKey(authClaim)
+					if keyErr != nil {
+						return "", keyErr
+					}
+					if pubKey := signer.Public(); authKey.X.Cmp(pubKey.X) != 0 || authKey.Y.Cmp(pubKey.Y) != 0 {
+						return "", withCode(errCodeKeyMismatch, fmt.Errorf("the key from %s is not the key of the auth claim recorded for %s", source, *issuerFlag))
+					}
+					genesis, err = issuer.GenesisOf(ctx, authClaim)
+				}
+				if err != nil {
+					return "", err
+				}
+				if genesis.ID.String() != *issuerFlag {
+					return "", withCode(errCodeKeyMismatch, fmt.Errorf("the key from %s is the key of %s, not %s", source, genesis.ID, *issuerFlag))
+				}
+				return fmt.Sprintf("the key from %s is the key of %s", source, *issuerFlag), nil
+			},
+			remedy: "inject the private key that the issuer was created with, in hex or base64",
+		},
+		{
+			name:     "state transitions",
+			critical: true,
+			run: func() (string, error) {
+				transitions, err := readTransitions(*transitionsFlag)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%d transitions", len(transitions)), nil
+			},
+			remedy: "fix or remove the invalid line, transition list shows the ones that parse",
+		},
+		{
+			name: "stale pending transitions",
+			run: func() (string, error) {
+				transitions, err := readTransitions(*transitionsFlag)
+				if err != nil {
+					return "", err
+				}
+				pending := 0
+				for _, t := range transitions {
+					if t.Status != transitionPending {
+						continue
+					}
+					pending++
+					if age := now().Sub(t.Created); age > *staleFlag {
+						return "", fmt.Errorf("the transition of %s to %s has been pending since %s", t.Issuer, t.NewState, t.Created.Format(time.RFC3339))
+					}
+				}
+				return fmt.Sprintf("%d pending", pending), nil
+			},
+			remedy: "publish the transition and mark it with transition published, or abandon it with transition abandon",
+		},
+		{
+			name:     "schema registry",
+			critical: true,
+			run: func() (string, error) {
+				schemas, err := readSchemas(*schemasFlag)
+				if err != nil {
+					return "", err
+				}
+				names := map[string]bool{}
+				for _, s := range schemas {
+					names[s.Name] = true
+				}
+				for _, s := range schemas {
+					if err := s.verify(); err != nil {
+						return "", err
+					}
+					if s.SupersededBy != "" && !names[s.SupersededBy] {
+						return "", fmt.Errorf("schema '%s' is superseded by '%s', which is not registered", s.Name, s.SupersededBy)
+					}
+				}
+				return fmt.Sprintf("%d schemas, their documents match their hashes", len(schemas)), nil
+			},
+			remedy: "add the schema again with schema add, from the source it was registered from",
+		},
+		{
+			name:     "receipts",
+			critical: true,
+			run: func() (string, error) {
+				if _, err := receiptKeys.load(); err != nil {
+					return "", err
+				}
+				receipts, err := readReceipts(*receiptsFlag)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%d receipts", len(receipts)), nil
+			},
+			remedy: "restore the receipts or the data keys from a backup",
+		},
+		{
+			name:     "circuit artifact checksums",
+			critical: true,
+			run: func() (string, error) {
+				config, err := artifacts.readConfig()
+				if err != nil {
+					return "", err
+				}
+				checked := 0
+				for circuit, kinds := range config.Circuits {
+					for kind := range kinds {
+						path := artifacts.installedPath(circuit, kind)
+						if _, err := os.Stat(path); os.IsNotExist(err) {
+							continue
+						}
+						if err := artifacts.check(config, circuit, kind, path); err != nil {
+							return "", err
+						}
+						checked++
+					}
+				}
+				return fmt.Sprintf("%d installed artifacts match their checksums", checked), nil
+			},
+			remedy: "install the pinned artifacts again with circuits fetch",
+		},
+		{
+			name: "circuit artifacts installed",
+			run: func() (string, error) {
+				config, err := artifacts.readConfig()
+				if err != nil {
+					return "", err
+				}
+				if len(config.Circuits) == 0 {
+					return "", fmt.Errorf("no circuit artifacts are pinned in %s", artifacts.config)
+				}
+				for circuit, kinds := range config.Circuits {
+					for kind := range kinds {
+						if _, err := os.Stat(artifacts.installedPath(circuit, kind)); err != nil {
+							return "", fmt.Errorf("the %s of %s is not installed", kind, circuit)
+						}
+					}
+				}
+				return fmt.Sprintf("the artifacts of %d circuits", len(config.Circuits)), nil
+			},
+			remedy: "pin the artifacts in the circuits config and install them with circuits fetch",
+		},
+		{
+			name: "state contract project",
+			run: func() (string, error) {
+				if _, err := os.Stat(filepath.Join(*uploadDirFlag, "hardhat.config.js")); err != nil {
+					return "", fmt.Errorf("no hardhat project at %s", *uploadDirFlag)
+				}
+				if _, err := exec.LookPath("npx"); err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("hardhat project at %s", *uploadDirFlag), nil
+			},
+			remedy: "pass --upload-claims with the path of the upload-claims project, and install Node.js",
+		},
+	}
+
+	fmt.Println("Check the setup of the issuer")
+	failed := 0
+	for _, c := range checks {
+		detail, err := c.run()
+		switch {
+		case err == nil:
+			fmt.Printf("-> PASS %s: %s\n", c.name, detail)
+		case c.critical:
+			failed++
+			fmt.Printf("-> FAIL %s: %s\n", c.name, err)
+			fmt.Printf("   to fix: %s\n", c.remedy)
+		default:
+			fmt.Printf("-> WARN %s: %s\n", c.name, err)
+			fmt.Printf("   to fix: %s\n", c.remedy)
+		}
+	}
+	if failed > 0 {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("%d critical checks failed", failed))
+	}
+	return nil
+}
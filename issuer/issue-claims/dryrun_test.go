@@ -0,0 +1,97 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// snapshotDir returns the content of every file under the directory, by path
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		files[path] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDryRunLeavesNoFiles(t *testing.T) {
+	home := testHome(t)
+	code, printed := runWalkthrough(t, "--dry-run", "--output", "dir:"+home)
+	if code != 0 {
+		t.Fatalf("the dry run failed with %d: %s", code, printed)
+	}
+	if !strings.Contains(printed, `"dryRun": true`) {
+		t.Errorf("expected the would-be inputs marked as a dry run, got: %s", printed)
+	}
+	if files := snapshotDir(t, home); len(files) > 0 {
+		t.Errorf("expected the dry run to leave the home directory empty, found %d files", len(files))
+	}
+}
+
+func TestDryRunLeavesStoredIdentityUntouched(t *testing.T) {
+	home := testHome(t)
+	key := strings.Repeat("05", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	before := snapshotDir(t, home)
+
+	commands := []struct {
+		name string
+		run  func([]string) error
+		args []string
+	}{
+		{"update-claim", updateClaimCommand, []string{"--nonce", "4", "--slot", "v_2=1", "--revoke-previous", "--dry-run", "--abandon-pending"}},
+		{"revoke", revokeCommand, []string{"--nonce", "2", "--dry-run", "--abandon-pending"}},
+		{"state-transition", stateTransitionCommand, []string{"--issuer", printedValue(printed, "-> ID of the issuer identity:"), "--dry-run", "--abandon-pending"}},
+	}
+	for _, c := range commands {
+		t.Setenv(issuerKeyEnv, key)
+		printed := captureOutput(t, func() {
+			if err := c.run(c.args); err != nil {
+				t.Errorf("%s failed: %s", c.name, err)
+			}
+		})
+		if !strings.Contains(printed, `"dryRun": true`) {
+			t.Errorf("expected %s to print the would-be inputs, got: %s", c.name, printed)
+		}
+	}
+
+	after := snapshotDir(t, home)
+	if len(after) != len(before) {
+		t.Errorf("expected the %d files of the walkthrough, found %d", len(before), len(after))
+	}
+	for path, content := range before {
+		if after[path] != content {
+			t.Errorf("the dry runs changed %s", path)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+// The envelope algorithm is ECIES over the babyjubjub curve: an ephemeral key agrees a shared point with
+// the recipient's key, the AES-256-GCM key is the SHA-256 hash of the label, the shared point compressed,
+// and the ephemeral public key compressed
+const (
+	envelopeVersion   = 1
+	envelopeAlgorithm = "ECIES-BJJ-SHA256-AES256GCM"
+	envelopeKDFLabel  = "iden3-tutorial-envelope-v1"
+)
+
+// envelope is a payload encrypted to the babyjubjub key of its recipient. The compressed public keys are
+// in the hex format of the issuer keys.
+type envelope struct {
+	Version            int    `json:"version"`
+	Algorithm          string `json:"algorithm"`
+	Recipient          string `json:"recipient"`
+	EphemeralPublicKey string `json:"ephemeralPublicKey"`
+	Nonce              string `json:"nonce"`
+	Ciphertext         string `json:"ciphertext"`
+}
+
+// parsePublicKey parses a compressed babyjubjub public key, refusing points outside of the subgroup that
+// the keys are generated in
+func parsePublicKey(s string) (*babyjub.PublicKey, error) {
+	var pubKey babyjub.PublicKey
+	if err := pubKey.UnmarshalText([]byte(strings.TrimPrefix(strings.TrimSpace(s), "0x"))); err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err)
+	}
+	if !pubKey.Point().InSubGroup() {
+		return nil, fmt.Errorf("invalid public key: the point is not in the babyjubjub subgroup")
+	}
+	return &pubKey, nil
+}
+
+// parsePrivateKey parses a babyjubjub private key given as 32 bytes of hex
+func parsePrivateKey(s string) (*babyjub.PrivateKey, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(s), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %s", err)
+	}
+	var k babyjub.PrivateKey
+	if len(b) != len(k) {
+		return nil, fmt.Errorf("invalid private key: expected %d bytes, got %d", len(k), len(b))
+	}
+	copy(k[:], b)
+	wipe(b)
+	return &k, nil
+}
+
+func envelopeCipher(shared *babyjub.Point, ephemeral *babyjub.PublicKey) (cipher.AEAD, error) {
+	sharedComp := shared.Compress()
+	ephemeralComp := ephemeral.Compress()
+	h := sha256.New()
+	h.Write([]byte(envelopeKDFLabel))
+	h.Write(sharedComp[:])
+	h.Write(ephemeralComp[:])
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealEnvelope encrypts a payload to the public key of its recipient. The ephemeral key and the nonce
+// are always read from the system's secure source of randomness, as anyone who could derive the
+// ephemeral key could decrypt the payload.
+func sealEnvelope(recipient *babyjub.PublicKey, payload []byte) (*envelope, error) {
+	ephemeralKey, err := newPrivKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(ephemeralKey[:])
+	ephemeral := ephemeralKey.Public()
+	shared := babyjub.NewPoint().Mul(ephemeralKey.Scalar().BigInt(), recipient.Point())
+	aead, err := envelopeCipher(shared, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	e := &envelope{
+		Version:            envelopeVersion,
+		Algorithm:          envelopeAlgorithm,
+		Recipient:          recipient.String(),
+		EphemeralPublicKey: ephemeral.String(),
+		Nonce:              hex.EncodeToString(nonce),
+	}
+	// the header is authenticated along with the payload
+	e.Ciphertext = base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, payload, e.header()))
+	return e, nil
+}
+
+func (e *envelope) header() []byte {
+	return []byte(fmt.Sprintf("%d|%s|%s|%s", e.Version, e.Algorithm, e.Recipient, e.EphemeralPublicKey))
+}
+
+// open decrypts the payload with the private key of the recipient
+func (e *envelope) open(privKey *babyjub.PrivateKey) ([]byte, error) {
+	if e.Version != envelopeVersion || e.Algorithm != envelopeAlgorithm {
+		return nil, fmt.Errorf("unsupported envelope version %d with algorithm %q", e.Version, e.Algorithm)
+	}
+	if pubKey := privKey.Public().String(); pubKey != e.Recipient {
+		return nil, fmt.Errorf("the payload is encrypted to the key %s, not to the key %s", e.Recipient, pubKey)
+	}
+	ephemeral, err := parsePublicKey(e.EphemeralPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("ephemeral key: %s", err)
+	}
+	nonce, err := hex.DecodeString(e.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %s", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(e.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %s", err)
+	}
+	shared := babyjub.NewPoint().Mul(privKey.Scalar().BigInt(), ephemeral.Point())
+	aead, err := envelopeCipher(shared, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce: expected %d bytes, got %d", aead.NonceSize(), len(nonce))
+	}
+	payload, err := aead.Open(nil, nonce, ciphertext, e.header())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the payload, it was modified or not encrypted to this key")
+	}
+	return payload, nil
+}
@@ -0,0 +1,116 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+func newTestKey(t *testing.T) *babyjub.PrivateKey {
+	k, err := newPrivKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &k
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	payload := []byte(`{"receipts":[]}`)
+	e, err := sealEnvelope(key.Public(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Recipient != key.Public().String() {
+		t.Errorf("expected the recipient %s, got %s", key.Public(), e.Recipient)
+	}
+	opened, err := e.open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != string(payload) {
+		t.Errorf("expected the payload %s, got %s", payload, opened)
+	}
+
+	// the ephemeral key and the nonce are fresh for every envelope
+	again, err := sealEnvelope(key.Public(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.EphemeralPublicKey == e.EphemeralPublicKey || again.Nonce == e.Nonce {
+		t.Errorf("expected a new ephemeral key and nonce, got %s and %s twice", e.EphemeralPublicKey, e.Nonce)
+	}
+}
+
+func TestEnvelopeWrongKey(t *testing.T) {
+	key, other := newTestKey(t), newTestKey(t)
+	e, err := sealEnvelope(key.Public(), []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.open(other); err == nil || !strings.Contains(err.Error(), "not to the key") {
+		t.Errorf("expected the envelope to refuse another key, got %v", err)
+	}
+
+	// an envelope relabelled to the other key still doesn't decrypt with it
+	e.Recipient = other.Public().String()
+	if _, err := e.open(other); err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+		t.Errorf("expected the decryption with another key to fail, got %v", err)
+	}
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	key := newTestKey(t)
+	seal := func() *envelope {
+		e, err := sealEnvelope(key.Public(), []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	ephemeral := newTestKey(t).Public().String()
+	for _, tc := range []struct {
+		name   string
+		tamper func(e *envelope)
+	}{
+		{"ciphertext", func(e *envelope) {
+			b, _ := base64.StdEncoding.DecodeString(e.Ciphertext)
+			b[0] ^= 1
+			e.Ciphertext = base64.StdEncoding.EncodeToString(b)
+		}},
+		{"truncated ciphertext", func(e *envelope) {
+			b, _ := base64.StdEncoding.DecodeString(e.Ciphertext)
+			e.Ciphertext = base64.StdEncoding.EncodeToString(b[:len(b)-1])
+		}},
+		{"nonce", func(e *envelope) { e.Nonce = strings.Repeat("00", 12) }},
+		{"short nonce", func(e *envelope) { e.Nonce = "00" }},
+		{"ephemeral key", func(e *envelope) { e.EphemeralPublicKey = ephemeral }},
+		{"version", func(e *envelope) { e.Version = 2 }},
+		{"algorithm", func(e *envelope) { e.Algorithm = "none" }},
+	} {
+		e := seal()
+		tc.tamper(e)
+		if payload, err := e.open(key); err == nil {
+			t.Errorf("%s: expected the tampered envelope to fail, got %q", tc.name, payload)
+		}
+	}
+}
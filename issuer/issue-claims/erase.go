@@ -0,0 +1,606 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	core "github.com/iden3/go-iden3-core"
+)
+
+// erasedReason is recorded on the claim requests of an erased subject that were not issued yet
+const erasedReason = "erased at the request of the subject"
+
+// erasure is what erase scrubs: the claims of the issuer with the revocation nonces, the tombstones of
+// their hex encodings, and the DID of the holder whose data is erased
+type erasure struct {
+	issuer   string
+	nonces   map[uint64]bool
+	claims   map[string]string
+	subjects map[string]bool
+	receipts int
+}
+
+// matchesClaim tells whether a claim of an issuer with a revocation nonce is erased
+func (e *erasure) matchesClaim(issuerID string, revNonce uint64) bool {
+	return issuerID == e.issuer && e.nonces[revNonce]
+}
+
+// sortedNonces returns the erased revocation nonces in increasing order
+func (e *erasure) sortedNonces() []uint64 {
+	var nonces []uint64
+	for n := range e.nonces {
+		nonces = append(nonces, n)
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	return nonces
+}
+
+func (e *erasure) matchesEntry(entry *auditEntry) bool {
+	claim, subject := entry.Params["claim"], entry.Params["subject"]
+	for hex := range e.claims {
+		if claim == hex || claim == hashOf(hex) {
+			return true
+		}
+	}
+	for did := range e.subjects {
+		if subject == did || subject == hashOf(did) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchReceipts returns the revocation nonces of the receipts that match and are not erased yet, by issuer
+func matchReceipts(path string, match func(r *issuanceReceipt) (bool, error)) (map[string]map[uint64]bool, error) {
+	matched := map[string]map[uint64]bool{}
+	err := scanJSONLines(path, func(line int, b []byte) error {
+		var r issuanceReceipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("line %d of the receipts file is not a valid receipt: %s", line, err)
+		}
+		if r.erased() {
+			return nil
+		}
+		ok, err := match(&r)
+		if err != nil {
+			return fmt.Errorf("line %d of the receipts file: %w", line, err)
+		}
+		if ok {
+			if matched[r.Issuer] == nil {
+				matched[r.Issuer] = map[uint64]bool{}
+			}
+			matched[r.Issuer][r.RevocationNonce] = true
+		}
+		return nil
+	})
+	return matched, err
+}
+
+// eraseReceipts replaces the claims and the subjects of the receipts of the erased claims with tombstones.
+// The versions of an updated claim share its revocation nonce, so they are all erased. The other receipts
+// are copied as they are.
+func eraseReceipts(path string, e *erasure) error {
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = scanJSONLines(path, func(line int, b []byte) error {
+		var r issuanceReceipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("line %d of the receipts file is not a valid receipt: %s", line, err)
+		}
+		if !r.erased() && e.matchesClaim(r.Issuer, r.RevocationNonce) {
+			if err := receiptKeys.open(&r); err != nil {
+				return fmt.Errorf("line %d of the receipts file: %w", line, err)
+			}
+			tombstone := r
+			if err := tombstone.erase(); err != nil {
+				return fmt.Errorf("line %d of the receipts file: %w", line, err)
+			}
+			e.claims[r.Claim] = tombstone.Claim
+			e.receipts++
+			b, _ = json.Marshal(&tombstone)
+		}
+		_, err := f.Write(append(b, '\n'))
+		return err
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && e.receipts > 0 {
+		return os.Rename(tmp, path)
+	}
+	os.Remove(tmp)
+	return err
+}
+
+// eraseClaimRequests scrubs the descriptors of the requests for the erased claims, and of the requests
+// about an erased holder. The requests that were not issued yet are rejected.
+func eraseClaimRequests(path string, holder *core.ID, e *erasure) (int, error) {
+	requests, err := readClaimRequests(path)
+	if err != nil {
+		return 0, err
+	}
+	erased := 0
+	for _, r := range requests {
+		tombstone, issued := e.claims[r.Claim]
+		if !issued && holder != nil {
+			var d struct {
+				Subject string `json:"subject"`
+			}
+			if json.Unmarshal(r.Descriptor, &d) == nil && d.Subject != "" {
+				if id, err := parseHolderID(d.Subject); err == nil && id.Equal(holder) {
+					issued = true
+				}
+			}
+		}
+		if !issued || string(r.Descriptor) == "null" {
+			continue
+		}
+		r.Descriptor = json.RawMessage("null")
+		if r.Claim != "" {
+			r.Claim = tombstone
+		}
+		if r.Status == requestPending || r.Status == requestApproved || r.Status == requestFailed {
+			r.Status = requestRejected
+			r.Reason = erasedReason
+		}
+		erased++
+	}
+	if erased > 0 {
+		err = writeClaimRequests(path, requests)
+	}
+	return erased, err
+}
+
+// eraseAuditEntries replaces the sensitive params of the matching entries with their hashes, and returns
+// the sequence numbers of the entries that were changed. For the entries written before version 2, it also
+// returns their hashes once scrubbed, as <seq>:<hash>, for the erase entry to record.
+func eraseAuditEntries(path string, e *erasure) (erased, hashes []string, err error) {
+	entries, err := readAuditLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		if !e.matchesEntry(entry) {
+			continue
+		}
+		scrubbed := scrubbedParams(entry.Params)
+		changed := false
+		for _, k := range sensitiveAuditParams {
+			if scrubbed[k] != entry.Params[k] {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		entry.Params = scrubbed
+		entry.Erased = true
+		erased = append(erased, strconv.Itoa(entry.Seq))
+		if entry.Version < 2 {
+			hashes = append(hashes, fmt.Sprintf("%d:%s", entry.Seq, entry.scrubbedHash()))
+		}
+	}
+	if len(erased) > 0 {
+		err = writeAuditLog(path, entries)
+	}
+	return erased, hashes, err
+}
+
+// eraseTransitions replaces the erased claims that the recorded transitions of the issuer cover, the
+// abandoned and published ones included, with their tombstones
+func eraseTransitions(path string, e *erasure) (int, error) {
+	transitions, err := readTransitions(path)
+	if err != nil {
+		return 0, err
+	}
+	erased := 0
+	for _, t := range transitions {
+		if t.Issuer != e.issuer {
+			continue
+		}
+		for n, claimHex := range t.Claims {
+			if strings.HasPrefix(claimHex, erasedPrefix) {
+				continue
+			}
+			claim, err := claimFromHex(claimHex)
+			if err != nil {
+				return 0, fmt.Errorf("invalid claim in the transition to %s: %s", t.NewState, err)
+			}
+			if !e.nonces[claim.GetRevocationNonce()] {
+				continue
+			}
+			if t.Claims[n], err = claimTombstone(claimHex); err != nil {
+				return 0, err
+			}
+			erased++
+		}
+	}
+	if erased > 0 {
+		err = writeTransitions(path, transitions)
+	}
+	return erased, err
+}
+
+// erasePayload replaces the receipts of the erased claims in a holder payload with tombstones. It returns
+// nil for a payload to delete: one encrypted to the holder, which can't be read without the holder's key,
+// and one that is left with no claim.
+func erasePayload(path string, a *manifestArtifact, e *erasure) ([]byte, error) {
+	if a.Encrypted {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = decodeTransport(b); err != nil {
+		return nil, err
+	}
+	var payload holderPayload
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid holder payload %s: %s", path, err))
+	}
+	left := 0
+	for _, r := range payload.Receipts {
+		if !r.erased() && e.matchesClaim(r.Issuer, r.RevocationNonce) {
+			if err := r.erase(); err != nil {
+				return nil, err
+			}
+		}
+		if !r.erased() {
+			left++
+		}
+	}
+	if left == 0 {
+		return nil, nil
+	}
+	b, _ = json.MarshalIndent(&payload, "", "  ")
+	return encodeTransport(append(b, '\n'), a.Encoding)
+}
+
+// eraseCredentials takes the credentials of the erased claims out of a file of W3C credentials, and returns
+// nil for a file that is left with none
+func eraseCredentials(path string, e *erasure) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var credentials []json.RawMessage
+	if err := json.Unmarshal(b, &credentials); err != nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid W3C credentials %s: %s", path, err))
+	}
+	var kept []json.RawMessage
+	for _, c := range credentials {
+		var vc struct {
+			CredentialStatus *w3cCredentialStatus `json:"credentialStatus"`
+		}
+		if err := json.Unmarshal(c, &vc); err != nil {
+			return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid W3C credential in %s: %s", path, err))
+		}
+		if vc.CredentialStatus == nil || !e.nonces[vc.CredentialStatus.RevocationNonce] {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+	b, _ = json.MarshalIndent(kept, "", "  ")
+	return b, nil
+}
+
+// eraseArtifacts scrubs the artifacts that the manifest of the issuer lists with an erased claim: the holder
+// payload and the W3C credentials are rewritten without the claims, or deleted, and the hash of the receipts
+// file is updated. It returns whether the manifest changed.
+func eraseArtifacts(m *manifest, e *erasure) (bool, error) {
+	if m.Issuer != e.issuer {
+		return false, nil
+	}
+	changed := false
+	var kept []*manifestArtifact
+	for _, a := range m.Artifacts {
+		var nonces []uint64
+		for _, n := range a.RevocationNonces {
+			if !e.nonces[n] {
+				nonces = append(nonces, n)
+			}
+		}
+		if len(nonces) == len(a.RevocationNonces) {
+			kept = append(kept, a)
+			continue
+		}
+		path := a.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(m.dir, path)
+		}
+		var data []byte
+		var err error
+		switch a.Format {
+		case formatHolderPayload:
+			data, err = erasePayload(path, a, e)
+		case formatW3CCredentials:
+			data, err = eraseCredentials(path, e)
+		case formatReceipts:
+			// the receipts are erased in place already
+			if a.SHA256, err = fileSHA256(path); err != nil {
+				return changed, err
+			}
+			a.RevocationNonces = nonces
+			kept = append(kept, a)
+			changed = true
+			continue
+		default:
+			// the inputs of a transition and their signature carry no claim
+			kept = append(kept, a)
+			continue
+		}
+		if os.IsNotExist(err) {
+			fmt.Printf("-> The %s %s is gone already\n", a.Format, path)
+			changed = true
+			continue
+		} else if err != nil {
+			return changed, fmt.Errorf("failed to erase the %s %s: %w", a.Format, path, err)
+		}
+		if err := readOnly.check(path); err != nil {
+			return changed, err
+		}
+		changed = true
+		if data == nil {
+			if err := os.Remove(path); err != nil {
+				return changed, err
+			}
+			fmt.Printf("-> Deleted the %s %s\n", a.Format, path)
+			continue
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return changed, err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return changed, err
+		}
+		fmt.Printf("-> Erased the claims from the %s %s\n", a.Format, path)
+		sum := sha256.Sum256(data)
+		a.SHA256 = hex.EncodeToString(sum[:])
+		a.RevocationNonces = nonces
+		kept = append(kept, a)
+	}
+	m.Artifacts = kept
+	return changed, nil
+}
+
+// eraseCommand handles the "erase" command, which erases the personal data of a claim, or of every claim
+// of a holder. The claims are revoked, as a tombstone can't be proved against, and the stored identity,
+// the recorded transitions, the receipts, the claim requests, the audit log and the holder payload and
+// the W3C credentials of the manifest in the output keep the index and value hashes of each claim as its
+// tombstone, or the hashes of its params. The claims tree still holds the leaves, and can't give them up:
+// the state that the issuer published commits to them. Backups, and the copies already handed over to the
+// holder or posted to an http output, are out of reach.
+func eraseCommand(args []string) error {
+	fs := flag.NewFlagSet("erase", flag.ExitOnError)
+	readOnly.register(fs, false)
+	nonceFlag := fs.String("nonce", "", "revocation nonce of the claim to erase")
+	holderFlag := fs.String("holder", "", "ID or DID of the holder whose claims are all erased, instead of --nonce")
+	receiptsFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file")
+	receiptKeys.register(fs)
+	requestsFlag := fs.String("requests", defaultClaimRequestsPath(), "path of the file that the claim requests are recorded in")
+	var stored storedIdentityFlags
+	stored.register(fs)
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	if (*nonceFlag == "") == (*holderFlag == "") {
+		return usageError("usage: erase --nonce <revocation nonce> [--issuer <id>] | erase --holder <id or did> [--issuer <id>]")
+	}
+	if stored.dryRun {
+		return usageError("erase can't be dry run, the claims are erased for good")
+	}
+
+	var match func(r *issuanceReceipt) (bool, error)
+	var holder *core.ID
+	if *nonceFlag != "" {
+		revNonce, err := strconv.ParseUint(*nonceFlag, 10, 64)
+		if err != nil {
+			return usageError("invalid --nonce %q: %s", *nonceFlag, err)
+		}
+		match = func(r *issuanceReceipt) (bool, error) {
+			return r.RevocationNonce == revNonce, nil
+		}
+		fmt.Printf("Erase the claim with the revocation nonce %d\n", revNonce)
+	} else {
+		var err error
+		if holder, err = parseHolderID(*holderFlag); err != nil {
+			return err
+		}
+		did := (&core.DID{ID: *holder}).String()
+		match = func(r *issuanceReceipt) (bool, error) {
+			return receiptKeys.matchesSubject(r, did)
+		}
+		fmt.Printf("Erase the claims of the holder %s\n", sensitive.id(did))
+	}
+	operator, err := operators.authorize(roleRevoke)
+	if err != nil {
+		return fmt.Errorf("not authorized to erase claims: %w", err)
+	}
+
+	matched, err := matchReceipts(*receiptsFlag, match)
+	if err != nil {
+		return err
+	}
+	if stored.issuer != "" {
+		matched = map[string]map[uint64]bool{stored.issuer: matched[stored.issuer]}
+		if matched[stored.issuer] == nil {
+			delete(matched, stored.issuer)
+		}
+	}
+	if len(matched) > 1 {
+		return usageError("claims of %d issuers match, pick the issuer with --issuer", len(matched))
+	} else if len(matched) == 0 && holder == nil {
+		return withCode(errCodeNotFound, fmt.Errorf("no claim with the revocation nonce %s in the receipts, or it was already erased", *nonceFlag), "revocationNonce", *nonceFlag)
+	}
+	e := &erasure{nonces: map[uint64]bool{}, claims: map[string]string{}, subjects: map[string]bool{}}
+	if holder != nil {
+		e.subjects[(&core.DID{ID: *holder}).String()] = true
+	}
+	for issuerID, nonces := range matched {
+		e.issuer, e.nonces = issuerID, nonces
+	}
+
+	if e.issuer != "" {
+		stored.issuer = e.issuer
+		ctx, cancel := newCommandContext(stored.timeout)
+		defer cancel()
+		if err := eraseIssuedClaims(ctx, &stored, operator, *receiptsFlag, e); err != nil {
+			return err
+		}
+	}
+	requests, err := eraseClaimRequests(*requestsFlag, holder, e)
+	if err != nil {
+		return fmt.Errorf("failed to erase the claim requests: %s", err)
+	}
+	fmt.Printf("-> Erased the descriptors of %d claim requests\n", requests)
+	entries, hashes, err := eraseAuditEntries(stored.auditLog, e)
+	if err != nil {
+		return fmt.Errorf("failed to erase the audit log entries: %s", err)
+	}
+	fmt.Printf("-> Replaced the plaintext claims and subjects of %d audit log entries with their hashes\n", len(entries))
+
+	auditLog, err := openAuditLog(stored.auditLog)
+	if err != nil {
+		return err
+	}
+	auditLog.operator = operator
+	var claims []string
+	for _, n := range e.sortedNonces() {
+		claims = append(claims, fmt.Sprintf("%s/%d", e.issuer, n))
+	}
+	params := map[string]string{
+		"claims":   strings.Join(claims, ","),
+		"requests": strconv.Itoa(requests),
+		"entries":  strings.Join(entries, ","),
+	}
+	if len(hashes) > 0 {
+		params["erasedHashes"] = strings.Join(hashes, ",")
+	}
+	err = auditLog.record("erase", auditCompleted, params, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to record the erasure in the audit log: %s", err)
+	}
+	return nil
+}
+
+// eraseIssuedClaims revokes the erased claims of the stored identity that are not revoked yet, and writes
+// the transition that publishes the revocations, with its manifest. The claims are then replaced with their
+// tombstones in the stored identity, the receipts and the recorded transitions, and in the artifacts that
+// the manifest in the output listed before it was replaced.
+func eraseIssuedClaims(ctx context.Context, stored *storedIdentityFlags, operator, receiptsPath string, e *erasure) error {
+	o, err := stored.open(ctx, operator)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+	authNonce := o.identity.AuthClaim.GetRevocationNonce()
+	var revoke []uint64
+	for _, n := range e.sortedNonces() {
+		if n == authNonce {
+			return withCode(errCodeConflict, fmt.Errorf("the revocation nonce %d is the one of the auth claim of %s, which is not personal data", n, e.issuer), "revocationNonce", fmt.Sprint(n))
+		}
+		revoked, _, err := o.identity.RevocationStatus(ctx, n)
+		if err != nil {
+			return err
+		} else if !revoked {
+			revoke = append(revoke, n)
+		}
+	}
+	var artifacts *manifest
+	if dir, ok := o.output.(dirSink); ok {
+		if artifacts, err = readManifest(dir.location(manifestName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		fmt.Printf("-> The artifacts posted to %s are out of reach, ask their recipient to delete them\n", o.output.location(""))
+	}
+
+	oldState := o.publishedState()
+	for _, n := range revoke {
+		if err := o.revoke(ctx, n); err != nil {
+			return fmt.Errorf("failed to revoke the nonce %d: %w", n, err)
+		}
+		fmt.Printf("-> Revoked the revocation nonce %d\n", n)
+	}
+	erased, err := o.identity.EraseClaims(e.sortedNonces()...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("-> Replaced %d claims of the identity with their tombstones\n", erased)
+	if len(revoke) > 0 {
+		if err := o.finish(ctx, "erase", oldState); err != nil {
+			return err
+		}
+	} else {
+		s, err := newStoredIdentity(o.identity, o.stored.TreeDepth, o.stored.Imported)
+		if err != nil {
+			return err
+		}
+		if err := saveIdentity(stored.identities, s); err != nil {
+			return fmt.Errorf("failed to store the identity: %w", err)
+		}
+		fmt.Printf("-> Identity stored in the file: %s\n", stored.identities)
+	}
+
+	if err := eraseReceipts(receiptsPath, e); err != nil {
+		return err
+	}
+	fmt.Printf("-> Replaced the claims and the subjects of %d receipts with tombstones\n", e.receipts)
+	transitions, err := eraseTransitions(stored.transitions, e)
+	if err != nil {
+		return fmt.Errorf("failed to erase the claims of the transitions: %s", err)
+	}
+	fmt.Printf("-> Replaced %d claims of the recorded transitions with tombstones\n", transitions)
+	if artifacts == nil {
+		return nil
+	}
+	changed, err := eraseArtifacts(artifacts, e)
+	if err != nil {
+		return err
+	}
+	// the manifest of the transition replaced the scrubbed one already
+	if changed && len(revoke) == 0 {
+		if err := o.output.Write(manifestName, artifacts.encode()); err != nil {
+			return fmt.Errorf("failed to write the manifest of the artifacts: %s", err)
+		}
+	}
+	return nil
+}
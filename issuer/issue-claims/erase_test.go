@@ -0,0 +1,161 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeV1AuditLog writes an audit log of entries from before version 2, whose hash covers the plaintext
+// params, with the claim recorded in plaintext in the second entry
+func writeV1AuditLog(t *testing.T, path, claimHex string) {
+	entries := []*auditEntry{
+		{Version: 1, Seq: 1, Time: time.Unix(1, 0).UTC(), Operation: "create-identity", Status: auditCompleted, NewState: "1"},
+		{Version: 1, Seq: 2, Time: time.Unix(2, 0).UTC(), Operation: "issue-claim", Status: auditCompleted, Params: map[string]string{"claim": claimHex}, OldState: "1", NewState: "2"},
+	}
+	prevHash := ""
+	for _, e := range entries {
+		e.PrevHash = prevHash
+		e.Hash = e.calculateHash()
+		prevHash = e.Hash
+	}
+	if err := writeAuditLog(path, entries); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAuditChainChecksErasedV1Entries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeV1AuditLog(t, path, "aabb")
+	erased, hashes, err := eraseAuditEntries(path, &erasure{claims: map[string]string{"aabb": "tombstone"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(erased, ",") != "2" || len(hashes) != 1 {
+		t.Fatalf("expected the second entry to be erased with its hash, got %v and %v", erased, hashes)
+	}
+	entries, err := readAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyAuditChain(entries); err == nil || !strings.Contains(err.Error(), "no erase entry recorded its hash") {
+		t.Fatalf("expected an erased entry without a recorded hash to be refused, got %v", err)
+	}
+
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.record("erase", auditCompleted, map[string]string{"entries": "2", "erasedHashes": strings.Join(hashes, ",")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = readAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyAuditChain(entries); err != nil {
+		t.Fatalf("expected the erased log to verify, got %v", err)
+	}
+
+	// the fields of an erased entry that erase didn't scrub are still covered by the hash
+	entries[1].NewState = "3"
+	if err := verifyAuditChain(entries); err == nil || !strings.Contains(err.Error(), "entry 2 doesn't match the hash recorded when it was erased") {
+		t.Fatalf("expected the modified erased entry to be refused, got %v", err)
+	}
+}
+
+func TestEraseRevokesAndScrubsTheClaimsOfAHolder(t *testing.T) {
+	home := testHome(t)
+	key := strings.Repeat("0d", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t, "--holder-id", testHolderID, "--w3c-credentials", "credentials.json", "--revocation-endpoint", "http://localhost:8080/revocations", "--schema-url", "http://localhost:8080/schema.json")
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+	claims := map[string]bool{}
+	var nonces []uint64
+	err := scanJSONLines(defaultReceiptsPath(), func(line int, b []byte) error {
+		var r issuanceReceipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return err
+		}
+		if r.Subject != "self" {
+			claims[r.Claim] = true
+			nonces = append(nonces, r.RevocationNonce)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(claims) == 0 {
+		t.Fatal("expected receipts of claims about the holder")
+	}
+
+	t.Setenv(issuerKeyEnv, key)
+	printed = captureOutput(t, func() {
+		if err := eraseCommand([]string{"--holder", testHolderID, "--abandon-pending"}); err != nil {
+			t.Fatalf("failed to erase the claims of the holder: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "-> Revoked the revocation nonce ") || !strings.Contains(printed, "-> Deleted the holder-payload ") {
+		t.Errorf("expected the claims to be revoked and the payload deleted, got: %s", printed)
+	}
+	for _, name := range []string{"iden3_identities.json", "iden3_transitions.json", "iden3_receipts.json", "credentials.json"} {
+		b, err := os.ReadFile(filepath.Join(home, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		for claim := range claims {
+			if strings.Contains(string(b), claim) {
+				t.Errorf("expected the erased claim to be gone from %s", name)
+			}
+		}
+		if strings.Contains(string(b), testHolderID) {
+			t.Errorf("expected the erased holder to be gone from %s", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(home, "iden3_holder_payload.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the holder payload to be deleted, got %v", err)
+	}
+
+	// the stored identity still rebuilds to its state from the tombstones, with the claims revoked
+	stored, err := findIdentity(defaultIdentitiesPath(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := stored.rebuild(context.Background()); err != nil || state.BigInt().String() != stored.State {
+		t.Errorf("expected the erased identity to rebuild to %s, got %v", stored.State, err)
+	}
+	revoked, err := revokedClaims(defaultIdentitiesPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nonces {
+		if !revoked[issuedClaimRef{id, n}] {
+			t.Errorf("expected the erased nonce %d to be revoked", n)
+		}
+	}
+}
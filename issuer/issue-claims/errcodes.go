@@ -0,0 +1,222 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+//go:generate go run . error-codes --out ERROR_CODES.md
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"kaleido.io/iden3-tutorial/issuer"
+	"kaleido.io/iden3-tutorial/verifier"
+)
+
+// errorCode is a class of failure that scripts can tell apart without parsing the message. Each class has
+// the exit code of the command that fails with it, and the status of an HTTP response that reports it.
+type errorCode struct {
+	Code        string `json:"code"`
+	HTTPStatus  int    `json:"httpStatus"`
+	ExitCode    int    `json:"exitCode"`
+	Description string `json:"description"`
+}
+
+var (
+	errCodeInternal           = &errorCode{"internal", http.StatusInternalServerError, 1, "An unexpected failure, the message tells what failed"}
+	errCodeUsage              = &errorCode{"usage", http.StatusBadRequest, 2, "The command or its options are missing or invalid"}
+	errCodeInvalidInput       = &errorCode{"invalid-input", http.StatusBadRequest, 3, "An input such as a claim, a descriptor or a slot value is malformed"}
+	errCodeInvalidHolderID    = &errorCode{"invalid-holder-id", http.StatusBadRequest, 3, "The holder ID or DID is malformed, or its checksum doesn't match"}
+	errCodeNotFound           = &errorCode{"not-found", http.StatusNotFound, 4, "A file or a recorded request, schema or holder doesn't exist"}
+	errCodeConflict           = &errorCode{"conflict", http.StatusConflict, 5, "A record is not in the state that the operation requires, such as a request that was already decided"}
+	errCodeNonceInUse         = &errorCode{"nonce-in-use", http.StatusConflict, 5, "The revocation nonce is already used by another claim of the identity, or already revoked"}
+	errCodeUnauthorized       = &errorCode{"unauthorized", http.StatusForbidden, 6, "The operator doesn't hold the role that the operation requires"}
+	errCodeKeyMismatch        = &errorCode{"key-mismatch", http.StatusInternalServerError, 7, "The signing key doesn't belong to the identity, nothing was signed"}
+	errCodeVerificationFailed = &errorCode{"verification-failed", http.StatusUnprocessableEntity, 8, "A proof, signature, receipt or hash chain doesn't verify"}
+	errCodeClaimRevoked       = &errorCode{"claim-revoked", http.StatusUnprocessableEntity, 8, "The claim is revoked in the issuer's current state"}
+	errCodeUnavailable        = &errorCode{"unavailable", http.StatusServiceUnavailable, 9, "A remote service, such as an IPFS node or a revocation status endpoint, couldn't be reached"}
+	errCodeTimeout            = &errorCode{"timeout", http.StatusGatewayTimeout, 10, "The operation, such as the generation or the verification of a proof, didn't complete in time and was stopped"}
+)
+
+// errorCodes lists every code, in the order of their exit codes, for the reference
+var errorCodes = []*errorCode{
+	errCodeInternal,
+	errCodeUsage,
+	errCodeInvalidInput,
+	errCodeInvalidHolderID,
+	errCodeNotFound,
+	errCodeConflict,
+	errCodeNonceInUse,
+	errCodeUnauthorized,
+	errCodeKeyMismatch,
+	errCodeVerificationFailed,
+	errCodeClaimRevoked,
+	errCodeUnavailable,
+	errCodeTimeout,
+}
+
+// codedError is an error of a known class, with the details that a script needs to act on it
+type codedError struct {
+	code    *errorCode
+	details map[string]string
+	err     error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// withCode classifies an error, the details are pairs of keys and values
+func withCode(code *errorCode, err error, details ...string) error {
+	e := &codedError{code: code, err: err}
+	for i := 0; i+1 < len(details); i += 2 {
+		if e.details == nil {
+			e.details = map[string]string{}
+		}
+		e.details[details[i]] = details[i+1]
+	}
+	return e
+}
+
+func usageError(format string, a ...interface{}) error {
+	return withCode(errCodeUsage, fmt.Errorf(format, a...))
+}
+
+// classifyError finds the class of an error, from the code it was given, or from the errors of the library
+// packages that it wraps
+func classifyError(err error) *codedError {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		if coded.err != err && err.Error() != coded.err.Error() {
+			// the message of the error that wraps the coded one carries more context
+			return &codedError{code: coded.code, details: coded.details, err: err}
+		}
+		return coded
+	}
+	switch {
+	case errors.Is(err, issuer.ErrKeyMismatch):
+		return &codedError{code: errCodeKeyMismatch, err: err}
+	case errors.Is(err, verifier.ErrRevoked):
+		return &codedError{code: errCodeClaimRevoked, err: err}
+	case errors.Is(err, os.ErrNotExist):
+		return &codedError{code: errCodeNotFound, err: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &codedError{code: errCodeTimeout, err: err}
+	}
+	return &codedError{code: errCodeInternal, err: err}
+}
+
+// errorBody is the JSON that an error is reported as, by the commands in their JSON mode
+type errorBody struct {
+	Error struct {
+		Code    string            `json:"code"`
+		Message string            `json:"message"`
+		Details map[string]string `json:"details,omitempty"`
+	} `json:"error"`
+}
+
+func (e *codedError) body() *errorBody {
+	var b errorBody
+	b.Error.Code = e.code.Code
+	b.Error.Message = e.err.Error()
+	b.Error.Details = e.details
+	return &b
+}
+
+// reportError prints the error of a command, as JSON in the JSON mode of the command, and returns the exit
+// code of its class
+func reportError(err error, jsonMode bool) int {
+	coded := classifyError(err)
+	if jsonMode {
+		out, _ := json.Marshal(coded.body())
+		fmt.Println(string(out))
+	} else {
+		fmt.Println(err)
+	}
+	return coded.code.ExitCode
+}
+
+// jsonMode tells whether the options of a command turn on its JSON mode, with --json or --format json
+func jsonMode(args []string) bool {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if arg == name {
+			continue
+		}
+		switch {
+		case name == "json" || name == "json=true":
+			return true
+		case name == "format=json":
+			return true
+		case name == "format" && i+1 < len(args) && args[i+1] == "json":
+			return true
+		}
+	}
+	return false
+}
+
+// writeErrorCodes generates the reference of the error codes, in markdown
+func writeErrorCodes(w io.Writer) {
+	fmt.Fprintln(w, "# Error codes")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "<!-- Generated by `go run . error-codes --out ERROR_CODES.md` from errcodes.go, don't edit. -->")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "The commands exit with the exit code of the class of their failure. In their JSON mode (`--json` or `--format json`), they print the failure as `{\"error\": {\"code\": ..., \"message\": ..., \"details\": {...}}}`, which is also the body of an HTTP response with the HTTP status of the class.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "| Code | Exit code | HTTP status | Description |")
+	fmt.Fprintln(w, "|------|-----------|-------------|-------------|")
+	codes := append([]*errorCode{}, errorCodes...)
+	sort.SliceStable(codes, func(i, j int) bool { return codes[i].ExitCode < codes[j].ExitCode })
+	for _, c := range codes {
+		fmt.Fprintf(w, "| `%s` | %d | %d %s | %s |\n", c.Code, c.ExitCode, c.HTTPStatus, http.StatusText(c.HTTPStatus), c.Description)
+	}
+}
+
+// errorCodesCommand handles the "error-codes" command that prints the reference of the error codes
+func errorCodesCommand(args []string) error {
+	fs := flag.NewFlagSet("error-codes", flag.ExitOnError)
+	outFlag := fs.String("out", "", "path to write the reference to, instead of printing it")
+	jsonFlag := fs.Bool("json", false, "print the codes as JSON")
+	fs.Parse(args)
+	if *jsonFlag {
+		out, _ := json.MarshalIndent(errorCodes, "", "  ")
+		fmt.Println(string(out))
+		return nil
+	}
+	if *outFlag == "" {
+		writeErrorCodes(os.Stdout)
+		return nil
+	}
+	f, err := os.Create(*outFlag)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	writeErrorCodes(f)
+	return nil
+}
@@ -0,0 +1,397 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+)
+
+// The formats that the audit log and the issued claims are exported in
+const (
+	exportText = "text"
+	exportCSV  = "csv"
+	exportJSON = "json"
+)
+
+// exportColumn is a column of an export, in the order of the default columns
+type exportColumn struct {
+	name  string
+	value func(v interface{}) string
+}
+
+// auditColumns are the columns of an exported audit log entry. The params that have no column of their own
+// are in the params column, as a JSON object.
+var auditColumns = []exportColumn{
+	{"seq", func(v interface{}) string { return strconv.Itoa(v.(*auditEntry).Seq) }},
+	{"time", func(v interface{}) string { return exportTime(v.(*auditEntry).Time) }},
+	{"operation", func(v interface{}) string { return v.(*auditEntry).Operation }},
+	{"status", func(v interface{}) string { return v.(*auditEntry).Status }},
+	{"operator", func(v interface{}) string { return v.(*auditEntry).Operator }},
+	{"issuer", auditParam("issuer")},
+	{"subject", auditParam("subject")},
+	{"schemaHash", auditParam("schemaHash")},
+	{"revocationNonce", auditParam("revocationNonce")},
+	{"version", auditParam("version")},
+	{"claim", auditParam("claim")},
+	{"error", auditParam("error")},
+	{"params", func(v interface{}) string {
+		params := map[string]string{}
+		for k, p := range v.(*auditEntry).Params {
+			switch k {
+			case "issuer", "subject", "schemaHash", "revocationNonce", "version", "claim", "error":
+			default:
+				params[k] = p
+			}
+		}
+		if len(params) == 0 {
+			return ""
+		}
+		b, _ := json.Marshal(params)
+		return string(b)
+	}},
+	{"oldState", func(v interface{}) string { return v.(*auditEntry).OldState }},
+	{"newState", func(v interface{}) string { return v.(*auditEntry).NewState }},
+	{"prevHash", func(v interface{}) string { return v.(*auditEntry).PrevHash }},
+	{"hash", func(v interface{}) string { return v.(*auditEntry).Hash }},
+}
+
+// claimColumns are the columns of an exported claim, from its issuance receipt
+var claimColumns = []exportColumn{
+	{"issuedAt", func(v interface{}) string { return exportTime(time.Unix(v.(*issuanceReceipt).Timestamp, 0)) }},
+	{"issuer", func(v interface{}) string { return v.(*issuanceReceipt).Issuer }},
+	{"subject", func(v interface{}) string { return v.(*issuanceReceipt).Subject }},
+	{"schemaHash", func(v interface{}) string { return v.(*issuanceReceipt).SchemaHash }},
+	{"revocationNonce", func(v interface{}) string { return strconv.FormatUint(v.(*issuanceReceipt).RevocationNonce, 10) }},
+	{"claim", func(v interface{}) string { return v.(*issuanceReceipt).Claim }},
+	{"oldState", func(v interface{}) string { return v.(*issuanceReceipt).OldState }},
+	{"newState", func(v interface{}) string { return v.(*issuanceReceipt).NewState }},
+	{"claimsRoot", func(v interface{}) string { return v.(*issuanceReceipt).ClaimsRoot }},
+	{"revocationRoot", func(v interface{}) string { return v.(*issuanceReceipt).RevocationRoot }},
+	{"rootOfRoots", func(v interface{}) string { return v.(*issuanceReceipt).RootOfRoots }},
+	{"issuerPublicKey", func(v interface{}) string { return v.(*issuanceReceipt).IssuerPublicKey }},
+	{"signature", func(v interface{}) string { return v.(*issuanceReceipt).Signature }},
+	{"expiration", func(v interface{}) string {
+		if expiration, ok := receiptExpiration(v.(*issuanceReceipt)); ok {
+			return exportTime(expiration)
+		}
+		return ""
+	}},
+	{"supersedes", func(v interface{}) string {
+		if s := v.(*issuanceReceipt).Supersedes; s != nil {
+			return exportNonce(&s.RevocationNonce)
+		}
+		return ""
+	}},
+	{"supersededBy", func(v interface{}) string { return exportNonce(v.(*issuanceReceipt).supersededBy) }},
+}
+
+// receiptExpiration returns the expiration of the claim of a receipt, false if it has none
+func receiptExpiration(r *issuanceReceipt) (time.Time, bool) {
+	claim, err := claimFromHex(r.Claim)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return claim.GetExpirationDate()
+}
+
+func exportNonce(nonce *uint64) string {
+	if nonce == nil {
+		return ""
+	}
+	return strconv.FormatUint(*nonce, 10)
+}
+
+func auditParam(name string) func(v interface{}) string {
+	return func(v interface{}) string { return v.(*auditEntry).Params[name] }
+}
+
+// exportTime formats the times of an export in ISO 8601, in UTC
+func exportTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// selectColumns picks the columns named by the --columns option, in the order they are named, or all the
+// columns if none are named
+func selectColumns(all []exportColumn, names string) ([]exportColumn, error) {
+	if names == "" {
+		return all, nil
+	}
+	var selected []exportColumn
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, c := range all {
+			if c.name == name {
+				selected = append(selected, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			available := make([]string, len(all))
+			for i, c := range all {
+				available[i] = c.name
+			}
+			return nil, fmt.Errorf("unknown column '%s', the columns are %s", name, strings.Join(available, ","))
+		}
+	}
+	return selected, nil
+}
+
+// scanJSONLines calls fn with each line of a JSON lines file in turn, without reading the whole file in
+// memory. A missing file has no lines.
+func scanJSONLines(path string, fn func(line int, b []byte) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if err := fn(line, scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// exportWriter writes the rows of an export as they are read, as CSV with a header row, as JSON lines of
+// the selected columns, or as tab separated text
+type exportWriter struct {
+	format  string
+	columns []exportColumn
+	out     *bufio.Writer
+	csv     *csv.Writer
+}
+
+func newExportWriter(w io.Writer, format string, columns []exportColumn) (*exportWriter, error) {
+	e := &exportWriter{format: format, columns: columns, out: bufio.NewWriter(w)}
+	switch format {
+	case exportCSV:
+		e.csv = csv.NewWriter(e.out)
+		// RFC 4180 ends the records with CRLF
+		e.csv.UseCRLF = true
+		header := make([]string, len(columns))
+		for i, c := range columns {
+			header[i] = c.name
+		}
+		return e, e.csv.Write(header)
+	case exportText, exportJSON:
+		return e, nil
+	}
+	return nil, fmt.Errorf("the format must be one of %s, %s, %s, got %q", exportText, exportCSV, exportJSON, format)
+}
+
+func (e *exportWriter) write(v interface{}) error {
+	switch e.format {
+	case exportCSV:
+		record := make([]string, len(e.columns))
+		for i, c := range e.columns {
+			record[i] = c.value(v)
+		}
+		return e.csv.Write(record)
+	case exportJSON:
+		// a JSON object keeps the keys sorted, the order of the columns is only kept by the CSV
+		row := make(map[string]string, len(e.columns))
+		for _, c := range e.columns {
+			row[c.name] = c.value(v)
+		}
+		line, _ := json.Marshal(row)
+		_, err := e.out.Write(append(line, '\n'))
+		return err
+	default:
+		values := make([]string, len(e.columns))
+		for i, c := range e.columns {
+			values[i] = c.value(v)
+		}
+		_, err := e.out.WriteString(strings.Join(values, "\t") + "\n")
+		return err
+	}
+}
+
+func (e *exportWriter) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return e.out.Flush()
+}
+
+// listClaimsCommand handles the "list-claims" command that lists the issued claims from their receipts, in
+// the order they were issued, which is the order of the receipts file. The filters apply before the page.
+func listClaimsCommand(args []string) error {
+	fs := flag.NewFlagSet("list-claims", flag.ExitOnError)
+	pathFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file")
+	formatFlag := fs.String("format", exportText, "the format of the list: text, csv (RFC 4180 with a header row) or json (JSON lines)")
+	columnsFlag := fs.String("columns", "issuedAt,issuer,subject,schemaHash,revocationNonce", "comma separated columns to list, in order, or \"all\"")
+	issuerFlag := fs.String("issuer", "", "only list the claims issued by this issuer ID")
+	subjectFlag := fs.String("subject", "", "only list the claims issued to this holder ID or DID, found by the HMAC index of the encrypted receipts")
+	expiringWithinFlag := fs.Duration("expiring-within", 0, "only list the claims that expire within this long, or have expired, and were not reissued, for example 720h")
+	deprecatedFlag := fs.Bool("deprecated", false, "only list the claims issued with a schema version that is superseded, and not migrated yet")
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file of the registered schemas, for --deprecated")
+	schemaHashFlag := fs.String("schema-hash", "", "only list the claims with this schema hash, in hex")
+	revokedFlag := fs.String("revoked", "", "only list the claims that are revoked (true) or not revoked (false) by the stored identity of their issuer")
+	identitiesFlag := fs.String("identities", defaultIdentitiesPath(), "path of the file of the stored issuer identities, for --revoked")
+	fromFlag := fs.String("from", "", "only list the claims issued at or after this time, in RFC 3339 format")
+	toFlag := fs.String("to", "", "only list the claims issued before this time, in RFC 3339 format")
+	offsetFlag := fs.Int("offset", 0, "skip this many of the claims that match the filters")
+	limitFlag := fs.Int("limit", 0, "list at most this many claims, 0 for no limit")
+	receiptKeys.register(fs)
+	readOnly.register(fs, true)
+	fs.Parse(args)
+
+	subject := ""
+	if *subjectFlag != "" {
+		id, err := parseHolderID(*subjectFlag)
+		if err != nil {
+			return err
+		}
+		subject = (&core.DID{ID: *id}).String()
+	}
+
+	timeRange, err := parseAuditTimeRange(*fromFlag, *toFlag)
+	if err != nil {
+		return err
+	}
+	if *offsetFlag < 0 || *limitFlag < 0 {
+		return usageError("--offset and --limit can't be negative")
+	}
+	// the revocations are known from the stored identities, a claim of an issuer that isn't stored is not
+	// revoked
+	var revoked map[issuedClaimRef]bool
+	wantRevoked := false
+	if *revokedFlag != "" {
+		if wantRevoked, err = strconv.ParseBool(*revokedFlag); err != nil {
+			return usageError("invalid --revoked %q, must be true or false", *revokedFlag)
+		}
+		if revoked, err = revokedClaims(*identitiesFlag); err != nil {
+			return err
+		}
+	}
+
+	names := *columnsFlag
+	if names == "all" {
+		names = ""
+	}
+	columns, err := selectColumns(claimColumns, names)
+	if err != nil {
+		return err
+	}
+	// the deprecated schema versions are known by their schema hashes
+	deprecated := map[string]bool{}
+	if *deprecatedFlag {
+		schemas, err := readSchemas(*schemasFlag)
+		if err != nil {
+			return err
+		}
+		for _, s := range schemas {
+			if s.SupersededBy != "" {
+				deprecated[s.Hash] = true
+			}
+		}
+	}
+	w, err := newExportWriter(os.Stdout, *formatFlag, columns)
+	if err != nil {
+		return err
+	}
+	// a first pass finds the claims that were reissued, by the claims that supersede them
+	supersededBy := map[issuedClaimRef]uint64{}
+	err = scanJSONLines(*pathFlag, func(line int, b []byte) error {
+		var r issuanceReceipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("line %d of the receipts file is not a valid receipt: %s", line, err)
+		}
+		// a run that reuses the nonce of the claim it supersedes doesn't link the claim to itself
+		if r.Supersedes != nil && *r.Supersedes != (issuedClaimRef{r.Issuer, r.RevocationNonce}) {
+			supersededBy[*r.Supersedes] = r.RevocationNonce
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	expiringBy := now().Add(*expiringWithinFlag)
+	matched := 0
+	err = scanJSONLines(*pathFlag, func(line int, b []byte) error {
+		var r issuanceReceipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("line %d of the receipts file is not a valid receipt: %s", line, err)
+		}
+		if *issuerFlag != "" && r.Issuer != *issuerFlag {
+			return nil
+		}
+		if *schemaHashFlag != "" && !strings.EqualFold(r.SchemaHash, *schemaHashFlag) {
+			return nil
+		}
+		if !timeRange.contains(time.Unix(r.Timestamp, 0)) {
+			return nil
+		}
+		if revoked != nil && revoked[issuedClaimRef{r.Issuer, r.RevocationNonce}] != wantRevoked {
+			return nil
+		}
+		if subject != "" {
+			if ok, err := receiptKeys.matchesSubject(&r, subject); err != nil || !ok {
+				return err
+			}
+		}
+		if err := receiptKeys.open(&r); err != nil {
+			return fmt.Errorf("line %d of the receipts file: %w", line, err)
+		}
+		if nonce, ok := supersededBy[issuedClaimRef{r.Issuer, r.RevocationNonce}]; ok {
+			r.supersededBy = &nonce
+		}
+		if *deprecatedFlag && (!deprecated[r.SchemaHash] || r.supersededBy != nil) {
+			return nil
+		}
+		if *expiringWithinFlag > 0 {
+			expiration, ok := receiptExpiration(&r)
+			if !ok || expiration.After(expiringBy) || r.supersededBy != nil {
+				return nil
+			}
+		}
+		matched++
+		if matched <= *offsetFlag || (*limitFlag > 0 && matched > *offsetFlag+*limitFlag) {
+			return nil
+		}
+		return w.write(&r)
+	})
+	if flushErr := w.flush(); err == nil {
+		err = flushErr
+	}
+	// the hint goes to stderr, so that the csv and json lists stay whole
+	if err == nil && *limitFlag > 0 && matched > *offsetFlag+*limitFlag {
+		fmt.Fprintf(os.Stderr, "-> %d of %d claims listed, --offset %d lists the next ones\n", *limitFlag, matched, *offsetFlag+*limitFlag)
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListClaimsFiltersAndPages(t *testing.T) {
+	testHome(t)
+	t.Cleanup(func() { readOnly.on = false })
+	issued := time.Date(2022, 6, 10, 0, 0, 0, 0, time.UTC)
+	var receipts []*issuanceReceipt
+	for nonce := uint64(2); nonce <= 7; nonce++ {
+		schemaHash := "4b6598ce5bd0bd1c128fda186a5eca21"
+		if nonce%2 == 1 {
+			schemaHash = "4f07222b2799ff6926a2e387a528f8af"
+		}
+		receipts = append(receipts, &issuanceReceipt{
+			Issuer:          testHolderID,
+			RevocationNonce: nonce,
+			SchemaHash:      schemaHash,
+			Timestamp:       issued.Add(time.Duration(nonce) * 24 * time.Hour).Unix(),
+		})
+	}
+	if err := writeReceipts(defaultReceiptsPath(), receipts); err != nil {
+		t.Fatal(err)
+	}
+	stored := &storedIdentity{ID: testHolderID, Pending: storedChanges{Revocations: []uint64{4}}, Published: []storedTransition{{storedChanges: storedChanges{Revocations: []uint64{6}}}}}
+	if err := writeIdentities(defaultIdentitiesPath(), []*storedIdentity{stored}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{nil, "2 3 4 5 6 7"},
+		{[]string{"--schema-hash", "4B6598CE5BD0BD1C128FDA186A5ECA21"}, "2 4 6"},
+		{[]string{"--revoked", "true"}, "4 6"},
+		{[]string{"--revoked", "false"}, "2 3 5 7"},
+		{[]string{"--from", "2022-06-13T00:00:00Z", "--to", "2022-06-16T00:00:00Z"}, "3 4 5"},
+		{[]string{"--limit", "2"}, "2 3"},
+		{[]string{"--offset", "2", "--limit", "2"}, "4 5"},
+		{[]string{"--revoked", "false", "--offset", "3"}, "7"},
+	} {
+		var err error
+		printed := captureOutput(t, func() {
+			err = listClaimsCommand(append([]string{"--format", "csv", "--columns", "revocationNonce"}, test.args...))
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", test.args, err)
+		}
+		// the rows follow the header row
+		if listed := strings.Join(strings.Fields(printed)[1:], " "); listed != test.expected {
+			t.Fatalf("%v: expected the claims %s, listed %s", test.args, test.expected, listed)
+		}
+	}
+
+	if err := listClaimsCommand([]string{"--revoked", "maybe"}); err == nil || classifyError(err).code != errCodeUsage {
+		t.Fatalf("expected an invalid --revoked to be a usage error, got %v", err)
+	}
+}
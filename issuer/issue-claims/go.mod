@@ -2,14 +2,17 @@ module kaleido.io/iden3-tutorial
 
 go 1.17
 
+require (
+	github.com/iden3/go-circuits v0.1.0
+	github.com/iden3/go-iden3-core v0.1.0
+	github.com/iden3/go-iden3-crypto v0.0.13
+	github.com/iden3/go-merkletree-sql v1.0.2
+	github.com/mr-tron/base58 v1.2.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+)
+
 require (
 	github.com/dchest/blake512 v1.0.0 // indirect
-	github.com/iden3/go-circuits v0.1.0 // indirect
-	github.com/iden3/go-iden3-core v0.1.0 // indirect
-	github.com/iden3/go-iden3-crypto v0.0.13 // indirect
-	github.com/iden3/go-merkletree-sql v1.0.2 // indirect
-	github.com/mr-tron/base58 v1.2.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871 // indirect
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 )
@@ -0,0 +1,118 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/iden3/go-iden3-crypto/poseidon"
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+// printHashValue prints a hash as a decimal, as the circuit inputs carry it, and as the big-endian hex of
+// the integer. The merkle tree hashes are also printed in the little-endian hex of the trees.
+func printHashValue(name string, v *big.Int) {
+	fmt.Printf("%s:\n", name)
+	fmt.Printf("   -> Decimal: %s\n", v)
+	fmt.Printf("   -> Hex: 0x%064x\n", v)
+	if h, err := merkletree.NewHashFromBigInt(v); err == nil {
+		fmt.Printf("   -> Merkle tree hex: %s\n", h.Hex())
+	}
+}
+
+func parseHashInputs(args []string) ([]*big.Int, error) {
+	inputs := make([]*big.Int, len(args))
+	for i, arg := range args {
+		var ok bool
+		if inputs[i], ok = new(big.Int).SetString(strings.TrimSpace(arg), 0); !ok {
+			return nil, fmt.Errorf("input %q is not an integer", arg)
+		}
+	}
+	return inputs, nil
+}
+
+// hashCommand handles the "hash" subcommands that recompute the hashes used by the issuer, to bisect
+// mismatches with other tooling
+func hashCommand(args []string) error {
+	usage := usageError("usage: hash poseidon <int>... | hash claim-hihv --hex <claim> | hash state <claims root> <revocations root> <roots root> | hash schema --schema <name|file> [--type <credential type>]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "poseidon":
+		inputs, err := parseHashInputs(args[1:])
+		if err != nil {
+			return err
+		}
+		h, err := poseidon.Hash(inputs)
+		if err != nil {
+			return err
+		}
+		printHashValue("Poseidon hash", h)
+	case "claim-hihv":
+		fs := flag.NewFlagSet("hash claim-hihv", flag.ExitOnError)
+		hexFlag := fs.String("hex", "", "the claim in the canonical hex encoding")
+		fs.Parse(args[1:])
+		c, err := claimFromHex(*hexFlag)
+		if err != nil {
+			return withCode(errCodeInvalidInput, fmt.Errorf("failed to decode the claim: %s", err))
+		}
+		hIndex, hValue, err := c.HiHv()
+		if err != nil {
+			return err
+		}
+		printHashValue("Index hash", hIndex)
+		printHashValue("Value hash", hValue)
+	case "state":
+		if len(args) != 4 {
+			return usageError("usage: hash state <claims root> <revocations root> <roots root>")
+		}
+		roots, err := parseHashInputs(args[1:])
+		if err != nil {
+			return err
+		}
+		state, err := merkletree.HashElems(roots...)
+		if err != nil {
+			return err
+		}
+		printHashValue("State", state.BigInt())
+	case "schema":
+		fs := flag.NewFlagSet("hash schema", flag.ExitOnError)
+		schemaFlag := fs.String("schema", "./schemas/test.json-ld", "a registered schema, or the path of a schema document")
+		schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file that the registered schemas are kept in")
+		typeFlag := fs.String("type", "", "the credential type in the schema document, implied by a registered schema")
+		fs.Parse(args[1:])
+		schemaBytes, credentialType, err := resolveSchema(*schemasFlag, *schemaFlag, *typeFlag)
+		if err != nil {
+			return fmt.Errorf("failed to load the schema: %s", err)
+		}
+		if credentialType == "" {
+			return usageError("the --type option is required")
+		}
+		sHash := schemaHash(schemaBytes, credentialType)
+		sHashText, _ := sHash.MarshalText()
+		fmt.Printf("Schema hash for '%s': %s\n", credentialType, sHashText)
+		printHashValue("Schema hash", sHash.BigInt())
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package holder implements the wallet of an iden3 holder identity: the credentials issued to it, and the
+// inputs of the credentialAtomicQuerySig circuit that prove a query against one of them.
+package holder
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	merkletree "github.com/iden3/go-merkletree-sql"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// Credential is a credential held by the wallet. The ID is the hex of the hash of the claim's index
+// slots, which is the key of the claim in the issuer's claims tree.
+type Credential struct {
+	ID string
+	*issuer.Credential
+}
+
+// Wallet holds the credentials of a holder identity. The identity of a holder has the same genesis state,
+// made of an auth claim for its key, and the same trees as an issuer identity.
+type Wallet struct {
+	identity    *issuer.Identity
+	signer      issuer.Signer
+	credentials map[string]*Credential
+}
+
+// New creates a wallet with a new holder identity, with its trees in the given storage
+func New(ctx context.Context, storage issuer.Storage, signer issuer.Signer) (*Wallet, error) {
+	identity, err := issuer.New(ctx, storage, signer)
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{
+		identity:    identity,
+		signer:      signer,
+		credentials: map[string]*Credential{},
+	}, nil
+}
+
+// ID returns the ID of the holder identity, which the claims for the holder carry as their subject
+func (w *Wallet) ID() *core.ID {
+	return w.identity.ID
+}
+
+// Identity returns the holder identity
+func (w *Wallet) Identity() *issuer.Identity {
+	return w.identity
+}
+
+// AddCredential verifies a credential issued to the holder and stores it
+func (w *Wallet) AddCredential(c *issuer.Credential) (*Credential, error) {
+	subject, err := c.Claim.GetID()
+	if err != nil {
+		return nil, fmt.Errorf("the claim has no subject: %s", err)
+	}
+	if subject != *w.identity.ID {
+		return nil, fmt.Errorf("the claim is issued to %s, not to the holder %s", &subject, w.identity.ID)
+	}
+	if err := c.Verify(); err != nil {
+		return nil, fmt.Errorf("invalid credential: %s", err)
+	}
+	hIndex, err := c.Claim.HIndex()
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%064x", hIndex)
+	if _, ok := w.credentials[id]; ok {
+		return nil, fmt.Errorf("the wallet already holds the credential %s", id)
+	}
+	stored := &Credential{ID: id, Credential: c}
+	w.credentials[id] = stored
+	return stored, nil
+}
+
+// Credentials returns the credentials in the wallet, ordered by ID
+func (w *Wallet) Credentials() []*Credential {
+	credentials := make([]*Credential, 0, len(w.credentials))
+	for _, c := range w.credentials {
+		credentials = append(credentials, c)
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].ID < credentials[j].ID
+	})
+	return credentials
+}
+
+// RefreshNonRevProof replaces the proof that the claim of a credential is not revoked with one against a newer
+// state of the issuer, such as one served by the issuer's status endpoint. The new proof is verified on a copy
+// of the credential, and the stored credential keeps its previous proof if it doesn't verify, or if it shows
+// that the claim was revoked.
+func (w *Wallet) RefreshNonRevProof(credentialID string, nonRev circuits.ClaimNonRevStatus) error {
+	c, ok := w.credentials[credentialID]
+	if !ok {
+		return fmt.Errorf("the wallet doesn't hold the credential %s", credentialID)
+	}
+	ts := nonRev.TreeState
+	if ts.State == nil || ts.ClaimsRoot == nil || ts.RevocationRoot == nil || ts.RootOfRoots == nil || nonRev.Proof == nil {
+		return fmt.Errorf("the proof of non-revocation is incomplete")
+	}
+	state, err := merkletree.HashElems(ts.ClaimsRoot.BigInt(), ts.RevocationRoot.BigInt(), ts.RootOfRoots.BigInt())
+	if err != nil {
+		return err
+	}
+	if !state.Equals(ts.State) {
+		return fmt.Errorf("the roots of the proof of non-revocation don't make up its state %s", ts.State.BigInt())
+	}
+	refreshed := *c.Credential
+	refreshed.NonRevProof = nonRev
+	if err := refreshed.Verify(); err != nil {
+		return fmt.Errorf("the refreshed credential %s doesn't verify: %s", credentialID, err)
+	}
+	c.Credential = &refreshed
+	return nil
+}
+
+// SignChallenge signs the challenge of a verifier with the key of the holder's auth claim
+func (w *Wallet) SignChallenge(challenge *big.Int) *babyjub.Signature {
+	return w.signer.SignPoseidon(challenge)
+}
+
+// ProofInputs builds the inputs of the credentialAtomicQuerySig circuit, which prove that the claim of a
+// credential satisfies the query, and that the holder signed the challenge. The claim is checked against
+// the query first, as the circuit can't produce a proof for a claim that doesn't satisfy it.
+func (w *Wallet) ProofInputs(ctx context.Context, credentialID string, query circuits.Query, challenge *big.Int) (*circuits.AtomicQuerySigInputs, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, ok := w.credentials[credentialID]
+	if !ok {
+		return nil, fmt.Errorf("the wallet doesn't hold the credential %s", credentialID)
+	}
+
+	slots := c.Claim.RawSlotsAsInts()
+	if query.SlotIndex < 0 || query.SlotIndex >= len(slots) {
+		return nil, fmt.Errorf("slot index %d is out of range", query.SlotIndex)
+	}
+	comparer, err := circuits.FactoryComparer(slots[query.SlotIndex], query.Values, query.Operator)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := comparer.Compare(query.Operator); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("the claim of the credential %s doesn't satisfy the query", credentialID)
+	}
+
+	auth, err := w.identity.AuthClaimProof(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &circuits.AtomicQuerySigInputs{
+		ID:        w.identity.ID,
+		AuthClaim: *auth,
+		Challenge: challenge,
+		Signature: w.SignChallenge(challenge),
+		Claim: circuits.Claim{
+			IssuerID:       c.IssuerID,
+			Claim:          c.Claim,
+			NonRevProof:    &c.NonRevProof,
+			SignatureProof: c.SignatureProof,
+		},
+		Query:            query,
+		CurrentTimeStamp: time.Now().Unix(),
+	}, nil
+}
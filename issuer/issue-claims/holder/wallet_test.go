@@ -0,0 +1,172 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package holder
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+func testKey(b byte) *babyjub.PrivateKey {
+	var key babyjub.PrivateKey
+	key[0] = b
+	return &key
+}
+
+// issued creates an issuer and a wallet, and issues a claim with the birthday to the holder of the wallet
+func issued(t *testing.T, birthday int64) (*issuer.Identity, *Wallet, *issuer.Credential) {
+	ctx := context.Background()
+	identity, err := issuer.New(ctx, issuer.NewMemoryStorage(), testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := New(ctx, issuer.NewMemoryStorage(), testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim, err := core.NewClaim(core.NewSchemaHashFromInt(big.NewInt(42)), core.WithIndexID(*wallet.ID()), core.WithRevocationNonce(2), core.WithIndexDataInts(big.NewInt(birthday), big.NewInt(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := identity.IssueClaim(ctx, claim); err != nil {
+		t.Fatal(err)
+	}
+	credential, err := identity.Credential(ctx, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity, wallet, credential
+}
+
+func TestAddCredential(t *testing.T) {
+	_, wallet, credential := issued(t, 19960424)
+	stored, err := wallet.AddCredential(credential)
+	if err != nil {
+		t.Fatalf("expected the wallet to accept the credential: %s", err)
+	}
+	if credentials := wallet.Credentials(); len(credentials) != 1 || credentials[0].ID != stored.ID {
+		t.Errorf("expected the wallet to hold the credential %s", stored.ID)
+	}
+	if _, err := wallet.AddCredential(credential); err == nil {
+		t.Errorf("expected the same credential to be refused the second time")
+	}
+
+	// a credential for another holder, or with a signature over another claim, is refused
+	other, err := New(context.Background(), issuer.NewMemoryStorage(), testKey(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.AddCredential(credential); err == nil {
+		t.Errorf("expected the credential of another holder to be refused")
+	}
+	_, wallet, credential = issued(t, 19960424)
+	_, _, forged := issued(t, 20100101)
+	credential.SignatureProof.Signature = forged.SignatureProof.Signature
+	if _, err := wallet.AddCredential(credential); err == nil {
+		t.Errorf("expected a credential with the signature of another claim to be refused")
+	}
+}
+
+func TestProofInputs(t *testing.T) {
+	ctx := context.Background()
+	identity, wallet, credential := issued(t, 19960424)
+	stored, err := wallet.AddCredential(credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := circuits.Query{SlotIndex: 2, Values: []*big.Int{big.NewInt(20040611)}, Operator: circuits.LT}
+	challenge := big.NewInt(12345)
+	inputs, err := wallet.ProofInputs(ctx, stored.ID, query, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testKey(2).Public().VerifyPoseidon(challenge, inputs.Signature) {
+		t.Errorf("expected the challenge signed by the key of the holder")
+	}
+	if !inputs.ID.Equal(wallet.ID()) || !inputs.Claim.IssuerID.Equal(identity.ID) {
+		t.Errorf("expected the inputs of the holder %s for the issuer %s", wallet.ID(), identity.ID)
+	}
+	hIndex, hValue, err := inputs.Claim.Claim.HiHv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimHash, err := poseidon.Hash([]*big.Int{hIndex, hValue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testKey(1).Public().VerifyPoseidon(claimHash, inputs.Claim.SignatureProof.Signature) {
+		t.Errorf("expected the claim signed by the key of the issuer")
+	}
+
+	b, err := inputs.InputsMarshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	values, _ := fields["value"].([]interface{})
+	if fields["userID"] != wallet.ID().BigInt().String() || fields["issuerID"] != identity.ID.BigInt().String() ||
+		fields["challenge"] != "12345" || fields["operator"] != float64(circuits.LT) || fields["slotIndex"] != float64(2) ||
+		len(values) == 0 || values[0] != "20040611" {
+		t.Errorf("unexpected inputs: %s", b)
+	}
+
+	// a query that the claim doesn't satisfy has no proof
+	query.Values = []*big.Int{big.NewInt(19900101)}
+	if _, err := wallet.ProofInputs(ctx, stored.ID, query, challenge); err == nil {
+		t.Errorf("expected no inputs for a query that the claim doesn't satisfy")
+	}
+	if _, err := wallet.ProofInputs(ctx, "unknown", query, challenge); err == nil {
+		t.Errorf("expected no inputs for a credential that the wallet doesn't hold")
+	}
+}
+
+func TestRefreshNonRevProofKeepsTheProofOfARevokedClaim(t *testing.T) {
+	ctx := context.Background()
+	identity, wallet, credential := issued(t, 19960424)
+	stored, err := wallet.AddCredential(credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := identity.Revoke(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := identity.StatePublished(ctx, issuer.Publication{TxHash: "0x01"}); err != nil {
+		t.Fatal(err)
+	}
+	treeState, proof, err := identity.PublishedRevocationStatus(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wallet.RefreshNonRevProof(stored.ID, circuits.ClaimNonRevStatus{TreeState: treeState, Proof: proof}); err == nil {
+		t.Errorf("expected the proof of the revocation to be refused")
+	}
+	if wallet.Credentials()[0].NonRevProof.Proof.Existence {
+		t.Errorf("expected the credential to keep its proof of non-revocation")
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	core "github.com/iden3/go-iden3-core"
+
+	"kaleido.io/iden3-tutorial/issuer"
+	"kaleido.io/iden3-tutorial/verifier"
+)
+
+// holderPayload is what the issuer hands to the holder of the claims: the receipts of the claims issued
+// to them, which carry each claim and the proof that it is in the issuer's claims tree. The holder adds the
+// latest revocation status of each credential that it refreshes, by credential ID.
+type holderPayload struct {
+	Receipts []*issuanceReceipt                    `json:"receipts"`
+	Statuses map[string]*verifier.RevocationStatus `json:"statuses,omitempty"`
+}
+
+func defaultHolderPayloadPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_holder_payload.json")
+}
+
+// encodeHolderPayload encodes the payload for the holder, encrypted to the holder's key if one is given
+func encodeHolderPayload(payload *holderPayload, encryptTo string) ([]byte, error) {
+	out, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if encryptTo != "" {
+		recipient, err := parsePublicKey(encryptTo)
+		if err != nil {
+			return nil, err
+		}
+		e, err := sealEnvelope(recipient, out)
+		if err != nil {
+			return nil, err
+		}
+		out, _ = json.MarshalIndent(e, "", "  ")
+	}
+	return append(out, '\n'), nil
+}
+
+// holderCommand handles the "holder" subcommands, that stand in for the holder's wallet
+func holderCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "keygen" && args[0] != "receive" && args[0] != "refresh") {
+		return usageError("usage: holder keygen | holder receive [--in <file> | --manifest <file>] [--decrypt --key <private key>] [--out <file>] | holder refresh --credential <id> --issuer-url <url> [--in <file>]")
+	}
+	if args[0] == "refresh" {
+		return holderRefreshCommand(args[1:])
+	}
+
+	if args[0] == "keygen" {
+		privKey, err := newPrivKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		defer wipe(privKey[:])
+		ctx, cancel := newCommandContext(0)
+		defer cancel()
+		identity, err := issuer.New(ctx, issuer.NewMemoryStorage(), &privKey)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Private key:", hex.EncodeToString(privKey[:]))
+		fmt.Println("Public key:", privKey.Public())
+		fmt.Println("ID:", identity.ID)
+		fmt.Println("-> Keep the private key secret, give the public key to --encrypt-to and the ID to --holder-id")
+		return nil
+	}
+
+	fs := flag.NewFlagSet("holder receive", flag.ExitOnError)
+	inFlag := fs.String("in", defaultHolderPayloadPath(), "path of the payload received from the issuer, as JSON or a base64url token")
+	decryptFlag := fs.Bool("decrypt", false, "decrypt the payload, which was encrypted to the holder's key")
+	keyFlag := fs.String("key", "", "the holder's private key in hex, to decrypt the payload")
+	outFlag := fs.String("out", "", "path to write the decrypted payload to")
+	manifestFlag := fs.String("manifest", "", "path of the manifest of an issuance, to receive the payload that it lists instead of --in")
+	fs.Parse(args[1:])
+	if *manifestFlag != "" {
+		m, err := readManifest(*manifestFlag)
+		if err != nil {
+			return err
+		}
+		if *inFlag, err = m.artifact(formatHolderPayload); err != nil {
+			return err
+		}
+	}
+
+	b, err := os.ReadFile(*inFlag)
+	if err != nil {
+		return err
+	}
+	// the payload may have been handed over as a base64url token
+	if b, err = decodeTransport(b); err != nil {
+		return err
+	}
+	var e envelope
+	if err := json.Unmarshal(b, &e); err == nil && e.Ciphertext != "" {
+		if !*decryptFlag {
+			return fmt.Errorf("the payload is encrypted to the key %s, use --decrypt with the holder's --key", e.Recipient)
+		}
+		privKey, err := parsePrivateKey(*keyFlag)
+		if err != nil {
+			return err
+		}
+		defer wipe(privKey[:])
+		if b, err = e.open(privKey); err != nil {
+			return err
+		}
+	} else if *decryptFlag {
+		return fmt.Errorf("the payload is not encrypted")
+	}
+
+	var payload holderPayload
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %s", err)
+	}
+	for i, r := range payload.Receipts {
+		if err := r.verify(); err != nil {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("receipt %d failed verification: %s", i+1, err), "receipt", strconv.Itoa(i+1))
+		}
+		fmt.Printf("Received the claim with schema hash %s from the issuer %s\n", r.SchemaHash, r.Issuer)
+		fmt.Printf("-> Hex: %s\n", r.Claim)
+	}
+	if *outFlag != "" {
+		if err := os.WriteFile(*outFlag, b, 0600); err != nil {
+			return err
+		}
+		fmt.Println("-> Payload written to the file:", *outFlag)
+	}
+	return nil
+}
+
+// holderRefreshCommand handles "holder refresh", which fetches the current revocation status of a credential
+// from the issuer's status endpoint, and keeps it in the payload as the credential's proof of non-revocation
+// once it verifies. The payload is only rewritten then, so a status that fails leaves the previous one.
+func holderRefreshCommand(args []string) error {
+	fs := flag.NewFlagSet("holder refresh", flag.ExitOnError)
+	inFlag := fs.String("in", defaultHolderPayloadPath(), "path of the payload received from the issuer, decrypted")
+	credentialFlag := fs.String("credential", "", "the ID of the credential, the hex of the hash of the index slots of its claim")
+	issuerURLFlag := fs.String("issuer-url", "", "the URL of the issuer's revocation status endpoint")
+	timeoutFlag := fs.Duration("timeout", 0, "give up on the command after this long, for example 30s (no timeout by default)")
+	fs.Parse(args)
+	if *credentialFlag == "" || *issuerURLFlag == "" {
+		return usageError("usage: holder refresh --credential <id> --issuer-url <url> [--in <file>]")
+	}
+
+	b, err := os.ReadFile(*inFlag)
+	if err != nil {
+		return err
+	}
+	if b, err = decodeTransport(b); err != nil {
+		return err
+	}
+	var e envelope
+	if err := json.Unmarshal(b, &e); err == nil && e.Ciphertext != "" {
+		return usageError("the payload is encrypted, decrypt it first with holder receive --decrypt --out <file>")
+	}
+	var payload holderPayload
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid payload: %s", err))
+	}
+	var receipt *issuanceReceipt
+	for _, r := range payload.Receipts {
+		claim, err := claimFromHex(r.Claim)
+		if err != nil {
+			return withCode(errCodeInvalidInput, fmt.Errorf("invalid claim in the payload: %s", err))
+		}
+		hIndex, err := claim.HIndex()
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%064x", hIndex) == *credentialFlag {
+			receipt = r
+		}
+	}
+	if receipt == nil {
+		return withCode(errCodeNotFound, fmt.Errorf("the payload holds no credential %s", *credentialFlag), "credential", *credentialFlag)
+	}
+	if err := receipt.verify(); err != nil {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the receipt of the credential %s failed verification: %s", *credentialFlag, err), "credential", *credentialFlag)
+	}
+	issuerID, err := core.IDFromString(receipt.Issuer)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid issuer in the receipt: %s", err))
+	}
+
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+	fmt.Printf("Fetch the revocation status of the credential %s from %s\n", *credentialFlag, *issuerURLFlag)
+	status, err := (&verifier.HTTPRevocationChecker{URL: *issuerURLFlag}).RevocationStatus(ctx, &issuerID, receipt.RevocationNonce)
+	if err != nil {
+		return withCode(errCodeUnavailable, fmt.Errorf("failed to fetch the revocation status: %s", err))
+	}
+	if err := status.Verify(receipt.RevocationNonce); err != nil {
+		if errors.Is(err, verifier.ErrRevoked) {
+			return fmt.Errorf("the credential %s was revoked by the issuer: %w", *credentialFlag, err)
+		}
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the revocation status doesn't verify, the credential keeps its previous status: %s", err), "credential", *credentialFlag)
+	}
+	if previous := payload.Statuses[*credentialFlag]; previous != nil {
+		fmt.Println("-> Previous issuer state:", previous.Issuer.State.BigInt())
+	}
+	fmt.Println("-> Issuer state:", status.Issuer.State.BigInt())
+
+	if payload.Statuses == nil {
+		payload.Statuses = map[string]*verifier.RevocationStatus{}
+	}
+	payload.Statuses[*credentialFlag] = status
+	out, _ := json.MarshalIndent(&payload, "", "  ")
+	tmp := *inFlag + ".tmp"
+	if err := os.WriteFile(tmp, append(out, '\n'), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, *inFlag); err != nil {
+		return err
+	}
+	fmt.Println("-> The credential is not revoked, its proof of non-revocation is updated in", *inFlag)
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/mr-tron/base58"
+)
+
+// maxHolderIDLength caps the holder IDs and DIDs that are decoded, well above the length of a DID with its
+// blockchain and network, as decoding base58 takes quadratic time
+const maxHolderIDLength = 256
+
+// parseHolderID parses a holder ID given in base58, or as a did:iden3 DID, and explains what is wrong
+// with it when it's invalid, rather than returning the generic error from the core library. A mistyped
+// ID would otherwise result in claims addressed to an identity that nobody controls.
+func parseHolderID(s string) (*core.ID, error) {
+	if len(s) > maxHolderIDLength {
+		return nil, withCode(errCodeInvalidHolderID, fmt.Errorf("the holder ID is %d characters, longer than any ID or did:%s DID", len(s), core.DIDMethod))
+	}
+	id, err := decodeHolderID(strings.TrimSpace(s))
+	if err != nil {
+		return nil, withCode(errCodeInvalidHolderID, err, "holderId", strings.TrimSpace(s))
+	}
+	return id, nil
+}
+
+func decodeHolderID(s string) (*core.ID, error) {
+	if strings.HasPrefix(s, "did:") {
+		parts := strings.Split(s, ":")
+		if parts[1] != core.DIDMethod {
+			return nil, fmt.Errorf("unsupported DID method '%s', only did:%s is supported", parts[1], core.DIDMethod)
+		}
+		if len(parts) != 3 && len(parts) != 5 {
+			return nil, fmt.Errorf("a did:%s DID is either did:%s:<id> or did:%s:<blockchain>:<network>:<id>", core.DIDMethod, core.DIDMethod, core.DIDMethod)
+		}
+		s = parts[len(parts)-1]
+	}
+
+	b, err := base58.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not valid base58: %s", s, err)
+	}
+	if len(b) != len(core.ID{}) {
+		return nil, fmt.Errorf("'%s' decodes to %d bytes, but an ID is %d bytes (2 bytes of type, 27 bytes of genesis state and a 2 bytes checksum)", s, len(b), len(core.ID{}))
+	}
+
+	var id core.ID
+	copy(id[:], b)
+	typ, genesis, checksum, _ := core.DecomposeID(id)
+	if typ != core.TypeDefault && typ != core.TypeReadOnly {
+		return nil, fmt.Errorf("'%s' has the unsupported ID type %x, expected %x (default) or %x (read-only)", s, typ, core.TypeDefault, core.TypeReadOnly)
+	}
+	if expected := core.CalculateChecksum(typ, genesis); !core.CheckChecksum(id) {
+		return nil, fmt.Errorf("'%s' has the checksum %x, but its type and genesis state add up to %x, the ID was probably mistyped", s, checksum, expected)
+	}
+	return &id, nil
+}
+
+// holderIDFields are the fields that a holder file can carry the holder ID in, by precedence: the "id" and
+// "did" of an identity file, as onboard-holder writes it, and the "userID" of the circuit inputs of the
+// holder, which is the ID as a decimal integer
+var holderIDFields = []string{"id", "did", "userID"}
+
+// holderIDFromFile reads the holder ID from an identity file or circuit inputs of the holder, returning the
+// field it was taken from. When a file carries the ID in more than one field, they must all agree.
+func holderIDFromFile(path string) (*core.ID, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, "", fmt.Errorf("%s is not a JSON object: %s", path, err)
+	}
+
+	var id *core.ID
+	var from string
+	for _, name := range holderIDFields {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, "", fmt.Errorf("field %q of %s is not a string", name, path)
+		}
+		if name == "userID" {
+			i, ok := new(big.Int).SetString(v, 10)
+			if !ok {
+				return nil, "", fmt.Errorf("field %q of %s is not a decimal integer", name, path)
+			}
+			fromInt, err := core.IDFromInt(i)
+			if err != nil {
+				return nil, "", fmt.Errorf("field %q of %s is not an ID: %s", name, path, err)
+			}
+			v = fromInt.String()
+		}
+		parsed, err := parseHolderID(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("field %q of %s: %s", name, path, err)
+		}
+		if id == nil {
+			id, from = parsed, name
+		} else if !id.Equal(parsed) {
+			return nil, "", fmt.Errorf("fields %q and %q of %s hold different IDs, %s and %s", from, name, path, id, parsed)
+		}
+	}
+	if id == nil {
+		return nil, "", fmt.Errorf("%s has none of the fields %s", path, strings.Join(holderIDFields, ", "))
+	}
+	return id, from, nil
+}
@@ -0,0 +1,52 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzParseHolderID(f *testing.F) {
+	for _, seed := range []string{
+		testHolderID,
+		"did:iden3:" + testHolderID,
+		"did:iden3:polygon:mumbai:" + testHolderID,
+		"did:key:" + testHolderID,
+		"did:",
+		" " + testHolderID + "\n",
+		testHolderID[:len(testHolderID)-1] + "L",
+		"0OIl",
+		strings.Repeat("1", maxHolderIDLength+1),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		id, err := parseHolderID(s)
+		if err != nil {
+			if code := classifyError(err).code; code != errCodeInvalidHolderID {
+				t.Errorf("expected the invalid-holder-id code, got %s: %s", code.Code, err)
+			}
+			return
+		}
+		// a valid ID parses back to itself from its base58 encoding
+		again, err := parseHolderID(id.String())
+		if err != nil || *again != *id {
+			t.Errorf("expected %s to parse back to itself, got %v (%v)", id, again, err)
+		}
+	})
+}
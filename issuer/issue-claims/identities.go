@@ -0,0 +1,719 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	merkletree "github.com/iden3/go-merkletree-sql"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// storedIdentity is an issuer identity kept between the commands that change it. The trees are not stored,
+// they are rebuilt from the base of the identity, the changes of the transitions published since, and the
+// changes since the last published one. The base is the genesis state of the auth claim, or the snapshot of
+// an imported identity.
+type storedIdentity struct {
+	ID        string          `json:"id"`
+	AuthClaim string          `json:"authClaim"`
+	TreeDepth int             `json:"treeDepth"`
+	Imported  *storedSnapshot `json:"imported,omitempty"`
+	// Published are the transitions published since the base, in the order they were published
+	Published []storedTransition `json:"published,omitempty"`
+	Pending   storedChanges      `json:"pending"`
+	// State is the state that the rebuilt trees must make up
+	State   string    `json:"state"`
+	Updated time.Time `json:"updated"`
+}
+
+// storedChanges are the claims in the canonical hex encoding, the erased claims, and the revoked nonces, of
+// a transition
+type storedChanges struct {
+	Claims      []string            `json:"claims,omitempty"`
+	Erased      []storedErasedClaim `json:"erased,omitempty"`
+	Revocations []uint64            `json:"revocations,omitempty"`
+}
+
+// storedErasedClaim is a claim whose data was erased, by its tombstone as in the receipts, with its
+// revocation nonce
+type storedErasedClaim struct {
+	Claim           string `json:"claim"`
+	RevocationNonce uint64 `json:"revocationNonce"`
+}
+
+// storedTransition is a published state, with the changes that its transition covered
+type storedTransition struct {
+	State string `json:"state"`
+	storedChanges
+	TxHash      string `json:"txHash,omitempty"`
+	BlockNumber uint64 `json:"blockNumber,omitempty"`
+	BlockHash   string `json:"blockHash,omitempty"`
+}
+
+// storedSnapshot is the state that an imported identity was taken over at
+type storedSnapshot struct {
+	GenesisState string `json:"genesisState"`
+	State        string `json:"state"`
+	storedChanges
+	Roots []string `json:"roots,omitempty"`
+}
+
+func defaultIdentitiesPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_identities.json")
+}
+
+func readIdentities(path string) ([]*storedIdentity, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var identities []*storedIdentity
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var s storedIdentity
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil || s.ID == "" {
+			return nil, fmt.Errorf("line %d of the identities file is not a valid identity: %v", line, err)
+		}
+		identities = append(identities, &s)
+	}
+	return identities, scanner.Err()
+}
+
+// writeIdentities replaces the identities file, through a temporary file so that an interrupted write
+// leaves the previous file in place
+func writeIdentities(path string, identities []*storedIdentity) error {
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, s := range identities {
+		line, _ := json.Marshal(s)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// findIdentity returns the stored identity of the issuer, or nil if it is not stored
+func findIdentity(path, issuerID string) (*storedIdentity, error) {
+	identities, err := readIdentities(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range identities {
+		if s.ID == issuerID {
+			return s, nil
+		}
+	}
+	return nil, nil
+}
+
+// revokedClaims returns the claims that the stored identities revoked, in the imported snapshot, the
+// published transitions or the pending one
+func revokedClaims(path string) (map[issuedClaimRef]bool, error) {
+	identities, err := readIdentities(path)
+	if err != nil {
+		return nil, err
+	}
+	revoked := map[issuedClaimRef]bool{}
+	for _, s := range identities {
+		changes := []storedChanges{s.Pending}
+		if s.Imported != nil {
+			changes = append(changes, s.Imported.storedChanges)
+		}
+		for _, t := range s.Published {
+			changes = append(changes, t.storedChanges)
+		}
+		for _, c := range changes {
+			for _, nonce := range c.Revocations {
+				revoked[issuedClaimRef{s.ID, nonce}] = true
+			}
+		}
+	}
+	return revoked, nil
+}
+
+// saveIdentity stores the identity in place of the stored identity with the same ID, if any
+func saveIdentity(path string, s *storedIdentity) error {
+	identities, err := readIdentities(path)
+	if err != nil {
+		return err
+	}
+	for i, other := range identities {
+		if other.ID == s.ID {
+			identities[i] = s
+			return writeIdentities(path, identities)
+		}
+	}
+	return writeIdentities(path, append(identities, s))
+}
+
+func encodeChanges(changes issuer.Changes) (storedChanges, error) {
+	var c storedChanges
+	for _, claim := range changes.Claims {
+		claimHex, err := claimToHex(claim)
+		if err != nil {
+			return storedChanges{}, err
+		}
+		c.Claims = append(c.Claims, claimHex)
+	}
+	for _, e := range changes.Erased {
+		c.Erased = append(c.Erased, storedErasedClaim{Claim: leafTombstone(e.HIndex, e.HValue), RevocationNonce: e.RevocationNonce})
+	}
+	c.Revocations = append(c.Revocations, changes.Revocations...)
+	return c, nil
+}
+
+func (c storedChanges) decode() (issuer.Changes, error) {
+	changes := issuer.Changes{Revocations: c.Revocations}
+	for _, claimHex := range c.Claims {
+		claim, err := claimFromHex(claimHex)
+		if err != nil {
+			return issuer.Changes{}, withCode(errCodeInvalidInput, fmt.Errorf("invalid stored claim: %s", err))
+		}
+		changes.Claims = append(changes.Claims, claim)
+	}
+	for _, e := range c.Erased {
+		hIndex, hValue, err := parseTombstone(e.Claim)
+		if err != nil {
+			return issuer.Changes{}, withCode(errCodeInvalidInput, fmt.Errorf("invalid stored erased claim: %s", err))
+		}
+		changes.Erased = append(changes.Erased, issuer.ErasedClaim{HIndex: hIndex, HValue: hValue, RevocationNonce: e.RevocationNonce})
+	}
+	return changes, nil
+}
+
+// newStoredIdentity captures the history of the identity to store it. The published states after the
+// base of the identity are stored with the changes that they covered, and the changes of an imported
+// snapshot as the identity has them, with the claims that were erased since.
+func newStoredIdentity(identity *issuer.Identity, treeDepth int, imported *storedSnapshot) (*storedIdentity, error) {
+	authClaim, err := claimToHex(identity.AuthClaim)
+	if err != nil {
+		return nil, err
+	}
+	state, err := identity.State()
+	if err != nil {
+		return nil, err
+	}
+	published := identity.PublishedTransitions()
+	if imported != nil {
+		snapshot := *imported
+		if snapshot.storedChanges, err = encodeChanges(published[0].Changes); err != nil {
+			return nil, err
+		}
+		imported = &snapshot
+	}
+	s := &storedIdentity{
+		ID:        identity.ID.String(),
+		AuthClaim: authClaim,
+		TreeDepth: treeDepth,
+		Imported:  imported,
+		State:     state.BigInt().String(),
+		Updated:   now().UTC(),
+	}
+	for _, t := range published[1:] {
+		changes, err := encodeChanges(t.Changes)
+		if err != nil {
+			return nil, err
+		}
+		s.Published = append(s.Published, storedTransition{
+			State:         t.TreeState.State.BigInt().String(),
+			storedChanges: changes,
+			TxHash:        t.Publication.TxHash,
+			BlockNumber:   t.Publication.BlockNumber,
+			BlockHash:     t.Publication.BlockHash,
+		})
+	}
+	if s.Pending, err = encodeChanges(identity.PendingChanges()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// restore rebuilds the trees of the identity from its base and its changes, with the signer's key, which
+// must be the key of its auth claim
+func (s *storedIdentity) restore(ctx context.Context, signer issuer.Signer, options ...issuer.Option) (*issuer.Identity, error) {
+	authClaim, err := claimFromHex(s.AuthClaim)
+	if err != nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid stored auth claim of %s: %s", s.ID, err))
+	}
+	options = append([]issuer.Option{issuer.WithTreeDepth(s.TreeDepth)}, options...)
+	var identity *issuer.Identity
+	if s.Imported != nil {
+		snapshot, err := s.Imported.decode(s.ID, authClaim)
+		if err != nil {
+			return nil, err
+		}
+		identity, err = issuer.Import(ctx, issuer.NewMemoryStorage(), signer, snapshot, options...)
+		if err != nil {
+			return nil, classifyKeyError(err, s.ID)
+		}
+	} else {
+		options = append(options, issuer.WithAuthNonce(authClaim.GetRevocationNonce()))
+		if identity, err = issuer.New(ctx, issuer.NewMemoryStorage(), signer, options...); err != nil {
+			return nil, err
+		}
+		if identity.ID.String() != s.ID {
+			return nil, withCode(errCodeKeyMismatch, fmt.Errorf("the key is not the key of the identity %s", s.ID), "issuer", s.ID)
+		}
+	}
+
+	var published []issuer.PublishedTransition
+	for _, t := range s.Published {
+		changes, err := t.storedChanges.decode()
+		if err != nil {
+			return nil, err
+		}
+		state, err := merkletree.NewHashFromString(t.State)
+		if err != nil {
+			return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid stored state %q of %s", t.State, s.ID))
+		}
+		published = append(published, issuer.PublishedTransition{
+			TreeState:   circuits.TreeState{State: state},
+			Changes:     changes,
+			Publication: issuer.Publication{TxHash: t.TxHash, BlockNumber: t.BlockNumber, BlockHash: t.BlockHash},
+		})
+	}
+	pending, err := s.Pending.decode()
+	if err != nil {
+		return nil, err
+	}
+	if err := identity.Replay(ctx, published, pending); err != nil {
+		return nil, withCode(errCodeVerificationFailed, fmt.Errorf("failed to rebuild the trees of %s: %s", s.ID, err), "issuer", s.ID)
+	}
+	return identity, nil
+}
+
+// authKeyOnly stands in for the key of a stored identity, to rebuild its trees without the private key.
+// Rebuilding the trees doesn't sign, only the state transitions do, so it has no signature to give.
+type authKeyOnly struct {
+	key *babyjub.PublicKey
+}
+
+func (a authKeyOnly) Public() *babyjub.PublicKey {
+	return a.key
+}
+
+func (a authKeyOnly) SignPoseidon(msg *big.Int) *babyjub.Signature {
+	return nil
+}
+
+// rebuild rebuilds the trees of the stored identity with the key of its auth claim, and returns the
+// state they make up, which is the recorded state unless the file was changed or truncated
+func (s *storedIdentity) rebuild(ctx context.Context) (*merkletree.Hash, error) {
+	authClaim, err := claimFromHex(s.AuthClaim)
+	if err != nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid stored auth claim of %s: %s", s.ID, err))
+	}
+	key, err := issuer.AuthClaimKey(authClaim)
+	if err != nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid stored auth claim of %s: %s", s.ID, err))
+	}
+	identity, err := s.restore(ctx, authKeyOnly{key})
+	if err != nil {
+		return nil, err
+	}
+	return identity.State()
+}
+
+// classifyKeyError gives the key mismatch of a restored identity its error code
+func classifyKeyError(err error, issuerID string) error {
+	if errors.Is(err, issuer.ErrKeyMismatch) {
+		return withCode(errCodeKeyMismatch, err, "issuer", issuerID)
+	}
+	return err
+}
+
+func (s *storedSnapshot) decode(issuerID string, authClaim *core.Claim) (issuer.Snapshot, error) {
+	id, err := core.IDFromString(issuerID)
+	if err != nil {
+		return issuer.Snapshot{}, withCode(errCodeInvalidInput, fmt.Errorf("invalid stored identity %q: %s", issuerID, err))
+	}
+	genesis, err := merkletree.NewHashFromString(s.GenesisState)
+	if err != nil {
+		return issuer.Snapshot{}, withCode(errCodeInvalidInput, fmt.Errorf("invalid stored genesis state %q of %s", s.GenesisState, issuerID))
+	}
+	changes, err := s.storedChanges.decode()
+	if err != nil {
+		return issuer.Snapshot{}, err
+	}
+	snapshot := issuer.Snapshot{ID: &id, GenesisState: genesis, AuthClaim: authClaim, Claims: changes.Claims, Erased: changes.Erased, Revocations: changes.Revocations}
+	for _, r := range s.Roots {
+		root, err := merkletree.NewHashFromString(r)
+		if err != nil {
+			return issuer.Snapshot{}, withCode(errCodeInvalidInput, fmt.Errorf("invalid stored root %q of %s", r, issuerID))
+		}
+		snapshot.Roots = append(snapshot.Roots, root)
+	}
+	return snapshot, nil
+}
+
+// storedIdentityPublished records that the transition of a stored identity was published: the pending
+// changes of the identity are covered by the published state. The publication adds the claims root of the
+// state to the roots tree, so the identity is stored at the state that the rebuilt trees make up after it.
+// An identity that is not stored, or that changed since the inputs of the transition were written, is left
+// as it is.
+func storedIdentityPublished(ctx context.Context, path string, t *stateTransition) (*storedIdentity, error) {
+	s, err := findIdentity(path, t.Issuer)
+	if err != nil || s == nil || s.State != t.NewState {
+		return nil, err
+	}
+	s.Published = append(s.Published, storedTransition{State: t.NewState, storedChanges: s.Pending, TxHash: t.TxHash})
+	s.Pending = storedChanges{}
+	state, err := s.rebuild(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.State = state.BigInt().String()
+	s.Updated = now().UTC()
+	return s, saveIdentity(path, s)
+}
+
+// storedIdentityFlags are the options of the commands that change a stored identity and write the inputs
+// of the state transition that publishes the change
+type storedIdentityFlags struct {
+	identities  string
+	issuer      string
+	keyStdin    bool
+	transitions string
+	auditLog    string
+	output      string
+	dryRun      bool
+	// abandonPending replaces the pending transition of the issuer with the transition of the change
+	abandonPending bool
+	// acceptCurrentState adopts the state that the trees rebuild to when it isn't the recorded state
+	acceptCurrentState bool
+	notifiers          notifierList
+	notifyTimeout      time.Duration
+	timeout            time.Duration
+}
+
+func (f *storedIdentityFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.identities, "identities", defaultIdentitiesPath(), "path of the file that the issuer identities are stored in, by the issuance and import-state")
+	fs.StringVar(&f.issuer, "issuer", "", "base58 ID of the stored issuer identity")
+	fs.BoolVar(&f.keyStdin, "key-stdin", false, "read the issuer's private key from stdin, rather than "+issuerKeyEnv)
+	fs.StringVar(&f.transitions, "transitions", defaultTransitionsPath(), "path of the file that the state transitions are recorded in")
+	fs.StringVar(&f.auditLog, "audit-log", defaultAuditLogPath(), "path of the audit log that the operations are recorded in")
+	fs.StringVar(&f.output, "output", defaultOutput(), "where the inputs of the state transition are written, dir:<path> for a local directory or an http(s) URL to post them to")
+	fs.Var(&f.notifiers, "notify", "notify another system of the changed claims and the state transition, once the identity is stored, with webhook:<url>, jsonl:<path> (jsonl:- for stdout) or exec:<command> (repeatable)")
+	fs.DurationVar(&f.notifyTimeout, "notify-timeout", 5*time.Second, "how long the command waits for the notifiers of each event, retries included")
+	fs.DurationVar(&f.timeout, "timeout", 0, "give up on the command after this long, for example 30s (no timeout by default)")
+	fs.BoolVar(&f.acceptCurrentState, "accept-current-state", false, "adopt the state that the stored changes rebuild to, when it isn't the recorded state of the identity, after inspecting the identities file")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "compute the changes and the new state without writing to the filesystem, and print the would-be inputs")
+	fs.BoolVar(&f.abandonPending, "abandon-pending", false, "abandon the pending state transition of the issuer, to write the inputs of a transition that covers its changes and the new ones")
+}
+
+// openedIdentity is a stored identity restored for a command that changes it, with the key it signs with
+type openedIdentity struct {
+	flags    *storedIdentityFlags
+	stored   *storedIdentity
+	identity *issuer.Identity
+	trees    *issuerTrees
+	signer   *keySigner
+	auditLog *auditLog
+	output   outputSink
+	// abandoned is the pending transition that --abandon-pending replaces, if any
+	abandoned *stateTransition
+	// events are the events of the changes, that are delivered once the identity is stored with them
+	events []*issuanceEvent
+}
+
+// open restores the stored identity of the --issuer with the injected key, for the operator
+func (f *storedIdentityFlags) open(ctx context.Context, operator string) (*openedIdentity, error) {
+	if f.issuer == "" {
+		return nil, usageError("the --issuer option is required")
+	}
+	stored, err := findIdentity(f.identities, f.issuer)
+	if err != nil {
+		return nil, err
+	} else if stored == nil {
+		return nil, withCode(errCodeNotFound, fmt.Errorf("the identity %s is not stored in %s, create it with the issuance or import-state first", f.issuer, f.identities), "issuer", f.issuer)
+	}
+	// a pending transition is from the published state too, and two transitions from the same state must not
+	// both be handed over. It is checked before the command writes anything, the audit log included.
+	abandoned, err := pendingTransition(f.transitions, f.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the pending transitions: %w", err)
+	}
+	if abandoned != nil && !f.abandonPending {
+		err := fmt.Errorf("not changing the identity: the transition from %s to %s, written at %s, is pending, mark it with transition published, or pass --abandon-pending to replace it", abandoned.OldState, abandoned.NewState, abandoned.Created.Format(time.RFC3339))
+		return nil, withCode(errCodeConflict, err, "issuer", f.issuer)
+	}
+	output, err := newOutputSink(ctx, f.output)
+	if err != nil {
+		return nil, usageError("invalid --output: %s", err)
+	}
+	signer, source, err := injectedKeySigner(f.keyStdin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the signing key: %w", err)
+	} else if signer == nil {
+		return nil, usageError("the issuer's private key must be given on stdin with --key-stdin, or in %s", issuerKeyEnv)
+	}
+	identity, err := stored.restore(ctx, signer)
+	if err != nil {
+		signer.Close()
+		return nil, err
+	}
+	// a truncated or edited identities file can hold changes that don't make up the recorded state, and a
+	// change on top of them would publish a state that nobody recorded
+	state, err := identity.State()
+	if err != nil {
+		signer.Close()
+		return nil, err
+	}
+	if got := state.BigInt().String(); got != stored.State {
+		if !f.acceptCurrentState {
+			signer.Close()
+			err := fmt.Errorf("the trees of %s rebuild to the state %s, not the recorded %s. Compare the identities file with replay, or restore it from a backup, and pass --accept-current-state to adopt the rebuilt state", f.issuer, got, stored.State)
+			return nil, withCode(errCodeVerificationFailed, err, "issuer", f.issuer)
+		}
+		fmt.Printf("WARNING: adopting the rebuilt state %s of %s in place of the recorded %s, as --accept-current-state is set\n", got, f.issuer, stored.State)
+	}
+	auditLog, err := openAuditLog(f.auditLog)
+	if err != nil {
+		signer.Close()
+		return nil, err
+	}
+	auditLog.operator = operator
+	auditLog.signatures = signer.signatures
+	auditLog.dryRun = f.dryRun
+	if f.dryRun {
+		fmt.Print("Dry run, nothing will be written to the filesystem\n\n")
+	}
+	fmt.Printf("Restored the identity %s from %s, with the key from %s\n", f.issuer, f.identities, source)
+	return &openedIdentity{
+		flags:     f,
+		stored:    stored,
+		identity:  identity,
+		trees:     &issuerTrees{claims: identity.ClaimsTree(), revocations: identity.RevocationsTree(), roots: identity.RootsTree()},
+		signer:    signer,
+		auditLog:  auditLog,
+		output:    output,
+		abandoned: abandoned,
+	}, nil
+}
+
+// Close wipes the key
+func (o *openedIdentity) Close() {
+	o.signer.Close()
+}
+
+// revoke revokes a revocation nonce of the identity and records it in the audit log
+func (o *openedIdentity) revoke(ctx context.Context, revNonce uint64) error {
+	if err := checkRevocable(o.identity, revNonce); err != nil {
+		return err
+	}
+	id := o.identity.ID
+	oldState, _ := o.identity.State()
+	revokeErr := o.identity.Revoke(ctx, revNonce)
+	newState, _ := o.identity.State()
+	status := auditCompleted
+	params := map[string]string{"issuer": id.String(), "revocationNonce": fmt.Sprint(revNonce)}
+	if revokeErr != nil {
+		status = auditAborted
+		params["error"] = revokeErr.Error()
+	}
+	if err := o.auditLog.record("revoke-claim", status, params, oldState, newState); err != nil {
+		return fmt.Errorf("failed to record the operation in the audit log: %s", err)
+	}
+	if revokeErr == nil {
+		o.events = append(o.events, &issuanceEvent{
+			Type:            eventClaimRevoked,
+			Time:            now().UTC().Truncate(time.Second),
+			Issuer:          id.String(),
+			RevocationNonce: &revNonce,
+			OldState:        oldState.BigInt().String(),
+			NewState:        newState.BigInt().String(),
+		})
+	}
+	return revokeErr
+}
+
+// commit writes the inputs of the state transition that covers the pending changes of the identity, and
+// their signature. The pending transition of the issuer that --abandon-pending replaces is abandoned first,
+// as the new transition covers its changes too, and the identity is stored with the changes. The inputs are added to the manifest. The events of the
+// changes and of the transition are delivered to the notifiers once the identity is stored. In a dry run,
+// the inputs are printed instead, and nothing is written, recorded or delivered.
+func (o *openedIdentity) commit(ctx context.Context, artifacts *manifest) error {
+	id := o.identity.ID.String()
+	inputs, err := o.identity.StateTransition(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to construct the state transition: %w", err)
+	}
+	inputBytes, err := inputs.InputsMarshal()
+	if err != nil {
+		return err
+	}
+	pending := o.identity.PendingChanges()
+	if t := o.abandoned; t != nil {
+		fmt.Printf("-> Abandon the pending transition from %s to %s, the new transition covers its changes\n", t.OldState, t.NewState)
+		if !o.flags.dryRun {
+			if _, err := decideTransition(o.flags.transitions, id, func(t *stateTransition) { t.Status = transitionAbandoned }); err != nil {
+				return fmt.Errorf("failed to abandon the pending transition: %w", err)
+			}
+		}
+	}
+	if o.flags.dryRun {
+		dryRunOutput, _ := json.MarshalIndent(map[string]interface{}{
+			"dryRun":   true,
+			"file":     o.output.location(inputsName),
+			"oldState": inputs.OldTreeState.State.BigInt().String(),
+			"newState": inputs.NewState.BigInt().String(),
+			"inputs":   json.RawMessage(inputBytes),
+		}, "", "  ")
+		fmt.Printf("-> Dry run, the inputs would have been written to %s\n%s\n", o.output.describe(inputsName), dryRunOutput)
+		return nil
+	}
+	if err := o.output.Write(inputsName, inputBytes); err != nil {
+		return fmt.Errorf("failed to write the inputs: %w", err)
+	}
+	fmt.Printf("-> Inputs of the transition from %s to %s written to %s\n", inputs.OldTreeState.State.BigInt(), inputs.NewState.BigInt(), o.output.describe(inputsName))
+	sigBytes, err := signPayload(o.signer, o.identity.ID, inputsName, inputBytes)
+	if err == nil {
+		err = o.output.Write(payloadSignaturePath(inputsName), sigBytes)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sign the inputs: %w", err)
+	}
+	var nonces []uint64
+	for _, c := range pending.Claims {
+		nonces = append(nonces, c.GetRevocationNonce())
+	}
+	artifacts.add(inputsName, inputBytes, formatInputs, encodingJSON, nonces)
+	artifacts.add(payloadSignaturePath(inputsName), sigBytes, formatSignature, encodingJSON, nonces)
+
+	transition := newTransitionRecord(o.identity, inputs, inputBytes, pending, o.auditLog.operator, o.stored.TreeDepth)
+	if err := recordTransition(o.flags.transitions, transition); err != nil {
+		return fmt.Errorf("failed to record the pending transition: %w", err)
+	}
+	fmt.Printf("-> Transition recorded as pending in the file: %s, mark it with transition published once it is on-chain\n", o.flags.transitions)
+
+	stored, err := newStoredIdentity(o.identity, o.stored.TreeDepth, o.stored.Imported)
+	if err != nil {
+		return err
+	}
+	if err := saveIdentity(o.flags.identities, stored); err != nil {
+		return fmt.Errorf("failed to store the identity: %w", err)
+	}
+	o.stored = stored
+	fmt.Printf("-> Identity stored in the file: %s\n", o.flags.identities)
+	params := map[string]string{"issuer": id, "inputs": o.output.location(inputsName)}
+	if err := o.auditLog.record("state-transition", auditCompleted, params, inputs.OldTreeState.State, inputs.NewState); err != nil {
+		return fmt.Errorf("failed to record the operation in the audit log: %s", err)
+	}
+	for _, event := range o.events {
+		o.flags.notifiers.notifyAll(ctx, o.flags.notifyTimeout, event)
+	}
+	o.events = nil
+	o.flags.notifiers.notifyAll(ctx, o.flags.notifyTimeout, &issuanceEvent{
+		Type:     eventStateTransition,
+		Time:     now().UTC().Truncate(time.Second),
+		Issuer:   id,
+		OldState: inputs.OldTreeState.State.BigInt().String(),
+		NewState: inputs.NewState.BigInt().String(),
+		Inputs:   o.output.location(inputsName),
+	})
+	return nil
+}
+
+// publishedState is the state of the identity on-chain, that the transition of the pending changes is from
+func (o *openedIdentity) publishedState() string {
+	published := o.identity.PublishedTransitions()
+	return published[len(published)-1].TreeState.State.BigInt().String()
+}
+
+// finish commits the pending changes of the operation, and writes the manifest of the inputs
+func (o *openedIdentity) finish(ctx context.Context, operation, oldState string) error {
+	newState, err := o.identity.State()
+	if err != nil {
+		return err
+	}
+	artifacts := newManifest(operation, o.identity.ID.String(), oldState, newState.BigInt().String())
+	if err := o.commit(ctx, artifacts); err != nil {
+		return err
+	}
+	if o.flags.dryRun {
+		return nil
+	}
+	if err := o.output.Write(manifestName, artifacts.encode()); err != nil {
+		return fmt.Errorf("failed to write the manifest of the artifacts: %s", err)
+	}
+	fmt.Printf("-> Manifest of the artifacts written to %s\n", o.output.describe(manifestName))
+	return nil
+}
+
+// newTransitionRecord records the inputs of a state transition as pending, with the changes it covers and
+// the roots of the trees of its new state
+func newTransitionRecord(identity *issuer.Identity, inputs *circuits.StateTransitionInputs, inputBytes []byte, pending issuer.Changes, operator string, treeDepth int) *stateTransition {
+	t := &stateTransition{
+		Issuer:      identity.ID.String(),
+		Status:      transitionPending,
+		OldState:    inputs.OldTreeState.State.BigInt().String(),
+		NewState:    inputs.NewState.BigInt().String(),
+		InputsHash:  inputsHash(inputBytes),
+		Inputs:      inputBytes,
+		Revocations: pending.Revocations,
+		Created:     now().UTC(),
+		Operator:    operator,
+		TreeDepth:   treeDepth,
+
+		OldStateGenesis: inputs.IsOldStateGenesis,
+		ClaimsRoot:      identity.ClaimsTree().Root().BigInt().String(),
+		RevocationRoot:  identity.RevocationsTree().Root().BigInt().String(),
+		RootOfRoots:     identity.RootsTree().Root().BigInt().String(),
+	}
+	for _, c := range pending.Claims {
+		claimHex, _ := claimToHex(c)
+		t.Claims = append(t.Claims, claimHex)
+	}
+	for _, e := range pending.Erased {
+		t.Claims = append(t.Claims, leafTombstone(e.HIndex, e.HValue))
+	}
+	return t
+}
@@ -0,0 +1,120 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenRefusesAStateTheTreesDontRebuildTo(t *testing.T) {
+	home := testHome(t)
+	key := strings.Repeat("0b", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+	path := filepath.Join(home, "iden3_identities.json")
+	identities, err := readIdentities(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := identities[0].State
+	identities[0].State = "1"
+	if err := writeIdentities(path, identities); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(issuerKeyEnv, key)
+	captureOutput(t, func() { err = stateTransitionCommand([]string{"--issuer", id, "--abandon-pending"}) })
+	if err == nil || classifyError(err).code != errCodeVerificationFailed || !strings.Contains(err.Error(), "--accept-current-state") {
+		t.Fatalf("expected the recorded state that the trees don't rebuild to to be refused, got %v", err)
+	}
+
+	t.Setenv(issuerKeyEnv, key)
+	printed = captureOutput(t, func() {
+		if err := stateTransitionCommand([]string{"--issuer", id, "--accept-current-state", "--abandon-pending"}); err != nil {
+			t.Fatalf("failed to adopt the rebuilt state: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "WARNING: adopting the rebuilt state "+rebuilt) {
+		t.Errorf("expected the rebuilt state to be adopted, got: %s", printed)
+	}
+	stored, err := findIdentity(path, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != rebuilt {
+		t.Errorf("expected the stored identity to record the rebuilt state %s, got %s", rebuilt, stored.State)
+	}
+}
+
+func TestOpenRefusesAPendingTransition(t *testing.T) {
+	home := testHome(t)
+	key := strings.Repeat("0d", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+	before := snapshotDir(t, home)
+
+	commands := []struct {
+		name string
+		run  func([]string) error
+		args []string
+	}{
+		{"update-claim", updateClaimCommand, []string{"--nonce", "4", "--slot", "v_2=1"}},
+		{"revoke", revokeCommand, []string{"--nonce", "2"}},
+		{"state-transition", stateTransitionCommand, []string{"--issuer", id}},
+	}
+	for _, c := range commands {
+		t.Setenv(issuerKeyEnv, key)
+		var err error
+		captureOutput(t, func() { err = c.run(c.args) })
+		if err == nil || classifyError(err).code != errCodeConflict || !strings.Contains(err.Error(), "--abandon-pending") {
+			t.Errorf("expected %s to refuse the pending transition, got %v", c.name, err)
+		}
+	}
+	after := snapshotDir(t, home)
+	for path, content := range before {
+		if after[path] != content {
+			t.Errorf("the refused commands changed %s", path)
+		}
+	}
+
+	t.Setenv(issuerKeyEnv, key)
+	printed = captureOutput(t, func() {
+		if err := revokeCommand([]string{"--nonce", "2", "--abandon-pending"}); err != nil {
+			t.Fatalf("failed to revoke with --abandon-pending: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "-> Abandon the pending transition from ") {
+		t.Errorf("expected the pending transition to be abandoned, got: %s", printed)
+	}
+	transitions, err := readTransitions(filepath.Join(home, "iden3_transitions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transitions) != 2 || transitions[0].Status != transitionAbandoned || transitions[1].Status != transitionPending {
+		t.Errorf("expected the abandoned transition of the walkthrough and the pending one of the revocation, got %d transitions", len(transitions))
+	}
+}
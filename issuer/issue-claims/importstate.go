@@ -0,0 +1,287 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	core "github.com/iden3/go-iden3-core"
+	merkletree "github.com/iden3/go-merkletree-sql"
+	"github.com/iden3/go-merkletree-sql/db/memory"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// stateSnapshot is the state of an identity exported by another iden3 implementation, such as the tables of
+// the PolygonID issuer node: its claims, its revoked nonces, the claims roots added to its roots tree, in
+// order, and the state that they make up. The hashes are in decimal, or in the 64 digit hex of the
+// merkletree library.
+type stateSnapshot struct {
+	Identifier    string          `json:"identifier"`
+	GenesisState  string          `json:"genesisState,omitempty"`
+	State         snapshotState   `json:"state"`
+	Claims        []snapshotClaim `json:"claims"`
+	RevokedNonces []uint64        `json:"revokedNonces"`
+	RootsHistory  []string        `json:"rootsHistory"`
+}
+
+type snapshotState struct {
+	State              string `json:"state"`
+	ClaimsTreeRoot     string `json:"claimsTreeRoot"`
+	RevocationTreeRoot string `json:"revocationTreeRoot"`
+	RootOfRoots        string `json:"rootOfRoots"`
+}
+
+// snapshotClaim is a claim of the snapshot in the canonical hex encoding
+type snapshotClaim struct {
+	CoreClaim string `json:"coreClaim"`
+}
+
+// parseSnapshotHash parses a hash of the snapshot, in decimal or in hex
+func parseSnapshotHash(name, s string) (*merkletree.Hash, error) {
+	var h *merkletree.Hash
+	var err error
+	if len(s) == 64 {
+		h, err = merkletree.NewHashFromHex(s)
+	} else {
+		h, err = merkletree.NewHashFromString(s)
+	}
+	if err != nil || s == "" {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid %s %q in the snapshot", name, s))
+	}
+	return h, nil
+}
+
+// rebuildSnapshot adds the claims, the revoked nonces and the roots of the snapshot to fresh trees
+func rebuildSnapshot(ctx context.Context, snapshot *stateSnapshot, levels int) (*issuerTrees, []*core.Claim, error) {
+	var trees issuerTrees
+	for _, t := range []**merkletree.MerkleTree{&trees.claims, &trees.revocations, &trees.roots} {
+		tree, err := merkletree.NewMerkleTree(ctx, memory.NewMemoryStorage(), levels)
+		if err != nil {
+			return nil, nil, err
+		}
+		*t = tree
+	}
+	claims := make([]*core.Claim, len(snapshot.Claims))
+	for i, c := range snapshot.Claims {
+		claim, err := claimFromHex(c.CoreClaim)
+		if err != nil {
+			return nil, nil, withCode(errCodeInvalidInput, fmt.Errorf("claim %d of the snapshot: %s", i+1, err))
+		}
+		hIndex, hValue, err := claim.HiHv()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := trees.claims.Add(ctx, hIndex, hValue); err != nil {
+			return nil, nil, withCode(errCodeInvalidInput, fmt.Errorf("claim %d of the snapshot: %s", i+1, err))
+		}
+		claims[i] = claim
+	}
+	for _, nonce := range snapshot.RevokedNonces {
+		if err := trees.revocations.Add(ctx, new(big.Int).SetUint64(nonce), big.NewInt(0)); err != nil {
+			return nil, nil, withCode(errCodeInvalidInput, fmt.Errorf("revoked nonce %d of the snapshot: %s", nonce, err))
+		}
+	}
+	for i, r := range snapshot.RootsHistory {
+		root, err := parseSnapshotHash(fmt.Sprintf("root %d of the roots history", i+1), r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := trees.roots.Add(ctx, root.BigInt(), big.NewInt(0)); err != nil {
+			return nil, nil, withCode(errCodeInvalidInput, fmt.Errorf("root %d of the roots history: %s", i+1, err))
+		}
+	}
+	return &trees, claims, nil
+}
+
+// checkSnapshotState compares the roots and the state of the rebuilt trees with the ones the snapshot declares
+func checkSnapshotState(trees *issuerTrees, declared snapshotState) error {
+	state, err := trees.state()
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		name     string
+		declared string
+		got      *merkletree.Hash
+	}{
+		{"claims tree root", declared.ClaimsTreeRoot, trees.claims.Root()},
+		{"revocation tree root", declared.RevocationTreeRoot, trees.revocations.Root()},
+		{"root of roots", declared.RootOfRoots, trees.roots.Root()},
+		{"state", declared.State, state},
+	} {
+		want, err := parseSnapshotHash(c.name, c.declared)
+		if err != nil {
+			return err
+		}
+		if !want.Equals(c.got) {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("the recomputed %s is %s, the snapshot declares %s", c.name, c.got.BigInt(), want.BigInt()))
+		}
+	}
+	return nil
+}
+
+// importStateCommand handles the "import-state" command, that takes over an identity from a snapshot of
+// another implementation. The trees are rebuilt from the snapshot and must make up its declared state, and
+// the key must be the key of an auth claim of the identity, before anything is written. The import is then
+// recorded in the audit log, which replay rebuilds the trees from.
+func importStateCommand(args []string) error {
+	fs := flag.NewFlagSet("import-state", flag.ExitOnError)
+	readOnly.register(fs, false)
+	snapshotFlag := fs.String("snapshot", "", "path of the snapshot of the identity")
+	auditLogFlag := fs.String("audit-log", defaultAuditLogPath(), "path of the audit log that the import is recorded in")
+	keyStdinFlag := fs.Bool("key-stdin", false, "read the identity's private key from stdin, rather than "+issuerKeyEnv)
+	treeDepthFlag := fs.Int("tree-depth", 32, "depth of the rebuilt trees")
+	timeoutFlag := fs.Duration("timeout", 0, "give up on the command after this long, for example 30s (no timeout by default)")
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	if *snapshotFlag == "" {
+		return usageError("usage: import-state --snapshot <path> [--key-stdin] [--audit-log <path>] [--tree-depth <levels>]")
+	}
+	if *treeDepthFlag < 1 || *treeDepthFlag > issuer.MaxTreeDepth {
+		return usageError("--tree-depth must be between 1 and %d", issuer.MaxTreeDepth)
+	}
+	operator, err := operators.authorize(roleIssue)
+	if err != nil {
+		return fmt.Errorf("not authorized to import an identity: %w", err)
+	}
+
+	b, err := os.ReadFile(*snapshotFlag)
+	if err != nil {
+		return err
+	}
+	var snapshot stateSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid snapshot %s: %s", *snapshotFlag, err))
+	}
+	id, err := core.IDFromString(snapshot.Identifier)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid identifier %q in the snapshot: %s", snapshot.Identifier, err))
+	}
+	fmt.Printf("Import the state of %s from %s\n", id.String(), *snapshotFlag)
+
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+	trees, claims, err := rebuildSnapshot(ctx, &snapshot, *treeDepthFlag)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("-> Rebuilt the trees from %d claims, %d revoked nonces and %d roots\n", len(claims), len(snapshot.RevokedNonces), len(snapshot.RootsHistory))
+	if err := checkSnapshotState(trees, snapshot.State); err != nil {
+		return err
+	}
+	state, _ := trees.state()
+	fmt.Println("-> The recomputed state matches the snapshot:", state.BigInt())
+	if snapshot.GenesisState != "" {
+		genesis, err := parseSnapshotHash("genesis state", snapshot.GenesisState)
+		if err != nil {
+			return err
+		}
+		genesisID, err := core.IdGenesisFromIdenState([2]byte{id[0], id[1]}, genesis.BigInt())
+		if err != nil {
+			return err
+		}
+		if !genesisID.Equal(&id) {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("the genesis state of the snapshot is the genesis state of %s, not %s", genesisID, id.String()))
+		}
+		fmt.Println("-> The identifier matches the genesis state")
+	}
+	// there is no RPC client in this sample, the state contract is only reached through hardhat
+	fmt.Println("-> The on-chain state is not checked, compare it with the state contract before using the identity")
+
+	signer, source, err := injectedKeySigner(*keyStdinFlag)
+	if err != nil {
+		return fmt.Errorf("failed to read the key: %w", err)
+	} else if signer == nil {
+		return usageError("the identity's private key must be given on stdin with --key-stdin, or in %s", issuerKeyEnv)
+	}
+	defer signer.Close()
+	revoked := map[uint64]bool{}
+	for _, nonce := range snapshot.RevokedNonces {
+		revoked[nonce] = true
+	}
+	pubKey := signer.Public()
+	authorized := false
+	for _, c := range claims {
+		sHash := c.GetSchemaHash()
+		if sHashText, _ := sHash.MarshalText(); string(sHashText) != issuer.AuthSchemaHash || revoked[c.GetRevocationNonce()] {
+			continue
+		}
+		slots := c.RawSlotsAsInts()
+		if slots[2].Cmp(pubKey.X) == 0 && slots[3].Cmp(pubKey.Y) == 0 {
+			authorized = true
+			break
+		}
+	}
+	if !authorized {
+		return withCode(errCodeKeyMismatch, fmt.Errorf("the key from %s is not the key of an unrevoked auth claim of %s", source, id.String()))
+	}
+	fmt.Printf("-> The key from %s is the key of an auth claim of the identity\n", source)
+
+	// an identity that is in the audit log already would be rebuilt from two histories
+	entries, err := readAuditLog(*auditLogFlag)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Params["issuer"] == id.String() && (e.Operation == "create-identity" || e.Operation == "import-state") {
+			return withCode(errCodeConflict, fmt.Errorf("the identity %s is recorded in %s already, at entry %d", id.String(), *auditLogFlag, e.Seq), "issuer", id.String())
+		}
+	}
+	auditLog, err := openAuditLog(*auditLogFlag)
+	if err != nil {
+		return err
+	}
+	auditLog.operator = operator
+	for _, c := range claims {
+		leaf, err := claimLeaf(c)
+		if err != nil {
+			return err
+		}
+		if err := auditLog.record("import-claim", auditCompleted, map[string]string{"issuer": id.String(), "leaf": leaf}, nil, nil); err != nil {
+			return fmt.Errorf("failed to record the import in the audit log: %s", err)
+		}
+	}
+	nonces := make([]string, len(snapshot.RevokedNonces))
+	for i, nonce := range snapshot.RevokedNonces {
+		nonces[i] = strconv.FormatUint(nonce, 10)
+	}
+	roots := make([]string, len(snapshot.RootsHistory))
+	for i, r := range snapshot.RootsHistory {
+		root, _ := parseSnapshotHash("root", r)
+		roots[i] = root.BigInt().String()
+	}
+	params := map[string]string{
+		"issuer":      id.String(),
+		"claims":      strconv.Itoa(len(claims)),
+		"revocations": strings.Join(nonces, ","),
+		"roots":       strings.Join(roots, ","),
+	}
+	if err := auditLog.record("import-state", auditCompleted, params, nil, state); err != nil {
+		return fmt.Errorf("failed to record the import in the audit log: %s", err)
+	}
+	fmt.Printf("-> Import recorded in the audit log: %s, replay --issuer %s rebuilds the trees from it\n", *auditLogFlag, id.String())
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A document is published as a single raw block with a version 1 CID, which is the sha2-256 multihash of
+// the document itself, so the CID can be checked against the content without an IPFS node. Larger
+// documents would be split into blocks of the default chunk size.
+const (
+	ipfsMaxBlockSize = 256 * 1024
+	ipfsCIDVersion   = 0x01
+	ipfsRawCodec     = 0x55
+	ipfsSHA256Code   = 0x12
+	ipfsSHA256Length = 0x20
+)
+
+var ipfsBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func defaultIPFSGateway() string {
+	return "https://ipfs.io"
+}
+
+// ipfsCID computes the version 1 CID of a document stored as a raw block, in the base32 multibase
+func ipfsCID(document []byte) string {
+	digest := sha256.Sum256(document)
+	prefix := []byte{ipfsCIDVersion, ipfsRawCodec, ipfsSHA256Code, ipfsSHA256Length}
+	return "b" + strings.ToLower(ipfsBase32.EncodeToString(append(prefix, digest[:]...)))
+}
+
+// ipfsCIDDigest returns the sha2-256 hash that a CID addresses its content by. Only the raw block CIDs that
+// schema publish produces are supported, as the content of other CIDs can't be checked without the blocks
+// that it was split into.
+func ipfsCIDDigest(cid string) ([]byte, error) {
+	if !strings.HasPrefix(cid, "b") {
+		return nil, fmt.Errorf("can't verify the content of %s, only base32 version 1 CIDs of raw blocks are supported", cid)
+	}
+	b, err := ipfsBase32.DecodeString(strings.ToUpper(cid[1:]))
+	if err != nil || len(b) != 4+sha256.Size || b[0] != ipfsCIDVersion || b[2] != ipfsSHA256Code || b[3] != ipfsSHA256Length {
+		return nil, fmt.Errorf("can't verify the content of %s, only version 1 CIDs with a sha2-256 hash are supported", cid)
+	}
+	if b[1] != ipfsRawCodec {
+		return nil, fmt.Errorf("can't verify the content of %s, only CIDs of raw blocks are supported", cid)
+	}
+	return b[4:], nil
+}
+
+// fetchIPFS fetches the content of an ipfs://<cid> URL from an HTTP gateway, and verifies it against the CID
+// as the gateway is not trusted
+func fetchIPFS(ctx context.Context, gateway, ipfsURL string) ([]byte, error) {
+	cid := strings.TrimSuffix(strings.TrimPrefix(ipfsURL, "ipfs://"), "/")
+	if cid == "" || strings.Contains(cid, "/") {
+		return nil, fmt.Errorf("%s is not the URL of a single document, ipfs://<cid>", ipfsURL)
+	}
+	expected, err := ipfsCIDDigest(cid)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(gateway, "/")+"/ipfs/"+cid, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, withCode(errCodeUnavailable, err, "gateway", gateway)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, withCode(errCodeUnavailable, fmt.Errorf("the gateway responded with %s for %s", res.Status, cid), "gateway", gateway)
+	}
+	content, err := io.ReadAll(io.LimitReader(res.Body, ipfsMaxBlockSize+1))
+	if err != nil {
+		return nil, withCode(errCodeUnavailable, err, "gateway", gateway)
+	}
+	if digest := sha256.Sum256(content); !bytes.Equal(digest[:], expected) {
+		return nil, fmt.Errorf("the content returned for %s doesn't match its hash", cid)
+	}
+	return content, nil
+}
+
+// publishIPFS adds a document to an IPFS node through its HTTP API, pinned, and returns its CID. The CID
+// that the node returns is checked against the one computed locally, so the recorded CID is known to
+// address the document.
+func publishIPFS(ctx context.Context, api string, name string, document []byte) (string, error) {
+	if len(document) > ipfsMaxBlockSize {
+		return "", fmt.Errorf("the document is %d bytes, only documents of up to %d bytes fit in a single block", len(document), ipfsMaxBlockSize)
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", name)
+	if err != nil {
+		return "", err
+	}
+	part.Write(document)
+	w.Close()
+
+	u := strings.TrimSuffix(api, "/") + "/api/v0/add?cid-version=1&raw-leaves=true&pin=true"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", withCode(errCodeUnavailable, err, "api", api)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", withCode(errCodeUnavailable, fmt.Errorf("the IPFS API responded with %s: %s", res.Status, strings.TrimSpace(string(b))), "api", api)
+	}
+	var added struct {
+		Hash string `json:"Hash"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&added); err != nil {
+		return "", fmt.Errorf("invalid response from the IPFS API: %s", err)
+	}
+	if cid := ipfsCID(document); added.Hash != cid {
+		return "", fmt.Errorf("the IPFS API returned the CID %s, expected %s", added.Hash, cid)
+	}
+	return added.Hash, nil
+}
@@ -0,0 +1,69 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchIPFSReportsAnUnreachableGatewayAsUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	gateway := server.URL
+	server.Close()
+
+	_, err := fetchIPFS(context.Background(), gateway, "ipfs://"+ipfsCID([]byte("{}")))
+	if err == nil {
+		t.Fatal("fetched a document from a closed gateway")
+	}
+	if code := classifyError(err).code; code != errCodeUnavailable {
+		t.Errorf("the error is classified as %s, expected %s", code.Code, errCodeUnavailable.Code)
+	}
+}
+
+func TestFetchIPFSStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	_, err := fetchIPFS(ctx, server.URL, "ipfs://"+ipfsCID([]byte("{}")))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the fetch to be cancelled, got %v", err)
+	}
+}
+
+func TestFetchSchemaRefusesAnOversizedDocument(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat(" ", ipfsMaxBlockSize+1)))
+	}))
+	defer server.Close()
+
+	_, err := fetchSchema(context.Background(), server.URL, defaultIPFSGateway())
+	if err == nil {
+		t.Fatal("fetched a document larger than the limit")
+	}
+	if code := classifyError(err).code; code != errCodeInvalidInput {
+		t.Errorf("the error is classified as %s, expected %s", code.Code, errCodeInvalidInput.Code)
+	}
+}
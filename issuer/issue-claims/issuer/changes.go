@@ -0,0 +1,185 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuer
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+)
+
+// Changes are the claims added to the claims tree and the nonces added to the revocation tree between two
+// published states. Claims accumulate in the trees and are usable as signed credentials right away, while
+// one state transition covers all the changes since the published state.
+type Changes struct {
+	Claims []*core.Claim
+	// Erased are the claims whose data was erased, which stay in the claims tree by their leaf
+	Erased      []ErasedClaim
+	Revocations []uint64
+}
+
+// ErasedClaim stands in for a claim whose data was erased. The claims tree can't forget a leaf, so the
+// hashes of the index and value slots of the claim are kept to rebuild it, and the revocation nonce, so
+// that it isn't given to another claim.
+type ErasedClaim struct {
+	HIndex          *big.Int
+	HValue          *big.Int
+	RevocationNonce uint64
+}
+
+// Empty tells whether there are no changes
+func (c Changes) Empty() bool {
+	return len(c.Claims) == 0 && len(c.Erased) == 0 && len(c.Revocations) == 0
+}
+
+// copy returns the changes in slices of their own
+func (c Changes) copy() Changes {
+	return Changes{
+		Claims:      append([]*core.Claim(nil), c.Claims...),
+		Erased:      append([]ErasedClaim(nil), c.Erased...),
+		Revocations: append([]uint64(nil), c.Revocations...),
+	}
+}
+
+// PublishedTransition is a published state, with the changes that its state transition covered and the
+// transaction that published it. The genesis state covers the auth claim and has no publication.
+type PublishedTransition struct {
+	TreeState   circuits.TreeState
+	Changes     Changes
+	Publication Publication
+}
+
+// PendingChanges returns the changes since the published state, that the next state transition covers
+func (i *Identity) PendingChanges() Changes {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.pending.copy()
+}
+
+// PublishedTransitions returns the genesis state followed by the published states, in the order they were
+// published, with the changes that each of them covered
+func (i *Identity) PublishedTransitions() []PublishedTransition {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	transitions := make([]PublishedTransition, len(i.publishedTreeStates))
+	for n, treeState := range i.publishedTreeStates {
+		transitions[n] = PublishedTransition{
+			TreeState:   treeState,
+			Changes:     i.covered[n].copy(),
+			Publication: i.publications[treeState.State.BigInt().String()],
+		}
+	}
+	return transitions
+}
+
+// ClaimTreeState returns the published state whose transition covered the claim, which is the first state
+// that a proof of the claim's inclusion in the claims tree can be generated against. It returns false if
+// the claim is not covered by a published state yet.
+func (i *Identity) ClaimTreeState(claim *core.Claim) (circuits.TreeState, bool, error) {
+	hIndex, err := claim.HIndex()
+	if err != nil {
+		return circuits.TreeState{}, false, err
+	}
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	for n, changes := range i.covered {
+		for _, c := range changes.Claims {
+			h, err := c.HIndex()
+			if err != nil {
+				return circuits.TreeState{}, false, err
+			}
+			if h.Cmp(hIndex) == 0 {
+				return i.publishedTreeStates[n], true, nil
+			}
+		}
+		for _, e := range changes.Erased {
+			if e.HIndex.Cmp(hIndex) == 0 {
+				return i.publishedTreeStates[n], true, nil
+			}
+		}
+	}
+	return circuits.TreeState{}, false, nil
+}
+
+// ActiveRevocationNonces returns the revocation nonces of the claims issued by the identity that are not
+// revoked in its published state, which are the nonces that holders ask for the revocation status of
+func (i *Identity) ActiveRevocationNonces() []uint64 {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	revoked := map[uint64]bool{}
+	for _, changes := range i.covered {
+		for _, revNonce := range changes.Revocations {
+			revoked[revNonce] = true
+		}
+	}
+	var nonces []uint64
+	for _, changes := range append(i.covered, i.pending) {
+		for _, claim := range changes.Claims {
+			if revNonce := claim.GetRevocationNonce(); !revoked[revNonce] {
+				revoked[revNonce] = true
+				nonces = append(nonces, revNonce)
+			}
+		}
+		for _, e := range changes.Erased {
+			if !revoked[e.RevocationNonce] {
+				revoked[e.RevocationNonce] = true
+				nonces = append(nonces, e.RevocationNonce)
+			}
+		}
+	}
+	return nonces
+}
+
+// EraseClaims replaces the claims of the revocation nonces, in the published and the pending changes, with
+// their erased claims, so that the identity no longer holds their data. The trees and the states don't
+// change. The versions of an updated claim share its nonce, and are all erased. It returns the number of
+// claims erased. The auth claim can't be erased, as the state transitions prove the key with it.
+func (i *Identity) EraseClaims(revNonces ...uint64) (int, error) {
+	erase := map[uint64]bool{}
+	for _, revNonce := range revNonces {
+		if revNonce == i.AuthClaim.GetRevocationNonce() {
+			return 0, fmt.Errorf("the revocation nonce %d is the nonce of the auth claim, which can't be erased", revNonce)
+		}
+		erase[revNonce] = true
+	}
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	all := []*Changes{&i.pending}
+	for n := range i.covered {
+		all = append(all, &i.covered[n])
+	}
+	erased := 0
+	for _, changes := range all {
+		var kept []*core.Claim
+		for _, claim := range changes.Claims {
+			if !erase[claim.GetRevocationNonce()] {
+				kept = append(kept, claim)
+				continue
+			}
+			hIndex, hValue, err := claim.HiHv()
+			if err != nil {
+				return erased, err
+			}
+			changes.Erased = append(changes.Erased, ErasedClaim{HIndex: hIndex, HValue: hValue, RevocationNonce: claim.GetRevocationNonce()})
+			erased++
+		}
+		changes.Claims = kept
+	}
+	return erased, nil
+}
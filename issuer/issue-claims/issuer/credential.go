@@ -0,0 +1,218 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuer
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+// Credential is a claim as it is handed to its holder: signed by the issuer, with the proof that the issuer's
+// auth claim is in its claims tree and the proof that the claim is not revoked
+type Credential struct {
+	IssuerID       *core.ID
+	Claim          *core.Claim
+	SignatureProof circuits.BJJSignatureProof
+	NonRevProof    circuits.ClaimNonRevStatus
+	IssuerState    IssuerState
+}
+
+// IssuerState describes the issuer state that the proofs of a credential are generated against, which is the
+// state that verifiers compare with the state contract. A genesis state is valid without being published, as
+// the ID of the issuer is derived from it. Once the issuer publishes a new state, the credential must be
+// requested again to prove non-revocation against it.
+type IssuerState struct {
+	State       string `json:"state"`
+	Genesis     bool   `json:"genesis"`
+	Published   bool   `json:"published"`
+	TxHash      string `json:"txHash,omitempty"`
+	BlockNumber uint64 `json:"blockNumber,omitempty"`
+	BlockHash   string `json:"blockHash,omitempty"`
+}
+
+// TreeState returns the current state with the roots of the 3 trees
+func (i *Identity) TreeState() (circuits.TreeState, error) {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.treeState()
+}
+
+func (i *Identity) treeState() (circuits.TreeState, error) {
+	state, err := i.state()
+	if err != nil {
+		return circuits.TreeState{}, err
+	}
+	return circuits.TreeState{
+		State:          state,
+		ClaimsRoot:     i.claims.Root(),
+		RevocationRoot: i.revocations.Root(),
+		RootOfRoots:    i.roots.Root(),
+	}, nil
+}
+
+// PublishedState returns the state that was last published to the state contract, or nil if the identity
+// has only its genesis state
+func (i *Identity) PublishedState() *merkletree.Hash {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	if i.oldTreeState.State.Equals(i.GenesisState) {
+		return nil
+	}
+	return i.oldTreeState.State
+}
+
+// AuthClaimProof returns the auth claim with the proofs of its inclusion in the claims tree and its
+// exclusion from the revocation tree of the published state, or of the genesis state before the first
+// publication, which are the states that verifiers accept
+func (i *Identity) AuthClaimProof(ctx context.Context) (*circuits.Claim, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.authClaimProof(), nil
+}
+
+func (i *Identity) authClaimProof() *circuits.Claim {
+	return &circuits.Claim{
+		IssuerID:    i.ID,
+		Claim:       i.AuthClaim,
+		TreeState:   i.oldTreeState,
+		Proof:       i.authMTProof,
+		NonRevProof: &circuits.ClaimNonRevStatus{TreeState: i.oldTreeState, Proof: i.authNonRevMTProof},
+	}
+}
+
+// PublishedRevocationStatus returns the published state, or the genesis state before the first
+// publication, with the proof of the inclusion or exclusion of a revocation nonce in its revocation tree,
+// which is the status that verifiers accept
+func (i *Identity) PublishedRevocationStatus(ctx context.Context, revNonce uint64) (circuits.TreeState, *merkletree.Proof, error) {
+	if err := ctx.Err(); err != nil {
+		return circuits.TreeState{}, nil, err
+	}
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	proof, _, err := i.revocations.GenerateProof(ctx, new(big.Int).SetUint64(revNonce), i.oldTreeState.RevocationRoot)
+	if err != nil {
+		return circuits.TreeState{}, nil, err
+	}
+	return i.oldTreeState, proof, nil
+}
+
+// Credential signs a claim for its holder. The signer signs the Poseidon hash of the index and value hashes
+// of the claim, which is what the credentialAtomicQuerySig circuit verifies, so the claim doesn't need to
+// be in a published state of the issuer. The proofs are generated against the published state. It fails
+// without signing if CheckSigner fails.
+func (i *Identity) Credential(ctx context.Context, claim *core.Claim) (*Credential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	if err := i.checkSigner(ctx); err != nil {
+		return nil, err
+	}
+	hIndex, hValue, err := claim.HiHv()
+	if err != nil {
+		return nil, err
+	}
+	claimHash, err := poseidon.Hash([]*big.Int{hIndex, hValue})
+	if err != nil {
+		return nil, err
+	}
+	auth := i.authClaimProof()
+	nonRevProof, _, err := i.revocations.GenerateProof(ctx, new(big.Int).SetUint64(claim.GetRevocationNonce()), i.oldTreeState.RevocationRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &Credential{
+		IssuerID: i.ID,
+		Claim:    claim,
+		SignatureProof: circuits.BJJSignatureProof{
+			IssuerID:              i.ID,
+			Signature:             i.signer.SignPoseidon(claimHash),
+			IssuerTreeState:       auth.TreeState,
+			IssuerAuthClaim:       i.AuthClaim,
+			IssuerAuthClaimMTP:    auth.Proof,
+			IssuerAuthNonRevProof: *auth.NonRevProof,
+		},
+		NonRevProof: circuits.ClaimNonRevStatus{TreeState: auth.TreeState, Proof: nonRevProof},
+		IssuerState: i.issuerState(auth.TreeState.State),
+	}, nil
+}
+
+func (i *Identity) issuerState(state *merkletree.Hash) IssuerState {
+	s := IssuerState{
+		State:   state.BigInt().String(),
+		Genesis: state.Equals(i.GenesisState),
+	}
+	if publication, ok := i.publications[s.State]; ok {
+		s.Published = true
+		s.TxHash = publication.TxHash
+		s.BlockNumber = publication.BlockNumber
+		s.BlockHash = publication.BlockHash
+	}
+	return s
+}
+
+// Verify checks the signature of the issuer over the claim, and the proofs of the credential against the
+// tree states it carries. It doesn't check that those states are published.
+func (c *Credential) Verify() error {
+	sp := c.SignatureProof
+	if sp.Signature == nil || sp.IssuerAuthClaim == nil || sp.IssuerAuthClaimMTP == nil || sp.IssuerAuthNonRevProof.Proof == nil || c.NonRevProof.Proof == nil {
+		return fmt.Errorf("the credential is missing its signature or proofs")
+	}
+
+	// the public key of the issuer is in the index data slots of its auth claim
+	authSlots := sp.IssuerAuthClaim.RawSlotsAsInts()
+	pubKey := babyjub.PublicKey{X: authSlots[2], Y: authSlots[3]}
+	hIndex, hValue, err := c.Claim.HiHv()
+	if err != nil {
+		return err
+	}
+	claimHash, err := poseidon.Hash([]*big.Int{hIndex, hValue})
+	if err != nil {
+		return err
+	}
+	if !pubKey.VerifyPoseidon(claimHash, sp.Signature) {
+		return fmt.Errorf("the signature doesn't match the claim and the issuer's auth claim")
+	}
+
+	authHIndex, authHValue, err := sp.IssuerAuthClaim.HiHv()
+	if err != nil {
+		return err
+	}
+	if !merkletree.VerifyProof(sp.IssuerTreeState.ClaimsRoot, sp.IssuerAuthClaimMTP, authHIndex, authHValue) || !sp.IssuerAuthClaimMTP.Existence {
+		return fmt.Errorf("the issuer's auth claim is not in the claims tree of the issuer's state")
+	}
+	authRevNonce := new(big.Int).SetUint64(sp.IssuerAuthClaim.GetRevocationNonce())
+	if !merkletree.VerifyProof(sp.IssuerTreeState.RevocationRoot, sp.IssuerAuthNonRevProof.Proof, authRevNonce, big.NewInt(0)) || sp.IssuerAuthNonRevProof.Proof.Existence {
+		return fmt.Errorf("the issuer's auth claim is revoked")
+	}
+	revNonce := new(big.Int).SetUint64(c.Claim.GetRevocationNonce())
+	if !merkletree.VerifyProof(c.NonRevProof.TreeState.RevocationRoot, c.NonRevProof.Proof, revNonce, big.NewInt(0)) || c.NonRevProof.Proof.Existence {
+		return fmt.Errorf("the claim is revoked")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuer
+
+import (
+	"context"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	merkletree "github.com/iden3/go-merkletree-sql"
+	"github.com/iden3/go-merkletree-sql/db/memory"
+)
+
+// Genesis is the genesis state of an identity, with the auth claim of its public key that the state is
+// made of, and the ID derived from it
+type Genesis struct {
+	ID        *core.ID
+	AuthClaim *core.Claim
+	TreeState circuits.TreeState
+}
+
+// NewGenesis computes the genesis state of the identity of a public key, the same way New does, without the
+// private key. This lets an issuer onboard a holder that keeps its key elsewhere. The auth claim has the
+// default revocation nonce, AuthRevocationNonce.
+func NewGenesis(ctx context.Context, pubKey *babyjub.PublicKey) (*Genesis, error) {
+	authClaim, err := newAuthClaim(pubKey, AuthRevocationNonce)
+	if err != nil {
+		return nil, err
+	}
+	return GenesisOf(ctx, authClaim)
+}
+
+// GenesisOf computes the genesis state of the identity of an auth claim, for an identity whose auth claim
+// has another revocation nonce than the default
+func GenesisOf(ctx context.Context, authClaim *core.Claim) (*Genesis, error) {
+	claims, err := merkletree.NewMerkleTree(ctx, memory.NewMemoryStorage(), mtLevels)
+	if err != nil {
+		return nil, err
+	}
+	hIndex, hValue, err := authClaim.HiHv()
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.Add(ctx, hIndex, hValue); err != nil {
+		return nil, err
+	}
+
+	// the revocation and roots trees are empty in the genesis state
+	emptyRoot := &merkletree.HashZero
+	state, err := merkletree.HashElems(claims.Root().BigInt(), emptyRoot.BigInt(), emptyRoot.BigInt())
+	if err != nil {
+		return nil, err
+	}
+	id, err := core.IdGenesisFromIdenState(core.TypeDefault, state.BigInt())
+	if err != nil {
+		return nil, err
+	}
+	return &Genesis{
+		ID:        id,
+		AuthClaim: authClaim,
+		TreeState: circuits.TreeState{
+			State:          state,
+			ClaimsRoot:     claims.Root(),
+			RevocationRoot: emptyRoot,
+			RootOfRoots:    emptyRoot,
+		},
+	}, nil
+}
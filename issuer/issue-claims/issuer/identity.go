@@ -0,0 +1,580 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package issuer implements an iden3 issuer identity: its genesis state, the claims it issues and revokes,
+// and the inputs of the state transition circuit that publishes its new state.
+package issuer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+	merkletree "github.com/iden3/go-merkletree-sql"
+	"github.com/iden3/go-merkletree-sql/db/memory"
+)
+
+// AuthSchemaHash is the schema hash of the auth claims, which hold the public keys of an identity
+const AuthSchemaHash = "ca938857241db9451ea329256b9c06e5"
+
+// AuthRevocationNonce is the revocation nonce of the auth claim of the genesis state, unless WithAuthNonce
+// sets another
+const AuthRevocationNonce = uint64(1)
+
+// ErrKeyMismatch is returned when the signer's key is not the key of the identity, so anything it signs
+// would never verify against the identity's state
+var ErrKeyMismatch = errors.New("key does not match identity")
+
+// The default depth of the trees, which is the depth the circuits are compiled for
+const mtLevels = 32
+
+// MaxTreeDepth is the largest depth of the trees, as the index of a leaf is a field element of 254 bits
+const MaxTreeDepth = 254
+
+// Signer signs with the babyjubjub key of an identity. A *babyjub.PrivateKey is a Signer.
+type Signer interface {
+	Public() *babyjub.PublicKey
+	SignPoseidon(msg *big.Int) *babyjub.Signature
+}
+
+// Storage holds the storage of each of the 3 trees of an identity
+type Storage struct {
+	Claims      merkletree.Storage
+	Revocations merkletree.Storage
+	Roots       merkletree.Storage
+}
+
+// NewMemoryStorage returns in-memory storage for the trees, which is lost when the process exits
+func NewMemoryStorage() Storage {
+	return Storage{
+		Claims:      memory.NewMemoryStorage(),
+		Revocations: memory.NewMemoryStorage(),
+		Roots:       memory.NewMemoryStorage(),
+	}
+}
+
+// Option configures an Identity
+type Option func(*Identity)
+
+// WithTreeObserver sets a function that is called after every addition to one of the trees, with the name
+// of the tree ("claims", "revocations" or "roots") and the time the addition took
+func WithTreeObserver(observe func(tree string, elapsed time.Duration)) Option {
+	return func(i *Identity) {
+		i.observe = observe
+	}
+}
+
+// WithTreeDepth sets the depth of the trees, for circuits that are compiled for another depth than 32. The
+// roots of the trees only depend on their leaves, so the ID and the states of an identity are the same at
+// any depth that its leaves fit in. The depth only changes the length of the proofs that the circuits take.
+func WithTreeDepth(levels int) Option {
+	return func(i *Identity) {
+		i.levels = levels
+	}
+}
+
+// WithAuthNonce sets the revocation nonce of the auth claim of the genesis state, which changes the genesis
+// state and so the ID of the identity
+func WithAuthNonce(nonce uint64) Option {
+	return func(i *Identity) {
+		i.authNonce = nonce
+	}
+}
+
+// Identity is an issuer identity. An iden3 state is made up of 3 parts:
+//   - a claims tree. This is a sparse merkle tree where each claim is uniquely identified with a key
+//   - a revocation tree. This captures whether a claim, identified by its revocation nonce, has been revoked
+//   - a roots tree. This captures the historical progression of the merkle tree root of the claims tree
+type Identity struct {
+	// ID is derived from the genesis state
+	ID *core.ID
+	// AuthClaim holds the public key of the signer
+	AuthClaim *core.Claim
+	// GenesisState is the state with only the auth claim in the claims tree
+	GenesisState *merkletree.Hash
+
+	signer Signer
+	// mux serializes the changes to the trees and the published state, while reads of them run concurrently.
+	// The trees returned by ClaimsTree, RevocationsTree and RootsTree are not covered by it.
+	mux         sync.RWMutex
+	claims      *merkletree.MerkleTree
+	revocations *merkletree.MerkleTree
+	roots       *merkletree.MerkleTree
+	observe     func(tree string, elapsed time.Duration)
+	onChange    []func()
+	levels      int
+	authNonce   uint64
+	// imported is set for an identity taken over from a snapshot, whose auth claim may have been added
+	// after its genesis state
+	imported bool
+
+	// the published state that the next state transition starts from, and the proofs for the auth claim in it
+	oldTreeState      circuits.TreeState
+	authMTProof       *merkletree.Proof
+	authNonRevMTProof *merkletree.Proof
+	// the transactions that published the states, by the decimal state
+	publications map[string]Publication
+	// the published states whose publication added their claims root to the roots tree, by the decimal state
+	addedRoots map[string]bool
+	// the genesis state followed by the published states, in the order they were published, with the changes
+	// that each of them covers
+	publishedTreeStates []circuits.TreeState
+	covered             []Changes
+	// the changes since the published state, that the next state transition covers
+	pending Changes
+}
+
+// Publication is the transaction that published a state to the state contract, and the block it was
+// included in. The block hash tells whether the block is still on the canonical chain.
+type Publication struct {
+	TxHash      string
+	BlockNumber uint64
+	BlockHash   string
+}
+
+// IssuedClaim is a claim added to the claims tree, with the states of the identity before and after it
+type IssuedClaim struct {
+	Claim    *core.Claim
+	OldState *merkletree.Hash
+	NewState *merkletree.Hash
+}
+
+// New creates an identity with a genesis state:
+//   - issue an auth claim based on the public key and revocation nonce, this will determine the identity's ID
+//   - add the auth claim to the claims tree
+//   - snapshot the genesis state, as the old state of the first state transition
+//   - add the claims tree root at this point in time to the roots tree
+func New(ctx context.Context, storage Storage, signer Signer, options ...Option) (*Identity, error) {
+	i := &Identity{signer: signer, publications: map[string]Publication{}, addedRoots: map[string]bool{}, levels: mtLevels, authNonce: AuthRevocationNonce}
+	for _, option := range options {
+		option(i)
+	}
+	if i.levels < 1 || i.levels > MaxTreeDepth {
+		return nil, fmt.Errorf("the depth of the trees must be between 1 and %d, got %d", MaxTreeDepth, i.levels)
+	}
+
+	if err := i.newTrees(ctx, storage); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if i.AuthClaim, err = newAuthClaim(signer.Public(), i.authNonce); err != nil {
+		return nil, err
+	}
+	hIndex, hValue, err := i.AuthClaim.HiHv()
+	if err != nil {
+		return nil, err
+	}
+	if err := i.add(ctx, "claims", i.claims, hIndex, hValue); err != nil {
+		return nil, err
+	}
+
+	if i.GenesisState, err = i.State(); err != nil {
+		return nil, err
+	}
+	if i.ID, err = core.IdGenesisFromIdenState(core.TypeDefault, i.GenesisState.BigInt()); err != nil {
+		return nil, err
+	}
+
+	if i.authMTProof, _, err = i.claims.GenerateProof(ctx, hIndex, i.claims.Root()); err != nil {
+		return nil, err
+	}
+	if i.authNonRevMTProof, _, err = i.revocations.GenerateProof(ctx, new(big.Int).SetUint64(i.authNonce), i.revocations.Root()); err != nil {
+		return nil, err
+	}
+	i.oldTreeState = circuits.TreeState{
+		State:          i.GenesisState,
+		ClaimsRoot:     i.claims.Root(),
+		RevocationRoot: i.revocations.Root(),
+		RootOfRoots:    i.roots.Root(),
+	}
+	i.publishedTreeStates = []circuits.TreeState{i.oldTreeState}
+	i.covered = []Changes{{Claims: []*core.Claim{i.AuthClaim}}}
+
+	// before updating the claims tree, add the claims tree root at this point to the roots tree
+	if err := i.add(ctx, "roots", i.roots, i.claims.Root().BigInt(), big.NewInt(0)); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// newTrees creates the 3 trees in the storage, at the depth of the identity
+func (i *Identity) newTrees(ctx context.Context, storage Storage) error {
+	var err error
+	if i.claims, err = merkletree.NewMerkleTree(ctx, storage.Claims, i.levels); err != nil {
+		return err
+	}
+	if i.revocations, err = merkletree.NewMerkleTree(ctx, storage.Revocations, i.levels); err != nil {
+		return err
+	}
+	i.roots, err = merkletree.NewMerkleTree(ctx, storage.Roots, i.levels)
+	return err
+}
+
+// An auth claim includes the X and Y curve coordinates of the public key, along with the revocation nonce
+func newAuthClaim(pubKey *babyjub.PublicKey, nonce uint64) (*core.Claim, error) {
+	authSchemaHash, _ := core.NewSchemaHashFromHex(AuthSchemaHash)
+	return core.NewClaim(authSchemaHash, core.WithIndexDataInts(pubKey.X, pubKey.Y), core.WithRevocationNonce(nonce))
+}
+
+// AuthClaimKey returns the public key that an auth claim holds, and fails for a claim that is not an auth claim
+func AuthClaimKey(authClaim *core.Claim) (*babyjub.PublicKey, error) {
+	if sHash, _ := authClaim.GetSchemaHash().MarshalText(); string(sHash) != AuthSchemaHash {
+		return nil, fmt.Errorf("the claim of schema hash %s is not an auth claim", sHash)
+	}
+	slots := authClaim.RawSlotsAsInts()
+	return &babyjub.PublicKey{X: slots[2], Y: slots[3]}, nil
+}
+
+func (i *Identity) add(ctx context.Context, name string, tree *merkletree.MerkleTree, k, v *big.Int) error {
+	start := time.Now()
+	if err := tree.Add(ctx, k, v); err != nil {
+		return err
+	}
+	if i.observe != nil {
+		i.observe(name, time.Since(start))
+	}
+	return nil
+}
+
+// ClaimsTree returns the claims tree. Reading it directly is not synchronized with the changes to the
+// identity.
+func (i *Identity) ClaimsTree() *merkletree.MerkleTree {
+	return i.claims
+}
+
+// RevocationsTree returns the revocation tree
+func (i *Identity) RevocationsTree() *merkletree.MerkleTree {
+	return i.revocations
+}
+
+// RootsTree returns the roots tree
+func (i *Identity) RootsTree() *merkletree.MerkleTree {
+	return i.roots
+}
+
+// State returns the current state, which is the hash of the roots of the 3 trees
+func (i *Identity) State() (*merkletree.Hash, error) {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.state()
+}
+
+func (i *Identity) state() (*merkletree.Hash, error) {
+	return merkletree.HashElems(i.claims.Root().BigInt(), i.revocations.Root().BigInt(), i.roots.Root().BigInt())
+}
+
+// IssueClaim adds a claim to the claims tree, keyed by the hash of its index slots
+func (i *Identity) IssueClaim(ctx context.Context, claim *core.Claim) (*IssuedClaim, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	oldState, err := i.state()
+	if err != nil {
+		return nil, err
+	}
+	hIndex, hValue, err := claim.HiHv()
+	if err != nil {
+		return nil, err
+	}
+	if err := i.add(ctx, "claims", i.claims, hIndex, hValue); err != nil {
+		return nil, err
+	}
+	i.pending.Claims = append(i.pending.Claims, claim)
+	newState, err := i.state()
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedClaim{Claim: claim, OldState: oldState, NewState: newState}, nil
+}
+
+// addErased adds the leaf of an erased claim to the claims tree, for an identity that is rebuilt from its
+// history
+func (i *Identity) addErased(ctx context.Context, e ErasedClaim) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	if err := i.add(ctx, "claims", i.claims, e.HIndex, e.HValue); err != nil {
+		return err
+	}
+	i.pending.Erased = append(i.pending.Erased, e)
+	return nil
+}
+
+// Revoke adds a revocation nonce to the revocation tree, which revokes every claim that carries it
+func (i *Identity) Revoke(ctx context.Context, revNonce uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mux.Lock()
+	err := i.add(ctx, "revocations", i.revocations, new(big.Int).SetUint64(revNonce), big.NewInt(0))
+	if err == nil {
+		i.pending.Revocations = append(i.pending.Revocations, revNonce)
+	}
+	i.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	i.changed()
+	return nil
+}
+
+// RevocationStatus returns whether a revocation nonce is revoked, with the proof of its inclusion or
+// exclusion in the current revocation tree
+func (i *Identity) RevocationStatus(ctx context.Context, revNonce uint64) (bool, *merkletree.Proof, error) {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.revocationStatus(ctx, revNonce)
+}
+
+func (i *Identity) revocationStatus(ctx context.Context, revNonce uint64) (bool, *merkletree.Proof, error) {
+	proof, _, err := i.revocations.GenerateProof(ctx, new(big.Int).SetUint64(revNonce), i.revocations.Root())
+	if err != nil {
+		return false, nil, err
+	}
+	return proof.Existence, proof, nil
+}
+
+// StatePublished records that the current state was published to the state contract by a transaction. The
+// next state transition starts from this state, and the changes since the previous published state are
+// recorded as covered by it. The claims root of the state is added to the roots tree, unless it is there
+// already, so that the states after it can prove that the claims tree had that root.
+func (i *Identity) StatePublished(ctx context.Context, publication Publication) error {
+	changed, err := i.statePublished(ctx, publication)
+	if changed {
+		i.changed()
+	}
+	return err
+}
+
+func (i *Identity) statePublished(ctx context.Context, publication Publication) (bool, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	treeState, err := i.treeState()
+	if err != nil {
+		return false, err
+	}
+	changed := !treeState.State.Equals(i.oldTreeState.State)
+	if changed {
+		if err := i.setOldTreeState(ctx, treeState); err != nil {
+			return false, err
+		}
+		i.publishedTreeStates = append(i.publishedTreeStates, treeState)
+		i.covered = append(i.covered, i.pending)
+		i.pending = Changes{}
+		proof, _, err := i.roots.GenerateProof(ctx, treeState.ClaimsRoot.BigInt(), i.roots.Root())
+		if err != nil {
+			return true, err
+		}
+		if !proof.Existence {
+			if err := i.add(ctx, "roots", i.roots, treeState.ClaimsRoot.BigInt(), big.NewInt(0)); err != nil {
+				return true, err
+			}
+			i.addedRoots[treeState.State.BigInt().String()] = true
+		}
+	}
+	i.publications[treeState.State.BigInt().String()] = publication
+	return changed, nil
+}
+
+// PublicationReverted records that the transaction that published the state was reorganized out of the
+// chain, so the state is no longer on-chain. Only the last published state can be reverted, as the
+// transitions after a state depend on it. The next state transition starts from the state published
+// before it again, or from the genesis state, so that the transition can be submitted again.
+func (i *Identity) PublicationReverted(ctx context.Context, state *merkletree.Hash) error {
+	if err := i.publicationReverted(ctx, state); err != nil {
+		return err
+	}
+	i.changed()
+	return nil
+}
+
+func (i *Identity) publicationReverted(ctx context.Context, state *merkletree.Hash) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	last := len(i.publishedTreeStates) - 1
+	if last == 0 || !i.publishedTreeStates[last].State.Equals(state) {
+		return fmt.Errorf("the state %s is not the last published state", state.BigInt())
+	}
+	// the claims root that the publication added to the roots tree is taken out again
+	if i.addedRoots[state.BigInt().String()] {
+		if err := i.roots.Delete(ctx, i.publishedTreeStates[last].ClaimsRoot.BigInt()); err != nil {
+			return err
+		}
+		delete(i.addedRoots, state.BigInt().String())
+	}
+	if err := i.setOldTreeState(ctx, i.publishedTreeStates[last-1]); err != nil {
+		return err
+	}
+	i.publishedTreeStates = i.publishedTreeStates[:last]
+	// the changes of the reverted state are covered by the next transition again
+	i.pending = Changes{
+		Claims:      append(i.covered[last].Claims, i.pending.Claims...),
+		Erased:      append(i.covered[last].Erased, i.pending.Erased...),
+		Revocations: append(i.covered[last].Revocations, i.pending.Revocations...),
+	}
+	i.covered = i.covered[:last]
+	delete(i.publications, state.BigInt().String())
+	return nil
+}
+
+// OnRevocationsChanged registers a function that is called after a revocation, and after a state transition
+// changes the published state, which is when the revocation status of a nonce at the published state can
+// change. Caches of revocation statuses use it to drop their entries. The function is called after the
+// change is complete, outside of the lock of the identity, so it may read the identity.
+func (i *Identity) OnRevocationsChanged(fn func()) {
+	i.onChange = append(i.onChange, fn)
+}
+
+func (i *Identity) changed() {
+	for _, fn := range i.onChange {
+		fn()
+	}
+}
+
+// setOldTreeState sets the state that the next state transition starts from, with the proofs of the auth
+// claim in it
+func (i *Identity) setOldTreeState(ctx context.Context, treeState circuits.TreeState) error {
+	hIndex, err := i.AuthClaim.HIndex()
+	if err != nil {
+		return err
+	}
+	authMTProof, _, err := i.claims.GenerateProof(ctx, hIndex, treeState.ClaimsRoot)
+	if err != nil {
+		return err
+	}
+	authNonRevMTProof, _, err := i.revocations.GenerateProof(ctx, new(big.Int).SetUint64(i.AuthClaim.GetRevocationNonce()), treeState.RevocationRoot)
+	if err != nil {
+		return err
+	}
+	i.oldTreeState = treeState
+	i.authMTProof = authMTProof
+	i.authNonRevMTProof = authNonRevMTProof
+	return nil
+}
+
+// CheckSigner checks that the signer holds the key of the identity: the identity's auth claim holds its
+// public key, is in the claims tree and not revoked, and its genesis state derives the identity's ID. The
+// errors wrap ErrKeyMismatch.
+func (i *Identity) CheckSigner(ctx context.Context) error {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.checkSigner(ctx)
+}
+
+func (i *Identity) checkSigner(ctx context.Context) error {
+	pubKey := i.signer.Public()
+	authClaim := i.AuthClaim
+	authKey, err := AuthClaimKey(authClaim)
+	if err != nil {
+		return err
+	}
+	if authKey.X.Cmp(pubKey.X) != 0 || authKey.Y.Cmp(pubKey.Y) != 0 {
+		return fmt.Errorf("%w: the auth claim of the identity holds the public key %s, not %s", ErrKeyMismatch, authKey, pubKey)
+	}
+	hIndex, hValue, err := authClaim.HiHv()
+	if err != nil {
+		return err
+	}
+	proof, _, err := i.claims.GenerateProof(ctx, hIndex, i.claims.Root())
+	if err != nil {
+		return err
+	}
+	if !proof.Existence || !merkletree.VerifyProof(i.claims.Root(), proof, hIndex, hValue) {
+		return fmt.Errorf("%w: the auth claim of the public key %s is not in the claims tree", ErrKeyMismatch, pubKey)
+	}
+	revoked, _, err := i.revocationStatus(ctx, authClaim.GetRevocationNonce())
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return fmt.Errorf("%w: the auth claim of the public key %s is revoked", ErrKeyMismatch, pubKey)
+	}
+	if i.imported {
+		// the key of an imported identity may have been added after the genesis state, which Import
+		// checked that the ID derives from
+		return nil
+	}
+	genesis, err := GenesisOf(ctx, authClaim)
+	if err != nil {
+		return err
+	}
+	if genesis.ID.String() != i.ID.String() {
+		return fmt.Errorf("%w: the public key %s derives the ID %s, not %s", ErrKeyMismatch, pubKey, genesis.ID, i.ID)
+	}
+	return nil
+}
+
+// StateTransition builds the inputs of the state transition circuit from the published state to the
+// current state. The signer signs the Poseidon hash of the old and new states, after CheckSigner.
+func (i *Identity) StateTransition(ctx context.Context) (*circuits.StateTransitionInputs, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	if err := i.checkSigner(ctx); err != nil {
+		return nil, err
+	}
+	newState, err := i.state()
+	if err != nil {
+		return nil, err
+	}
+	hashOldAndNewState, err := poseidon.Hash([]*big.Int{i.oldTreeState.State.BigInt(), newState.BigInt()})
+	if err != nil {
+		return nil, err
+	}
+	return &circuits.StateTransitionInputs{
+		BaseConfig:        circuits.BaseConfig{MTLevel: i.levels},
+		ID:                i.ID,
+		OldTreeState:      i.oldTreeState,
+		NewState:          newState,
+		IsOldStateGenesis: i.oldTreeState.State.Equals(i.GenesisState),
+		AuthClaim: circuits.Claim{
+			Claim: i.AuthClaim,
+			Proof: i.authMTProof,
+			NonRevProof: &circuits.ClaimNonRevStatus{
+				Proof: i.authNonRevMTProof,
+			},
+		},
+		Signature: i.signer.SignPoseidon(hashOldAndNewState),
+	}, nil
+}
+
+// StateTransitionInputs returns the inputs of the state transition circuit as the JSON that the proof
+// generation takes
+func (i *Identity) StateTransitionInputs(ctx context.Context) ([]byte, error) {
+	inputs, err := i.StateTransition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b, err := inputs.InputsMarshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the state transition inputs: %s", err)
+	}
+	return b, nil
+}
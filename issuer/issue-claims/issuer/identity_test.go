@@ -0,0 +1,436 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+func testKey(b byte) *babyjub.PrivateKey {
+	var key babyjub.PrivateKey
+	key[0] = b
+	return &key
+}
+
+func testIdentity(t *testing.T, options ...Option) *Identity {
+	identity, err := New(context.Background(), NewMemoryStorage(), testKey(1), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func testClaim(t *testing.T, revNonce uint64) *core.Claim {
+	claim, err := core.NewClaim(core.NewSchemaHashFromInt(big.NewInt(42)), core.WithRevocationNonce(revNonce), core.WithIndexDataInts(big.NewInt(int64(revNonce)), big.NewInt(7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claim
+}
+
+// inTree tells whether the claim is in the tree at its current root
+func inTree(t *testing.T, tree *merkletree.MerkleTree, claim *core.Claim) bool {
+	hIndex, hValue, err := claim.HiHv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, _, err := tree.GenerateProof(context.Background(), hIndex, tree.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof.Existence && merkletree.VerifyProof(tree.Root(), proof, hIndex, hValue)
+}
+
+func TestNew(t *testing.T) {
+	identity := testIdentity(t)
+	if !inTree(t, identity.ClaimsTree(), identity.AuthClaim) {
+		t.Errorf("expected the auth claim in the claims tree")
+	}
+	if identity.AuthClaim.GetRevocationNonce() != AuthRevocationNonce {
+		t.Errorf("expected the auth nonce %d, got %d", AuthRevocationNonce, identity.AuthClaim.GetRevocationNonce())
+	}
+	id, err := core.IdGenesisFromIdenState(core.TypeDefault, identity.GenesisState.BigInt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.Equal(identity.ID) {
+		t.Errorf("expected the ID %s of the genesis state, got %s", id, identity.ID)
+	}
+	if identity.PublishedState() != nil {
+		t.Errorf("expected no published state before the first publication")
+	}
+	if err := identity.CheckSigner(context.Background()); err != nil {
+		t.Errorf("expected the signer to hold the key of the identity: %s", err)
+	}
+
+	// the ID derives from the key
+	if same := testIdentity(t); !same.ID.Equal(identity.ID) {
+		t.Errorf("expected the same key to derive the same ID, got %s and %s", identity.ID, same.ID)
+	}
+	if _, err := New(context.Background(), NewMemoryStorage(), testKey(1), WithTreeDepth(MaxTreeDepth+1)); err == nil {
+		t.Errorf("expected a tree depth over %d to be refused", MaxTreeDepth)
+	}
+}
+
+func TestIssueClaim(t *testing.T) {
+	ctx := context.Background()
+	identity := testIdentity(t)
+	before, err := identity.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim := testClaim(t, 2)
+	issued, err := identity.IssueClaim(ctx, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := identity.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issued.OldState.Equals(before) || !issued.NewState.Equals(after) || before.Equals(after) {
+		t.Errorf("expected the claim to move the state from %s to %s, got %s to %s", before.BigInt(), after.BigInt(), issued.OldState.BigInt(), issued.NewState.BigInt())
+	}
+	if !inTree(t, identity.ClaimsTree(), claim) {
+		t.Errorf("expected the claim in the claims tree")
+	}
+	expected, err := merkletree.HashElems(identity.ClaimsTree().Root().BigInt(), identity.RevocationsTree().Root().BigInt(), identity.RootsTree().Root().BigInt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.Equals(expected) {
+		t.Errorf("expected the state to hash the roots of the 3 trees")
+	}
+	if pending := identity.PendingChanges(); len(pending.Claims) != 1 || pending.Claims[0] != claim {
+		t.Errorf("expected the claim to be pending, got %v", pending.Claims)
+	}
+	if _, err := identity.IssueClaim(ctx, claim); err == nil {
+		t.Errorf("expected the same claim to be refused the second time")
+	}
+	if len(identity.PendingChanges().Claims) != 1 {
+		t.Errorf("expected the refused claim not to be pending")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	identity := testIdentity(t)
+	changed := 0
+	identity.OnRevocationsChanged(func() { changed++ })
+	if revoked, _, err := identity.RevocationStatus(ctx, 2); err != nil || revoked {
+		t.Fatalf("expected the nonce 2 not to be revoked, got %t (%v)", revoked, err)
+	}
+	if err := identity.Revoke(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	revoked, proof, err := identity.RevocationStatus(ctx, 2)
+	if err != nil || !revoked {
+		t.Fatalf("expected the nonce 2 to be revoked, got %t (%v)", revoked, err)
+	}
+	if !merkletree.VerifyProof(identity.RevocationsTree().Root(), proof, big.NewInt(2), big.NewInt(0)) {
+		t.Errorf("expected the proof of the revocation to verify")
+	}
+	if changed != 1 {
+		t.Errorf("expected the revocation to be notified once, got %d", changed)
+	}
+	if pending := identity.PendingChanges(); len(pending.Revocations) != 1 || pending.Revocations[0] != 2 {
+		t.Errorf("expected the revocation to be pending, got %v", pending.Revocations)
+	}
+	if err := identity.Revoke(ctx, 2); err == nil {
+		t.Errorf("expected the nonce to be revoked only once")
+	}
+	if revoked, _, _ := identity.RevocationStatus(ctx, 3); revoked {
+		t.Errorf("expected the nonce 3 not to be revoked")
+	}
+}
+
+func TestStateTransitionInputs(t *testing.T) {
+	ctx := context.Background()
+	identity := testIdentity(t)
+	if _, err := identity.IssueClaim(ctx, testClaim(t, 2)); err != nil {
+		t.Fatal(err)
+	}
+	inputs, err := identity.StateTransition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newState, _ := identity.State()
+	if !inputs.OldTreeState.State.Equals(identity.GenesisState) || !inputs.IsOldStateGenesis || !inputs.NewState.Equals(newState) {
+		t.Errorf("expected the transition from the genesis state to the current state")
+	}
+	hash, err := poseidon.Hash([]*big.Int{identity.GenesisState.BigInt(), newState.BigInt()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testKey(1).Public().VerifyPoseidon(hash, inputs.Signature) {
+		t.Errorf("expected the signature of the old and new states by the key")
+	}
+
+	b, err := identity.StateTransitionInputs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["userID"] != identity.ID.BigInt().String() || fields["oldUserState"] != identity.GenesisState.BigInt().String() || fields["newUserState"] != newState.BigInt().String() || fields["isOldStateGenesis"] != "1" {
+		t.Errorf("unexpected inputs of the transition from the genesis state: %s", b)
+	}
+
+	// once published, the next transition starts from the published state
+	if err := identity.StatePublished(ctx, Publication{TxHash: "0x01"}); err != nil {
+		t.Fatal(err)
+	}
+	if !identity.PendingChanges().Empty() {
+		t.Errorf("expected no pending changes after the publication")
+	}
+	if published := identity.PublishedState(); published == nil || !published.Equals(newState) {
+		t.Errorf("expected the published state %s", newState.BigInt())
+	}
+	if err := identity.Revoke(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	next, err := identity.StateTransition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.OldTreeState.State.Equals(newState) || next.IsOldStateGenesis {
+		t.Errorf("expected the next transition from the published state %s, got %s", newState.BigInt(), next.OldTreeState.State.BigInt())
+	}
+	if !inTree(t, identity.ClaimsTree(), identity.AuthClaim) {
+		t.Errorf("expected the auth claim in the claims tree")
+	}
+}
+
+func TestPublicationAddsTheClaimsRootToTheRootsTree(t *testing.T) {
+	ctx := context.Background()
+	identity := testIdentity(t)
+	if _, err := identity.IssueClaim(ctx, testClaim(t, 2)); err != nil {
+		t.Fatal(err)
+	}
+	published, err := identity.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsRoot, rootsRoot := identity.ClaimsTree().Root(), identity.RootsTree().Root()
+	if err := identity.StatePublished(ctx, Publication{TxHash: "0x01"}); err != nil {
+		t.Fatal(err)
+	}
+	proof, _, err := identity.RootsTree().GenerateProof(ctx, claimsRoot.BigInt(), identity.RootsTree().Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proof.Existence {
+		t.Errorf("expected the claims root of the published state in the roots tree")
+	}
+	if state, _ := identity.State(); state.Equals(published) || !identity.PublishedState().Equals(published) {
+		t.Errorf("expected the state to move on from the published state %s with the roots tree", published.BigInt())
+	}
+
+	// a revocation leaves the claims root as it is, so its publication adds nothing
+	if err := identity.Revoke(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	withRoot := identity.RootsTree().Root()
+	if err := identity.StatePublished(ctx, Publication{TxHash: "0x02"}); err != nil {
+		t.Fatal(err)
+	}
+	if !identity.RootsTree().Root().Equals(withRoot) {
+		t.Errorf("expected the roots tree to keep its root when the claims root is in it already")
+	}
+
+	// the reverted publication of the claims takes the claims root out again
+	last, _ := identity.State()
+	if err := identity.PublicationReverted(ctx, identity.PublishedState()); err != nil {
+		t.Fatal(err)
+	}
+	if err := identity.PublicationReverted(ctx, published); err != nil {
+		t.Fatal(err)
+	}
+	if !identity.RootsTree().Root().Equals(rootsRoot) {
+		t.Errorf("expected the roots tree to be back at its root before the publication")
+	}
+	if state, _ := identity.State(); state.Equals(last) {
+		t.Errorf("expected the state to change with the reverted publications")
+	}
+}
+
+func TestCheckSignerRefusesRevokedKey(t *testing.T) {
+	ctx := context.Background()
+	identity := testIdentity(t)
+	if err := identity.Revoke(ctx, identity.AuthClaim.GetRevocationNonce()); err != nil {
+		t.Fatal(err)
+	}
+	if err := identity.CheckSigner(ctx); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected the revoked key to be refused, got %v", err)
+	}
+	if _, err := identity.StateTransition(ctx); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected no state transition signed by the revoked key, got %v", err)
+	}
+}
+
+func TestConcurrentIssuance(t *testing.T) {
+	ctx := context.Background()
+	identity := testIdentity(t)
+	const claims = 100
+	issued := make([]*core.Claim, claims)
+	for n := range issued {
+		issued[n] = testClaim(t, uint64(n+2))
+	}
+
+	// the claims are issued concurrently with reads of the statuses and credentials, and with revocations
+	// and publications between them
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*claims)
+	for n, claim := range issued {
+		wg.Add(3)
+		go func(claim *core.Claim) {
+			defer wg.Done()
+			if _, err := identity.IssueClaim(ctx, claim); err != nil {
+				errs <- err
+			}
+		}(claim)
+		go func(n int) {
+			defer wg.Done()
+			treeState, proof, err := identity.PublishedRevocationStatus(ctx, uint64(n+2))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !merkletree.VerifyProof(treeState.RevocationRoot, proof, big.NewInt(int64(n+2)), big.NewInt(0)) {
+				errs <- errors.New("the proof of the revocation status doesn't verify against its published root")
+			}
+			if _, err := identity.Credential(ctx, identity.AuthClaim); err != nil {
+				errs <- err
+			}
+		}(n)
+		go func(n int) {
+			defer wg.Done()
+			if n%10 != 0 {
+				return
+			}
+			if err := identity.Revoke(ctx, uint64(1000+n)); err != nil {
+				errs <- err
+				return
+			}
+			if err := identity.StatePublished(ctx, Publication{TxHash: "0x01"}); err != nil {
+				errs <- err
+			}
+		}(n)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, claim := range issued {
+		if !inTree(t, identity.ClaimsTree(), claim) {
+			t.Errorf("expected the claim of the nonce %d in the claims tree", claim.GetRevocationNonce())
+		}
+	}
+	for n := 0; n < claims; n += 10 {
+		if revoked, _, err := identity.RevocationStatus(ctx, uint64(1000+n)); err != nil || !revoked {
+			t.Errorf("expected the nonce %d to be revoked, got %t (%v)", 1000+n, revoked, err)
+		}
+	}
+	state, err := identity.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := merkletree.HashElems(identity.ClaimsTree().Root().BigInt(), identity.RevocationsTree().Root().BigInt(), identity.RootsTree().Root().BigInt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Equals(expected) {
+		t.Errorf("expected the state to hash the roots of the 3 trees")
+	}
+}
+
+func TestSameClaimsGiveTheSameRoot(t *testing.T) {
+	ctx := context.Background()
+	batch := make([]*core.Claim, 20)
+	for n := range batch {
+		batch[n] = testClaim(t, uint64(n+2))
+	}
+	first, second, reversed := testIdentity(t), testIdentity(t), testIdentity(t)
+	for n := range batch {
+		for _, issue := range []struct {
+			identity *Identity
+			claim    *core.Claim
+		}{{first, batch[n]}, {second, batch[n]}, {reversed, batch[len(batch)-1-n]}} {
+			if _, err := issue.identity.IssueClaim(ctx, issue.claim); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the root of the sparse merkle tree only depends on the claims in it
+	root := first.ClaimsTree().Root()
+	if !second.ClaimsTree().Root().Equals(root) {
+		t.Errorf("expected the same batch to give the claims root %s twice, got %s", root.BigInt(), second.ClaimsTree().Root().BigInt())
+	}
+	if !reversed.ClaimsTree().Root().Equals(root) {
+		t.Errorf("expected the batch in the reverse order to give the claims root %s, got %s", root.BigInt(), reversed.ClaimsTree().Root().BigInt())
+	}
+}
+
+func TestTreeDepthKeepsTheState(t *testing.T) {
+	ctx := context.Background()
+	identity, deeper := testIdentity(t), testIdentity(t, WithTreeDepth(40))
+	for _, i := range []*Identity{identity, deeper} {
+		if _, err := i.IssueClaim(ctx, testClaim(t, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !deeper.ID.Equal(identity.ID) {
+		t.Errorf("expected the depth of the trees to keep the ID %s, got %s", identity.ID, deeper.ID)
+	}
+	state, _ := identity.State()
+	deeperState, _ := deeper.State()
+	if !deeperState.Equals(state) {
+		t.Errorf("expected the depth of the trees to keep the state %s, got %s", state.BigInt(), deeperState.BigInt())
+	}
+	inputs, err := deeper.StateTransition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs.AuthClaim.Proof.AllSiblings()) > 40 {
+		t.Errorf("expected the proof of the auth claim in a tree of depth 40")
+	}
+	b, err := deeper.StateTransitionInputs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if siblings, _ := fields["authClaimMtp"].([]interface{}); len(siblings) != 40 {
+		t.Errorf("expected the proof of the auth claim padded to 40 siblings, got %d", len(siblings))
+	}
+}
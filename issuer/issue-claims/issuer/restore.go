@@ -0,0 +1,152 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuer
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+// Snapshot is the content of the trees of an identity at a published state, such as one exported by another
+// iden3 implementation
+type Snapshot struct {
+	ID *core.ID
+	// GenesisState is the state that the ID derives from
+	GenesisState *merkletree.Hash
+	// AuthClaim is the auth claim of the signer's key, which must be among the claims
+	AuthClaim *core.Claim
+	Claims    []*core.Claim
+	// Erased are the claims of the snapshot whose data was erased since it was imported
+	Erased      []ErasedClaim
+	Revocations []uint64
+	// Roots are the claims roots in the roots tree
+	Roots       []*merkletree.Hash
+	Publication Publication
+}
+
+// Import creates an identity from a snapshot of its trees. The ID must derive from the genesis state of the
+// snapshot, and the signer must hold the key of its auth claim. The state of the snapshot is the published
+// state that the next state transition starts from.
+func Import(ctx context.Context, storage Storage, signer Signer, snapshot Snapshot, options ...Option) (*Identity, error) {
+	i := &Identity{signer: signer, publications: map[string]Publication{}, addedRoots: map[string]bool{}, levels: mtLevels, imported: true}
+	for _, option := range options {
+		option(i)
+	}
+	if i.levels < 1 || i.levels > MaxTreeDepth {
+		return nil, fmt.Errorf("the depth of the trees must be between 1 and %d, got %d", MaxTreeDepth, i.levels)
+	}
+	if snapshot.ID == nil || snapshot.GenesisState == nil || snapshot.AuthClaim == nil {
+		return nil, fmt.Errorf("the snapshot must have the ID, the genesis state and the auth claim of the identity")
+	}
+	genesisID, err := core.IdGenesisFromIdenState([2]byte{snapshot.ID[0], snapshot.ID[1]}, snapshot.GenesisState.BigInt())
+	if err != nil {
+		return nil, err
+	}
+	if !genesisID.Equal(snapshot.ID) {
+		return nil, fmt.Errorf("the ID %s doesn't derive from the genesis state %s", snapshot.ID, snapshot.GenesisState.BigInt())
+	}
+	i.ID, i.AuthClaim, i.GenesisState, i.authNonce = snapshot.ID, snapshot.AuthClaim, snapshot.GenesisState, snapshot.AuthClaim.GetRevocationNonce()
+
+	if err := i.newTrees(ctx, storage); err != nil {
+		return nil, err
+	}
+	for _, claim := range snapshot.Claims {
+		hIndex, hValue, err := claim.HiHv()
+		if err != nil {
+			return nil, err
+		}
+		if err := i.add(ctx, "claims", i.claims, hIndex, hValue); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range snapshot.Erased {
+		if err := i.add(ctx, "claims", i.claims, e.HIndex, e.HValue); err != nil {
+			return nil, err
+		}
+	}
+	for _, revNonce := range snapshot.Revocations {
+		if err := i.add(ctx, "revocations", i.revocations, new(big.Int).SetUint64(revNonce), big.NewInt(0)); err != nil {
+			return nil, err
+		}
+	}
+	for _, root := range snapshot.Roots {
+		if err := i.add(ctx, "roots", i.roots, root.BigInt(), big.NewInt(0)); err != nil {
+			return nil, err
+		}
+	}
+	if err := i.checkSigner(ctx); err != nil {
+		return nil, err
+	}
+
+	treeState, err := i.treeState()
+	if err != nil {
+		return nil, err
+	}
+	if err := i.setOldTreeState(ctx, treeState); err != nil {
+		return nil, err
+	}
+	i.publishedTreeStates = []circuits.TreeState{treeState}
+	i.covered = []Changes{Changes{Claims: snapshot.Claims, Erased: snapshot.Erased, Revocations: snapshot.Revocations}.copy()}
+	i.publications[treeState.State.BigInt().String()] = snapshot.Publication
+	return i, nil
+}
+
+// Replay applies the transitions that were published since the state the identity is at, and then the
+// pending changes, to restore an identity from its history. The state of each transition must be the state
+// that its changes make up.
+func (i *Identity) Replay(ctx context.Context, transitions []PublishedTransition, pending Changes) error {
+	for n, t := range transitions {
+		if err := i.apply(ctx, t.Changes); err != nil {
+			return err
+		}
+		state, err := i.State()
+		if err != nil {
+			return err
+		}
+		if t.TreeState.State != nil && !state.Equals(t.TreeState.State) {
+			return fmt.Errorf("the changes of the published transition %d make up the state %s, not %s", n+1, state.BigInt(), t.TreeState.State.BigInt())
+		}
+		if err := i.StatePublished(ctx, t.Publication); err != nil {
+			return err
+		}
+	}
+	return i.apply(ctx, pending)
+}
+
+func (i *Identity) apply(ctx context.Context, changes Changes) error {
+	for _, claim := range changes.Claims {
+		if _, err := i.IssueClaim(ctx, claim); err != nil {
+			return err
+		}
+	}
+	for _, e := range changes.Erased {
+		if err := i.addErased(ctx, e); err != nil {
+			return err
+		}
+	}
+	for _, revNonce := range changes.Revocations {
+		if err := i.Revoke(ctx, revNonce); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testSeed         = "000102030405060708090a0b0c0d0e0f"
+	testIssuanceTime = "2022-06-10T15:04:05Z"
+	testHolderID     = "11AKuMMuuWfTgHCGbVjVi41SyjHbGiz3TuFQxsgPKh"
+)
+
+// testHome points the home directory, where the registries and the outputs go by default, to a
+// directory of the test
+func testHome(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	return home
+}
+
+// captureOutput runs f and returns what it printed to stdout
+func captureOutput(t *testing.T, f func()) string {
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	saved := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = saved }()
+	f()
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	printed, _ := io.ReadAll(out)
+	return string(printed)
+}
+
+// runWalkthrough runs the issuance walkthrough with the arguments, and returns its exit code and output
+func runWalkthrough(t *testing.T, args ...string) (int, string) {
+	saved := now
+	defer func() { now = saved }()
+	var code int
+	printed := captureOutput(t, func() { code = run(args) })
+	return code, printed
+}
+
+// printedValue returns the rest of the first printed line that starts with the prefix
+func printedValue(printed, prefix string) string {
+	for _, line := range strings.Split(printed, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, prefix))
+		}
+	}
+	return ""
+}
+
+func TestRunReturnsExitCode(t *testing.T) {
+	testHome(t)
+	code, printed := runWalkthrough(t, "--self", "--holder-id", testHolderID)
+	if code != errCodeUsage.ExitCode {
+		t.Fatalf("expected the exit code %d, got %d: %s", errCodeUsage.ExitCode, code, printed)
+	}
+	if !strings.Contains(printed, "mutually exclusive") {
+		t.Errorf("expected the usage error, got: %s", printed)
+	}
+}
+
+func TestSameKeyKeepsTheID(t *testing.T) {
+	testHome(t)
+	key := strings.Repeat("02", 32)
+	var ids []string
+	for run := 0; run < 2; run++ {
+		t.Setenv(issuerKeyEnv, key)
+		code, printed := runWalkthrough(t)
+		if code != 0 {
+			t.Fatalf("run %d failed with %d: %s", run, code, printed)
+		}
+		ids = append(ids, printedValue(printed, "-> ID of the issuer identity:"))
+	}
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("expected two runs with the same key to have the same ID, got %q and %q", ids[0], ids[1])
+	}
+}
+
+func TestSameKeyKeepsTheRandomAuthNonce(t *testing.T) {
+	testHome(t)
+	key := strings.Repeat("03", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t, "--auth-nonce", "random")
+	if code != 0 {
+		t.Fatalf("the first run failed with %d: %s", code, printed)
+	}
+	first := printedValue(printed, "-> ID of the issuer identity:")
+	// the next run without --auth-nonce takes the nonce recorded for the key
+	t.Setenv(issuerKeyEnv, key)
+	code, printed = runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the second run failed with %d: %s", code, printed)
+	}
+	if !strings.Contains(printed, "-> Revocation nonce of the auth claim taken from the identity of the key") {
+		t.Errorf("expected the second run to take the recorded auth nonce, got: %s", printed)
+	}
+	if second := printedValue(printed, "-> ID of the issuer identity:"); second != first {
+		t.Errorf("expected the ID %s of the recorded auth nonce, got %s", first, second)
+	}
+}
+
+func TestNewKeyDrawsARandomAuthNonce(t *testing.T) {
+	key := strings.Repeat("04", 32)
+	var nonces []string
+	for run := 0; run < 2; run++ {
+		// a new home has no audit log, so the key is new to each run
+		testHome(t)
+		t.Setenv(issuerKeyEnv, key)
+		code, printed := runWalkthrough(t)
+		if code != 0 {
+			t.Fatalf("run %d failed with %d: %s", run, code, printed)
+		}
+		if !strings.Contains(printed, "-> Random revocation nonce drawn for the auth claim") {
+			t.Errorf("expected run %d to draw the auth nonce, got: %s", run, printed)
+		}
+		nonces = append(nonces, printedValue(printed, "      -> Revocation nonce:"))
+	}
+	if nonces[0] == "" || nonces[0] == nonces[1] {
+		t.Errorf("expected two different random auth nonces for the new key, got %q and %q", nonces[0], nonces[1])
+	}
+}
+
+func TestSeededRunsDrawTheSameNonces(t *testing.T) {
+	testHome(t)
+	args := []string{"--deterministic", "--seed", strings.Repeat("05", 16), "--issuance-time", "2026-01-02T03:04:05Z", "--nonce", "random"}
+	var runs []string
+	for run := 0; run < 2; run++ {
+		// the second run takes the auth nonce recorded by the first, and still reads it from the seed
+		code, printed := runWalkthrough(t, args...)
+		if code != 0 {
+			t.Fatalf("run %d failed with %d: %s", run, code, printed)
+		}
+		var nonces []string
+		for _, line := range strings.Split(printed, "\n") {
+			if strings.HasPrefix(line, "      -> Revocation nonce:") {
+				nonces = append(nonces, line)
+			}
+		}
+		runs = append(runs, strings.Join(nonces, "\n"))
+	}
+	if runs[0] == "" || runs[0] != runs[1] {
+		t.Errorf("expected the seeded runs to draw the same nonces, got:\n%s\nand:\n%s", runs[0], runs[1])
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The manifest lists the files that an issuance produced, so that the relations between them don't have to
+// be read from its output. It is written to the output with the files, as the last of them.
+const (
+	manifestName    = "manifest.json"
+	manifestVersion = 1
+)
+
+// The formats of the artifacts listed in a manifest, each at version 1 until its structure changes
+const (
+	formatInputs          = "state-transition-inputs"
+	formatSignature       = "payload-signature"
+	formatHolderPayload   = "holder-payload"
+	formatW3CCredentials  = "w3c-credentials"
+	formatReceipts        = "receipts"
+	artifactFormatVersion = 1
+)
+
+// toolVersion is the version of the tool that produced the artifacts, set at build time with
+// -ldflags "-X main.toolVersion=<version>"
+var toolVersion = "dev"
+
+// manifestArtifact is a file that the operation produced. The path of a file in the output is relative to
+// the manifest, the receipts file is kept elsewhere and its path is absolute.
+type manifestArtifact struct {
+	Path             string   `json:"path"`
+	SHA256           string   `json:"sha256"`
+	Format           string   `json:"format"`
+	Version          int      `json:"version"`
+	Encoding         string   `json:"encoding,omitempty"`
+	Encrypted        bool     `json:"encrypted,omitempty"`
+	RevocationNonces []uint64 `json:"revocationNonces,omitempty"`
+	State            string   `json:"state"`
+}
+
+// manifest is the versioned list of the artifacts of an operation
+type manifest struct {
+	Version     int                 `json:"version"`
+	Operation   string              `json:"operation"`
+	ToolVersion string              `json:"toolVersion"`
+	Issuer      string              `json:"issuer"`
+	OldState    string              `json:"oldState"`
+	NewState    string              `json:"newState"`
+	Created     time.Time           `json:"created"`
+	Artifacts   []*manifestArtifact `json:"artifacts"`
+
+	// dir is the directory of a manifest that was read, which the paths of its artifacts are relative to
+	dir string
+}
+
+func newManifest(operation, issuer, oldState, newState string) *manifest {
+	return &manifest{
+		Version:     manifestVersion,
+		Operation:   operation,
+		ToolVersion: toolVersion,
+		Issuer:      issuer,
+		OldState:    oldState,
+		NewState:    newState,
+		Created:     now().UTC(),
+	}
+}
+
+// add lists a file with the hash of the bytes that were written, and the revocation nonces of the claims
+// that it carries
+func (m *manifest) add(path string, data []byte, format, encoding string, nonces []uint64) *manifestArtifact {
+	h := sha256.Sum256(data)
+	// the versions of an updated claim share its nonce
+	var unique []uint64
+	seen := map[uint64]bool{}
+	for _, n := range nonces {
+		if !seen[n] {
+			seen[n] = true
+			unique = append(unique, n)
+		}
+	}
+	a := &manifestArtifact{
+		Path:             path,
+		SHA256:           hex.EncodeToString(h[:]),
+		Format:           format,
+		Version:          artifactFormatVersion,
+		Encoding:         encoding,
+		RevocationNonces: unique,
+		State:            m.NewState,
+	}
+	m.Artifacts = append(m.Artifacts, a)
+	return a
+}
+
+func (m *manifest) encode() []byte {
+	out, _ := json.MarshalIndent(m, "", "  ")
+	return append(out, '\n')
+}
+
+// readManifest reads a manifest, refusing the versions it doesn't know
+func readManifest(path string) (*manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid manifest %s: %s", path, err))
+	}
+	if m.Version != manifestVersion {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("unsupported version %d of the manifest %s", m.Version, path))
+	}
+	m.dir = filepath.Dir(path)
+	return &m, nil
+}
+
+// artifact returns the path of the artifact of a format, after checking that the file is the one the
+// manifest lists
+func (m *manifest) artifact(format string) (string, error) {
+	for _, a := range m.Artifacts {
+		if a.Format != format {
+			continue
+		}
+		if a.Version != artifactFormatVersion {
+			return "", withCode(errCodeInvalidInput, fmt.Errorf("unsupported version %d of the %s in the manifest", a.Version, format))
+		}
+		path := a.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(m.dir, path)
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return "", err
+		}
+		if sum != a.SHA256 {
+			return "", withCode(errCodeVerificationFailed, fmt.Errorf("%s hashes to %s, the manifest lists %s, the file was modified", path, sum, a.SHA256))
+		}
+		return path, nil
+	}
+	return "", withCode(errCodeNotFound, fmt.Errorf("the manifest lists no %s", format), "format", format)
+}
@@ -0,0 +1,108 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/constants"
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+// A claim of a V2 credential carries the merklized root of its credentialSubject in a data slot, instead of
+// raw values, and bits 5 to 7 of the flags byte of i_0 tell which slot. The core library of this version
+// predates the flag, so the claims are built the way the WithIndexMerklizedRoot and WithValueMerklizedRoot
+// options of later versions build them, byte for byte.
+const (
+	slotTypeMerklized = "merklized"
+
+	flagsByteIdx          = 16
+	flagMerklizedBitIdx   = 5
+	flagMerklizedBitsMask = 0b11100000
+
+	merklizedPositionIndex = 1
+	merklizedPositionValue = 2
+)
+
+// merklizedSlots are the slots that can carry the merklized root, by the position they are flagged with
+var merklizedSlots = map[string]byte{
+	"i_2": merklizedPositionIndex,
+	"v_2": merklizedPositionValue,
+}
+
+// parseMerklizedRoot parses a merklized root given in decimal, or in the 64-digit hex of the merkletree
+// library
+func parseMerklizedRoot(s string) (*big.Int, error) {
+	s = strings.TrimSpace(s)
+	var root *big.Int
+	if len(s) == 64 {
+		h, err := merkletree.NewHashFromHex(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merklized root %q: %s", s, err)
+		}
+		root = h.BigInt()
+	} else {
+		var ok bool
+		if root, ok = new(big.Int).SetString(s, 10); !ok {
+			return nil, fmt.Errorf("invalid merklized root %q, must be decimal or 64 hex digits", s)
+		}
+	}
+	if root.Sign() < 0 || root.Cmp(constants.Q) >= 0 {
+		return nil, fmt.Errorf("the merklized root %s is not in the field", root)
+	}
+	return root, nil
+}
+
+// withMerklizedRoot stores the merklized root in a slot, i_2 or v_2, and flags the claim with its position.
+// It is given after the options of the raw slot data, which would overwrite the root.
+func withMerklizedRoot(slot string, root *big.Int) core.Option {
+	return func(c *core.Claim) error {
+		b, err := c.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		elem, err := core.NewElemBytesFromInt(root)
+		if err != nil {
+			return err
+		}
+		copy(b[dataSlotIndexes[slot]*32:], elem[:])
+		b[flagsByteIdx] = b[flagsByteIdx]&^flagMerklizedBitsMask | merklizedSlots[slot]<<flagMerklizedBitIdx
+		return c.UnmarshalBinary(b)
+	}
+}
+
+// merklizedRoot returns the slot that a claim carries a merklized root in, and the root, or an empty slot
+// for a claim of raw values
+func merklizedRoot(c *core.Claim) (string, *big.Int, error) {
+	b, err := c.MarshalBinary()
+	if err != nil {
+		return "", nil, err
+	}
+	position := (b[flagsByteIdx] & flagMerklizedBitsMask) >> flagMerklizedBitIdx
+	for slot, p := range merklizedSlots {
+		if p == position {
+			return slot, c.RawSlotsAsInts()[dataSlotIndexes[slot]], nil
+		}
+	}
+	if position != 0 {
+		return "", nil, fmt.Errorf("invalid merklized root position %d in the flags of the claim", position)
+	}
+	return "", nil, nil
+}
@@ -0,0 +1,191 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+// The phases of the issuance that are timed. The inputs phase includes the signature of the transition,
+// which is also timed as signing.
+const (
+	phaseTreeInsertion = "tree insertion"
+	phaseAuditLog      = "audit log"
+	phaseSigning       = "signing"
+	phaseInputs        = "inputs generation"
+	phaseSelfCheck     = "self-check"
+	phaseOutput        = "file output"
+)
+
+// issuancePhases lists the phases in the order of the issuance
+var issuancePhases = []string{phaseTreeInsertion, phaseAuditLog, phaseSigning, phaseInputs, phaseSelfCheck, phaseOutput}
+
+// issuanceMetrics counts the operations of a run, and how long they took. There is no metrics endpoint
+// since the sample has no server, the summary is printed at the end of the run with --verbose.
+type issuanceMetrics struct {
+	claimsIssued    int
+	claimsUpdated   int
+	inputsGenerated int
+	signatures      int
+	treeLeaves      map[string]int
+	treeOps         int
+	treeOpTime      time.Duration
+	issuanceTimes   []time.Duration
+	phaseTimes      map[string][]time.Duration
+}
+
+func newIssuanceMetrics() *issuanceMetrics {
+	return &issuanceMetrics{treeLeaves: map[string]int{}, phaseTimes: map[string][]time.Duration{}}
+}
+
+// observeTreeAdd records the addition of a leaf to one of the trees
+func (m *issuanceMetrics) observeTreeAdd(tree string, elapsed time.Duration) {
+	m.treeOps++
+	m.treeOpTime += elapsed
+	m.treeLeaves[tree]++
+	m.observePhase(phaseTreeInsertion, elapsed)
+}
+
+// observePhase records the time taken by one step of a phase of the issuance
+func (m *issuanceMetrics) observePhase(phase string, elapsed time.Duration) {
+	m.phaseTimes[phase] = append(m.phaseTimes[phase], elapsed)
+}
+
+// timePhase runs a step of a phase of the issuance and records the time it took, whether it failed or not
+func (m *issuanceMetrics) timePhase(phase string, step func() error) error {
+	start := time.Now()
+	err := step()
+	m.observePhase(phase, time.Since(start))
+	return err
+}
+
+// phaseSummary is the count and the distribution of the times of the steps of a phase
+type phaseSummary struct {
+	Phase string        `json:"phase"`
+	Count int           `json:"count"`
+	Total time.Duration `json:"total"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+}
+
+// runSummary is the summary of a run that --verbose prints, the durations are in nanoseconds in JSON
+type runSummary struct {
+	ClaimsIssued    int             `json:"claimsIssued"`
+	ClaimsUpdated   int             `json:"claimsUpdated"`
+	InputsGenerated int             `json:"inputsGenerated"`
+	Signatures      int             `json:"signatures"`
+	ClaimsPerSecond float64         `json:"claimsPerSecond"`
+	Phases          []*phaseSummary `json:"phases"`
+	TreeLeaves      map[string]int  `json:"treeLeaves"`
+	State           string          `json:"state"`
+}
+
+// percentile returns the nearest-rank percentile of sorted times
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func (m *issuanceMetrics) summary(state *merkletree.Hash) *runSummary {
+	s := &runSummary{
+		ClaimsIssued:    m.claimsIssued,
+		ClaimsUpdated:   m.claimsUpdated,
+		InputsGenerated: m.inputsGenerated,
+		Signatures:      m.signatures,
+		TreeLeaves:      m.treeLeaves,
+		State:           state.BigInt().String(),
+	}
+	var issuance time.Duration
+	for _, t := range m.issuanceTimes {
+		issuance += t
+	}
+	if issuance > 0 {
+		s.ClaimsPerSecond = float64(len(m.issuanceTimes)) / issuance.Seconds()
+	}
+	for _, phase := range issuancePhases {
+		times := append([]time.Duration{}, m.phaseTimes[phase]...)
+		if len(times) == 0 {
+			continue
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+		p := &phaseSummary{Phase: phase, Count: len(times), P50: percentile(times, 50), P95: percentile(times, 95)}
+		for _, t := range times {
+			p.Total += t
+		}
+		s.Phases = append(s.Phases, p)
+	}
+	return s
+}
+
+// printJSON prints the summary of the run as JSON
+func (m *issuanceMetrics) printJSON(state *merkletree.Hash) {
+	out, _ := json.MarshalIndent(m.summary(state), "", "  ")
+	fmt.Println(string(out))
+}
+
+// observeIssuance records a claim issued by the given operation, along with the time taken to add it to
+// the claims tree and record it
+func (m *issuanceMetrics) observeIssuance(operation string, elapsed time.Duration) {
+	if operation == "update-claim" {
+		m.claimsUpdated++
+	} else {
+		m.claimsIssued++
+	}
+	m.issuanceTimes = append(m.issuanceTimes, elapsed)
+}
+
+func (m *issuanceMetrics) print(state *merkletree.Hash) {
+	fmt.Println("Summary of the run")
+	fmt.Println("-> Claims issued:", m.claimsIssued)
+	fmt.Println("-> Claims updated:", m.claimsUpdated)
+	fmt.Println("-> State transition inputs generated:", m.inputsGenerated)
+	fmt.Println("-> Signatures by the issuer key:", m.signatures)
+	if len(m.issuanceTimes) > 0 {
+		var total, max time.Duration
+		for _, t := range m.issuanceTimes {
+			total += t
+			if t > max {
+				max = t
+			}
+		}
+		fmt.Printf("-> Issuance latency: avg=%s max=%s\n", total/time.Duration(len(m.issuanceTimes)), max)
+	}
+	if m.treeOps > 0 {
+		fmt.Printf("-> Tree operations: %d in %s\n", m.treeOps, m.treeOpTime)
+	}
+	if s := m.summary(state); len(s.Phases) > 0 {
+		if s.ClaimsPerSecond > 0 {
+			fmt.Printf("-> Throughput: %.1f claims/sec\n", s.ClaimsPerSecond)
+		}
+		fmt.Printf("-> Time by phase:\n   %-18s %6s %12s %12s %12s\n", "phase", "count", "total", "p50", "p95")
+		for _, p := range s.Phases {
+			fmt.Printf("   %-18s %6d %12s %12s %12s\n", p.Phase, p.Count, p.Total.Round(time.Microsecond), p.P50.Round(time.Microsecond), p.P95.Round(time.Microsecond))
+		}
+	}
+	for _, tree := range []string{"claims", "revocations", "roots"} {
+		fmt.Printf("-> Leaves in the %s tree: %d\n", tree, m.treeLeaves[tree])
+	}
+	fmt.Println("-> Current state:", state.BigInt())
+}
@@ -0,0 +1,227 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+)
+
+// fieldDefaults collects the values of the fields that a new schema version adds, from repeated
+// "--default field=value" options
+type fieldDefaults map[string]*big.Int
+
+func (f fieldDefaults) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%s", name, f[name])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f fieldDefaults) Set(arg string) error {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected <field>=<value>, e.g. documentType=2 or issued=date:2022-06-10")
+	}
+	name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if _, ok := f[name]; ok {
+		return fmt.Errorf("field %s is set more than once", name)
+	}
+	v, err := parseSlotValue(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for field %s: %s", name, err)
+	}
+	f[name] = v
+	return nil
+}
+
+// migrationDescriptor describes the claim under the new schema version. Each field of the new version takes
+// the value of the field of the same name in the claim, wherever the old version stored it, or else its
+// default. The subject, the expiration and the updatable flag are kept, and the revocation nonce is left for
+// the issuance to allocate.
+func migrationDescriptor(claim *core.Claim, from, to *registeredSchema, defaults fieldDefaults) (*claimDescriptor, error) {
+	slots := claim.RawSlotsAsInts()
+	values := map[string]*big.Int{}
+	for slot, field := range from.Fields {
+		if index, ok := dataSlotIndexes[slot]; ok {
+			values[field] = slots[index]
+		}
+	}
+	d := &claimDescriptor{
+		Schema:          to.Name,
+		Type:            to.Type,
+		Slots:           map[string]slotDescriptor{},
+		RevocationNonce: "next",
+		Updatable:       claim.GetFlagUpdatable(),
+	}
+	copySubject(d, claim)
+	if expiration, ok := claim.GetExpirationDate(); ok {
+		d.Expiration = expiration.UTC().Format(time.RFC3339)
+	}
+	for slot, field := range to.Fields {
+		if _, ok := dataSlotIndexes[slot]; !ok {
+			continue
+		}
+		v, ok := values[field]
+		if !ok {
+			if v, ok = defaults[field]; !ok {
+				return nil, usageError("the field %s of '%s' is not in '%s', give its value with --default %s=<value>", field, to.Name, from.Name, field)
+			}
+		}
+		d.Slots[slot] = slotDescriptor{Type: "int", Value: json.RawMessage(strconv.Quote(v.String()))}
+	}
+	return d, nil
+}
+
+// migrateClaimsCommand handles the "migrate-claims" command, which moves the claims of a schema version to
+// the version that supersedes it. It records an approved claim request for each claim that wasn't migrated
+// or reissued yet, which the issuance queue issues with new revocation nonces, each linked to the claim it
+// supersedes.
+func migrateClaimsCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate-claims", flag.ExitOnError)
+	readOnly.register(fs, false)
+	fromFlag := fs.String("from-schema", "", "the registered schema version that the claims are issued with")
+	toFlag := fs.String("to-schema", "", "the registered schema version to migrate the claims to, the one that supersedes --from-schema by default")
+	defaults := fieldDefaults{}
+	fs.Var(defaults, "default", "value of a field that the new version adds, as <field>=<value> (repeatable)")
+	issuerFlag := fs.String("issuer", "", "only migrate the claims issued by this issuer ID")
+	dryRunFlag := fs.Bool("dry-run", false, "list the claims that would be migrated without recording the requests")
+	receiptsFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file")
+	receiptKeys.register(fs)
+	requestsFlag := fs.String("requests", defaultClaimRequestsPath(), "path of the file that the claim requests are recorded in")
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file of the registered schemas")
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	if *fromFlag == "" {
+		return usageError("usage: migrate-claims --from-schema <name> [--to-schema <name>] [--default <field>=<value>]... [--issuer <id>] [--dry-run]")
+	}
+	operator, err := operators.authorize(roleIssue)
+	if err != nil {
+		return fmt.Errorf("not authorized to migrate the claims: %w", err)
+	}
+
+	from, err := findSchema(*schemasFlag, *fromFlag)
+	if err != nil {
+		return err
+	} else if from == nil {
+		return withCode(errCodeNotFound, fmt.Errorf("no schema named '%s' is registered", *fromFlag), "schema", *fromFlag)
+	}
+	if *toFlag == "" {
+		if *toFlag = from.SupersededBy; *toFlag == "" {
+			return usageError("'%s' is not superseded by another version, deprecate it with schema deprecate or give --to-schema", from.Name)
+		}
+	}
+	to, err := findSchema(*schemasFlag, *toFlag)
+	if err != nil {
+		return err
+	} else if to == nil {
+		return withCode(errCodeNotFound, fmt.Errorf("no schema named '%s' is registered", *toFlag), "schema", *toFlag)
+	}
+	for _, s := range []*registeredSchema{from, to} {
+		if err := s.verify(); err != nil {
+			return err
+		}
+	}
+	fields := map[string]bool{}
+	for _, field := range to.Fields {
+		fields[field] = true
+	}
+	for field := range defaults {
+		if !fields[field] {
+			return usageError("'%s' has no field %s to give a default to", to.Name, field)
+		}
+	}
+	fmt.Printf("Migrate the claims of '%s' (%s) to '%s' (%s)\n", from.Name, from.Hash, to.Name, to.Hash)
+	for _, field := range from.Fields {
+		if !fields[field] {
+			fmt.Printf("-> The field %s is not in '%s', it is dropped\n", field, to.Name)
+		}
+	}
+
+	requests, err := readClaimRequests(*requestsFlag)
+	if err != nil {
+		return err
+	}
+	var migrated, skipped int
+	err = scanJSONLines(*receiptsFlag, func(line int, b []byte) error {
+		var r issuanceReceipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("line %d of the receipts file is not a valid receipt: %s", line, err)
+		}
+		if r.SchemaHash != from.Hash || (*issuerFlag != "" && r.Issuer != *issuerFlag) || r.erased() {
+			return nil
+		}
+		old := issuedClaimRef{Issuer: r.Issuer, RevocationNonce: r.RevocationNonce}
+		if existing := supersedingRequest(requests, old); existing != nil {
+			skipped++
+			return nil
+		}
+		if err := receiptKeys.open(&r); err != nil {
+			return fmt.Errorf("line %d of the receipts file: %w", line, err)
+		}
+		claim, err := claimFromHex(r.Claim)
+		if err != nil {
+			return withCode(errCodeInvalidInput, fmt.Errorf("line %d of the receipts file holds an invalid claim: %s", line, err))
+		}
+		d, err := migrationDescriptor(claim, from, to, defaults)
+		if err != nil {
+			return err
+		}
+		request, err := newSupersedingRequest(d, *schemasFlag, operator, old, fmt.Sprintf("migration of the claim with the revocation nonce %d from '%s' to '%s'", r.RevocationNonce, from.Name, to.Name))
+		if err != nil {
+			return fmt.Errorf("the claim with the revocation nonce %d can't be migrated: %w", r.RevocationNonce, err)
+		}
+		requests = append(requests, request)
+		migrated++
+		fmt.Printf("-> Claim with the revocation nonce %d to %s: request %s\n", r.RevocationNonce, sensitive.id(r.Subject), request.ID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		fmt.Printf("-> %d claims were already migrated or reissued\n", skipped)
+	}
+	if *dryRunFlag {
+		fmt.Printf("Dry run, %d claims would be migrated\n", migrated)
+		return nil
+	}
+	if migrated == 0 {
+		fmt.Println("No claims to migrate")
+		return nil
+	}
+	if err := writeClaimRequests(*requestsFlag, requests); err != nil {
+		return err
+	}
+	fmt.Printf("Recorded %d approved claim requests, issue them from the queue with: --from-request next\n", migrated)
+	return nil
+}
@@ -0,0 +1,306 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// Revoking a nonce revokes every claim that carries it, so the claims of an identity, including its auth
+// claim, must each be given a distinct revocation nonce. Only the versions of an updatable claim share one.
+
+const maxRandomNonceAttempts = 16
+
+// nonceRange is a range of revocation nonces, both ends included. A registered schema can be given a
+// range of its own, which its claims take their nonces from and no other claim does, so that the claims
+// of a credential type can be told by their nonces.
+type nonceRange struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+// parseNonceRange parses a range given as <first>-<last>
+func parseNonceRange(s string) (*nonceRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("a nonce range is <first>-<last>, got %q", s)
+	}
+	var r nonceRange
+	var err error
+	if r.First, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid first nonce %q", parts[0])
+	}
+	if r.Last, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid last nonce %q", parts[1])
+	}
+	if r.First > r.Last {
+		return nil, fmt.Errorf("the first nonce %d is after the last nonce %d", r.First, r.Last)
+	}
+	return &r, nil
+}
+
+func (r *nonceRange) contains(nonce uint64) bool {
+	return nonce >= r.First && nonce <= r.Last
+}
+
+func (r *nonceRange) overlaps(other *nonceRange) bool {
+	return r.First <= other.Last && other.First <= r.Last
+}
+
+func (r *nonceRange) String() string {
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// schemaNonces is the nonce range of a registered schema, and the next nonce of its sequence
+type schemaNonces struct {
+	schema string
+	nonceRange
+	next uint64
+}
+
+// nonceAllocator hands out the revocation nonces for the claims of an identity, and refuses nonces that are
+// already used by another claim or already revoked. It is safe for concurrent use: a nonce is checked and
+// taken under one lock, so two claims can't be given the same nonce.
+type nonceAllocator struct {
+	identity *issuer.Identity
+	mux      sync.Mutex
+	rand     io.Reader
+	random   bool
+	next     uint64
+	used     map[uint64]string
+	// ranges are the nonce ranges of the registered schemas, by schema hash
+	ranges map[string]*schemaNonces
+}
+
+// authNonce returns the revocation nonce of the auth claim of a new identity from the --auth-nonce option,
+// which is either "random", read from rand, or an integer
+func authNonce(option string, rand io.Reader) (uint64, error) {
+	if option == "random" {
+		var b [8]byte
+		if _, err := io.ReadFull(rand, b[:]); err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(b[:]), nil
+	}
+	nonce, err := strconv.ParseUint(option, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("the auth nonce must be \"random\" or an integer between 0 and %d, got %q", uint64(1<<64-1), option)
+	}
+	return nonce, nil
+}
+
+// newNonceAllocator creates an allocator from the --nonce option, which is either "random" or the first
+// nonce of a sequence. Random nonces are read from rand.
+func newNonceAllocator(identity *issuer.Identity, nonceOption string, rand io.Reader) (*nonceAllocator, error) {
+	a := &nonceAllocator{identity: identity, rand: rand, used: map[uint64]string{}, ranges: map[string]*schemaNonces{}}
+	if nonceOption == "random" {
+		a.random = true
+		return a, nil
+	}
+	next, err := strconv.ParseUint(nonceOption, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("the nonce must be \"random\" or an integer between 0 and %d, got %q", uint64(1<<64-1), nonceOption)
+	}
+	a.next = next
+	return a, nil
+}
+
+// useRanges allocates the nonces of the claims of the registered schemas that have a nonce range from
+// their ranges, and keeps the other claims out of them. It fails if a range includes a nonce that is already
+// reserved, such as the nonce of the auth claim, which is reserved before the ranges apply.
+func (a *nonceAllocator) useRanges(schemas []*registeredSchema) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for _, s := range schemas {
+		if s.NonceRange == nil {
+			continue
+		}
+		for nonce, claimName := range a.used {
+			if s.NonceRange.contains(nonce) {
+				err := fmt.Errorf("the nonce range %s of the schema '%s' includes the revocation nonce %d of the %s", s.NonceRange, s.Name, nonce, claimName)
+				return withCode(errCodeInvalidInput, err, "nonce", strconv.FormatUint(nonce, 10), "schema", s.Name)
+			}
+		}
+		a.ranges[s.Hash] = &schemaNonces{schema: s.Name, nonceRange: *s.NonceRange, next: s.NonceRange.First}
+	}
+	return nil
+}
+
+// useIssued marks the nonces of the claims of the identity as used, for an allocator of a restored
+// identity, and moves the sequence past the largest of them
+func (a *nonceAllocator) useIssued(identity *issuer.Identity) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	// the auth claim's nonce is drawn at random, so it doesn't move the sequence of the other claims
+	authNonce := identity.AuthClaim.GetRevocationNonce()
+	var changes []issuer.Changes
+	for _, t := range identity.PublishedTransitions() {
+		changes = append(changes, t.Changes)
+	}
+	for _, c := range append(changes, identity.PendingChanges()) {
+		for _, claim := range c.Claims {
+			nonce := claim.GetRevocationNonce()
+			if _, ok := a.used[nonce]; !ok {
+				sHashText, _ := claim.GetSchemaHash().MarshalText()
+				a.used[nonce] = fmt.Sprintf("claim of schema hash %s", sHashText)
+			}
+			if !a.random && nonce != authNonce && nonce >= a.next && nonce < 1<<64-1 && a.rangeOf(nonce) == nil {
+				a.next = nonce + 1
+			}
+		}
+		// an erased claim is revoked, and its nonce is not given to another claim
+		for _, e := range c.Erased {
+			if _, ok := a.used[e.RevocationNonce]; !ok {
+				a.used[e.RevocationNonce] = "erased claim"
+			}
+			if !a.random && e.RevocationNonce >= a.next && e.RevocationNonce < 1<<64-1 && a.rangeOf(e.RevocationNonce) == nil {
+				a.next = e.RevocationNonce + 1
+			}
+		}
+	}
+}
+
+// checkRange fails if the nonce is outside of the range of the schema, or in the range of another schema
+func (a *nonceAllocator) checkRange(nonce uint64, schemaHash, claimName string) error {
+	if own := a.ranges[schemaHash]; own != nil {
+		if !own.contains(nonce) {
+			err := fmt.Errorf("revocation nonce %d of the %s is outside of the nonce range %s of the schema '%s'", nonce, claimName, &own.nonceRange, own.schema)
+			return withCode(errCodeInvalidInput, err, "nonce", strconv.FormatUint(nonce, 10), "schema", own.schema)
+		}
+		return nil
+	}
+	if other := a.rangeOf(nonce); other != nil {
+		err := fmt.Errorf("revocation nonce %d of the %s is in the nonce range %s of the schema '%s'", nonce, claimName, &other.nonceRange, other.schema)
+		return withCode(errCodeInvalidInput, err, "nonce", strconv.FormatUint(nonce, 10), "schema", other.schema)
+	}
+	return nil
+}
+
+// rangeOf returns the schema range that the nonce is in, if any
+func (a *nonceAllocator) rangeOf(nonce uint64) *schemaNonces {
+	for _, r := range a.ranges {
+		if r.contains(nonce) {
+			return r
+		}
+	}
+	return nil
+}
+
+// reserve claims a nonce for the named claim of the schema, failing if the nonce is outside of the
+// schema's range, if another claim already uses it or if it is revoked
+func (a *nonceAllocator) reserve(ctx context.Context, nonce uint64, schemaHash, claimName string) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if err := a.checkRange(nonce, schemaHash, claimName); err != nil {
+		return err
+	}
+	return a.take(ctx, nonce, claimName)
+}
+
+func (a *nonceAllocator) take(ctx context.Context, nonce uint64, claimName string) error {
+	if other, ok := a.used[nonce]; ok {
+		err := fmt.Errorf("revocation nonce %d of the %s is already used by the %s", nonce, claimName, other)
+		return withCode(errCodeNonceInUse, err, "nonce", strconv.FormatUint(nonce, 10), "usedBy", other)
+	}
+	revoked, _, err := a.identity.RevocationStatus(ctx, nonce)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		err := fmt.Errorf("revocation nonce %d of the %s is already revoked", nonce, claimName)
+		return withCode(errCodeNonceInUse, err, "nonce", strconv.FormatUint(nonce, 10), "revoked", "true")
+	}
+	a.used[nonce] = claimName
+	return nil
+}
+
+// allocate picks the nonce for the named claim of the schema, either the next free nonce of the sequence,
+// or a random one. The claims of a schema with a nonce range take the nonces of its range, the sequence of
+// the other claims skips over the ranges.
+func (a *nonceAllocator) allocate(ctx context.Context, schemaHash, claimName string) (uint64, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.random {
+		return a.takeRandom(ctx, schemaHash, claimName)
+	}
+	if own := a.ranges[schemaHash]; own != nil {
+		if own.next > own.Last || own.next < own.First {
+			err := fmt.Errorf("the nonce range %s of the schema '%s' is used up", &own.nonceRange, own.schema)
+			return 0, withCode(errCodeNonceInUse, err, "schema", own.schema)
+		}
+		nonce := own.next
+		if err := a.take(ctx, nonce, claimName); err != nil {
+			return 0, err
+		}
+		// past the top of the 64-bit range, the next nonce wraps around to below the range
+		own.next++
+		return nonce, nil
+	}
+	for r := a.rangeOf(a.next); r != nil; r = a.rangeOf(a.next) {
+		if r.Last == 1<<64-1 {
+			return 0, fmt.Errorf("the sequence of nonces from %d runs into the nonce range %s of the schema '%s'", a.next, &r.nonceRange, r.schema)
+		}
+		a.next = r.Last + 1
+	}
+	nonce := a.next
+	if err := a.take(ctx, nonce, claimName); err != nil {
+		return 0, err
+	}
+	a.next++
+	return nonce, nil
+}
+
+// allocateRandom draws a random nonce for the named claim of the schema, from the schema's range or from
+// the full 64-bit range outside of the ranges, and draws again if the nonce is taken
+func (a *nonceAllocator) allocateRandom(ctx context.Context, schemaHash, claimName string) (uint64, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.takeRandom(ctx, schemaHash, claimName)
+}
+
+func (a *nonceAllocator) takeRandom(ctx context.Context, schemaHash, claimName string) (uint64, error) {
+	var err error
+	own := a.ranges[schemaHash]
+	for i := 0; i < maxRandomNonceAttempts; i++ {
+		var b [8]byte
+		if _, err := io.ReadFull(a.rand, b[:]); err != nil {
+			return 0, err
+		}
+		nonce := binary.LittleEndian.Uint64(b[:])
+		if own != nil {
+			// a range of the full 64 bits has a span that overflows to 0, and takes the drawn nonce as it is
+			if span := own.Last - own.First + 1; span != 0 {
+				nonce = own.First + nonce%span
+			}
+		}
+		if err = a.checkRange(nonce, schemaHash, claimName); err != nil {
+			continue
+		}
+		if err = a.take(ctx, nonce, claimName); err == nil {
+			return nonce, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to draw a free random nonce after %d attempts: %s", maxRandomNonceAttempts, err)
+}
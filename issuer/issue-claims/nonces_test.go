@@ -0,0 +1,52 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzParseNonceRange(f *testing.F) {
+	for _, seed := range []string{"100-199", "2-2", "0-18446744073709551615", "199-100", "1-", "-1", "a-b", "1-2-3", "18446744073709551616-1"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		r, err := parseNonceRange(s)
+		if err != nil {
+			return
+		}
+		if r.First > r.Last {
+			t.Fatalf("expected the first nonce of %q before the last, got %s", s, r)
+		}
+		again, err := parseNonceRange(r.String())
+		if err != nil || *again != *r {
+			t.Errorf("expected %s to parse back to itself, got %v (%v)", r, again, err)
+		}
+	})
+}
+
+func TestRangeIncludingTheAuthNonceIsRefused(t *testing.T) {
+	a := &nonceAllocator{used: map[uint64]string{7519640297415123398: "auth claim"}, ranges: map[string]*schemaNonces{}}
+	err := a.useRanges([]*registeredSchema{
+		{Name: "kyc", Hash: "1", NonceRange: &nonceRange{First: 100, Last: 199}},
+		{Name: "all", Hash: "2", NonceRange: &nonceRange{First: 0, Last: 1<<64 - 1}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "includes the revocation nonce 7519640297415123398 of the auth claim") {
+		t.Fatalf("expected the range including the auth nonce to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A failed notification is retried a few times, within the timeout of the notifications
+const (
+	notifyAttempts = 3
+	notifyBackoff  = 500 * time.Millisecond
+)
+
+// The types of the issuance events
+const (
+	eventClaimIssued     = "claim-issued"
+	eventClaimUpdated    = "claim-updated"
+	eventClaimRevoked    = "claim-revoked"
+	eventStateTransition = "state-transition"
+)
+
+// issuanceEvent is what the notifiers are told about an issued, updated or revoked claim, or a state
+// transition
+type issuanceEvent struct {
+	Type            string    `json:"type"`
+	Time            time.Time `json:"time"`
+	Issuer          string    `json:"issuer"`
+	Subject         string    `json:"subject,omitempty"`
+	SchemaHash      string    `json:"schemaHash,omitempty"`
+	Claim           string    `json:"claim,omitempty"`
+	RevocationNonce *uint64   `json:"revocationNonce,omitempty"`
+	OldState        string    `json:"oldState"`
+	NewState        string    `json:"newState"`
+	Inputs          string    `json:"inputs,omitempty"`
+}
+
+// receiptEvent is the event of the claim of a receipt, of the type claim-issued or claim-updated
+func receiptEvent(eventType string, r *issuanceReceipt) *issuanceEvent {
+	return &issuanceEvent{
+		Type:            eventType,
+		Time:            time.Unix(r.Timestamp, 0).UTC(),
+		Issuer:          r.Issuer,
+		Subject:         r.Subject,
+		SchemaHash:      r.SchemaHash,
+		Claim:           r.Claim,
+		RevocationNonce: &r.RevocationNonce,
+		OldState:        r.OldState,
+		NewState:        r.NewState,
+	}
+}
+
+// notifier delivers the issuance events to another system
+type notifier interface {
+	Notify(ctx context.Context, event *issuanceEvent) error
+	// describe names the notifier in the narration
+	describe() string
+}
+
+// newNotifier creates the notifier selected by a --notify option: "webhook:<url>" posts each event as
+// JSON, "jsonl:<path>" appends it as a JSON line to a file, or to stdout with "jsonl:-", and "exec:<command>"
+// runs a command with the event on its stdin
+func newNotifier(spec string) (notifier, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "webhook":
+		u, err := url.Parse(arg)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("the webhook must be an http(s) URL, got %q", arg)
+		}
+		return &webhookNotifier{url: u.String(), client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case "jsonl":
+		if arg == "" {
+			return nil, fmt.Errorf("jsonl needs a path, or - for stdout")
+		}
+		return &jsonLinesNotifier{path: arg}, nil
+	case "exec":
+		args := strings.Fields(arg)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("exec needs a command")
+		}
+		return execNotifier(args), nil
+	}
+	return nil, fmt.Errorf("the notifier must be webhook:<url>, jsonl:<path> or exec:<command>, got %q", spec)
+}
+
+// notifierList collects the notifiers from repeated "--notify" options
+type notifierList []notifier
+
+func (l *notifierList) String() string {
+	parts := make([]string, len(*l))
+	for i, n := range *l {
+		parts[i] = n.describe()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *notifierList) Set(spec string) error {
+	n, err := newNotifier(spec)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, n)
+	return nil
+}
+
+// notifyAll delivers an event to every notifier at the same time, and waits for them at most for the
+// timeout. A failed notification is retried and then reported, it never fails the issuance.
+func (l notifierList) notifyAll(ctx context.Context, timeout time.Duration, event *issuanceEvent) {
+	if len(l) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	errs := make([]error, len(l))
+	var wg sync.WaitGroup
+	for i, n := range l {
+		wg.Add(1)
+		go func(i int, n notifier) {
+			defer wg.Done()
+			errs[i] = notifyWithRetry(ctx, n, event)
+		}(i, n)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			fmt.Printf("   -> Failed to notify %s of the %s event: %s\n", l[i].describe(), event.Type, err)
+		}
+	}
+}
+
+func notifyWithRetry(ctx context.Context, n notifier, event *issuanceEvent) error {
+	var err error
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		if err = n.Notify(ctx, event); err == nil {
+			return nil
+		}
+		if attempt < notifyAttempts {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%s, then %s", err, ctx.Err())
+			case <-time.After(notifyBackoff * time.Duration(attempt)):
+			}
+		}
+	}
+	return fmt.Errorf("%s, after %d attempts", err, notifyAttempts)
+}
+
+// webhookNotifier posts each event as JSON to a URL
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, event *issuanceEvent) error {
+	b, _ := json.Marshal(event)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("the webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+func (w *webhookNotifier) describe() string {
+	return "the webhook " + w.url
+}
+
+// jsonLinesNotifier appends each event as a line of JSON to a file, or writes it to stdout, for piping
+// to other tools
+type jsonLinesNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (j *jsonLinesNotifier) Notify(ctx context.Context, event *issuanceEvent) error {
+	line, _ := json.Marshal(event)
+	line = append(line, '\n')
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.path == "-" {
+		_, err := os.Stdout.Write(line)
+		return err
+	}
+	if err := readOnly.check(j.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(line)
+	return err
+}
+
+func (j *jsonLinesNotifier) describe() string {
+	if j.path == "-" {
+		return "stdout"
+	}
+	return "the file " + j.path
+}
+
+// execNotifier runs a command for each event, with the event as JSON on its stdin. The command is killed
+// when the timeout of the notifications expires.
+type execNotifier []string
+
+func (e execNotifier) Notify(ctx context.Context, event *issuanceEvent) error {
+	b, _ := json.Marshal(event)
+	cmd := exec.CommandContext(ctx, e[0], e[1:]...)
+	cmd.Stdin = bytes.NewReader(append(b, '\n'))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func (e execNotifier) describe() string {
+	return "the command " + strings.Join(e, " ")
+}
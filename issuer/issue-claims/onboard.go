@@ -0,0 +1,187 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// onboardedHolder is a holder identity that the issuer computed from the holder's public key, recorded so
+// that the claims issued later can be checked against a known key
+type onboardedHolder struct {
+	ID             string    `json:"id"`
+	DID            string    `json:"did"`
+	PublicKey      string    `json:"publicKey"`
+	AuthClaim      string    `json:"authClaim"`
+	GenesisState   string    `json:"genesisState"`
+	ClaimsRoot     string    `json:"claimsRoot"`
+	RevocationRoot string    `json:"revocationRoot"`
+	RootOfRoots    string    `json:"rootOfRoots"`
+	Time           time.Time `json:"time"`
+}
+
+// onboardRequest is the request file that a holder sends to be onboarded
+type onboardRequest struct {
+	PublicKey string `json:"publicKey"`
+}
+
+func defaultHoldersPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_holders.json")
+}
+
+func readHolders(path string) ([]*onboardedHolder, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var holders []*onboardedHolder
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var h onboardedHolder
+		if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+			return nil, fmt.Errorf("line %d of the holders file is not a valid holder: %s", line, err)
+		}
+		holders = append(holders, &h)
+	}
+	return holders, scanner.Err()
+}
+
+// findHolder looks up an onboarded holder by ID, returning nil if the holder was not onboarded
+func findHolder(path string, id *core.ID) (*onboardedHolder, error) {
+	holders, err := readHolders(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range holders {
+		if h.ID == id.String() {
+			return h, nil
+		}
+	}
+	return nil, nil
+}
+
+// appendHolders records onboarded holders at the end of the holders file
+func appendHolders(path string, holders ...*onboardedHolder) error {
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, h := range holders {
+		line, _ := json.Marshal(h)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+func newOnboardedHolder(genesis *issuer.Genesis, publicKey string) (*onboardedHolder, error) {
+	authClaim, err := claimToHex(genesis.AuthClaim)
+	if err != nil {
+		return nil, err
+	}
+	return &onboardedHolder{
+		ID:             genesis.ID.String(),
+		DID:            (&core.DID{ID: *genesis.ID}).String(),
+		PublicKey:      publicKey,
+		AuthClaim:      authClaim,
+		GenesisState:   genesis.TreeState.State.BigInt().String(),
+		ClaimsRoot:     genesis.TreeState.ClaimsRoot.BigInt().String(),
+		RevocationRoot: genesis.TreeState.RevocationRoot.BigInt().String(),
+		RootOfRoots:    genesis.TreeState.RootOfRoots.BigInt().String(),
+		Time:           now().UTC(),
+	}, nil
+}
+
+// onboardHolderCommand handles the "onboard-holder" command, that computes the identity of a holder from
+// the holder's public key and records it. The holder keeps the private key, and gets back the ID and the
+// genesis state to start its wallet from.
+func onboardHolderCommand(args []string) error {
+	fs := flag.NewFlagSet("onboard-holder", flag.ExitOnError)
+	readOnly.register(fs, false)
+	pubKeyFlag := fs.String("public-key", "", "the holder's compressed babyjubjub public key in hex")
+	requestFlag := fs.String("request", "", "path of a JSON request file with the holder's \"publicKey\"")
+	holdersFlag := fs.String("holders", defaultHoldersPath(), "path of the file that the onboarded holders are recorded in")
+	timeoutFlag := fs.Duration("timeout", 0, "give up on the command after this long, for example 30s (no timeout by default)")
+	fs.Parse(args)
+
+	publicKey := *pubKeyFlag
+	if *requestFlag != "" {
+		if publicKey != "" {
+			return usageError("the --public-key and --request options are mutually exclusive")
+		}
+		b, err := os.ReadFile(*requestFlag)
+		if err != nil {
+			return err
+		}
+		var req onboardRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			return fmt.Errorf("invalid request file: %s", err)
+		}
+		publicKey = req.PublicKey
+	}
+	if publicKey == "" {
+		return usageError("usage: onboard-holder --public-key <key> | onboard-holder --request <file>")
+	}
+	pubKey, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+	genesis, err := issuer.NewGenesis(ctx, pubKey)
+	if err != nil {
+		return fmt.Errorf("failed to compute the genesis state: %s", err)
+	}
+	h, err := newOnboardedHolder(genesis, pubKey.String())
+	if err != nil {
+		return err
+	}
+	if known, err := findHolder(*holdersFlag, genesis.ID); err != nil {
+		return err
+	} else if known != nil {
+		return fmt.Errorf("the holder %s was already onboarded at %s", known.ID, known.Time.Format(time.RFC3339))
+	}
+
+	if err := appendHolders(*holdersFlag, h); err != nil {
+		return err
+	}
+
+	out, _ := json.MarshalIndent(h, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// The roles that operators are authorized by. An admin holds every role.
+const (
+	roleIssue   = "issue"
+	roleRevoke  = "revoke"
+	rolePublish = "publish"
+	roleAdmin   = "admin"
+)
+
+var knownRoles = []string{roleIssue, roleRevoke, rolePublish, roleAdmin}
+
+// operatorsConfig authorizes the OS users that may operate the issuer, separately from the issuer's signing
+// key. Without a config file, every user is authorized, as in a single user demo.
+type operatorsConfig struct {
+	Operators []*operator `json:"operators"`
+}
+
+// operator is an OS user and the roles they hold. The roles they may assume with --role-assume are
+// configured separately, so that a role is only held for the operations that need it.
+type operator struct {
+	User      string   `json:"user"`
+	Roles     []string `json:"roles"`
+	Assumable []string `json:"assumable,omitempty"`
+}
+
+// operatorFlags are the options that commands take to authorize the operator
+type operatorFlags struct {
+	config string
+	assume string
+}
+
+func defaultOperatorsPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_operators.json")
+}
+
+func readOperatorsConfig(path string) (*operatorsConfig, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var config operatorsConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("invalid operators config %s: %s", path, err)
+	}
+	for _, o := range config.Operators {
+		for _, role := range append(append([]string{}, o.Roles...), o.Assumable...) {
+			if !hasRole(knownRoles, role) {
+				return nil, fmt.Errorf("invalid operators config %s: unknown role '%s' of %s, must be one of %s", path, role, o.User, strings.Join(knownRoles, ", "))
+			}
+		}
+	}
+	return &config, nil
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *operatorFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.config, "operators", defaultOperatorsPath(), "path of the config of the operators that are authorized to operate the issuer, and their roles")
+	fs.StringVar(&f.assume, "role-assume", "", "assume a role for this operation, which the operators config must allow the operator to assume")
+}
+
+// authorize checks that the OS user running the command holds the role, before anything is signed or
+// changed. It returns the operator to record in the audit log, with the role they assumed if any.
+func (f *operatorFlags) authorize(role string) (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to identify the operator: %s", err)
+	}
+	principal := u.Username
+	if f.assume != "" {
+		principal = fmt.Sprintf("%s as %s", u.Username, f.assume)
+	}
+	config, err := readOperatorsConfig(f.config)
+	if err != nil {
+		return "", err
+	}
+	if config == nil {
+		if f.assume != "" {
+			return "", withCode(errCodeUnauthorized, fmt.Errorf("no operators are configured in %s, so there are no roles to assume", f.config), "role", f.assume)
+		}
+		return principal, nil
+	}
+
+	for _, o := range config.Operators {
+		if o.User != u.Username {
+			continue
+		}
+		roles := o.Roles
+		if f.assume != "" {
+			if !hasRole(o.Assumable, f.assume) {
+				return "", withCode(errCodeUnauthorized, fmt.Errorf("operator %s is not allowed to assume the %s role", u.Username, f.assume), "operator", u.Username, "role", f.assume)
+			}
+			roles = []string{f.assume}
+		}
+		if !hasRole(roles, role) && !hasRole(roles, roleAdmin) {
+			return "", withCode(errCodeUnauthorized, fmt.Errorf("operator %s doesn't hold the %s role", principal, role), "operator", principal, "role", role)
+		}
+		return principal, nil
+	}
+	return "", withCode(errCodeUnauthorized, fmt.Errorf("%s is not an operator of the issuer, see %s", u.Username, f.config), "operator", u.Username, "role", role)
+}
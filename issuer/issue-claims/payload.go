@@ -0,0 +1,314 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// payloadSignature is the detached signature of a file that the issuer hands to the holder, written next
+// to the file with the ".sig" extension. The issuer signs the Poseidon hash of the canonical JSON of the file.
+type payloadSignature struct {
+	Issuer          string `json:"issuer"`
+	IssuerPublicKey string `json:"issuerPublicKey"`
+	Payload         string `json:"payload"`
+	Hash            string `json:"hash"`
+	Signature       string `json:"signature"`
+}
+
+func payloadSignaturePath(payloadPath string) string {
+	return payloadPath + ".sig"
+}
+
+// canonicalJSON re-encodes a JSON document so that any implementation can reproduce its bytes: no white
+// space, object keys sorted by their bytes, strings without HTML escaping, and numbers as decimal integers.
+// Numbers with a fraction or an exponent are refused, as the payloads only carry field elements, and so
+// are objects with a key twice, as which of the values a reader keeps is up to the reader.
+func canonicalJSON(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON document")
+	}
+	var buf bytes.Buffer
+	if err := writeCanonicalJSON(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeJSONValue decodes the next value of the decoder like Decode does, token by token to see the keys
+// of the objects as they come
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		m := map[string]interface{}{}
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := k.(string)
+			if _, ok := m[key]; ok {
+				return nil, fmt.Errorf("duplicate key %q", key)
+			}
+			if m[key], err = decodeJSONValue(dec); err != nil {
+				return nil, err
+			}
+		}
+		_, err := dec.Token()
+		return m, err
+	case json.Delim('['):
+		a := []interface{}{}
+		for dec.More() {
+			e, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, e)
+		}
+		_, err := dec.Token()
+		return a, err
+	}
+	return t, nil
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case string:
+		writeCanonicalString(buf, v)
+	case json.Number:
+		n, ok := new(big.Int).SetString(string(v), 10)
+		if !ok {
+			return fmt.Errorf("number %s is not an integer", v)
+		}
+		buf.WriteString(n.String())
+	case bool:
+		fmt.Fprint(buf, v)
+	case nil:
+		buf.WriteString("null")
+	}
+	return nil
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	// the encoder terminates the value with a new line
+	buf.Truncate(buf.Len() - 1)
+}
+
+func payloadHash(payload []byte) (*big.Int, error) {
+	canonical, err := canonicalJSON(payload)
+	if err != nil {
+		return nil, fmt.Errorf("the payload is not valid JSON: %s", err)
+	}
+	return poseidon.HashBytes(canonical)
+}
+
+// signPayload signs a file for its transport to the holder, returning the detached signature that is written
+// next to it
+func signPayload(signer issuer.Signer, issuerID *core.ID, name string, payload []byte) ([]byte, error) {
+	h, err := payloadHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	sigText, err := signer.SignPoseidon(h).Compress().MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	sig := payloadSignature{
+		Issuer:          issuerID.String(),
+		IssuerPublicKey: signer.Public().String(),
+		Payload:         name,
+		Hash:            h.String(),
+		Signature:       string(sigText),
+	}
+	out, _ := json.MarshalIndent(sig, "", "  ")
+	return append(out, '\n'), nil
+}
+
+// verify checks the signature over the payload with the key of the issuer. The public key and the issuer
+// in the signature file prove nothing by themselves, so the key is one that the holder pinned.
+func (s *payloadSignature) verify(payload []byte, pinnedKey string) error {
+	if s.IssuerPublicKey != pinnedKey {
+		return fmt.Errorf("the payload is signed by the key %s, expected %s", s.IssuerPublicKey, pinnedKey)
+	}
+	h, err := payloadHash(payload)
+	if err != nil {
+		return err
+	}
+	if h.String() != s.Hash {
+		return fmt.Errorf("the payload hashes to %s, the signature is for %s, the payload was modified", h, s.Hash)
+	}
+	var pubKey babyjub.PublicKey
+	if err := pubKey.UnmarshalText([]byte(s.IssuerPublicKey)); err != nil {
+		return fmt.Errorf("invalid issuer public key: %s", err)
+	}
+	var sigComp babyjub.SignatureComp
+	if err := sigComp.UnmarshalText([]byte(s.Signature)); err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	sig, err := sigComp.Decompress()
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	if !pubKey.VerifyPoseidon(h, sig) {
+		return fmt.Errorf("the signature doesn't verify with the issuer public key %s", s.IssuerPublicKey)
+	}
+	return nil
+}
+
+// issuerKeyOfAuthClaim returns the public key of the auth claim that the genesis state of the issuer is made
+// of, after checking that the ID of the issuer derives from that state
+func issuerKeyOfAuthClaim(ctx context.Context, authClaimHex, issuerID string) (string, error) {
+	authClaim, err := claimFromHex(authClaimHex)
+	if err != nil {
+		return "", usageError("invalid --issuer-auth-claim: %s", err)
+	}
+	key, err := issuer.AuthClaimKey(authClaim)
+	if err != nil {
+		return "", usageError("invalid --issuer-auth-claim: %s", err)
+	}
+	genesis, err := issuer.GenesisOf(ctx, authClaim)
+	if err != nil {
+		return "", err
+	}
+	if genesis.ID.String() != issuerID {
+		err := fmt.Errorf("the payload is signed for the issuer %s, the genesis state of the auth claim is the one of %s", issuerID, genesis.ID)
+		return "", withCode(errCodeVerificationFailed, err, "issuer", issuerID)
+	}
+	return key.String(), nil
+}
+
+// verifyPayloadCommand handles the "verify-payload" command, that the holder runs on a file received from
+// the issuer before importing it. The key that the payload must be signed with is pinned by the holder, or
+// taken from the auth claim that the ID of the issuer derives from.
+func verifyPayloadCommand(args []string) error {
+	homedir, _ := os.UserHomeDir()
+	fs := flag.NewFlagSet("verify-payload", flag.ExitOnError)
+	payloadFlag := fs.String("payload", filepath.Join(homedir, "iden3_input.json"), "path of the file to verify")
+	sigFlag := fs.String("signature", "", "path of the detached signature, the payload path with the .sig extension by default")
+	pubKeyFlag := fs.String("issuer-public-key", "", "the compressed public key the payload must be signed with")
+	authClaimFlag := fs.String("issuer-auth-claim", "", "the auth claim in hex that the genesis state of the issuer is made of, whose key the payload must be signed with, instead of --issuer-public-key")
+	manifestFlag := fs.String("manifest", "", "path of the manifest of an issuance, to verify the inputs and the signature that it lists instead of --payload and --signature")
+	fs.Parse(args)
+	if (*pubKeyFlag == "") == (*authClaimFlag == "") {
+		return usageError("usage: verify-payload --issuer-public-key <key> | --issuer-auth-claim <hex> [--payload <file> [--signature <file>] | --manifest <file>]")
+	}
+	if *manifestFlag != "" {
+		m, err := readManifest(*manifestFlag)
+		if err != nil {
+			return err
+		}
+		if *payloadFlag, err = m.artifact(formatInputs); err != nil {
+			return err
+		}
+		if *sigFlag, err = m.artifact(formatSignature); err != nil {
+			return err
+		}
+		fmt.Printf("The files listed in %s match their hashes\n", *manifestFlag)
+	}
+	if *sigFlag == "" {
+		*sigFlag = payloadSignaturePath(*payloadFlag)
+	}
+
+	payload, err := os.ReadFile(*payloadFlag)
+	if err != nil {
+		return err
+	}
+	// the signature is over the JSON, whether the file was handed over as JSON or as a base64url token
+	if payload, err = decodeTransport(payload); err != nil {
+		return err
+	}
+	sigBytes, err := os.ReadFile(*sigFlag)
+	if err != nil {
+		return err
+	}
+	var sig payloadSignature
+	if err := json.Unmarshal(sigBytes, &sig); err != nil {
+		return fmt.Errorf("invalid signature file: %s", err)
+	}
+	pinnedKey := *pubKeyFlag
+	if *authClaimFlag != "" {
+		if pinnedKey, err = issuerKeyOfAuthClaim(context.Background(), *authClaimFlag, sig.Issuer); err != nil {
+			return err
+		}
+	}
+	if err := sig.verify(payload, pinnedKey); err != nil {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the payload failed verification: %s", err))
+	}
+	if *authClaimFlag != "" {
+		fmt.Printf("Verified the signature of %s by the issuer %s, with the key of the auth claim that its ID derives from: %s\n", *payloadFlag, sig.Issuer, pinnedKey)
+	} else {
+		// the key doesn't tell which identity holds it, so the issuer named by the signature file is not shown
+		fmt.Printf("Verified the signature of %s with the pinned key %s\n", *payloadFlag, pinnedKey)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/iden3/go-iden3-crypto/babyjub"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	canonical, err := canonicalJSON([]byte(`{"b": 1, "a": ["<x>", 20, {"d": null, "c": true}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"a":["<x>",20,{"c":true,"d":null}],"b":1}`; string(canonical) != expected {
+		t.Errorf("expected %s, got %s", expected, canonical)
+	}
+	for _, doc := range []string{`{"a":1,"a":2}`, `{"b":[{"a":1,"a":1}]}`, `{"a":1.5}`, `{"a":1} {}`} {
+		if _, err := canonicalJSON([]byte(doc)); err == nil {
+			t.Errorf("expected %s to be refused", doc)
+		}
+	}
+}
+
+func TestVerifyPayloadNeedsTheIssuerKey(t *testing.T) {
+	testHome(t)
+	key := strings.Repeat("0f", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+	stored, err := findIdentity(defaultIdentitiesPath(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captureOutput(t, func() { err = verifyPayloadCommand(nil) })
+	if err == nil || classifyError(err).code != errCodeUsage {
+		t.Errorf("expected a payload without a pinned key to be refused, got %v", err)
+	}
+
+	printed = captureOutput(t, func() {
+		if err := verifyPayloadCommand([]string{"--issuer-auth-claim", stored.AuthClaim}); err != nil {
+			t.Fatalf("failed to verify the payload with the auth claim of the issuer: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "by the issuer "+id+",") {
+		t.Errorf("expected the issuer to be verified, got: %s", printed)
+	}
+
+	// the auth claim of another identity doesn't make up the ID that the payload is signed for, and its key
+	// doesn't verify the signature
+	var otherKey babyjub.PrivateKey
+	otherKey[0] = 1
+	genesis, err := issuer.NewGenesis(context.Background(), otherKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherAuthClaim, err := claimToHex(genesis.AuthClaim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"--issuer-auth-claim", otherAuthClaim}, {"--issuer-public-key", otherKey.Public().String()}} {
+		captureOutput(t, func() { err = verifyPayloadCommand(args) })
+		if err == nil || classifyError(err).code != errCodeVerificationFailed {
+			t.Errorf("expected %v to fail verification, got %v", args, err)
+		}
+	}
+}
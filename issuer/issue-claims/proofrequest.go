@@ -0,0 +1,391 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+
+	"kaleido.io/iden3-tutorial/verifier"
+)
+
+// The iden3comm message that a verifier sends to ask a holder for a proof
+const (
+	iden3commPlainJSON       = "application/iden3comm-plain-json"
+	authorizationRequestType = "https://iden3-communication.io/authorization/1.0/request"
+)
+
+// proofRequest is an iden3comm authorization request. The thread ID matches the holder's response to the
+// request, and the challenge is what the holder signs in the proof.
+type proofRequest struct {
+	ID          string           `json:"id"`
+	Typ         string           `json:"typ"`
+	Type        string           `json:"type"`
+	ThreadID    string           `json:"thid"`
+	ExpiresTime int64            `json:"expires_time"`
+	Body        proofRequestBody `json:"body"`
+}
+
+type proofRequestBody struct {
+	CallbackURL string              `json:"callbackUrl"`
+	Reason      string              `json:"reason"`
+	Scope       []proofRequestScope `json:"scope"`
+}
+
+// proofRequestScope is a proof that the holder is asked for, with the query of the proof as query-spec
+// generates it
+type proofRequestScope struct {
+	ID        int                `json:"id"`
+	CircuitID circuits.CircuitID `json:"circuit_id"`
+	Rules     proofRequestRules  `json:"rules"`
+}
+
+type proofRequestRules struct {
+	Challenge string     `json:"challenge"`
+	Query     *querySpec `json:"query"`
+}
+
+// proofRequestRecord is a request that the verifier sent, recorded to match the responses against it. A
+// request is used once, by the first response that passes verification.
+type proofRequestRecord struct {
+	Request *proofRequest `json:"request"`
+	UsedAt  *time.Time    `json:"usedAt,omitempty"`
+}
+
+func defaultProofRequestsPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_proof_requests.json")
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID(rnd io.Reader) (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rnd, b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func newProofRequest(rnd io.Reader, spec *querySpec, reason, callbackURL string, expires time.Time) (*proofRequest, error) {
+	id, err := newUUID(rnd)
+	if err != nil {
+		return nil, err
+	}
+	// the challenge is a random 64 bit integer, well within the field of the circuits
+	var b [8]byte
+	if _, err := io.ReadFull(rnd, b[:]); err != nil {
+		return nil, err
+	}
+	return &proofRequest{
+		ID:          id,
+		Typ:         iden3commPlainJSON,
+		Type:        authorizationRequestType,
+		ThreadID:    id,
+		ExpiresTime: expires.Unix(),
+		Body: proofRequestBody{
+			CallbackURL: callbackURL,
+			Reason:      reason,
+			Scope: []proofRequestScope{{
+				ID:        1,
+				CircuitID: spec.CircuitID,
+				Rules: proofRequestRules{
+					Challenge: new(big.Int).SetBytes(b[:]).String(),
+					Query:     spec,
+				},
+			}},
+		},
+	}, nil
+}
+
+// query returns the query and the challenge of the proof that the request asks for
+func (r *proofRequest) query() (circuits.Query, *big.Int, error) {
+	if len(r.Body.Scope) != 1 || r.Body.Scope[0].Rules.Query == nil {
+		return circuits.Query{}, nil, fmt.Errorf("the request must ask for exactly one proof with a query")
+	}
+	rules := r.Body.Scope[0].Rules
+	challenge, ok := new(big.Int).SetString(rules.Challenge, 10)
+	if !ok {
+		return circuits.Query{}, nil, fmt.Errorf("invalid challenge %q", rules.Challenge)
+	}
+	query := circuits.Query{SlotIndex: rules.Query.SlotIndex, Operator: rules.Query.Operator}
+	for _, s := range rules.Query.Values {
+		v, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return circuits.Query{}, nil, fmt.Errorf("invalid query value %q", s)
+		}
+		query.Values = append(query.Values, v)
+	}
+	return query, challenge, nil
+}
+
+func readProofRequests(path string) ([]*proofRequestRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*proofRequestRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r proofRequestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Request == nil {
+			return nil, fmt.Errorf("line %d of the proof requests file is not a valid request: %v", line, err)
+		}
+		records = append(records, &r)
+	}
+	return records, scanner.Err()
+}
+
+// writeProofRequests replaces the proof requests file, through a temporary file so that an interrupted
+// write leaves the previous file in place
+func writeProofRequests(path string, records []*proofRequestRecord) error {
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		line, _ := json.Marshal(r)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// verifierCommand handles the "verifier" subcommands, that stand in for a verifier that requests proofs
+// from holders and verifies them
+func verifierCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "request" && args[0] != "verify") {
+		return usageError("usage: verifier request --query-spec <file> --reason <reason> --callback <url> [--expires-in <duration>] | verifier verify --request-id <thid> --public-signals <file> [--proof <file> --verification-key <file>]")
+	}
+	if args[0] == "request" {
+		return verifierRequestCommand(args[1:])
+	}
+	return verifierVerifyCommand(args[1:])
+}
+
+func verifierRequestCommand(args []string) error {
+	fs := flag.NewFlagSet("verifier request", flag.ExitOnError)
+	readOnly.register(fs, false)
+	specFlag := fs.String("query-spec", "", "path of the query as query-spec prints it")
+	reasonFlag := fs.String("reason", "", "why the verifier asks for the proof, shown to the holder")
+	callbackFlag := fs.String("callback", "", "the URL the holder sends the proof to")
+	expiresFlag := fs.Duration("expires-in", time.Hour, "how long the request can be responded to")
+	requestsFlag := fs.String("requests", defaultProofRequestsPath(), "path of the file that the requests are recorded in")
+	outFlag := fs.String("out", "", "path to write the request to, instead of printing it")
+	encodingFlag := fs.String("encoding", encodingJSON, "encoding of the request: json, or a single-line token with base64url or base64url+gzip, to render as a QR code")
+	fs.Parse(args)
+	if *specFlag == "" || *reasonFlag == "" || *callbackFlag == "" {
+		return usageError("usage: verifier request --query-spec <file> --reason <reason> --callback <url> [--expires-in <duration>]")
+	}
+	if *expiresFlag <= 0 {
+		return usageError("--expires-in must be positive")
+	}
+
+	b, err := os.ReadFile(*specFlag)
+	if err != nil {
+		return err
+	}
+	var spec querySpec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid query spec: %s", err))
+	}
+	if spec.CircuitID == "" || len(spec.Values) == 0 {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid query spec: the circuit ID and the values are required"))
+	}
+	request, err := newProofRequest(rand.Reader, &spec, *reasonFlag, *callbackFlag, now().Add(*expiresFlag))
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(request, "", "  ")
+	out, err = encodeTransport(append(out, '\n'), *encodingFlag)
+	if err != nil {
+		return err
+	}
+
+	records, err := readProofRequests(*requestsFlag)
+	if err != nil {
+		return err
+	}
+	if err := writeProofRequests(*requestsFlag, append(records, &proofRequestRecord{Request: request})); err != nil {
+		return fmt.Errorf("failed to record the request: %s", err)
+	}
+	if *outFlag == "" {
+		fmt.Println(string(out))
+		return nil
+	}
+	if err := os.WriteFile(*outFlag, out, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Proof request %s written to the file: %s\n", request.ThreadID, *outFlag)
+	if *encodingFlag != encodingJSON {
+		if len(out) <= qrCodeCapacity {
+			fmt.Printf("-> Token of %d bytes, fits in a QR code (up to %d bytes)\n", len(out), qrCodeCapacity)
+		} else {
+			fmt.Printf("-> Token of %d bytes, too large for a QR code (up to %d bytes)\n", len(out), qrCodeCapacity)
+		}
+	}
+	return nil
+}
+
+func verifierVerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verifier verify", flag.ExitOnError)
+	readOnly.register(fs, false)
+	idFlag := fs.String("request-id", "", "the thread ID of the request that the proof responds to")
+	signalsFlag := fs.String("public-signals", "", "path of the public signals of the proof, as snarkjs writes them")
+	proofFlag := fs.String("proof", "", "path of the proof, as snarkjs writes it")
+	vkeyFlag := fs.String("verification-key", "", "path of the verification key of the circuit, to verify the proof with snarkjs")
+	snarkjsFlag := fs.String("snarkjs", "snarkjs", "the snarkjs command")
+	proofTimeoutFlag := fs.Duration("proof-timeout", 0, "stop the verification of the proof with snarkjs after this long, 0 for no timeout")
+	requestsFlag := fs.String("requests", defaultProofRequestsPath(), "path of the file that the requests are recorded in")
+	transitionsFlag := fs.String("transitions", defaultTransitionsPath(), "path of the recorded state transitions, that the published states of the issuer are resolved from")
+	gracePeriodFlag := fs.Duration("state-grace-period", 0, "how long after the issuer replaced a state a proof against it is still accepted")
+	// the command has no revocation nonce of the claim to check its current status with
+	allowSkippedFlag := fs.String("allow-skipped", "revocationStatus", "comma separated checks that the verification passes without, if they are skipped: proof, challenge, schema, issuerState, revocation, revocationStatus")
+	artifacts.register(fs)
+	fs.Parse(args)
+	if *idFlag == "" || *signalsFlag == "" || (*proofFlag == "" && *vkeyFlag != "") {
+		return usageError("usage: verifier verify --request-id <thid> --public-signals <file> [--proof <file> [--verification-key <file>]] [--allow-skipped <checks>]")
+	}
+	var optional []string
+	if *allowSkippedFlag != "" {
+		optional = strings.Split(*allowSkippedFlag, ",")
+	}
+
+	records, err := readProofRequests(*requestsFlag)
+	if err != nil {
+		return err
+	}
+	var record *proofRequestRecord
+	for _, r := range records {
+		if r.Request.ThreadID == *idFlag {
+			record = r
+		}
+	}
+	switch {
+	case record == nil:
+		return withCode(errCodeNotFound, fmt.Errorf("no request %s in %s", *idFlag, *requestsFlag), "request", *idFlag)
+	case record.UsedAt != nil:
+		return withCode(errCodeConflict, fmt.Errorf("the request %s was already used at %s", *idFlag, record.UsedAt.Format(time.RFC3339)), "request", *idFlag)
+	case now().Unix() >= record.Request.ExpiresTime:
+		return withCode(errCodeConflict, fmt.Errorf("the request %s expired at %s", *idFlag, time.Unix(record.Request.ExpiresTime, 0).UTC().Format(time.RFC3339)), "request", *idFlag)
+	}
+	query, challenge, err := record.Request.query()
+	if err != nil {
+		return err
+	}
+	schema, err := core.NewSchemaHashFromHex(record.Request.Body.Scope[0].Rules.Query.SchemaHash)
+	if err != nil {
+		return fmt.Errorf("invalid schema hash in the request: %s", err)
+	}
+
+	pubSignals, err := os.ReadFile(*signalsFlag)
+	if err != nil {
+		return err
+	}
+	options := verifier.Options{
+		Challenge:        challenge,
+		Schema:           &schema,
+		States:           transitionStates{*transitionsFlag},
+		StateGracePeriod: *gracePeriodFlag,
+		Optional:         optional,
+	}
+	var proof []byte
+	var prover *snarkjs
+	if *proofFlag != "" {
+		if proof, err = os.ReadFile(*proofFlag); err != nil {
+			return err
+		}
+		// the verification key is the one given, or else the one of the request's circuit installed with
+		// circuits fetch
+		vkey, err := artifacts.resolve(string(record.Request.Body.Scope[0].CircuitID), artifactVerificationKey, *vkeyFlag)
+		if err != nil {
+			return err
+		} else if vkey == "" {
+			return usageError("no verification key of %s is installed, fetch it with circuits fetch or give it with --verification-key", record.Request.Body.Scope[0].CircuitID)
+		}
+		dir, err := os.MkdirTemp("", "iden3-verify-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		prover = &snarkjs{bin: *snarkjsFlag, dir: dir, verificationKey: vkey, timeout: *proofTimeoutFlag}
+		options.Proof = prover
+	}
+	// an interrupt stops snarkjs rather than leaving it running
+	ctx, cancel := newCommandContext(0)
+	defer cancel()
+	result, err := verifier.Verify(ctx, proof, pubSignals, query, options)
+	if err != nil {
+		return err
+	}
+	for _, c := range result.Checks {
+		switch {
+		case c.Skipped && c.Optional:
+			fmt.Printf("-> %s: skipped\n", c.Name)
+		case c.Skipped:
+			fmt.Printf("-> %s: skipped, and required\n", c.Name)
+		case c.Passed:
+			fmt.Printf("-> %s: passed\n", c.Name)
+		default:
+			fmt.Printf("-> %s: failed, %s\n", c.Name, c.Error)
+		}
+	}
+	if prover != nil && prover.stopped != nil {
+		return prover.stopped
+	}
+	if !result.Passed() {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the proof for the request %s failed verification", *idFlag), "request", *idFlag)
+	}
+	usedAt := now().UTC()
+	record.UsedAt = &usedAt
+	if err := writeProofRequests(*requestsFlag, records); err != nil {
+		return fmt.Errorf("failed to record the use of the request: %s", err)
+	}
+	fmt.Printf("Verified the proof for the request %s\n", *idFlag)
+	return nil
+}
@@ -0,0 +1,218 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+)
+
+// stateTransitionSignals are the public signals of the state transition circuit, in the order of the
+// circuit, which is the order the state contract takes them in, with the fields of the inputs they come from
+var stateTransitionSignals = []struct{ name, input string }{
+	{"userID", "userID"},
+	{"oldUserState", "oldUserState"},
+	{"newUserState", "newUserState"},
+	{"isOldStateGenesis", "isOldStateGenesis"},
+}
+
+// txHashPrefix starts the line that the upload script prints the hash of the transaction on
+const txHashPrefix = "Transaction hash:"
+
+// checkTransitionSignals checks that the public signals of a proof are the ones of the pending transition's
+// inputs, naming the first signal that differs
+func checkTransitionSignals(t *stateTransition, pubSignals []byte) error {
+	var signals []string
+	if err := json.Unmarshal(pubSignals, &signals); err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("the public signals are not a JSON array of decimal strings: %s", err))
+	}
+	if len(signals) != len(stateTransitionSignals) {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the state transition circuit has %d public signals, got %d", len(stateTransitionSignals), len(signals)))
+	}
+	var inputs map[string]interface{}
+	if err := json.Unmarshal(t.Inputs, &inputs); err != nil {
+		return fmt.Errorf("the inputs of the pending transition are not valid: %s", err)
+	}
+	for n, signal := range stateTransitionSignals {
+		expected := fmt.Sprint(inputs[signal.input])
+		if signals[n] != expected {
+			err := fmt.Errorf("the public signal %d (%s) is %s, the pending transition has %s", n, signal.name, signals[n], expected)
+			return withCode(errCodeVerificationFailed, err, "signal", signal.name, "expected", expected, "actual", signals[n])
+		}
+	}
+	return nil
+}
+
+// transitionIssuer reads the issuer ID from the userID public signal, to find its pending transition
+func transitionIssuer(pubSignals []byte) (*core.ID, error) {
+	var signals []string
+	if err := json.Unmarshal(pubSignals, &signals); err != nil || len(signals) == 0 {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("the public signals are not a JSON array of decimal strings: %v", err))
+	}
+	i, ok := new(big.Int).SetString(signals[0], 10)
+	if !ok {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("the userID public signal %q is not a decimal integer", signals[0]))
+	}
+	id, err := core.IDFromInt(i)
+	if err != nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("the userID public signal is not a valid ID: %s", err))
+	}
+	return &id, nil
+}
+
+// submitTransition runs the upload script of the state contract with hardhat, which submits the proof as
+// it is, and returns the hash of the transaction it prints
+func submitTransition(ctx context.Context, dir, network, proofPath, publicPath string) (string, error) {
+	var err error
+	if proofPath, err = filepath.Abs(proofPath); err != nil {
+		return "", err
+	}
+	if publicPath, err = filepath.Abs(publicPath); err != nil {
+		return "", err
+	}
+	cmd := exec.CommandContext(ctx, "npx", "hardhat", "run", "scripts/upload-state-transition.js", "--network", network)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "IDEN3_PROOF="+proofPath, "IDEN3_PUBLIC="+publicPath)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", withCode(errCodeUnavailable, fmt.Errorf("failed to run hardhat: %s", err))
+	}
+	var txHash string
+	scanner := bufio.NewScanner(io.TeeReader(stdout, os.Stdout))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, txHashPrefix) {
+			txHash = strings.TrimSpace(strings.TrimPrefix(line, txHashPrefix))
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", withCode(errCodeUnavailable, fmt.Errorf("the upload script failed: %s", err))
+	}
+	if txHash == "" {
+		return "", fmt.Errorf("the upload script didn't print the hash of the transaction")
+	}
+	return txHash, nil
+}
+
+// publishStateCommand handles the "publish-state" command, that submits a proof of the pending state
+// transition that was generated outside of the upload script, after checking that its public signals are
+// the ones of the transition
+func publishStateCommand(args []string) error {
+	fs := flag.NewFlagSet("publish-state", flag.ExitOnError)
+	readOnly.register(fs, false)
+	proofFlag := fs.String("proof", "", "path of the proof of the state transition, as snarkjs writes it")
+	publicFlag := fs.String("public", "", "path of the public signals of the proof, as snarkjs writes them")
+	transitionsFlag := fs.String("transitions", defaultTransitionsPath(), "path of the file that the state transitions are recorded in")
+	identitiesFlag := fs.String("identities", defaultIdentitiesPath(), "path of the file of the stored identities, whose pending changes the published transition covers")
+	vkeyFlag := fs.String("verification-key", "", "path of the verification key of the state transition circuit, to verify the proof with snarkjs before submitting it")
+	snarkjsFlag := fs.String("snarkjs", "snarkjs", "the snarkjs command")
+	proofTimeoutFlag := fs.Duration("proof-timeout", 0, "stop the verification of the proof with snarkjs after this long, 0 for no timeout")
+	uploadDirFlag := fs.String("upload-claims", filepath.Join("..", "upload-claims"), "path of the hardhat project of the state contract")
+	networkFlag := fs.String("network", "kaleido", "the hardhat network to submit the transaction to")
+	checkOnlyFlag := fs.Bool("check-only", false, "check the proof without submitting it")
+	timeoutFlag := fs.Duration("timeout", 0, "give up on the command after this long, for example 30s (no timeout by default)")
+	var operators operatorFlags
+	operators.register(fs)
+	artifacts.register(fs)
+	fs.Parse(args)
+	if *proofFlag == "" || *publicFlag == "" {
+		return usageError("usage: publish-state --proof <proof.json> --public <public.json> [--verification-key <key.json>] [--check-only]")
+	}
+
+	operator, err := operators.authorize(rolePublish)
+	if err != nil {
+		return fmt.Errorf("not authorized to publish the state: %w", err)
+	}
+	proof, err := os.ReadFile(*proofFlag)
+	if err != nil {
+		return err
+	}
+	pubSignals, err := os.ReadFile(*publicFlag)
+	if err != nil {
+		return err
+	}
+	id, err := transitionIssuer(pubSignals)
+	if err != nil {
+		return err
+	}
+	t, err := pendingTransition(*transitionsFlag, id.String())
+	if err != nil {
+		return err
+	} else if t == nil {
+		return withCode(errCodeNotFound, fmt.Errorf("no transition of %s is pending", id), "issuer", id.String())
+	}
+	if err := checkTransitionSignals(t, pubSignals); err != nil {
+		return err
+	}
+	fmt.Printf("-> The public signals match the pending transition of %s from %s to %s\n", t.Issuer, t.OldState, t.NewState)
+
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+	// the verification key is the one given, or else the one installed with circuits fetch
+	vkey, err := artifacts.resolve(string(circuits.StateTransitionCircuitID), artifactVerificationKey, *vkeyFlag)
+	if err != nil {
+		return err
+	}
+	if vkey != "" {
+		dir, err := os.MkdirTemp("", "iden3-publish-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		prover := &snarkjs{bin: *snarkjsFlag, dir: dir, verificationKey: vkey, timeout: *proofTimeoutFlag}
+		if err := prover.VerifyProof(ctx, proof, pubSignals); prover.stopped != nil {
+			return prover.stopped
+		} else if err != nil {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("the proof doesn't verify: %s", err))
+		}
+		fmt.Println("-> The proof verifies against the verification key")
+	}
+	if *checkOnlyFlag {
+		return nil
+	}
+
+	txHash, err := submitTransition(ctx, *uploadDirFlag, *networkFlag, *proofFlag, *publicFlag)
+	if err != nil {
+		return err
+	}
+	if t, err = decideTransition(*transitionsFlag, t.Issuer, func(t *stateTransition) {
+		t.Status = transitionPublished
+		t.TxHash = txHash
+	}); err != nil {
+		return err
+	}
+	if _, err := storedIdentityPublished(ctx, *identitiesFlag, t); err != nil {
+		return fmt.Errorf("failed to record the publication in the stored identity: %w", err)
+	}
+	fmt.Printf("-> The transition is published by the transaction %s, submitted by %s\n", txHash, operator)
+	return nil
+}
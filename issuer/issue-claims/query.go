@@ -0,0 +1,189 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+)
+
+// querySpec is what a verifier needs to build a proof request over a field of a credential type, in the
+// form the atomic query circuits take it. The circuits expose the slot index, the operator and the values
+// as public signals, so the verifier checks them against the spec.
+type querySpec struct {
+	CircuitID      circuits.CircuitID `json:"circuitId"`
+	SchemaHash     string             `json:"schemaHash"`
+	CredentialType string             `json:"credentialType"`
+	Field          string             `json:"field"`
+	SlotIndex      int                `json:"slotIndex"`
+	Operator       int                `json:"operator"`
+	OperatorName   string             `json:"operatorName"`
+	Values         []string           `json:"values"`
+	ClaimValue     string             `json:"claimValue,omitempty"`
+	Satisfied      *bool              `json:"satisfied,omitempty"`
+}
+
+// newQuerySpec resolves the slot of the field from the schema, and pads the values to the size of the
+// values array of the circuits
+func newQuerySpec(schemaBytes []byte, credentialType, field, operator string, values []*big.Int) (*querySpec, error) {
+	fields, err := schemaFields(schemaBytes, credentialType)
+	if err != nil {
+		return nil, err
+	}
+	slot := ""
+	for s, name := range fields {
+		if name == field {
+			slot = s
+		}
+	}
+	if slot == "" {
+		return nil, fmt.Errorf("field '%s' is not declared by '%s'", field, credentialType)
+	}
+
+	op, ok := circuits.QueryOperators["$"+operator]
+	if !ok || op == circuits.NOOP {
+		return nil, fmt.Errorf("unknown operator '%s', must be one of eq, lt, gt, in, nin", operator)
+	}
+	maxValues := circuits.BaseConfig{}.GetValueArrSize()
+	switch op {
+	case circuits.EQ, circuits.LT, circuits.GT:
+		if len(values) != 1 {
+			return nil, fmt.Errorf("operator '%s' compares against exactly 1 value, got %d", operator, len(values))
+		}
+	case circuits.IN, circuits.NIN:
+		if len(values) == 0 || len(values) > maxValues {
+			return nil, fmt.Errorf("operator '%s' takes between 1 and %d values, got %d", operator, maxValues, len(values))
+		}
+	}
+	padded, err := circuits.PrepareCircuitArrayValues(values, maxValues)
+	if err != nil {
+		return nil, err
+	}
+
+	sHashText, _ := schemaHash(schemaBytes, credentialType).MarshalText()
+	spec := &querySpec{
+		CircuitID:      circuits.AtomicQuerySigCircuitID,
+		SchemaHash:     string(sHashText),
+		CredentialType: credentialType,
+		Field:          field,
+		SlotIndex:      dataSlotIndexes[slot],
+		Operator:       op,
+		OperatorName:   operator,
+		Values:         make([]string, len(padded)),
+	}
+	for i, v := range padded {
+		spec.Values[i] = v.String()
+	}
+	return spec, nil
+}
+
+// evaluate checks the query against the value a claim holds in the queried slot, the same way the circuit
+// compares them, so that a holder can tell whether a proof is possible before generating it
+func (q *querySpec) evaluate(c *core.Claim, values []*big.Int) error {
+	sHashText, _ := c.GetSchemaHash().MarshalText()
+	if string(sHashText) != q.SchemaHash {
+		return fmt.Errorf("the claim has the schema hash %s, the query is for %s", sHashText, q.SchemaHash)
+	}
+	value := c.RawSlotsAsInts()[q.SlotIndex]
+	cmp, err := circuits.FactoryComparer(value, values, q.Operator)
+	if err != nil {
+		return err
+	}
+	satisfied, err := cmp.Compare(q.Operator)
+	if err != nil {
+		return err
+	}
+	q.ClaimValue = value.String()
+	q.Satisfied = &satisfied
+	return nil
+}
+
+func parseQueryValues(s string) ([]*big.Int, error) {
+	var values []*big.Int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		v, err := parseSlotValue(part)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// queryCommand handles the "query-spec" command that generates the query for a field of a credential type
+func queryCommand(args []string) error {
+	fs := flag.NewFlagSet("query-spec", flag.ExitOnError)
+	schemaFlag := fs.String("schema", "./schemas/test.json-ld", "a registered schema, or the path of a schema document")
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file that the registered schemas are kept in")
+	typeFlag := fs.String("type", "", "the credential type in the schema document, implied by a registered schema")
+	fieldFlag := fs.String("field", "", "the field of the credential type to query")
+	opFlag := fs.String("op", "eq", "the comparison operator, one of eq, lt, gt, in, nin")
+	valuesFlag := fs.String("values", "", "comma separated integers, date:YYYY-MM-DD or timestamp:<RFC 3339 time> values to compare the field against")
+	claimFlag := fs.String("claim", "", "a claim in the canonical hex encoding to evaluate the query against")
+	contexts.register(fs)
+	minAgeFlag := fs.Int("min-age", 0, "query a birthday field for a minimum age in years, today, instead of --op and --values")
+	fs.Parse(args)
+	if *minAgeFlag > 0 {
+		opSet := false
+		fs.Visit(func(f *flag.Flag) { opSet = opSet || f.Name == "op" })
+		if opSet || *valuesFlag != "" {
+			return usageError("--min-age sets the operator and the value, it can't be combined with --op or --values")
+		}
+		if *fieldFlag == "" {
+			*fieldFlag = "birthday"
+		}
+		// born on or before the same date minAge years ago
+		*opFlag = "lt"
+		*valuesFlag = minAgeCutoff(now().UTC(), *minAgeFlag).String()
+	} else if *minAgeFlag < 0 {
+		return usageError("--min-age can't be negative")
+	}
+	schemaBytes, credentialType, err := resolveSchema(*schemasFlag, *schemaFlag, *typeFlag)
+	if err != nil {
+		return fmt.Errorf("failed to load the schema: %s", err)
+	}
+	if credentialType == "" || *fieldFlag == "" || *valuesFlag == "" {
+		return usageError("usage: query-spec [--schema <name|file>] --type <credential type> --field <field> [--op <operator>] --values <v1,v2,...> [--claim <claim>] | query-spec [--schema <name|file>] --type <credential type> [--field <field>] --min-age <years> [--claim <claim>]")
+	}
+	values, err := parseQueryValues(*valuesFlag)
+	if err != nil {
+		return err
+	}
+	spec, err := newQuerySpec(schemaBytes, credentialType, *fieldFlag, *opFlag, values)
+	if err != nil {
+		return fmt.Errorf("failed to generate the query: %s", err)
+	}
+	if *claimFlag != "" {
+		c, err := claimFromHex(*claimFlag)
+		if err != nil {
+			return withCode(errCodeInvalidInput, fmt.Errorf("failed to decode the claim: %s", err))
+		}
+		if err := spec.evaluate(c, values); err != nil {
+			return fmt.Errorf("failed to evaluate the query against the claim: %s", err)
+		}
+	}
+	out, _ := json.MarshalIndent(spec, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
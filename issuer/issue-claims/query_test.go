@@ -0,0 +1,122 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+)
+
+// evaluateQuery builds a claim of the slots and evaluates the query of the spec against it
+func evaluateQuery(t *testing.T, credentialType string, slots slotValues, spec *querySpec, values []*big.Int) error {
+	subject, err := core.IDFromString(testHolderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemaBytes, err := os.ReadFile("./schemas/test.json-ld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := append([]core.Option{withSubject(&subject), core.WithRevocationNonce(2)}, slots.options()...)
+	claim, err := core.NewClaim(schemaHash(schemaBytes, credentialType), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec.evaluate(claim, values)
+}
+
+func TestAgeLessThanQuery(t *testing.T) {
+	schemaBytes, err := os.ReadFile("./schemas/test.json-ld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cutoff := big.NewInt(20040611)
+	spec, err := newQuerySpec(schemaBytes, "KYCAgeCredential", "birthday", "lt", []*big.Int{cutoff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Operator != circuits.LT || spec.SlotIndex != 2 || spec.Values[0] != "20040611" || spec.Values[1] != "0" {
+		t.Fatalf("expected lt 20040611 on the slot 2, padded with zeros, got %+v", spec)
+	}
+
+	adult := slotValues{"i_2": big.NewInt(19960424), "i_3": big.NewInt(1)}
+	if err := evaluateQuery(t, "KYCAgeCredential", adult, spec, []*big.Int{cutoff}); err != nil {
+		t.Fatal(err)
+	}
+	if spec.ClaimValue != "19960424" || spec.Satisfied == nil || !*spec.Satisfied {
+		t.Errorf("expected a birthday before the cutoff to satisfy the query, got %+v", spec)
+	}
+
+	minor := slotValues{"i_2": big.NewInt(20100101), "i_3": big.NewInt(1)}
+	if err := evaluateQuery(t, "KYCAgeCredential", minor, spec, []*big.Int{cutoff}); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Satisfied == nil || *spec.Satisfied {
+		t.Errorf("expected a birthday after the cutoff not to satisfy the query, got %+v", spec)
+	}
+}
+
+func TestCountryInQuery(t *testing.T) {
+	schemaBytes, err := os.ReadFile("./schemas/test.json-ld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ISO 3166-1 numeric codes of DE, FR and US
+	codes := []*big.Int{big.NewInt(276), big.NewInt(250), big.NewInt(840)}
+	spec, err := newQuerySpec(schemaBytes, "KYCCountryOfResidenceCredential", "countryCode", "in", codes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Operator != circuits.IN || spec.SlotIndex != 2 || spec.Values[2] != "840" || spec.Values[3] != "0" {
+		t.Fatalf("expected in DE, FR, US on the slot 2, padded with zeros, got %+v", spec)
+	}
+
+	us := slotValues{"i_2": big.NewInt(840), "i_3": big.NewInt(1)}
+	if err := evaluateQuery(t, "KYCCountryOfResidenceCredential", us, spec, codes); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Satisfied == nil || !*spec.Satisfied {
+		t.Errorf("expected a country in the list to satisfy the query, got %+v", spec)
+	}
+
+	jp := slotValues{"i_2": big.NewInt(392), "i_3": big.NewInt(1)}
+	if err := evaluateQuery(t, "KYCCountryOfResidenceCredential", jp, spec, codes); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Satisfied == nil || *spec.Satisfied {
+		t.Errorf("expected a country out of the list not to satisfy the query, got %+v", spec)
+	}
+
+	if err := evaluateQuery(t, "KYCAgeCredential", us, spec, codes); err == nil {
+		t.Errorf("expected a claim of another schema to be refused")
+	}
+
+	tooMany := make([]*big.Int, circuits.BaseConfig{}.GetValueArrSize()+1)
+	for i := range tooMany {
+		tooMany[i] = big.NewInt(int64(i + 1))
+	}
+	if _, err := newQuerySpec(schemaBytes, "KYCCountryOfResidenceCredential", "countryCode", "in", tooMany); err == nil {
+		t.Errorf("expected in with more values than the circuit takes to be refused")
+	}
+	if _, err := newQuerySpec(schemaBytes, "KYCCountryOfResidenceCredential", "countryCode", "lt", codes); err == nil {
+		t.Errorf("expected lt with more than 1 value to be refused")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// The approved claim requests make up the issuance queue, that the issuance drains in the order they were
+// created with --from-request next. A request is counted as attempted before it is issued, so a run that
+// fails or is interrupted leaves the request in the queue to issue again, and one that keeps failing is
+// taken out of the queue as failed after maxIssueAttempts.
+const maxIssueAttempts = 3
+
+// queueNext is the --from-request value that takes the oldest approved request of the queue
+const queueNext = "next"
+
+// nextQueuedRequest returns the oldest approved request, which is the next one to issue
+func nextQueuedRequest(path string) (*claimRequest, error) {
+	requests, err := readClaimRequests(path)
+	if err != nil {
+		return nil, err
+	}
+	var next *claimRequest
+	for _, r := range requests {
+		if r.Status == requestApproved && (next == nil || r.Created.Before(next.Created)) {
+			next = r
+		}
+	}
+	if next == nil {
+		return nil, withCode(errCodeNotFound, fmt.Errorf("no approved claim request is queued"))
+	}
+	return next, nil
+}
+
+// attemptClaimRequest counts an attempt to issue an approved request. A request that was already attempted
+// maxIssueAttempts times is marked failed instead, and the error tells to retry it.
+func attemptClaimRequest(path, id string) error {
+	var failed bool
+	attempted := now().UTC()
+	_, err := updateClaimRequest(path, id, requestApproved, func(r *claimRequest) {
+		if r.Attempts >= maxIssueAttempts {
+			r.Status = requestFailed
+			failed = true
+			return
+		}
+		r.Attempts++
+		r.Attempted = &attempted
+	})
+	if err != nil {
+		return err
+	}
+	if failed {
+		err := fmt.Errorf("the claim request %s failed to issue %d times, and is marked failed, use queue retry %s after fixing the cause", id, maxIssueAttempts, id)
+		return withCode(errCodeConflict, err, "request", id, "status", requestFailed)
+	}
+	return nil
+}
+
+// queueCommand handles the "queue" subcommands, that list the approved claim requests waiting to be issued
+// and put failed requests back in the queue
+func queueCommand(args []string) error {
+	usage := usageError("usage: queue list [--failed] [--json] | queue retry <id>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("queue "+args[0], flag.ExitOnError)
+	requestsFlag := fs.String("requests", defaultClaimRequestsPath(), "path of the file that the claim requests are recorded in")
+	readOnly.register(fs, args[0] == "list")
+	switch args[0] {
+	case "list":
+		failedFlag := fs.Bool("failed", false, "only list the requests that failed to issue")
+		jsonFlag := fs.Bool("json", false, "print the requests as JSON lines, with their descriptors")
+		fs.Parse(args[1:])
+		requests, err := readClaimRequests(*requestsFlag)
+		if err != nil {
+			return err
+		}
+		for _, r := range requests {
+			if r.Status != requestFailed && (*failedFlag || r.Status != requestApproved) {
+				continue
+			}
+			if *jsonFlag {
+				line, _ := json.Marshal(r)
+				fmt.Println(string(line))
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\tattempts %d", r.ID, r.Status, r.Created.Format(time.RFC3339), r.Attempts)
+			if r.Attempted != nil {
+				fmt.Printf("\tlast attempted %s", r.Attempted.Format(time.RFC3339))
+			}
+			fmt.Println()
+		}
+	case "retry":
+		var operators operatorFlags
+		operators.register(fs)
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return usage
+		}
+		if _, err := operators.authorize(roleIssue); err != nil {
+			return fmt.Errorf("not authorized to retry the request: %w", err)
+		}
+		r, err := updateClaimRequest(*requestsFlag, fs.Arg(0), requestFailed, func(r *claimRequest) {
+			r.Status = requestApproved
+			r.Attempts = 0
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Queued the claim request %s again, issue it with: --from-request %s\n", r.ID, r.ID)
+	default:
+		return usage
+	}
+	return nil
+}
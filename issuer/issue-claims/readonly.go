@@ -0,0 +1,55 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// readOnlyMode guards every write to the issuer's files: the audit log, the receipts, the registries, the
+// pending transitions and the caches. In read-only mode a write that the command can't do without fails
+// before the file is touched, and a write that only fills a cache is skipped. The commands that only
+// inspect the files run read-only unless --read-only=false is passed.
+type readOnlyMode struct {
+	on bool
+}
+
+var readOnly = &readOnlyMode{}
+
+// register adds the --read-only option to the options of a command, on by default for the commands that
+// only inspect
+func (r *readOnlyMode) register(fs *flag.FlagSet, inspection bool) {
+	r.on = inspection
+	fs.BoolVar(&r.on, "read-only", r.on, "refuse to write to any of the issuer's files, on by default for the commands that only inspect them")
+}
+
+// check fails a write of the file at path in read-only mode
+func (r *readOnlyMode) check(path string) error {
+	if r.on {
+		return usageError("refusing to write %s in read-only mode, run without --read-only to write it", path)
+	}
+	return nil
+}
+
+// skip tells whether a write that only fills a cache is skipped, and narrates it
+func (r *readOnlyMode) skip(what string) bool {
+	if r.on {
+		fmt.Printf("-> Not caching %s in read-only mode\n", what)
+	}
+	return r.on
+}
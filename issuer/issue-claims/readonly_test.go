@@ -0,0 +1,149 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// homeFile is a file in the home directory as read-only mode must leave it
+type homeFile struct {
+	modTime time.Time
+	content []byte
+}
+
+func snapshotHome(t *testing.T, home string) map[string]homeFile {
+	files := map[string]homeFile{}
+	err := filepath.Walk(home, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		files[path] = homeFile{modTime: info.ModTime(), content: content}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// testReceipt issues a claim and returns its receipt
+func testReceipt(t *testing.T) *issuanceReceipt {
+	ctx := context.Background()
+	var key babyjub.PrivateKey
+	key[0] = 1
+	identity, err := issuer.New(ctx, issuer.NewMemoryStorage(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := core.IDFromString(testHolderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim, err := core.NewClaim(schemaHash([]byte("{}"), "ReadOnly"), withSubject(&subject), core.WithRevocationNonce(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := identity.IssueClaim(ctx, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trees := &issuerTrees{claims: identity.ClaimsTree(), revocations: identity.RevocationsTree(), roots: identity.RootsTree()}
+	r, err := newIssuanceReceipt(ctx, &key, identity.ID, claim, issued.OldState, trees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestInspectionCommandsLeaveTheFilesUnchanged(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Cleanup(func() { readOnly.on = false })
+	log, err := openAuditLog(defaultAuditLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.record("create-identity", "ok", map[string]string{"issuer": testHolderID}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeReceipts(defaultReceiptsPath(), []*issuanceReceipt{testReceipt(t)}); err != nil {
+		t.Fatal(err)
+	}
+	// the files are dated in the past, so that rewriting one with the same content shows in its mtime
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, path := range []string{defaultAuditLogPath(), defaultReceiptsPath()} {
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := snapshotHome(t, home)
+
+	for name, args := range map[string][]string{
+		"audit":          {"list"},
+		"stats":          nil,
+		"list-claims":    nil,
+		"verify-receipt": nil,
+		"schema":         {"list"},
+		"transition":     {"list"},
+		"circuits":       {"list"},
+		"request":        {"list"},
+		"queue":          {"list"},
+	} {
+		captureOutput(t, func() {
+			if err := commands[name](args); err != nil {
+				t.Errorf("%s: %s", name, err)
+			}
+		})
+		after := snapshotHome(t, home)
+		if len(after) != len(before) {
+			t.Errorf("%s: expected the %d files of the home directory, got %d", name, len(before), len(after))
+		}
+		for path, file := range before {
+			if a, ok := after[path]; !ok || !a.modTime.Equal(file.modTime) || !bytes.Equal(a.content, file.content) {
+				t.Errorf("%s: expected %s to be left unchanged", name, path)
+			}
+		}
+	}
+}
+
+func TestReadOnlyRefusesWrites(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Cleanup(func() { readOnly.on = false })
+	log, err := openAuditLog(defaultAuditLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly.on = true
+	if err := log.record("create-identity", "ok", nil, nil, nil); err == nil {
+		t.Errorf("expected the audit entry to be refused in read-only mode")
+	}
+	if _, err := os.Stat(defaultAuditLogPath()); !os.IsNotExist(err) {
+		t.Errorf("expected no audit log to be written in read-only mode")
+	}
+}
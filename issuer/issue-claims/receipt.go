@@ -0,0 +1,393 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+	merkletree "github.com/iden3/go-merkletree-sql"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// issuanceReceipt is the issuer's signed acknowledgment of an issued claim. It carries the roots of the
+// state after the issuance and the proof of the claim in the claims tree, so it can be verified on its own,
+// without the issuer's trees.
+type issuanceReceipt struct {
+	Issuer          string            `json:"issuer"`
+	IssuerPublicKey string            `json:"issuerPublicKey"`
+	Claim           string            `json:"claim"`
+	SchemaHash      string            `json:"schemaHash"`
+	Subject         string            `json:"subject"`
+	RevocationNonce uint64            `json:"revocationNonce"`
+	OldState        string            `json:"oldState"`
+	NewState        string            `json:"newState"`
+	ClaimsRoot      string            `json:"claimsRoot"`
+	RevocationRoot  string            `json:"revocationRoot"`
+	RootOfRoots     string            `json:"rootOfRoots"`
+	Proof           *merkletree.Proof `json:"proof"`
+	Timestamp       int64             `json:"timestamp"`
+	Signature       string            `json:"signature"`
+	// SubjectIndex is the HMAC of the subject of a receipt whose claim and subject are encrypted
+	SubjectIndex string `json:"subjectIndex,omitempty"`
+	// ErasedAt is the time that erase replaced the claim and the subject with tombstones
+	ErasedAt int64 `json:"erasedAt,omitempty"`
+	// Supersedes is the claim that this one renews, which is not signed
+	Supersedes *issuedClaimRef `json:"supersedes,omitempty"`
+
+	// supersededBy is the revocation nonce of the claim that renews this one, found by list-claims
+	supersededBy *uint64
+}
+
+// The tombstone of an erased claim keeps its index and value hashes, which are the leaf of the claims tree,
+// so that the signature and the proof of the receipt still verify
+const (
+	erasedPrefix  = "erased:"
+	erasedSubject = "erased"
+)
+
+func defaultReceiptsPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_receipts.json")
+}
+
+// newIssuanceReceipt signs a receipt for a claim that was just added to the claims tree
+func newIssuanceReceipt(ctx context.Context, signer issuer.Signer, issuer *core.ID, claim *core.Claim, oldState *merkletree.Hash, trees *issuerTrees) (*issuanceReceipt, error) {
+	claimHex, err := claimToHex(claim)
+	if err != nil {
+		return nil, err
+	}
+	d, err := decodeClaim(claim)
+	if err != nil {
+		return nil, err
+	}
+	hIndex, err := claim.HIndex()
+	if err != nil {
+		return nil, err
+	}
+	proof, _, err := trees.claims.GenerateProof(ctx, hIndex, trees.claims.Root())
+	if err != nil {
+		return nil, err
+	}
+	newState, err := trees.state()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &issuanceReceipt{
+		Issuer:          issuer.String(),
+		IssuerPublicKey: signer.Public().String(),
+		Claim:           claimHex,
+		SchemaHash:      d.SchemaHash,
+		Subject:         "self",
+		RevocationNonce: d.RevocationNonce,
+		OldState:        oldState.BigInt().String(),
+		NewState:        newState.BigInt().String(),
+		ClaimsRoot:      trees.claims.Root().BigInt().String(),
+		RevocationRoot:  trees.revocations.Root().BigInt().String(),
+		RootOfRoots:     trees.roots.Root().BigInt().String(),
+		Proof:           proof,
+		Timestamp:       now().Unix(),
+	}
+	if id, err := claim.GetID(); err == nil {
+		r.Subject = (&core.DID{ID: id}).String()
+	}
+	hIndex, hValue, err := claim.HiHv()
+	if err != nil {
+		return nil, err
+	}
+	h, err := r.hash(hIndex, hValue)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.SignPoseidon(h).Compress().MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	r.Signature = string(sig)
+	return r, nil
+}
+
+// hash is the Poseidon hash that the issuer signs: the claim by its index and value hashes, the issuer,
+// the states before and after the issuance, and the time of the issuance
+func (r *issuanceReceipt) hash(hIndex, hValue *big.Int) (*big.Int, error) {
+	issuer, err := core.IDFromString(r.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid issuer: %s", err)
+	}
+	oldState, ok := new(big.Int).SetString(r.OldState, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid old state %q", r.OldState)
+	}
+	newState, ok := new(big.Int).SetString(r.NewState, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid new state %q", r.NewState)
+	}
+	return poseidon.Hash([]*big.Int{hIndex, hValue, issuer.BigInt(), oldState, newState, big.NewInt(r.Timestamp)})
+}
+
+func (r *issuanceReceipt) erased() bool {
+	return strings.HasPrefix(r.Claim, erasedPrefix)
+}
+
+// claimTombstone returns the tombstone of the claim in the canonical hex encoding
+func claimTombstone(claimHex string) (string, error) {
+	claim, err := claimFromHex(claimHex)
+	if err != nil {
+		return "", fmt.Errorf("invalid claim: %s", err)
+	}
+	hIndex, hValue, err := claim.HiHv()
+	if err != nil {
+		return "", err
+	}
+	return leafTombstone(hIndex, hValue), nil
+}
+
+// leafTombstone is the tombstone of the claim of a leaf of the claims tree
+func leafTombstone(hIndex, hValue *big.Int) string {
+	return fmt.Sprintf("%s%s:%s", erasedPrefix, hIndex, hValue)
+}
+
+// parseTombstone returns the index and value hashes that the tombstone of an erased claim keeps
+func parseTombstone(tombstone string) (*big.Int, *big.Int, error) {
+	parts := strings.Split(strings.TrimPrefix(tombstone, erasedPrefix), ":")
+	if strings.HasPrefix(tombstone, erasedPrefix) && len(parts) == 2 {
+		hIndex, ok1 := new(big.Int).SetString(parts[0], 10)
+		hValue, ok2 := new(big.Int).SetString(parts[1], 10)
+		if ok1 && ok2 {
+			return hIndex, hValue, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("invalid tombstone %q", tombstone)
+}
+
+// erase replaces the claim and the subject with tombstones
+func (r *issuanceReceipt) erase() error {
+	tombstone, err := claimTombstone(r.Claim)
+	if err != nil {
+		return err
+	}
+	r.Claim = tombstone
+	r.Subject = erasedSubject
+	r.SubjectIndex = ""
+	r.ErasedAt = now().Unix()
+	return nil
+}
+
+// leafHashes returns the index and value hashes of the claim, or of its tombstone
+func (r *issuanceReceipt) leafHashes() (*big.Int, *big.Int, error) {
+	if r.erased() {
+		return parseTombstone(r.Claim)
+	}
+	claim, err := claimFromHex(r.Claim)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid claim: %s", err)
+	}
+	d, err := decodeClaim(claim)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid claim: %s", err)
+	}
+	subject := "self"
+	if id, err := claim.GetID(); err == nil {
+		subject = (&core.DID{ID: id}).String()
+	}
+	if d.SchemaHash != r.SchemaHash || subject != r.Subject || d.RevocationNonce != r.RevocationNonce {
+		return nil, nil, fmt.Errorf("the schema hash, subject or revocation nonce doesn't match the claim")
+	}
+	return claim.HiHv()
+}
+
+// verify checks the issuer's signature over the receipt, that the readable fields match the claim, and
+// that the claim is in the claims tree of the stated new state. The receipt of an erased claim is checked
+// by the leaf hashes in its tombstone.
+func (r *issuanceReceipt) verify() error {
+	hIndex, hValue, err := r.leafHashes()
+	if err != nil {
+		return err
+	}
+
+	var pubKey babyjub.PublicKey
+	if err := pubKey.UnmarshalText([]byte(r.IssuerPublicKey)); err != nil {
+		return fmt.Errorf("invalid issuer public key: %s", err)
+	}
+	var sigComp babyjub.SignatureComp
+	if err := sigComp.UnmarshalText([]byte(r.Signature)); err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	sig, err := sigComp.Decompress()
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	h, err := r.hash(hIndex, hValue)
+	if err != nil {
+		return err
+	}
+	if !pubKey.VerifyPoseidon(h, sig) {
+		return fmt.Errorf("the signature doesn't verify with the issuer public key %s", r.IssuerPublicKey)
+	}
+
+	roots := make([]*big.Int, 3)
+	for i, root := range []string{r.ClaimsRoot, r.RevocationRoot, r.RootOfRoots} {
+		var ok bool
+		if roots[i], ok = new(big.Int).SetString(root, 10); !ok {
+			return fmt.Errorf("invalid tree root %q", root)
+		}
+	}
+	state, err := merkletree.HashElems(roots...)
+	if err != nil {
+		return err
+	}
+	if state.BigInt().String() != r.NewState {
+		return fmt.Errorf("the tree roots don't make up the new state %s", r.NewState)
+	}
+	claimsRoot, err := merkletree.NewHashFromBigInt(roots[0])
+	if err != nil {
+		return err
+	}
+	if r.Proof == nil {
+		return fmt.Errorf("the receipt has no proof of the claim")
+	}
+	return verifyLeafInclusion(claimsRoot, r.Proof, hIndex, hValue)
+}
+
+// receiptKey identifies the issuance of a claim: the issuer, the revocation nonce and the claim
+func receiptKey(r *issuanceReceipt) string {
+	return fmt.Sprintf("%s/%d/%s", r.Issuer, r.RevocationNonce, r.Claim)
+}
+
+// writeReceipts appends the receipts to a file with one JSON receipt per line, with their claims and
+// subjects encrypted if there are data keys. A receipt of a claim that the file has a receipt of from
+// the issuer already, such as after resuming a transition, isn't appended again.
+func writeReceipts(path string, receipts []*issuanceReceipt) error {
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	written := map[string]bool{}
+	err := scanJSONLines(path, func(line int, b []byte) error {
+		var r issuanceReceipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("line %d of the receipts file is not a valid receipt: %s", line, err)
+		}
+		// a receipt encrypted with a data key that is gone can't be compared, nor can a tombstone
+		if receiptKeys.open(&r) == nil && !r.erased() {
+			written[receiptKey(&r)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var unwritten []*issuanceReceipt
+	for _, r := range receipts {
+		if !written[receiptKey(r)] {
+			written[receiptKey(r)] = true
+			unwritten = append(unwritten, r)
+		}
+	}
+	receipts = unwritten
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, r := range receipts {
+		sealed, err := receiptKeys.seal(r)
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(sealed)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+func readReceipts(path string) ([]*issuanceReceipt, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var receipts []*issuanceReceipt
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r issuanceReceipt
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("line %d of the receipts file is not a valid receipt: %s", line, err)
+		}
+		receipts = append(receipts, &r)
+	}
+	return receipts, scanner.Err()
+}
+
+// verifyReceiptCommand handles the "verify-receipt" command that verifies the receipts of issued claims
+func verifyReceiptCommand(args []string) error {
+	fs := flag.NewFlagSet("verify-receipt", flag.ExitOnError)
+	pathFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file")
+	claimFlag := fs.String("claim", "", "only verify the receipts for this claim, in the canonical hex encoding")
+	sensitive.register(fs)
+	receiptKeys.register(fs)
+	readOnly.register(fs, true)
+	fs.Parse(args)
+
+	receipts, err := readReceipts(*pathFlag)
+	if err != nil {
+		return err
+	}
+	verified := 0
+	for i, r := range receipts {
+		if err := receiptKeys.open(r); err != nil {
+			return fmt.Errorf("receipt %d: %w", i+1, err)
+		}
+		if *claimFlag != "" && r.Claim != *claimFlag {
+			continue
+		}
+		if err := r.verify(); err != nil {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("receipt %d failed verification: %s", i+1, err), "receipt", strconv.Itoa(i+1))
+		}
+		issuedAt := time.Unix(r.Timestamp, 0).UTC().Format(time.RFC3339)
+		if r.erased() {
+			fmt.Printf("Verified the receipt for the erased claim with schema hash %s at %s\n", r.SchemaHash, issuedAt)
+		} else {
+			fmt.Printf("Verified the receipt for the claim with schema hash %s issued to %s at %s\n", r.SchemaHash, sensitive.id(r.Subject), issuedAt)
+		}
+		verified++
+	}
+	if verified == 0 {
+		return fmt.Errorf("no receipts to verify in %s", *pathFlag)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteReceiptsSkipsDuplicates(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		home := testHome(t)
+		saved := receiptKeys
+		receiptKeys = &dataKeys{path: filepath.Join(home, "iden3_data_keys.json")}
+		defer func() { receiptKeys = saved }()
+		t.Setenv(issuerKeyEnv, strings.Repeat("08", 32))
+		if code, printed := runWalkthrough(t); code != 0 {
+			t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+		}
+		path := filepath.Join(home, "iden3_receipts.json")
+		if encrypted {
+			captureOutput(t, func() {
+				if err := rekeyRegistryCommand([]string{"--receipts", path, "--data-keys", receiptKeys.path}); err != nil {
+					t.Fatalf("failed to encrypt the receipts: %s", err)
+				}
+			})
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Fatalf("expected the encrypted receipts readable by the owner only, got the mode %v", info.Mode().Perm())
+			}
+		}
+		receipts, err := readReceipts(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, sealed := encryptedKeyID(receipts[0].Claim); sealed != encrypted {
+			t.Fatalf("expected the receipts encrypted %t", encrypted)
+		}
+		for _, r := range receipts {
+			if err := receiptKeys.open(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the same receipts again, and one of them twice in the batch, add nothing
+		if err := writeReceipts(path, append(receipts, receipts[0])); err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := readReceipts(path); len(again) != len(receipts) {
+			t.Errorf("encrypted %t: expected the %d receipts, found %d after writing them again", encrypted, len(receipts), len(again))
+		}
+
+		// a receipt of another claim on the same nonce is appended
+		other := *receipts[0]
+		other.Claim = receipts[1].Claim
+		if err := writeReceipts(path, []*issuanceReceipt{&other}); err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := readReceipts(path); len(again) != len(receipts)+1 {
+			t.Errorf("encrypted %t: expected %d receipts with the new one, found %d", encrypted, len(receipts)+1, len(again))
+		}
+	}
+}
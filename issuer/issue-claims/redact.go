@@ -0,0 +1,120 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	core "github.com/iden3/go-iden3-core"
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// redactedValue stands in for a masked data value
+const redactedValue = "***"
+
+// redaction masks the personal data in the narrative and log output: the claim data values are
+// masked and the holder identifiers are truncated, unless --show-sensitive is set. The files that
+// are written for the holder, or for the proofs, always carry the full values.
+type redaction struct {
+	show bool
+}
+
+var sensitive = &redaction{}
+
+func (r *redaction) register(fs *flag.FlagSet) {
+	fs.BoolVar(&r.show, "show-sensitive", r.show, "print the holder identifiers and the claim data in full, instead of truncated and masked")
+}
+
+// id truncates an identifier, or the identifier at the end of a DID, to enough characters to
+// tell apart the holders of a run
+func (r *redaction) id(s string) string {
+	if r.show {
+		return s
+	}
+	prefix := ""
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		prefix, s = s[:i+1], s[i+1:]
+	}
+	if len(s) <= 10 {
+		return prefix + s
+	}
+	return prefix + s[:6] + "..." + s[len(s)-4:]
+}
+
+// value masks a claim data value
+func (r *redaction) value(v interface{}) string {
+	if r.show {
+		return fmt.Sprint(v)
+	}
+	return redactedValue
+}
+
+// keptSlots are the slots of a claim that hold no personal data, and are never masked: the header slots i_0
+// and v_0 with the schema hash, the revocation nonce, the version and the expiration, and in an auth claim the
+// public key of the issuer in i_2 and i_3. The slots 0 to 3 are the index slots, 4 to 7 the value slots.
+func keptSlots(schemaHash string) map[int]bool {
+	kept := map[int]bool{0: true, 4: true}
+	if schemaHash == issuer.AuthSchemaHash {
+		kept[2], kept[3] = true, true
+	}
+	return kept
+}
+
+func schemaHashOf(c *core.Claim) string {
+	sHashText, _ := c.GetSchemaHash().MarshalText()
+	return string(sHashText)
+}
+
+// claimJSON encodes the slots of a claim, with the slots that keptSlots doesn't list masked
+func (r *redaction) claimJSON(c *core.Claim) string {
+	encoded, _ := json.Marshal(c)
+	if r.show {
+		return string(encoded)
+	}
+	var slots []string
+	if err := json.Unmarshal(encoded, &slots); err != nil || len(slots) != 8 {
+		return redactedValue
+	}
+	kept := keptSlots(schemaHashOf(c))
+	for i := range slots {
+		if !kept[i] {
+			slots[i] = redactedValue
+		}
+	}
+	masked, _ := json.Marshal(slots)
+	return string(masked)
+}
+
+// claimHex truncates the hex encoding of a claim to the slot i_0, with the schema hash. An auth claim holds
+// no personal data, and is printed in full.
+func (r *redaction) claimHex(c *core.Claim, h string) string {
+	if r.show || len(h) <= 64 || schemaHashOf(c) == issuer.AuthSchemaHash {
+		return h
+	}
+	return h[:64] + "... (truncated, --show-sensitive prints it in full)"
+}
+
+// hashOf is the SHA-256 hash of a value that the audit log records in place of the value
+func hashOf(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
@@ -0,0 +1,243 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+)
+
+// builtinSchemaTypes are the credential types of the schema document that the KYC claims are issued with,
+// which a reissued claim can refer to without a registered schema
+var builtinSchemaTypes = []string{"KYCAgeCredential", "KYCCountryOfResidenceCredential", "KYCCredential"}
+
+const builtinSchemaPath = "./schemas/test.json-ld"
+
+// findReceipt returns the latest receipt of the claim with the revocation nonce. Without an issuer, it fails
+// if issuers other than the one of the latest receipt also issued a claim with the nonce.
+func findReceipt(path, issuerID string, revNonce uint64) (*issuanceReceipt, error) {
+	var found *issuanceReceipt
+	issuers := map[string]bool{}
+	err := scanJSONLines(path, func(line int, b []byte) error {
+		var r issuanceReceipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("line %d of the receipts file is not a valid receipt: %s", line, err)
+		}
+		if r.RevocationNonce == revNonce && (issuerID == "" || r.Issuer == issuerID) {
+			found = &r
+			issuers[r.Issuer] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(issuers) > 1 {
+		err := fmt.Errorf("claims of %d issuers have the revocation nonce %d, name the issuer with --issuer", len(issuers), revNonce)
+		return nil, withCode(errCodeUsage, err, "revocationNonce", strconv.FormatUint(revNonce, 10))
+	}
+	if found != nil {
+		if found.erased() {
+			return nil, withCode(errCodeConflict, fmt.Errorf("the claim with the revocation nonce %d was erased", revNonce), "revocationNonce", strconv.FormatUint(revNonce, 10))
+		}
+		if err := receiptKeys.open(found); err != nil {
+			return nil, err
+		}
+	}
+	if found == nil {
+		return nil, withCode(errCodeNotFound, fmt.Errorf("no claim with the revocation nonce %d in the receipts", revNonce), "revocationNonce", strconv.FormatUint(revNonce, 10))
+	}
+	return found, nil
+}
+
+// reissueDescriptor describes a copy of the claim with a new expiration, taking the schema, the subject
+// and the data slots from the claim. The schema is named by the registered schema with the claim's schema
+// hash, or else by the path of the KYC schema document if one of its types has the hash. The revocation
+// nonce is left for the issuance to allocate.
+func reissueDescriptor(claim *core.Claim, schemasPath string, expiration time.Time) (*claimDescriptor, error) {
+	sHash := claim.GetSchemaHash()
+	sHashText, _ := sHash.MarshalText()
+	d := &claimDescriptor{
+		Slots:           map[string]slotDescriptor{},
+		RevocationNonce: "next",
+		Expiration:      expiration.UTC().Format(time.RFC3339),
+		Updatable:       claim.GetFlagUpdatable(),
+	}
+	schemas, err := readSchemas(schemasPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range schemas {
+		if s.Hash == string(sHashText) {
+			d.Schema, d.Type = s.Name, s.Type
+			break
+		}
+	}
+	if document, err := os.ReadFile(builtinSchemaPath); d.Schema == "" && err == nil {
+		for _, t := range builtinSchemaTypes {
+			if schemaHash(document, t) == sHash {
+				d.Schema, d.Type = builtinSchemaPath, t
+				break
+			}
+		}
+	}
+	if d.Schema == "" {
+		return nil, withCode(errCodeNotFound, fmt.Errorf("no registered schema has the schema hash %s of the claim, register it with schema add", sHashText), "schemaHash", string(sHashText))
+	}
+
+	copySubject(d, claim)
+	slots := claim.RawSlotsAsInts()
+	for name, index := range dataSlotIndexes {
+		if slots[index].Sign() != 0 {
+			d.Slots[name] = slotDescriptor{Type: "int", Value: json.RawMessage(strconv.Quote(slots[index].String()))}
+		}
+	}
+	return d, nil
+}
+
+// copySubject sets the subject of the descriptor to the subject of the claim, in the same position
+func copySubject(d *claimDescriptor, claim *core.Claim) {
+	if subject, err := claim.GetID(); err == nil {
+		d.Subject = subject.String()
+		if position, _ := claim.GetIDPosition(); position == core.IDPositionValue {
+			d.SubjectPosition = "value"
+		}
+	}
+}
+
+// issuedClaimRef refers to an issued claim by its issuer and revocation nonce, which tell it apart among the
+// receipts
+type issuedClaimRef struct {
+	Issuer          string `json:"issuer"`
+	RevocationNonce uint64 `json:"revocationNonce"`
+}
+
+// supersedingRequest returns the approved or issued request that supersedes the claim, or nil if there is
+// none
+func supersedingRequest(requests []*claimRequest, claim issuedClaimRef) *claimRequest {
+	for _, r := range requests {
+		if r.Supersedes != nil && *r.Supersedes == claim && (r.Status == requestApproved || r.Status == requestIssued) {
+			return r
+		}
+	}
+	return nil
+}
+
+// newSupersedingRequest validates the descriptor like a requested claim, so that it can be issued, and
+// returns an approved request for it that supersedes the claim
+func newSupersedingRequest(d *claimDescriptor, schemasPath, operator string, claim issuedClaimRef, reason string) (*claimRequest, error) {
+	b, _ := json.Marshal(d)
+	if _, err := parseClaimDescriptor(b, schemasPath); err != nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("invalid claim descriptor %s", err))
+	}
+	id, err := newUUID(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	decided := now().UTC()
+	return &claimRequest{
+		ID:         id,
+		Status:     requestApproved,
+		Requester:  operator,
+		Descriptor: b,
+		Created:    decided,
+		Approver:   operator,
+		Decided:    &decided,
+		Reason:     reason,
+		Supersedes: &claim,
+	}, nil
+}
+
+// reissueCommand handles the "reissue" command, which renews a claim with a new expiration. It records an
+// approved claim request for a copy of the claim, which the next issuance issues with --from-request and a
+// new revocation nonce, and which links the new claim to the one it supersedes.
+func reissueCommand(args []string) error {
+	fs := flag.NewFlagSet("reissue", flag.ExitOnError)
+	readOnly.register(fs, false)
+	nonceFlag := fs.String("nonce", "", "revocation nonce of the claim to reissue")
+	expirationFlag := fs.String("expiration", "", "expiration of the new claim, in RFC 3339 format")
+	issuerFlag := fs.String("issuer", "", "ID of the issuer of the claim, if the nonce was issued by more than one")
+	receiptsFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file")
+	receiptKeys.register(fs)
+	requestsFlag := fs.String("requests", defaultClaimRequestsPath(), "path of the file that the claim requests are recorded in")
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file of the registered schemas")
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	if *nonceFlag == "" || *expirationFlag == "" {
+		return usageError("usage: reissue --nonce <revocation nonce> --expiration <time> [--issuer <id>]")
+	}
+	revNonce, err := strconv.ParseUint(*nonceFlag, 10, 64)
+	if err != nil {
+		return usageError("invalid --nonce %q: %s", *nonceFlag, err)
+	}
+	expiration, err := time.Parse(time.RFC3339, *expirationFlag)
+	if err != nil {
+		return usageError("invalid --expiration %q: %s", *expirationFlag, err)
+	}
+	if !expiration.After(now()) {
+		return withCode(errCodeInvalidInput, fmt.Errorf("the expiration %s is in the past", expiration.UTC().Format(time.RFC3339)))
+	}
+	operator, err := operators.authorize(roleIssue)
+	if err != nil {
+		return fmt.Errorf("not authorized to reissue the claim: %w", err)
+	}
+
+	receipt, err := findReceipt(*receiptsFlag, *issuerFlag, revNonce)
+	if err != nil {
+		return err
+	}
+	claim, err := claimFromHex(receipt.Claim)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid claim in the receipt: %s", err))
+	}
+	if old, ok := claim.GetExpirationDate(); ok {
+		fmt.Printf("Reissue the claim with the revocation nonce %d, expiring %s\n", revNonce, old.UTC().Format(time.RFC3339))
+	} else {
+		fmt.Printf("Reissue the claim with the revocation nonce %d, which has no expiration\n", revNonce)
+	}
+	d, err := reissueDescriptor(claim, *schemasFlag, expiration)
+	if err != nil {
+		return err
+	}
+	requests, err := readClaimRequests(*requestsFlag)
+	if err != nil {
+		return err
+	}
+	old := issuedClaimRef{Issuer: receipt.Issuer, RevocationNonce: revNonce}
+	if existing := supersedingRequest(requests, old); existing != nil {
+		return withCode(errCodeConflict, fmt.Errorf("the claim with the revocation nonce %d is already reissued by the request %s", revNonce, existing.ID), "request", existing.ID)
+	}
+	r, err := newSupersedingRequest(d, *schemasFlag, operator, old, fmt.Sprintf("reissue of the claim with the revocation nonce %d", revNonce))
+	if err != nil {
+		return err
+	}
+	if err := writeClaimRequests(*requestsFlag, append(requests, r)); err != nil {
+		return err
+	}
+	fmt.Printf("-> Schema: %s (%s)\n", d.Schema, d.Type)
+	fmt.Printf("-> New expiration: %s\n", d.Expiration)
+	fmt.Printf("Recorded the approved claim request %s, issue it with: --from-request %s\n", r.ID, r.ID)
+	return nil
+}
@@ -0,0 +1,384 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	merkletree "github.com/iden3/go-merkletree-sql"
+	"github.com/iden3/go-merkletree-sql/db/memory"
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// replayer rebuilds the trees of an issuer from the leaves that the audit log records, and checks every
+// state it passes through against the state recorded after the operation
+type replayer struct {
+	levels   int
+	trees    *issuerTrees
+	replayed int
+	// importing is set from the first claim of an import until the state it makes up
+	importing bool
+	// history holds every state that the trees passed through, by the state in decimal
+	history map[string]*pastState
+	// published holds the states that the transitions file records as published, in decimal
+	published map[string]bool
+}
+
+// pastState is a state of the issuer as the replay passed through it. The trees are those of the run that
+// reached it, which keep its nodes after they moved on, and the roots pin them to the state.
+type pastState struct {
+	seq         int
+	operation   string
+	trees       *issuerTrees
+	claims      *merkletree.Hash
+	revocations *merkletree.Hash
+	roots       *merkletree.Hash
+}
+
+// reset starts over with empty trees, as every run of the issuer starts from its genesis state
+func (r *replayer) reset(ctx context.Context) error {
+	var trees issuerTrees
+	for _, t := range []**merkletree.MerkleTree{&trees.claims, &trees.revocations, &trees.roots} {
+		tree, err := merkletree.NewMerkleTree(ctx, memory.NewMemoryStorage(), r.levels)
+		if err != nil {
+			return err
+		}
+		*t = tree
+	}
+	r.trees = &trees
+	return nil
+}
+
+// addLeaf adds the leaf recorded in the params of an entry to the claims tree
+func (r *replayer) addLeaf(ctx context.Context, e *auditEntry) error {
+	leaf, ok := e.Params["leaf"]
+	if !ok {
+		return withCode(errCodeInvalidInput, fmt.Errorf("entry %d (%s) was recorded without the leaf of its claim, and can't be replayed", e.Seq, e.Operation), "seq", strconv.Itoa(e.Seq))
+	}
+	parts := strings.SplitN(leaf, ":", 2)
+	hIndex, okIndex := new(big.Int).SetString(parts[0], 10)
+	var hValue *big.Int
+	okValue := len(parts) == 2
+	if okValue {
+		hValue, okValue = new(big.Int).SetString(parts[1], 10)
+	}
+	if !okIndex || !okValue {
+		return withCode(errCodeInvalidInput, fmt.Errorf("entry %d (%s) has an invalid leaf %q", e.Seq, e.Operation, leaf), "seq", strconv.Itoa(e.Seq))
+	}
+	return r.trees.claims.Add(ctx, hIndex, hValue)
+}
+
+// addImported adds the revoked nonces and the roots recorded by an import to the revocations and roots trees
+func (r *replayer) addImported(ctx context.Context, e *auditEntry) error {
+	for _, list := range []struct {
+		param string
+		tree  *merkletree.MerkleTree
+	}{{"revocations", r.trees.revocations}, {"roots", r.trees.roots}} {
+		if e.Params[list.param] == "" {
+			continue
+		}
+		for _, v := range strings.Split(e.Params[list.param], ",") {
+			k, ok := new(big.Int).SetString(v, 10)
+			if !ok {
+				return withCode(errCodeInvalidInput, fmt.Errorf("entry %d (%s) has an invalid %s %q", e.Seq, e.Operation, list.param, v), "seq", strconv.Itoa(e.Seq))
+			}
+			if err := list.tree.Add(ctx, k, big.NewInt(0)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check compares the state of the rebuilt trees with the state recorded after an entry
+func (r *replayer) check(e *auditEntry) error {
+	state, err := r.trees.state()
+	if err != nil {
+		return err
+	}
+	if got := state.BigInt().String(); got != e.NewState {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the state diverges at entry %d (%s): the rebuilt trees are at %s, the entry recorded %s", e.Seq, e.Operation, got, e.NewState), "seq", strconv.Itoa(e.Seq))
+	}
+	if r.history == nil {
+		r.history = map[string]*pastState{}
+	}
+	if _, ok := r.history[e.NewState]; !ok {
+		r.history[e.NewState] = &pastState{
+			seq:         e.Seq,
+			operation:   e.Operation,
+			trees:       r.trees,
+			claims:      r.trees.claims.Root(),
+			revocations: r.trees.revocations.Root(),
+			roots:       r.trees.roots.Root(),
+		}
+	}
+	return nil
+}
+
+// root returns the root of the named tree at the state
+func (p *pastState) root(name string) *merkletree.Hash {
+	switch name {
+	case "claims":
+		return p.claims
+	case "revocations":
+		return p.revocations
+	default:
+		return p.roots
+	}
+}
+
+// checkPublished checks that a transition of the issuer to the state, or from its genesis state, is recorded
+// as published, and that the roots it recorded are those of the rebuilt trees
+func (p *pastState) checkPublished(transitions []*stateTransition, issuerID, state string) error {
+	for _, t := range transitions {
+		if t.Issuer != issuerID || t.Status != transitionPublished {
+			continue
+		}
+		if t.OldStateGenesis && t.OldState == state {
+			return nil
+		}
+		if t.NewState != state {
+			continue
+		}
+		for _, root := range []struct{ name, recorded string }{{"claims", t.ClaimsRoot}, {"revocations", t.RevocationRoot}, {"roots", t.RootOfRoots}} {
+			if root.recorded != "" && root.recorded != p.root(root.name).BigInt().String() {
+				return withCode(errCodeVerificationFailed, fmt.Errorf("the published transition to %s recorded the %s root %s, the rebuilt trees have %s", state, root.name, root.recorded, p.root(root.name).BigInt()))
+			}
+		}
+		return nil
+	}
+	return withCode(errCodeNotFound, fmt.Errorf("no published transition of %s reaches the state %s", issuerID, state), "state", state)
+}
+
+// replay applies an entry to the trees. The operations that don't change the trees, and those of a run
+// whose genesis isn't in the log, are skipped. An imported identity starts from the trees of its import.
+func (r *replayer) replay(ctx context.Context, e *auditEntry) error {
+	switch e.Operation {
+	case "create-identity":
+		if err := r.reset(ctx); err != nil {
+			return err
+		}
+		if err := r.addLeaf(ctx, e); err != nil {
+			return err
+		}
+		if err := r.check(e); err != nil {
+			return err
+		}
+		// before updating the claims tree, the claims tree root at this point is added to the roots tree
+		if err := r.trees.roots.Add(ctx, r.trees.claims.Root().BigInt(), big.NewInt(0)); err != nil {
+			return err
+		}
+	case "issue-claim", "update-claim":
+		if r.trees == nil {
+			return nil
+		}
+		if e.Status == auditAborted {
+			// an aborted addition may or may not have reached the tree
+			if err := r.check(e); err == nil {
+				r.replayed++
+				return nil
+			}
+		}
+		if err := r.addLeaf(ctx, e); err != nil {
+			return err
+		}
+		if err := r.check(e); err != nil {
+			return err
+		}
+	case "revoke-claim":
+		if r.trees == nil {
+			return nil
+		}
+		if e.Status == auditAborted {
+			// a refused revocation leaves the tree as it was
+			if err := r.check(e); err == nil {
+				r.replayed++
+				return nil
+			}
+		}
+		nonce, ok := new(big.Int).SetString(e.Params["revocationNonce"], 10)
+		if !ok {
+			return withCode(errCodeInvalidInput, fmt.Errorf("entry %d (%s) has an invalid revocation nonce %q", e.Seq, e.Operation, e.Params["revocationNonce"]), "seq", strconv.Itoa(e.Seq))
+		}
+		if err := r.trees.revocations.Add(ctx, nonce, big.NewInt(0)); err != nil {
+			return err
+		}
+		if err := r.check(e); err != nil {
+			return err
+		}
+	case "import-claim":
+		// the claims of an imported identity are recorded ahead of the state that they make up
+		if !r.importing {
+			if err := r.reset(ctx); err != nil {
+				return err
+			}
+			r.importing = true
+		}
+		if err := r.addLeaf(ctx, e); err != nil {
+			return err
+		}
+	case "import-state":
+		if !r.importing {
+			if err := r.reset(ctx); err != nil {
+				return err
+			}
+		}
+		r.importing = false
+		if err := r.addImported(ctx, e); err != nil {
+			return err
+		}
+		if err := r.check(e); err != nil {
+			return err
+		}
+	case "state-transition":
+		if r.trees == nil {
+			return nil
+		}
+		if err := r.check(e); err != nil {
+			return err
+		}
+		// once the new state is published, its claims root is added to the roots tree, unless it is there
+		// already, as the stored identity does
+		if r.published[e.NewState] {
+			root := r.trees.claims.Root().BigInt()
+			proof, _, err := r.trees.roots.GenerateProof(ctx, root, r.trees.roots.Root())
+			if err != nil {
+				return err
+			}
+			if !proof.Existence {
+				if err := r.trees.roots.Add(ctx, root, big.NewInt(0)); err != nil {
+					return err
+				}
+			}
+			delete(r.published, e.NewState)
+		}
+	default:
+		return nil
+	}
+	r.replayed++
+	return nil
+}
+
+// replayCommand handles the "replay" command, that rebuilds the trees of an issuer from the audit log and
+// verifies every intermediate state against the recorded ones
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	pathFlag := fs.String("audit-log", defaultAuditLogPath(), "path of the audit log")
+	issuerFlag := fs.String("issuer", "", "base58 ID of the issuer to rebuild the trees of")
+	treeDepthFlag := fs.Int("tree-depth", 32, "depth of the rebuilt trees")
+	timeoutFlag := fs.Duration("timeout", 0, "give up on the command after this long, for example 30s (no timeout by default)")
+	atStateFlag := fs.String("at-state", "", "a past state of the issuer, in decimal, to generate the --tree-proof proofs at instead of the latest state")
+	var treeProofs treeProofRequests
+	fs.Var(&treeProofs, "tree-proof", "print the proof for a key of a tree of the rebuilt trees, as <tree>:<key> with the tree one of claims, revocations, roots (repeatable)")
+	treeProofFormatFlag := fs.String("tree-proof-format", proofFormatBoth, "format of the proofs printed by --tree-proof: standard, circuit or both")
+	requirePublishedFlag := fs.Bool("require-published", false, "refuse an --at-state that no transition recorded as published reaches")
+	transitionsFlag := fs.String("transitions", defaultTransitionsPath(), "path of the file of the state transitions, that tells which states were published")
+	readOnly.register(fs, true)
+	fs.Parse(args)
+	if *issuerFlag == "" {
+		return usageError("usage: replay --issuer <id> [--audit-log <path>] [--tree-depth <levels>] [--at-state <state>] [--tree-proof <tree>:<key>]...")
+	}
+	var atState string
+	if *atStateFlag != "" {
+		v, ok := new(big.Int).SetString(*atStateFlag, 10)
+		if !ok {
+			return withCode(errCodeInvalidInput, fmt.Errorf("invalid state %q, must be decimal", *atStateFlag))
+		}
+		atState = v.String()
+	} else if *requirePublishedFlag {
+		return usageError("the --require-published option requires --at-state")
+	}
+	if *treeDepthFlag < 1 || *treeDepthFlag > issuer.MaxTreeDepth {
+		return usageError("--tree-depth must be between 1 and %d", issuer.MaxTreeDepth)
+	}
+
+	entries, err := readAuditLog(*pathFlag)
+	if err != nil {
+		return err
+	}
+	// a tampered entry would show as a divergence of the trees, rather than of the log
+	if err := verifyAuditChain(entries); err != nil {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the audit log failed verification: %s", err))
+	}
+	fmt.Printf("Replay the operations of %s recorded in %s\n", *issuerFlag, *pathFlag)
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+	transitions, err := readTransitions(*transitionsFlag)
+	if err != nil {
+		return err
+	}
+	r := &replayer{levels: *treeDepthFlag, published: map[string]bool{}}
+	for _, t := range transitions {
+		if t.Issuer == *issuerFlag && t.Status == transitionPublished {
+			r.published[t.NewState] = true
+		}
+	}
+	for _, e := range entries {
+		if e.Params["issuer"] != *issuerFlag {
+			continue
+		}
+		if err := r.replay(ctx, e); err != nil {
+			return err
+		}
+	}
+	if r.trees == nil {
+		return withCode(errCodeNotFound, fmt.Errorf("no creation or import of the identity %s is recorded in %s", *issuerFlag, *pathFlag), "issuer", *issuerFlag)
+	}
+	state, err := r.trees.state()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("-> Replayed %d operations, every state matches the audit log\n", r.replayed)
+	fmt.Printf("-> Claims tree root: %s\n", r.trees.claims.Root().BigInt())
+	fmt.Printf("-> Revocation tree root: %s\n", r.trees.revocations.Root().BigInt())
+	fmt.Printf("-> Roots tree root: %s\n", r.trees.roots.Root().BigInt())
+	fmt.Printf("-> State: %s\n", state.BigInt())
+
+	// the proofs are pinned to the roots of the requested state, not to the latest roots of the trees
+	at := &pastState{trees: r.trees, claims: r.trees.claims.Root(), revocations: r.trees.revocations.Root(), roots: r.trees.roots.Root()}
+	if atState != "" {
+		if at = r.history[atState]; at == nil {
+			return withCode(errCodeNotFound, fmt.Errorf("the state %s is not in the history of %s recorded in %s", atState, *issuerFlag, *pathFlag), "state", atState)
+		}
+		fmt.Printf("-> State %s was reached by entry %d (%s)\n", atState, at.seq, at.operation)
+		fmt.Printf("   -> Claims tree root: %s\n", at.claims.BigInt())
+		fmt.Printf("   -> Revocation tree root: %s\n", at.revocations.BigInt())
+		fmt.Printf("   -> Roots tree root: %s\n", at.roots.BigInt())
+		if *requirePublishedFlag {
+			if err := at.checkPublished(transitions, *issuerFlag, atState); err != nil {
+				return err
+			}
+			fmt.Printf("   -> Published, as recorded in %s\n", *transitionsFlag)
+		}
+	}
+	for _, req := range treeProofs {
+		fmt.Printf("-> Proof for the key %s of the %s tree\n", req.key, req.tree)
+		proof, err := at.trees.generateProofAt(ctx, req.tree, req.key, at.root(req.tree), *treeProofFormatFlag)
+		if err != nil {
+			return err
+		}
+		out, _ := json.MarshalIndent(proof, "", "  ")
+		fmt.Println(string(out))
+	}
+	return nil
+}
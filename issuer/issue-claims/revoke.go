@@ -0,0 +1,166 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// revokeCommand handles the "revoke" command, that revokes a revocation nonce of a stored issuer identity,
+// or every claim of a registered schema, and writes the inputs of the state transition that publishes the
+// revocations. Revoking a nonce revokes every version of the claim that has it.
+func revokeCommand(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	readOnly.register(fs, false)
+	nonceFlag := fs.String("nonce", "", "revocation nonce to revoke")
+	schemaFlag := fs.String("schema", "", "name of the registered schema whose claims --all revokes")
+	allFlag := fs.Bool("all", false, "revoke every claim of the --schema that the stored identity issued")
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file of the registered schemas, that --schema names")
+	receiptsFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file, that the issuer of the nonce is looked up in without --issuer")
+	var stored storedIdentityFlags
+	stored.register(fs)
+	receiptKeys.register(fs)
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	usage := usageError("usage: revoke --nonce <revocation nonce> [--issuer <id>] [--dry-run] | revoke --schema <name> --all --issuer <id> [--dry-run]")
+	if (*nonceFlag == "") == (*schemaFlag == "") || (*schemaFlag != "") != *allFlag {
+		return usage
+	}
+	var revNonce uint64
+	var schema *registeredSchema
+	var err error
+	if *nonceFlag != "" {
+		if revNonce, err = strconv.ParseUint(*nonceFlag, 10, 64); err != nil {
+			return usageError("invalid --nonce %q: %s", *nonceFlag, err)
+		}
+	} else {
+		if stored.issuer == "" {
+			return usageError("revoke --schema --all requires the --issuer option")
+		}
+		if schema, err = findSchema(*schemasFlag, *schemaFlag); err != nil {
+			return err
+		} else if schema == nil {
+			return withCode(errCodeNotFound, fmt.Errorf("no registered schema '%s'", *schemaFlag), "schema", *schemaFlag)
+		}
+	}
+	operator, err := operators.authorize(roleRevoke)
+	if err != nil {
+		return fmt.Errorf("not authorized to revoke: %w", err)
+	}
+	if stored.issuer == "" {
+		receipt, err := findReceipt(*receiptsFlag, "", revNonce)
+		if err != nil {
+			return err
+		}
+		stored.issuer = receipt.Issuer
+	}
+
+	ctx, cancel := newCommandContext(stored.timeout)
+	defer cancel()
+	o, err := stored.open(ctx, operator)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+	nonces := []uint64{revNonce}
+	if schema != nil {
+		if nonces, err = issuedSchemaNonces(ctx, o.identity, schema); err != nil {
+			return err
+		} else if len(nonces) == 0 {
+			return withCode(errCodeConflict, fmt.Errorf("the identity %s has no unrevoked claims of the schema '%s'", stored.issuer, schema.Name), "schema", schema.Name)
+		}
+		fmt.Printf("-> Revoke the %d claims of the schema '%s' (%s)\n", len(nonces), schema.Name, schema.Hash)
+	} else if revoked, _, err := o.identity.RevocationStatus(ctx, revNonce); err != nil {
+		return err
+	} else if revoked {
+		return withCode(errCodeConflict, fmt.Errorf("the revocation nonce %d is revoked already", revNonce), "revocationNonce", *nonceFlag)
+	}
+	oldState := o.publishedState()
+	for _, nonce := range nonces {
+		if err := o.revoke(ctx, nonce); err != nil {
+			return fmt.Errorf("failed to revoke the nonce %d: %w", nonce, err)
+		}
+		fmt.Printf("-> Revoked the revocation nonce %d\n", nonce)
+	}
+	fmt.Printf("   -> Revocation tree root: %s\n", o.identity.RevocationsTree().Root().BigInt())
+	return o.finish(ctx, "revoke-claim", oldState)
+}
+
+// issuedSchemaNonces returns the revocation nonces of the claims of the schema that the identity issued and
+// that are not revoked yet, in increasing order. The versions of an updated claim share a nonce.
+func issuedSchemaNonces(ctx context.Context, identity *issuer.Identity, schema *registeredSchema) ([]uint64, error) {
+	var changes []issuer.Changes
+	for _, t := range identity.PublishedTransitions() {
+		changes = append(changes, t.Changes)
+	}
+	seen := map[uint64]bool{}
+	var nonces []uint64
+	for _, c := range append(changes, identity.PendingChanges()) {
+		for _, claim := range c.Claims {
+			sHashText, _ := claim.GetSchemaHash().MarshalText()
+			nonce := claim.GetRevocationNonce()
+			if string(sHashText) != schema.Hash || seen[nonce] {
+				continue
+			}
+			seen[nonce] = true
+			revoked, _, err := identity.RevocationStatus(ctx, nonce)
+			if err != nil {
+				return nil, err
+			}
+			if !revoked {
+				nonces = append(nonces, nonce)
+			}
+		}
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	return nonces, nil
+}
+
+// checkRevocable fails for the nonce of the auth claim, as revoking it would revoke the key that signs the
+// state transitions, and for a nonce that no claim of the identity has
+func checkRevocable(identity *issuer.Identity, revNonce uint64) error {
+	nonce := strconv.FormatUint(revNonce, 10)
+	if revNonce == identity.AuthClaim.GetRevocationNonce() {
+		err := fmt.Errorf("the revocation nonce %d is the one of the auth claim of %s, revoking it would revoke the issuer's key", revNonce, identity.ID)
+		return withCode(errCodeConflict, err, "revocationNonce", nonce)
+	}
+	var changes []issuer.Changes
+	for _, t := range identity.PublishedTransitions() {
+		changes = append(changes, t.Changes)
+	}
+	for _, c := range append(changes, identity.PendingChanges()) {
+		for _, claim := range c.Claims {
+			if claim.GetRevocationNonce() == revNonce {
+				return nil
+			}
+		}
+		for _, e := range c.Erased {
+			if e.RevocationNonce == revNonce {
+				return nil
+			}
+		}
+	}
+	err := fmt.Errorf("the identity %s issued no claim with the revocation nonce %d", identity.ID, revNonce)
+	return withCode(errCodeNotFound, err, "revocationNonce", nonce)
+}
@@ -0,0 +1,146 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRevokeEveryClaimOfASchema(t *testing.T) {
+	testHome(t)
+	captureOutput(t, func() {
+		if err := schemaCommand([]string{"add", "--name", "kyc-country", "--file", builtinSchemaPath, "--type", "KYCCountryOfResidenceCredential"}); err != nil {
+			t.Fatalf("failed to register the schema: %s", err)
+		}
+	})
+	key := strings.Repeat("08", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+
+	t.Setenv(issuerKeyEnv, key)
+	printed = captureOutput(t, func() {
+		if err := revokeCommand([]string{"--schema", "kyc-country", "--all", "--issuer", id, "--abandon-pending"}); err != nil {
+			t.Fatalf("failed to revoke the claims of the schema: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "-> Revoke the 1 claims of the schema 'kyc-country'") || !strings.Contains(printed, "-> Revoked the revocation nonce 3\n") {
+		t.Errorf("expected the country claim with the nonce 3 to be revoked, got: %s", printed)
+	}
+
+	t.Setenv(issuerKeyEnv, key)
+	var err error
+	captureOutput(t, func() {
+		err = revokeCommand([]string{"--schema", "kyc-country", "--all", "--issuer", id, "--abandon-pending"})
+	})
+	if err == nil || classifyError(err).code != errCodeConflict {
+		t.Errorf("expected nothing left to revoke, got %v", err)
+	}
+}
+
+func TestRevokeRefusesANonceOfSeveralIssuers(t *testing.T) {
+	testHome(t)
+	for _, key := range []string{strings.Repeat("09", 32), strings.Repeat("0a", 32)} {
+		t.Setenv(issuerKeyEnv, key)
+		if code, printed := runWalkthrough(t); code != 0 {
+			t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+		}
+	}
+	var err error
+	captureOutput(t, func() { err = revokeCommand([]string{"--nonce", "2"}) })
+	if err == nil || classifyError(err).code != errCodeUsage || !strings.Contains(err.Error(), "claims of 2 issuers have the revocation nonce 2") {
+		t.Errorf("expected the nonce of two issuers to require --issuer, got %v", err)
+	}
+}
+
+func TestRevokeRefusesTheAuthNonceAndUnissuedNonces(t *testing.T) {
+	testHome(t)
+	key := strings.Repeat("0e", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+	stored, err := findIdentity(defaultIdentitiesPath(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authClaim, err := claimFromHex(stored.AuthClaim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for nonce, expected := range map[uint64]*errorCode{authClaim.GetRevocationNonce(): errCodeConflict, 999: errCodeNotFound} {
+		t.Setenv(issuerKeyEnv, key)
+		captureOutput(t, func() {
+			err = revokeCommand([]string{"--nonce", strconv.FormatUint(nonce, 10), "--issuer", id, "--abandon-pending"})
+		})
+		if err == nil || classifyError(err).code != expected {
+			t.Errorf("expected revoking the nonce %d to fail with %s, got %v", nonce, expected.Code, err)
+		}
+	}
+	if after, err := findIdentity(defaultIdentitiesPath(), id); err != nil || len(after.Pending.Revocations) != 0 {
+		t.Errorf("expected nothing to be revoked, got %v", err)
+	}
+}
+
+func TestChangesOfAStoredIdentityAreNotified(t *testing.T) {
+	home := testHome(t)
+	key := strings.Repeat("0c", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+
+	events := filepath.Join(home, "events.jsonl")
+	t.Setenv(issuerKeyEnv, key)
+	captureOutput(t, func() {
+		if err := updateClaimCommand([]string{"--nonce", "4", "--slot", "v_2=1", "--revoke-previous", "--issuer", id, "--notify", "jsonl:" + events, "--abandon-pending"}); err != nil {
+			t.Fatalf("failed to update the claim: %s", err)
+		}
+	})
+	b, err := os.ReadFile(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var event issuanceEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, event.Type)
+		if event.Type == eventClaimRevoked && (event.RevocationNonce == nil || *event.RevocationNonce != 4) {
+			t.Errorf("expected the revocation of the nonce 4, got %+v", event)
+		}
+	}
+	expected := []string{eventClaimUpdated, eventClaimRevoked, eventStateTransition}
+	if strings.Join(types, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the events %v, got %v", expected, types)
+	}
+}
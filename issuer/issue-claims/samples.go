@@ -0,0 +1,318 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// sampleSlots draws the data of a sample claim for the fields that the schema declares. The fields named
+// like a date get a YYYYMMDD date between 1950 and 2004, the others an integer below a million.
+func sampleSlots(fields map[string]string, rnd *seededReader) (slotValues, error) {
+	slots := slotValues{}
+	for slot, name := range fields {
+		var b [4]byte
+		if _, err := rnd.Read(b[:]); err != nil {
+			return nil, err
+		}
+		n := int64(b[0])<<24 | int64(b[1])<<16 | int64(b[2])<<8 | int64(b[3])
+		if lower := strings.ToLower(name); strings.Contains(lower, "date") || strings.Contains(lower, "birthday") {
+			day := time.Date(1950, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, int(n%(55*365)))
+			slots[slot] = big.NewInt(int64(day.Year()*10000 + int(day.Month())*100 + day.Day()))
+		} else {
+			slots[slot] = big.NewInt(1 + n%999999)
+		}
+	}
+	return slots, nil
+}
+
+// generateSampleDataCommand handles the "generate-sample-data" command, that issues claims to seeded holder
+// identities through the same steps as the issuance, to fill dashboards and measure the issuance at scale.
+// The holders are issued to in batches, each batch ending with a state transition that is recorded as
+// published, so that the next batch transitions from it.
+func generateSampleDataCommand(args []string) error {
+	fs := flag.NewFlagSet("generate-sample-data", flag.ExitOnError)
+	readOnly.register(fs, false)
+	holdersFlag := fs.Int("holders", 100, "number of holder identities to generate")
+	claimsFlag := fs.Int("claims-per-holder", 3, "number of claims to issue to each holder")
+	batchFlag := fs.Int("batch-size", 10, "number of holders whose claims are covered by each state transition")
+	schemaFlag := fs.String("schema", "./schemas/test.json-ld", "registered name or path of the schema document of the claims")
+	typeFlag := fs.String("type", "", "credential type of a schema document, KYCAgeCredential by default, a registered schema gives its own")
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file of the registered schemas, that --schema can name")
+	seedFlag := fs.String("seed", "", "hex seed of at least 16 bytes that the issuer and holder keys and the claim data are derived from")
+	issuanceTimeFlag := fs.String("issuance-time", "", "time stamped on the audit log and the receipts, in RFC 3339 format, the current time by default")
+	dirFlag := fs.String("dir", "iden3_sample_data", "directory that the audit log, receipts, transitions and holders of the sample data are written to")
+	treeDepthFlag := fs.Int("tree-depth", 32, "depth of the trees")
+	summaryJSONFlag := fs.Bool("summary-json", false, "print the summary as JSON, with the durations in nanoseconds")
+	fs.Parse(args)
+	if *seedFlag == "" {
+		return usageError("usage: generate-sample-data --seed <hex> [--holders <n>] [--claims-per-holder <n>] [--schema <name or path>] [--dir <path>]")
+	}
+	if *holdersFlag < 1 || *claimsFlag < 1 || *batchFlag < 1 {
+		return usageError("--holders, --claims-per-holder and --batch-size must be at least 1")
+	}
+	if *treeDepthFlag < 1 || *treeDepthFlag > issuer.MaxTreeDepth {
+		return usageError("--tree-depth must be between 1 and %d", issuer.MaxTreeDepth)
+	}
+	seeded, err := newSeededReader(*seedFlag)
+	if err != nil {
+		return usageError("invalid seed: %s", err)
+	}
+	if *issuanceTimeFlag != "" {
+		issuanceTime, err := time.Parse(time.RFC3339, *issuanceTimeFlag)
+		if err != nil {
+			return usageError("invalid issuance time: %s", err)
+		}
+		now = func() time.Time { return issuanceTime }
+	}
+
+	// the sample data is kept apart from the files of the issuer, which default to the home directory
+	dir, err := filepath.Abs(*dirFlag)
+	if err != nil {
+		return err
+	}
+	if homedir, _ := os.UserHomeDir(); homedir != "" && filepath.Clean(homedir) == dir {
+		return usageError("refusing to generate sample data in the home directory, where the issuer's own files are, pass another --dir")
+	}
+	if err := readOnly.check(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	auditLogPath := filepath.Join(dir, filepath.Base(defaultAuditLogPath()))
+	receiptsPath := filepath.Join(dir, filepath.Base(defaultReceiptsPath()))
+	transitionsPath := filepath.Join(dir, filepath.Base(defaultTransitionsPath()))
+	holdersPath := filepath.Join(dir, filepath.Base(defaultHoldersPath()))
+
+	schemaBytes, credentialType, err := resolveSchema(*schemasFlag, *schemaFlag, *typeFlag)
+	if err != nil {
+		return err
+	}
+	if credentialType == "" {
+		credentialType = "KYCAgeCredential"
+	}
+	fields, err := schemaFields(schemaBytes, credentialType)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 && *claimsFlag > 1 {
+		return usageError("'%s' declares no fields, so a holder can't be issued more than one distinct claim of it", credentialType)
+	}
+	sHash := schemaHash(schemaBytes, credentialType)
+	sHashText, _ := sHash.MarshalText()
+
+	ctx, cancel := newCommandContext(0)
+	defer cancel()
+	metrics := newIssuanceMetrics()
+	signer, err := newKeySigner(seeded)
+	if err != nil {
+		return err
+	}
+	defer signer.Close()
+	signer.observe = func(elapsed time.Duration) { metrics.observePhase(phaseSigning, elapsed) }
+	identity, err := issuer.New(ctx, issuer.NewMemoryStorage(), signer, issuer.WithTreeObserver(metrics.observeTreeAdd), issuer.WithTreeDepth(*treeDepthFlag))
+	if err != nil {
+		return fmt.Errorf("failed to create the issuer identity: %s", err)
+	}
+	id := identity.ID
+	fmt.Printf("Generate sample data for %d holders with %d '%s' claims each, in %s\n", *holdersFlag, *claimsFlag, credentialType, dir)
+	fmt.Println("-> Issuer ID, derived from the seed:", id)
+	fmt.Println("-> Schema hash:", string(sHashText))
+
+	// an audit log of another issuer is the log of a real issuer, which the sample data must not mix into
+	entries, err := readAuditLog(auditLogPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if other := e.Params["issuer"]; other != "" && other != id.String() {
+			return withCode(errCodeConflict, fmt.Errorf("the audit log %s records the issuer %s, refusing to add sample data to it", auditLogPath, other), "issuer", other)
+		}
+	}
+	auditLog, err := openAuditLog(auditLogPath)
+	if err != nil {
+		return err
+	}
+	auditLog.signatures = signer.signatures
+	authLeaf, _ := claimLeaf(identity.AuthClaim)
+	if err := auditLog.record("create-identity", auditCompleted, map[string]string{"issuer": id.String(), "leaf": authLeaf}, nil, identity.GenesisState); err != nil {
+		return fmt.Errorf("failed to record the operation in the audit log: %s", err)
+	}
+	nonces, err := newNonceAllocator(identity, "2", seeded)
+	if err != nil {
+		return err
+	}
+	registered, err := readSchemas(*schemasFlag)
+	if err != nil {
+		return err
+	}
+	if err := nonces.reserve(ctx, identity.AuthClaim.GetRevocationNonce(), "", "auth claim"); err != nil {
+		return err
+	}
+	if err := nonces.useRanges(registered); err != nil {
+		return err
+	}
+
+	// the holders are identified by the genesis state of a key drawn from the seed, as onboard-holder does
+	holders := make([]*onboardedHolder, *holdersFlag)
+	subjects := make([]*core.ID, *holdersFlag)
+	for i := range holders {
+		holderKey, err := newPrivKey(seeded)
+		if err != nil {
+			return err
+		}
+		genesis, err := issuer.NewGenesis(ctx, holderKey.Public())
+		if err != nil {
+			return fmt.Errorf("failed to compute the genesis state of a holder: %s", err)
+		}
+		if holders[i], err = newOnboardedHolder(genesis, holderKey.Public().String()); err != nil {
+			return err
+		}
+		subjects[i] = genesis.ID
+	}
+	if err := appendHolders(holdersPath, holders...); err != nil {
+		return err
+	}
+	fmt.Printf("-> %d holders recorded in %s\n", len(holders), holdersPath)
+
+	trees := &issuerTrees{claims: identity.ClaimsTree(), revocations: identity.RevocationsTree(), roots: identity.RootsTree()}
+	for batch, first := 1, 0; first < len(subjects); batch, first = batch+1, first+*batchFlag {
+		last := first + *batchFlag
+		if last > len(subjects) {
+			last = len(subjects)
+		}
+		oldState, _ := identity.State()
+		var receipts []*issuanceReceipt
+		for _, subject := range subjects[first:last] {
+			for k := 0; k < *claimsFlag; k++ {
+				if err := checkCancelled(ctx); err != nil {
+					return err
+				}
+				slots, err := sampleSlots(fields, seeded)
+				if err != nil {
+					return err
+				}
+				nonce, err := nonces.allocate(ctx, string(sHashText), "sample claim")
+				if err != nil {
+					return err
+				}
+				claim, err := core.NewClaim(sHash, append([]core.Option{withSubject(subject), core.WithRevocationNonce(nonce)}, slots.options()...)...)
+				if err != nil {
+					return fmt.Errorf("failed to create the claim: %s", err)
+				}
+				start := time.Now()
+				before, _ := identity.State()
+				_, addErr := identity.IssueClaim(ctx, claim)
+				after, _ := identity.State()
+				if err := metrics.timePhase(phaseAuditLog, func() error {
+					return auditLog.recordClaim("issue-claim", id, claim, before, after, addErr)
+				}); err != nil {
+					return fmt.Errorf("failed to record the operation in the audit log: %s", err)
+				}
+				if addErr != nil {
+					return fmt.Errorf("failed to add the claim: %s", addErr)
+				}
+				receipt, err := newIssuanceReceipt(ctx, signer, id, claim, before, trees)
+				if err != nil {
+					return fmt.Errorf("failed to sign the issuance receipt: %s", err)
+				}
+				receipts = append(receipts, receipt)
+				metrics.observeIssuance("issue-claim", time.Since(start))
+			}
+		}
+
+		pending := identity.PendingChanges()
+		var inputs []byte
+		var isOldStateGenesis bool
+		if err := metrics.timePhase(phaseInputs, func() error {
+			stateTransitionInputs, err := identity.StateTransition(ctx)
+			if err != nil {
+				return err
+			}
+			isOldStateGenesis = stateTransitionInputs.IsOldStateGenesis
+			inputs, err = stateTransitionInputs.InputsMarshal()
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to construct the state transition: %s", err)
+		}
+		metrics.inputsGenerated++
+		newState, _ := identity.State()
+		decided := now().UTC()
+		transition := &stateTransition{
+			Issuer:      id.String(),
+			Status:      transitionPublished,
+			OldState:    oldState.BigInt().String(),
+			NewState:    newState.BigInt().String(),
+			InputsHash:  inputsHash(inputs),
+			Inputs:      inputs,
+			Revocations: pending.Revocations,
+			Created:     now().UTC(),
+			Decided:     &decided,
+			TreeDepth:   *treeDepthFlag,
+
+			OldStateGenesis: isOldStateGenesis,
+			ClaimsRoot:      identity.ClaimsTree().Root().BigInt().String(),
+			RevocationRoot:  identity.RevocationsTree().Root().BigInt().String(),
+			RootOfRoots:     identity.RootsTree().Root().BigInt().String(),
+		}
+		for _, c := range pending.Claims {
+			claimHex, _ := claimToHex(c)
+			transition.Claims = append(transition.Claims, claimHex)
+		}
+		// the transition isn't submitted, it is marked published for the next batch to transition from it
+		if err := metrics.timePhase(phaseOutput, func() error {
+			return recordTransition(transitionsPath, transition)
+		}); err != nil {
+			return fmt.Errorf("failed to record the transition: %s", err)
+		}
+		if err := identity.StatePublished(ctx, issuer.Publication{}); err != nil {
+			return err
+		}
+		if err := metrics.timePhase(phaseAuditLog, func() error {
+			return auditLog.record("state-transition", auditCompleted, map[string]string{"issuer": id.String(), "inputs": transitionsPath}, oldState, newState)
+		}); err != nil {
+			return fmt.Errorf("failed to record the operation in the audit log: %s", err)
+		}
+		if err := metrics.timePhase(phaseOutput, func() error {
+			return writeReceipts(receiptsPath, receipts)
+		}); err != nil {
+			return fmt.Errorf("failed to write the receipts: %s", err)
+		}
+		fmt.Printf("-> Batch %d: %d claims to %d holders, state %s\n", batch, len(receipts), last-first, newState.BigInt())
+	}
+
+	state, _ := identity.State()
+	fmt.Println()
+	metrics.signatures = signer.signatures()
+	if *summaryJSONFlag {
+		metrics.printJSON(state)
+	} else {
+		metrics.print(state)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/keccak256"
+)
+
+// The serialization types used in the JSON-LD schemas to declare which slot holds each field
+var serializationSlots = map[string]string{
+	"serialization:IndexDataSlotA": "i_2",
+	"serialization:IndexDataSlotB": "i_3",
+	"serialization:ValueDataSlotA": "v_2",
+	"serialization:ValueDataSlotB": "v_3",
+}
+
+// schemaHash calculates the hash that a claim uses to refer to a credential type in a schema document,
+// which is the last 16 bytes of the keccak hash of the document and the type name
+func schemaHash(schemaBytes []byte, credentialType string) core.SchemaHash {
+	var sHash core.SchemaHash
+	h := keccak256.Hash(schemaBytes, []byte(credentialType))
+	copy(sHash[:], h[len(h)-16:])
+	return sHash
+}
+
+var errTypeNotDefined = errors.New("not defined in the schema document")
+
+// Contexts referenced by URL can reference further contexts, up to this depth
+const maxContextDepth = 8
+
+// schemaFields resolves the fields that a schema document declares for a credential type, as a
+// map from the slot to the name of the field stored in it. A type that the document doesn't define
+// itself is looked up in the contexts that it references by URL, which are resolved from the cache.
+func schemaFields(schemaBytes []byte, credentialType string) (map[string]string, error) {
+	return contextFields(schemaBytes, credentialType, 0)
+}
+
+func contextFields(schemaBytes []byte, credentialType string, depth int) (map[string]string, error) {
+	var doc struct {
+		Context json.RawMessage `json:"@context"`
+	}
+	if err := json.Unmarshal(schemaBytes, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse the schema document: %s", err)
+	}
+	// the context is a single context or an array of them
+	var elements []json.RawMessage
+	if err := json.Unmarshal(doc.Context, &elements); err != nil {
+		elements = []json.RawMessage{doc.Context}
+	}
+
+	var urls []string
+	for _, c := range elements {
+		var url string
+		if err := json.Unmarshal(c, &url); err == nil {
+			urls = append(urls, url)
+			continue
+		}
+		var types map[string]json.RawMessage
+		if err := json.Unmarshal(c, &types); err != nil {
+			continue
+		}
+		typeDef, ok := types[credentialType]
+		if !ok {
+			continue
+		}
+		var def struct {
+			Context map[string]json.RawMessage `json:"@context"`
+		}
+		if err := json.Unmarshal(typeDef, &def); err != nil {
+			return nil, fmt.Errorf("failed to parse the definition of '%s': %s", credentialType, err)
+		}
+		fields := map[string]string{}
+		for name, f := range def.Context {
+			var field struct {
+				Type string `json:"@type"`
+			}
+			if err := json.Unmarshal(f, &field); err != nil {
+				// terms like "@version" and the vocabulary prefixes are not fields
+				continue
+			}
+			slot, ok := serializationSlots[field.Type]
+			if !ok {
+				continue
+			}
+			if other, ok := fields[slot]; ok {
+				return nil, fmt.Errorf("fields '%s' and '%s' of '%s' are both declared in slot %s", other, name, credentialType, slot)
+			}
+			fields[slot] = name
+		}
+		return fields, nil
+	}
+
+	if depth < maxContextDepth {
+		for _, url := range urls {
+			b, err := contexts.load(url)
+			if err != nil {
+				return nil, fmt.Errorf("credential type '%s' is not defined in the schema document, and %s", credentialType, err)
+			}
+			fields, err := contextFields(b, credentialType, depth+1)
+			if err == nil {
+				return fields, nil
+			} else if !errors.Is(err, errTypeNotDefined) {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("credential type '%s' is %w", credentialType, errTypeNotDefined)
+}
+
+// validate checks the slot data against the fields declared by the schema, every field must be given
+// a value and no data may be given for slots that the schema doesn't declare
+func (s slotValues) validate(fields map[string]string, credentialType string) error {
+	var problems []string
+	for _, slot := range s.names() {
+		if _, ok := fields[slot]; !ok {
+			problems = append(problems, fmt.Sprintf("slot %s is not declared by '%s'", slot, credentialType))
+		}
+	}
+	declared := make([]string, 0, len(fields))
+	for slot := range fields {
+		declared = append(declared, slot)
+	}
+	sort.Strings(declared)
+	for _, slot := range declared {
+		if _, ok := s[slot]; !ok {
+			problems = append(problems, fmt.Sprintf("field '%s' (slot %s) is required by '%s'", fields[slot], slot, credentialType))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid data for '%s':\n   -> %s", credentialType, strings.Join(problems, "\n   -> "))
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A registered name has no dots or slashes, so it can't be mistaken for the path of a schema document
+var schemaNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// registeredSchema is a credential type of a schema document, registered under a name so that commands can
+// refer to it without the path of the document and the type. The document is kept in the registry, so a
+// schema added from a URL doesn't need to be fetched again. The CID is set once the document is
+// published to IPFS.
+type registeredSchema struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Source   string            `json:"source"`
+	Document []byte            `json:"document"`
+	Hash     string            `json:"hash"`
+	Fields   map[string]string `json:"fields"`
+	Added    time.Time         `json:"added"`
+	CID      string            `json:"cid,omitempty"`
+	// SupersededBy is the name of the schema that replaces this version, whose claims are migrated to it
+	SupersededBy string `json:"supersededBy,omitempty"`
+	// NonceRange is the range of revocation nonces that the claims of the schema are given
+	NonceRange *nonceRange `json:"nonceRange,omitempty"`
+}
+
+func defaultSchemasPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_schemas.json")
+}
+
+func readSchemas(path string) ([]*registeredSchema, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var schemas []*registeredSchema
+	scanner := bufio.NewScanner(f)
+	// the lines carry the whole schema documents
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var s registeredSchema
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil || s.Name == "" {
+			return nil, fmt.Errorf("line %d of the schemas file is not a valid schema: %v", line, err)
+		}
+		schemas = append(schemas, &s)
+	}
+	return schemas, scanner.Err()
+}
+
+// writeSchemas replaces the schemas file, through a temporary file so that an interrupted write leaves
+// the previous file in place
+func writeSchemas(path string, schemas []*registeredSchema) error {
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, s := range schemas {
+		line, _ := json.Marshal(s)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// findSchema looks up a registered schema by name, returning nil if there is no schema of that name
+func findSchema(path, name string) (*registeredSchema, error) {
+	schemas, err := readSchemas(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range schemas {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return nil, nil
+}
+
+// verify checks that the stored document still hashes to the schema hash it was registered with, as the
+// claims issued with the schema carry that hash
+func (s *registeredSchema) verify() error {
+	sHashText, _ := schemaHash(s.Document, s.Type).MarshalText()
+	if string(sHashText) != s.Hash {
+		err := fmt.Errorf("the document of schema '%s' hashes to %s, but was registered with the hash %s", s.Name, sHashText, s.Hash)
+		return withCode(errCodeVerificationFailed, err, "schema", s.Name, "hash", string(sHashText), "registeredHash", s.Hash)
+	}
+	return nil
+}
+
+// resolveSchema resolves the --schema option of a command, which is either the name of a registered schema
+// or the path of a schema document. A registered schema also gives the credential type, which must agree
+// with the type that the command was given, if any.
+func resolveSchema(registryPath, schema, credentialType string) ([]byte, string, error) {
+	if schemaNamePattern.MatchString(schema) {
+		s, err := findSchema(registryPath, schema)
+		if err != nil {
+			return nil, "", err
+		}
+		if s != nil {
+			if err := s.verify(); err != nil {
+				return nil, "", err
+			}
+			if credentialType != "" && credentialType != s.Type {
+				return nil, "", withCode(errCodeInvalidInput, fmt.Errorf("schema '%s' is registered for '%s', not '%s'", s.Name, s.Type, credentialType), "schema", s.Name)
+			}
+			return s.Document, s.Type, nil
+		}
+	}
+	schemaBytes, err := os.ReadFile(schema)
+	if err != nil {
+		return nil, "", withCode(errCodeNotFound, fmt.Errorf("'%s' is neither a registered schema nor a readable schema document: %s", schema, err), "schema", schema)
+	}
+	return schemaBytes, credentialType, nil
+}
+
+// url is where verifiers can retrieve the schema document from, the IPFS URL once it is published
+func (s *registeredSchema) url() string {
+	if s.CID != "" {
+		return "ipfs://" + s.CID
+	}
+	return s.Source
+}
+
+// fetchSchema reads a schema document from a file, an http(s) URL, or an ipfs:// URL through a gateway.
+// A document fetched over http(s) is limited to the size of a document that can be published to IPFS.
+func fetchSchema(ctx context.Context, source, gateway string) ([]byte, error) {
+	if strings.HasPrefix(source, "ipfs://") {
+		return fetchIPFS(ctx, gateway, source)
+	}
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, withCode(errCodeInvalidInput, err, "url", source)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, withCode(errCodeUnavailable, err, "url", source)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, withCode(errCodeUnavailable, fmt.Errorf("%s responded with %s", source, res.Status), "url", source)
+	}
+	document, err := io.ReadAll(io.LimitReader(res.Body, ipfsMaxBlockSize+1))
+	if err != nil {
+		return nil, withCode(errCodeUnavailable, err, "url", source)
+	}
+	if len(document) > ipfsMaxBlockSize {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("%s is larger than %d bytes", source, ipfsMaxBlockSize), "url", source)
+	}
+	return document, nil
+}
+
+// schemaCommand handles the "schema" subcommands, that manage the registry of named schemas
+func schemaCommand(args []string) error {
+	usage := usageError("usage: schema add --name <name> (--file <path> | --url <url>) --type <credential type> | schema list | schema show --name <name> | schema publish --name <name> [--ipfs-api <url>] | schema remove --name <name> | schema deprecate --name <name> --by <name> | schema nonce-range --name <name> (--range <first>-<last> | --clear) | schema cache-context [--file <path>] <url>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("schema "+args[0], flag.ExitOnError)
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file that the registered schemas are kept in")
+	readOnly.register(fs, args[0] == "list" || args[0] == "show")
+	var operators operatorFlags
+	operators.register(fs)
+	// authorize checks the role of the operator once the options are parsed
+	authorize := func(role string) error {
+		if _, err := operators.authorize(role); err != nil {
+			return fmt.Errorf("not authorized to %s the schema: %w", args[0], err)
+		}
+		return nil
+	}
+	switch args[0] {
+	case "add":
+		nameFlag := fs.String("name", "", "the name to register the schema under")
+		fileFlag := fs.String("file", "", "path of the schema document")
+		urlFlag := fs.String("url", "", "http(s) or ipfs:// URL of the schema document, fetched once and kept in the registry")
+		typeFlag := fs.String("type", "", "the credential type in the schema document")
+		gatewayFlag := fs.String("ipfs-gateway", defaultIPFSGateway(), "the HTTP gateway that ipfs:// URLs are fetched from")
+		contexts.register(fs)
+		fs.Parse(args[1:])
+		contexts.gateway = *gatewayFlag
+		if *nameFlag == "" || *typeFlag == "" || (*fileFlag == "") == (*urlFlag == "") {
+			return usage
+		}
+		if err := authorize(roleAdmin); err != nil {
+			return err
+		}
+		if !schemaNamePattern.MatchString(*nameFlag) {
+			return usageError("invalid name '%s', a name is letters, digits, '-' and '_'", *nameFlag)
+		}
+		source := *fileFlag + *urlFlag
+		ctx, cancel := newCommandContext(0)
+		defer cancel()
+		document, err := fetchSchema(ctx, source, *gatewayFlag)
+		if err != nil {
+			return fmt.Errorf("failed to load the schema: %w", err)
+		}
+		fields, err := schemaFields(document, *typeFlag)
+		if err != nil {
+			return err
+		}
+		sHashText, _ := schemaHash(document, *typeFlag).MarshalText()
+
+		schemas, err := readSchemas(*schemasFlag)
+		if err != nil {
+			return err
+		}
+		for _, s := range schemas {
+			if s.Name == *nameFlag {
+				return withCode(errCodeConflict, fmt.Errorf("a schema named '%s' is already registered, remove it first", s.Name), "schema", s.Name)
+			}
+		}
+		s := &registeredSchema{
+			Name:     *nameFlag,
+			Type:     *typeFlag,
+			Source:   source,
+			Document: document,
+			Hash:     string(sHashText),
+			Fields:   fields,
+			Added:    now().UTC(),
+		}
+		if strings.HasPrefix(source, "ipfs://") {
+			// the content was verified against the CID, so the schema is already published
+			s.CID = strings.TrimSuffix(strings.TrimPrefix(source, "ipfs://"), "/")
+		}
+		if err := writeSchemas(*schemasFlag, append(schemas, s)); err != nil {
+			return err
+		}
+		fmt.Printf("Registered '%s' for '%s' with the schema hash %s\n", s.Name, s.Type, s.Hash)
+	case "cache-context":
+		fileFlag := fs.String("file", "", "path of a copy of the context, to cache it without fetching it")
+		gatewayFlag := fs.String("ipfs-gateway", defaultIPFSGateway(), "the HTTP gateway that ipfs:// URLs are fetched from")
+		contexts.register(fs)
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return usage
+		}
+		if err := authorize(roleAdmin); err != nil {
+			return err
+		}
+		url := fs.Arg(0)
+		contexts.gateway = *gatewayFlag
+		if *fileFlag != "" {
+			b, err := os.ReadFile(*fileFlag)
+			if err != nil {
+				return err
+			}
+			if err := contexts.store(url, b); err != nil {
+				return err
+			}
+		} else {
+			ctx, cancel := newCommandContext(0)
+			defer cancel()
+			if _, err := contexts.fetch(ctx, url); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Cached the JSON-LD context %s in %s\n", url, contexts.path(url))
+	case "list":
+		fs.Parse(args[1:])
+		schemas, err := readSchemas(*schemasFlag)
+		if err != nil {
+			return err
+		}
+		for _, s := range schemas {
+			status := "ok"
+			if err := s.verify(); err != nil {
+				status = "hash mismatch"
+			}
+			if s.SupersededBy != "" {
+				status += ", superseded by " + s.SupersededBy
+			}
+			if s.NonceRange != nil {
+				status += ", nonces " + s.NonceRange.String()
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", s.Name, s.Type, s.Hash, s.url(), status)
+		}
+	case "deprecate":
+		nameFlag := fs.String("name", "", "the name of the schema version that is deprecated")
+		byFlag := fs.String("by", "", "the name of the schema version that replaces it")
+		fs.Parse(args[1:])
+		if *nameFlag == "" || *byFlag == "" {
+			return usage
+		}
+		if err := authorize(roleAdmin); err != nil {
+			return err
+		}
+		if *nameFlag == *byFlag {
+			return usageError("a schema can't be superseded by itself")
+		}
+		schemas, err := readSchemas(*schemasFlag)
+		if err != nil {
+			return err
+		}
+		byName := map[string]*registeredSchema{}
+		for _, s := range schemas {
+			byName[s.Name] = s
+		}
+		for _, name := range []string{*nameFlag, *byFlag} {
+			if byName[name] == nil {
+				return withCode(errCodeNotFound, fmt.Errorf("no schema named '%s' is registered", name), "schema", name)
+			}
+		}
+		old, replacement := byName[*nameFlag], byName[*byFlag]
+		// following the versions from the replacement must not lead back to the deprecated one
+		for s := replacement; s != nil; s = byName[s.SupersededBy] {
+			if s.SupersededBy == old.Name {
+				return withCode(errCodeConflict, fmt.Errorf("'%s' already leads to '%s', which can't be superseded by it", replacement.Name, old.Name), "schema", replacement.Name)
+			}
+		}
+		old.SupersededBy = replacement.Name
+		if err := writeSchemas(*schemasFlag, schemas); err != nil {
+			return err
+		}
+		fmt.Printf("Deprecated '%s' in favour of '%s', migrate its claims with: migrate-claims --from-schema %s\n", old.Name, replacement.Name, old.Name)
+	case "nonce-range":
+		nameFlag := fs.String("name", "", "the name of the schema")
+		rangeFlag := fs.String("range", "", "the range of revocation nonces of the schema's claims, as <first>-<last>")
+		clearFlag := fs.Bool("clear", false, "remove the nonce range of the schema")
+		fs.Parse(args[1:])
+		if *nameFlag == "" || (*rangeFlag == "") == !*clearFlag {
+			return usage
+		}
+		if err := authorize(roleAdmin); err != nil {
+			return err
+		}
+		var r *nonceRange
+		if *rangeFlag != "" {
+			var err error
+			if r, err = parseNonceRange(*rangeFlag); err != nil {
+				return usageError("invalid --range: %s", err)
+			}
+		}
+		schemas, err := readSchemas(*schemasFlag)
+		if err != nil {
+			return err
+		}
+		var s *registeredSchema
+		for _, other := range schemas {
+			if other.Name == *nameFlag {
+				s = other
+			} else if r != nil && other.NonceRange != nil && other.NonceRange.overlaps(r) {
+				return withCode(errCodeConflict, fmt.Errorf("the range %s overlaps the nonce range %s of '%s'", r, other.NonceRange, other.Name), "schema", other.Name)
+			}
+		}
+		if s == nil {
+			return withCode(errCodeNotFound, fmt.Errorf("no schema named '%s' is registered", *nameFlag), "schema", *nameFlag)
+		}
+		s.NonceRange = r
+		if err := writeSchemas(*schemasFlag, schemas); err != nil {
+			return err
+		}
+		if r != nil {
+			fmt.Printf("The claims of '%s' take their revocation nonces from %s\n", s.Name, r)
+		} else {
+			fmt.Printf("Removed the nonce range of '%s'\n", s.Name)
+		}
+	case "show", "remove", "publish":
+		nameFlag := fs.String("name", "", "the name of the schema")
+		apiFlag := fs.String("ipfs-api", "http://127.0.0.1:5001", "the HTTP API of the IPFS node to publish to, with the credentials in the URL for a hosted node")
+		fs.Parse(args[1:])
+		if *nameFlag == "" {
+			return usage
+		}
+		switch args[0] {
+		case "publish":
+			if err := authorize(rolePublish); err != nil {
+				return err
+			}
+		case "remove":
+			if err := authorize(roleAdmin); err != nil {
+				return err
+			}
+		}
+		schemas, err := readSchemas(*schemasFlag)
+		if err != nil {
+			return err
+		}
+		for i, s := range schemas {
+			if s.Name != *nameFlag {
+				continue
+			}
+			if args[0] == "publish" {
+				if err := s.verify(); err != nil {
+					return err
+				}
+				ctx, cancel := newCommandContext(0)
+				defer cancel()
+				cid, err := publishIPFS(ctx, *apiFlag, s.Name+".json-ld", s.Document)
+				if err != nil {
+					return fmt.Errorf("failed to publish '%s': %w", s.Name, err)
+				}
+				s.CID = cid
+				if err := writeSchemas(*schemasFlag, schemas); err != nil {
+					return err
+				}
+				fmt.Printf("Published '%s' as %s\n", s.Name, s.url())
+				return nil
+			}
+			if args[0] == "remove" {
+				// claims issued with the schema keep its hash, removing it only forgets the name
+				if err := writeSchemas(*schemasFlag, append(schemas[:i], schemas[i+1:]...)); err != nil {
+					return err
+				}
+				fmt.Printf("Removed '%s'\n", s.Name)
+				return nil
+			}
+			out, _ := json.MarshalIndent(struct {
+				Name         string            `json:"name"`
+				Type         string            `json:"type"`
+				Source       string            `json:"source"`
+				URL          string            `json:"url"`
+				Hash         string            `json:"hash"`
+				Fields       map[string]string `json:"fields"`
+				Added        time.Time         `json:"added"`
+				Verified     bool              `json:"verified"`
+				SupersededBy string            `json:"supersededBy,omitempty"`
+				NonceRange   *nonceRange       `json:"nonceRange,omitempty"`
+			}{s.Name, s.Type, s.Source, s.url(), s.Hash, s.Fields, s.Added, s.verify() == nil, s.SupersededBy, s.NonceRange}, "", "  ")
+			fmt.Println(string(out))
+			return nil
+		}
+		return withCode(errCodeNotFound, fmt.Errorf("no schema named '%s' is registered", *nameFlag), "schema", *nameFlag)
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	core "github.com/iden3/go-iden3-core"
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+// The checks below repeat what the circuits verify, so that a broken proof or signature is reported
+// with a precise error before the inputs are written, rather than as a failed witness calculation later
+
+// selfCheck is a named check that is run before the inputs are written
+type selfCheck struct {
+	name  string
+	check func() error
+}
+
+// verifyInclusion checks that a merkle proof shows the claim is included in the claims tree with the given root
+func verifyInclusion(root *merkletree.Hash, proof *merkletree.Proof, claim *core.Claim) error {
+	hIndex, hValue, err := claim.HiHv()
+	if err != nil {
+		return err
+	}
+	return verifyLeafInclusion(root, proof, hIndex, hValue)
+}
+
+// verifyLeafInclusion checks that a merkle proof shows the leaf of a claim, by its index and value hashes,
+// is included in the claims tree with the given root
+func verifyLeafInclusion(root *merkletree.Hash, proof *merkletree.Proof, hIndex, hValue *big.Int) error {
+	if !proof.Existence {
+		return fmt.Errorf("the proof is a proof of non-existence")
+	}
+	if !merkletree.VerifyProof(root, proof, hIndex, hValue) {
+		return fmt.Errorf("the proof doesn't verify against the claims root %s", root.BigInt())
+	}
+	return nil
+}
+
+// verifyNonRevocation checks that a merkle proof shows the revocation nonce is absent from the revocation
+// tree with the given root
+func verifyNonRevocation(root *merkletree.Hash, proof *merkletree.Proof, revNonce uint64) error {
+	if proof.Existence {
+		return fmt.Errorf("the revocation nonce %d is revoked", revNonce)
+	}
+	if !merkletree.VerifyProof(root, proof, new(big.Int).SetUint64(revNonce), big.NewInt(0)) {
+		return fmt.Errorf("the proof doesn't verify against the revocation root %s", root.BigInt())
+	}
+	return nil
+}
+
+// verifyClaimInTree generates a fresh proof for the claim at the current root of the claims tree and
+// verifies it
+func verifyClaimInTree(ctx context.Context, claimTree *merkletree.MerkleTree, claim *core.Claim) error {
+	hIndex, err := claim.HIndex()
+	if err != nil {
+		return err
+	}
+	proof, _, err := claimTree.GenerateProof(ctx, hIndex, claimTree.Root())
+	if err != nil {
+		return err
+	}
+	return verifyInclusion(claimTree.Root(), proof, claim)
+}
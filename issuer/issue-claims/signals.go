@@ -0,0 +1,239 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+// publicSignal is a public signal of a circuit at its position, with what it means and the value that the
+// inputs of the circuit give it
+type publicSignal struct {
+	name     string
+	meaning  string
+	expected string
+}
+
+// circuitInputs are the inputs of a circuit as this tool writes them, by the name of the input
+type circuitInputs map[string]json.RawMessage
+
+// value returns an input as a decimal string, the inputs are written as strings or numbers
+func (in circuitInputs) value(name string) (string, error) {
+	raw, ok := in[name]
+	if !ok {
+		return "", fmt.Errorf("the inputs have no %q", name)
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return "", fmt.Errorf("the input %q is not a number: %s", name, err)
+	}
+	return n.String(), nil
+}
+
+// state computes the state from the inputs of the roots of its 3 trees
+func (in circuitInputs) state(claimsRoot, revRoot, rootsRoot string) (string, error) {
+	var roots []*merkletree.Hash
+	for _, name := range []string{claimsRoot, revRoot, rootsRoot} {
+		v, err := in.value(name)
+		if err != nil {
+			return "", err
+		}
+		h, err := merkletree.NewHashFromString(v)
+		if err != nil {
+			return "", fmt.Errorf("the input %q is not a hash: %s", name, err)
+		}
+		roots = append(roots, h)
+	}
+	state, err := merkletree.HashElems(roots[0].BigInt(), roots[1].BigInt(), roots[2].BigInt())
+	if err != nil {
+		return "", err
+	}
+	return state.BigInt().String(), nil
+}
+
+// signalLayouts computes the public signals that each circuit outputs for its inputs, in the order of the
+// circuit. These are the V1 circuits that go-circuits v0.1.0 builds the inputs of.
+var signalLayouts = map[string]func(in circuitInputs) ([]publicSignal, error){
+	"stateTransition": func(in circuitInputs) ([]publicSignal, error) {
+		return inputSignals(in, [][2]string{
+			{"userID", "ID of the identity"},
+			{"oldUserState", "state that the transition starts from"},
+			{"newUserState", "state that the transition ends in"},
+			{"isOldStateGenesis", "1 if the old state is the genesis state"},
+		})
+	},
+	"credentialAtomicQuerySig": func(in circuitInputs) ([]publicSignal, error) {
+		issuerAuthState, err := in.state("issuerAuthClaimsTreeRoot", "issuerAuthRevTreeRoot", "issuerAuthRootsTreeRoot")
+		if err != nil {
+			return nil, err
+		}
+		signals := []publicSignal{{"issuerAuthState", "issuer state of the issuer's auth claim, computed from its roots", issuerAuthState}}
+		return appendQuerySignals(in, signals, [][2]string{
+			{"userID", "ID of the holder"},
+			{"userState", "state of the holder"},
+			{"challenge", "challenge of the verifier"},
+			{"issuerID", "ID of the issuer"},
+			{"issuerClaimNonRevState", "issuer state of the claim's non-revocation proof"},
+		})
+	},
+	"credentialAtomicQueryMTP": func(in circuitInputs) ([]publicSignal, error) {
+		return appendQuerySignals(in, nil, [][2]string{
+			{"userID", "ID of the holder"},
+			{"userState", "state of the holder"},
+			{"challenge", "challenge of the verifier"},
+			{"issuerClaimIdenState", "issuer state that the claim is in"},
+			{"issuerID", "ID of the issuer"},
+			{"issuerClaimNonRevState", "issuer state of the claim's non-revocation proof"},
+		})
+	},
+}
+
+func inputSignals(in circuitInputs, names [][2]string) ([]publicSignal, error) {
+	var signals []publicSignal
+	for _, n := range names {
+		v, err := in.value(n[0])
+		if err != nil {
+			return nil, err
+		}
+		signals = append(signals, publicSignal{n[0], n[1], v})
+	}
+	return signals, nil
+}
+
+// appendQuerySignals appends the signals that the query circuits share after the identities and states:
+// the timestamp, the schema, the query and its values
+func appendQuerySignals(in circuitInputs, signals []publicSignal, names [][2]string) ([]publicSignal, error) {
+	head, err := inputSignals(in, append(names, [][2]string{
+		{"timestamp", "time of the proof, in unix seconds"},
+		{"claimSchema", "schema hash of the claim"},
+		{"slotIndex", "slot of the claim that the query is on"},
+		{"operator", "operator of the query"},
+	}...))
+	if err != nil {
+		return nil, err
+	}
+	signals = append(signals, head...)
+	var values []json.RawMessage
+	if err := json.Unmarshal(in["value"], &values); err != nil {
+		return nil, fmt.Errorf("the input \"value\" is not an array: %v", err)
+	}
+	for i, raw := range values {
+		v, err := circuitInputs{"value": raw}.value("value")
+		if err != nil {
+			return nil, err
+		}
+		signals = append(signals, publicSignal{fmt.Sprintf("value[%d]", i), "value of the query", v})
+	}
+	return signals, nil
+}
+
+// signalCircuit splits the --circuit option into the name of the circuit and its version, V1 by default
+func signalCircuit(circuit string) (string, string) {
+	for _, version := range []string{"V1", "V2"} {
+		if strings.HasSuffix(circuit, version) {
+			return strings.TrimSuffix(circuit, version), version
+		}
+	}
+	return circuit, "V1"
+}
+
+// validateSignalsCommand handles the "validate-signals" command, that recomputes the public signals of a
+// circuit from the inputs that this tool wrote, and diffs them with the public signals that snarkjs wrote
+func validateSignalsCommand(args []string) error {
+	fs := flag.NewFlagSet("validate-signals", flag.ExitOnError)
+	inputsFlag := fs.String("inputs", "", "path of the circuit inputs that this tool wrote")
+	publicFlag := fs.String("public", "", "path of the public signals that snarkjs wrote")
+	circuitFlag := fs.String("circuit", "stateTransition", "the circuit, optionally with its version, as in credentialAtomicQuerySigV1")
+	fs.Parse(args)
+	var names []string
+	for name := range signalLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if *inputsFlag == "" || *publicFlag == "" {
+		return usageError("usage: validate-signals --inputs <inputs.json> --public <public.json> [--circuit %s]", strings.Join(names, "|"))
+	}
+	name, version := signalCircuit(*circuitFlag)
+	layout, ok := signalLayouts[name]
+	if !ok {
+		return usageError("unknown circuit %q, must be one of %s", name, strings.Join(names, ", "))
+	} else if version != "V1" {
+		return withCode(errCodeInvalidInput, fmt.Errorf("the %s layout of %s is not supported, the inputs are built with go-circuits v0.1.0, which only has the V1 circuits", version, name), "circuit", *circuitFlag)
+	}
+
+	b, err := os.ReadFile(*inputsFlag)
+	if err != nil {
+		return err
+	}
+	var inputs circuitInputs
+	if err := json.Unmarshal(b, &inputs); err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("the inputs are not a JSON object: %s", err))
+	}
+	expected, err := layout(inputs)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("the inputs are not inputs of %s: %s", name, err))
+	}
+	b, err = os.ReadFile(*publicFlag)
+	if err != nil {
+		return err
+	}
+	var actual []string
+	if err := json.Unmarshal(b, &actual); err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("the public signals are not a JSON array of decimal strings: %s", err))
+	}
+
+	// a value that diverges is looked up among the expected signals, to tell a reordered signal apart from a
+	// wrong value
+	positions := map[string][]int{}
+	for i, s := range expected {
+		positions[s.expected] = append(positions[s.expected], i)
+	}
+	diverged := 0
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			fmt.Printf("%d\t%s (%s): expected %s, missing from the public signals\n", i, expected[i].name, expected[i].meaning, expected[i].expected)
+		case i >= len(expected):
+			fmt.Printf("%d\tunexpected extra public signal %s, %s has %d\n", i, actual[i], name, len(expected))
+		case actual[i] != expected[i].expected:
+			fmt.Printf("%d\t%s (%s): expected %s, the public signals have %s", i, expected[i].name, expected[i].meaning, expected[i].expected, actual[i])
+			if others := positions[actual[i]]; len(others) > 0 {
+				fmt.Printf(", which is the expected %s at position %d", expected[others[0]].name, others[0])
+			}
+			fmt.Println()
+		default:
+			continue
+		}
+		diverged++
+	}
+	if diverged > 0 {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("%d of the %d public signals diverge from the inputs of %s", diverged, len(expected), name), "circuit", name)
+	}
+	fmt.Printf("The %d public signals match the inputs of %s\n", len(expected), name)
+	return nil
+}
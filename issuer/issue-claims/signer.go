@@ -0,0 +1,177 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+// issuerKeyEnv is the environment variable that a deployment can inject the issuer's private key in
+const issuerKeyEnv = "IDEN3_ISSUER_PRIVATE_KEY"
+
+// maxKeyTextBytes caps what is read from stdin for a key, which is 32 bytes in hex or base64
+const maxKeyTextBytes = 4096
+
+// keySigner holds the issuer's private key, and is the only place that reads it. The key is read straight
+// into a buffer of its own, which Close wipes. It can also be locked in memory, so that it isn't swapped
+// to disk, where the platform supports it. The intermediate values of a signature are computed by the
+// crypto library, and can't be wiped from here.
+type keySigner struct {
+	key    *babyjub.PrivateKey
+	locked bool
+	// signed counts the signatures made with the key
+	signed int
+	// observe is called with the time that each signature took
+	observe func(elapsed time.Duration)
+}
+
+// newKeySigner reads a private key from the source of randomness
+func newKeySigner(rand io.Reader) (*keySigner, error) {
+	s := &keySigner{key: new(babyjub.PrivateKey)}
+	if _, err := io.ReadFull(rand, s.key[:]); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// newKeySignerFromText parses a private key given as 32 bytes in hex, with or without 0x, or in base64. The
+// errors never include the text, which would leak the key, or part of it, into the logs.
+func newKeySignerFromText(text []byte) (*keySigner, error) {
+	text = bytes.TrimPrefix(bytes.TrimSpace(text), []byte("0x"))
+	s := &keySigner{key: new(babyjub.PrivateKey)}
+	var decoded []byte
+	if b := make([]byte, hex.DecodedLen(len(text))); len(b) == len(s.key) {
+		if _, err := hex.Decode(b, text); err == nil {
+			decoded = b
+		} else {
+			wipe(b)
+		}
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded != nil {
+			break
+		}
+		if b := make([]byte, encoding.DecodedLen(len(text))); len(b) >= len(s.key) {
+			if n, err := encoding.Decode(b, text); err == nil && n == len(s.key) {
+				decoded = b[:n]
+			} else {
+				wipe(b)
+			}
+		}
+	}
+	if decoded == nil {
+		return nil, withCode(errCodeInvalidInput, fmt.Errorf("the private key is not 32 bytes in hex or base64"))
+	}
+	copy(s.key[:], decoded)
+	wipe(decoded)
+	return s, nil
+}
+
+// injectedKeySigner reads the issuer's private key from stdin, when keyStdin is set, or from the
+// environment, and returns nil if neither is given. The variable is removed from the environment, so that
+// the processes that the run spawns don't inherit it. When both are given, they must be the same key.
+func injectedKeySigner(keyStdin bool) (*keySigner, string, error) {
+	var fromStdin, fromEnv *keySigner
+	if text, ok := os.LookupEnv(issuerKeyEnv); ok {
+		os.Unsetenv(issuerKeyEnv)
+		var err error
+		if fromEnv, err = newKeySignerFromText([]byte(text)); err != nil {
+			return nil, "", fmt.Errorf("invalid %s: %w", issuerKeyEnv, err)
+		}
+	}
+	if !keyStdin {
+		return fromEnv, issuerKeyEnv, nil
+	}
+	text, err := io.ReadAll(io.LimitReader(os.Stdin, maxKeyTextBytes+1))
+	if err == nil && len(text) > maxKeyTextBytes {
+		err = withCode(errCodeInvalidInput, fmt.Errorf("more than %d bytes were given", maxKeyTextBytes))
+	}
+	if err == nil {
+		fromStdin, err = newKeySignerFromText(text)
+	}
+	wipe(text)
+	if err != nil {
+		if fromEnv != nil {
+			fromEnv.Close()
+		}
+		return nil, "", fmt.Errorf("invalid private key on stdin: %w", err)
+	}
+	if fromEnv != nil {
+		same := subtle.ConstantTimeCompare(fromStdin.key[:], fromEnv.key[:]) == 1
+		fromEnv.Close()
+		if !same {
+			fromStdin.Close()
+			return nil, "", withCode(errCodeKeyMismatch, fmt.Errorf("the private key on stdin is not the key in %s", issuerKeyEnv))
+		}
+	}
+	return fromStdin, "stdin", nil
+}
+
+func (s *keySigner) Public() *babyjub.PublicKey {
+	return s.key.Public()
+}
+
+func (s *keySigner) SignPoseidon(msg *big.Int) *babyjub.Signature {
+	start := time.Now()
+	sig := s.key.SignPoseidon(msg)
+	s.signed++
+	if s.observe != nil {
+		s.observe(time.Since(start))
+	}
+	return sig
+}
+
+// signatures returns the number of signatures made with the key
+func (s *keySigner) signatures() int {
+	return s.signed
+}
+
+// lock keeps the key in memory until Close
+func (s *keySigner) lock() error {
+	if err := lockMemory(s.key[:]); err != nil {
+		return err
+	}
+	s.locked = true
+	return nil
+}
+
+// Close wipes the key and unlocks its memory. The signer can't be used after it's closed.
+func (s *keySigner) Close() {
+	wipe(s.key[:])
+	if s.locked {
+		unlockMemory(s.key[:])
+		s.locked = false
+	}
+}
+
+// wipe zeroes a buffer that held key material
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeySignerCloseWipesTheKey(t *testing.T) {
+	s, err := newKeySignerFromText([]byte(strings.Repeat("ab", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := s.Public()
+	if sig := s.SignPoseidon(big.NewInt(1)); !pubKey.VerifyPoseidon(big.NewInt(1), sig) {
+		t.Fatal("expected the signature to verify")
+	}
+	s.Close()
+	for i, b := range s.key {
+		if b != 0 {
+			t.Fatalf("expected the key to be wiped, byte %d is %x", i, b)
+		}
+	}
+}
+
+func TestKeySignerErrorsLeaveOutTheKey(t *testing.T) {
+	text := strings.Repeat("zz", 32)
+	_, err := newKeySignerFromText([]byte(text))
+	if err == nil {
+		t.Fatal("expected an invalid key to be rejected")
+	}
+	if strings.Contains(err.Error(), "zz") {
+		t.Errorf("expected the error to leave out the key, got: %s", err)
+	}
+	if code := classifyError(err).code; code != errCodeInvalidInput {
+		t.Errorf("expected the error code %s, got %s", errCodeInvalidInput.Code, code.Code)
+	}
+}
+
+func TestInjectedKeySignerUnsetsTheEnvironment(t *testing.T) {
+	t.Setenv(issuerKeyEnv, strings.Repeat("01", 32))
+	s, source, err := injectedKeySigner(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if source != issuerKeyEnv {
+		t.Errorf("expected the key to come from %s, got %s", issuerKeyEnv, source)
+	}
+	if _, ok := os.LookupEnv(issuerKeyEnv); ok {
+		t.Errorf("expected %s to be removed from the environment", issuerKeyEnv)
+	}
+}
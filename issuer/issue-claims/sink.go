@@ -0,0 +1,156 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The HTTP sink retries a failed write a few times before it fails the issuance
+const (
+	httpSinkAttempts = 3
+	httpSinkBackoff  = time.Second
+)
+
+// outputSink receives the files that the issuance produces for others: the inputs of the state transition,
+// their signature and the payload for the holder. A failed write fails the issuance, as the payload for the
+// holder is the only copy of it.
+type outputSink interface {
+	Write(name string, data []byte) error
+	// location is the path or URL that a file of the given name is written to
+	location(name string) string
+	// describe tells where a file of the given name is written, for the narration
+	describe(name string) string
+}
+
+// newOutputSink creates the sink selected by the --output option, either "dir:<path>" for a local directory,
+// or an http(s) URL that the files are posted to
+func newOutputSink(ctx context.Context, output string) (outputSink, error) {
+	switch {
+	case strings.HasPrefix(output, "dir:"):
+		dir := strings.TrimPrefix(output, "dir:")
+		if info, err := os.Stat(dir); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		return dirSink(dir), nil
+	case strings.HasPrefix(output, "http://") || strings.HasPrefix(output, "https://"):
+		u, err := url.Parse(output)
+		if err != nil {
+			return nil, err
+		}
+		return &httpSink{ctx: ctx, base: u, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("the output must be dir:<path> or an http(s) URL, got %q", output)
+}
+
+func defaultOutput() string {
+	homedir, _ := os.UserHomeDir()
+	return "dir:" + homedir
+}
+
+// timedSink records the time of every write to a sink in the file output phase of the issuance
+type timedSink struct {
+	outputSink
+	metrics *issuanceMetrics
+}
+
+func (t *timedSink) Write(name string, data []byte) error {
+	return t.metrics.timePhase(phaseOutput, func() error {
+		return t.outputSink.Write(name, data)
+	})
+}
+
+// dirSink writes the files to a local directory
+type dirSink string
+
+func (d dirSink) Write(name string, data []byte) error {
+	if err := readOnly.check(filepath.Join(string(d), name)); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(string(d), name), data, 0644)
+}
+
+func (d dirSink) location(name string) string {
+	return filepath.Join(string(d), name)
+}
+
+func (d dirSink) describe(name string) string {
+	return "the file: " + d.location(name)
+}
+
+// httpSink posts each file to the base URL followed by the name of the file
+type httpSink struct {
+	ctx    context.Context
+	base   *url.URL
+	client *http.Client
+}
+
+func (h *httpSink) location(name string) string {
+	u := *h.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + url.PathEscape(name)
+	return u.String()
+}
+
+func (h *httpSink) Write(name string, data []byte) error {
+	var err error
+	for attempt := 1; attempt <= httpSinkAttempts; attempt++ {
+		if err = h.post(name, data); err == nil {
+			return nil
+		}
+		if attempt < httpSinkAttempts {
+			select {
+			case <-h.ctx.Done():
+				return h.ctx.Err()
+			case <-time.After(httpSinkBackoff * time.Duration(attempt)):
+			}
+		}
+	}
+	return fmt.Errorf("failed to post %s after %d attempts: %s", name, httpSinkAttempts, err)
+}
+
+func (h *httpSink) post(name string, data []byte) error {
+	req, err := http.NewRequestWithContext(h.ctx, http.MethodPost, h.location(name), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("the endpoint responded with %s", res.Status)
+	}
+	return nil
+}
+
+func (h *httpSink) describe(name string) string {
+	return "the endpoint: " + h.location(name)
+}
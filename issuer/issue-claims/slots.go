@@ -0,0 +1,115 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/constants"
+)
+
+// A claim is made up of 4 index slots and 4 value slots. The first 2 slots of each half are used
+// by the protocol, which leaves i_2, i_3, v_2 and v_3 for the claim data. The index of a slot
+// among all 8 slots is what a query uses to select the slot to compare against.
+var dataSlotIndexes = map[string]int{
+	"i_2": 2,
+	"i_3": 3,
+	"v_2": 6,
+	"v_3": 7,
+}
+
+var reservedSlots = map[string]string{
+	"i_0": "the schema hash, flags and version",
+	"i_1": "the subject ID",
+	"v_0": "the revocation nonce and expiration date",
+	"v_1": "the subject ID",
+}
+
+// slotValues collects the integer data for the claim slots from repeated "--slot name=value" options
+type slotValues map[string]*big.Int
+
+func (s slotValues) String() string {
+	names := s.names()
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%s", name, s[name])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (s slotValues) Set(arg string) error {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected <slot>=<value>, e.g. i_2=19960424 or i_2=date:1996-04-24")
+	}
+	name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if usage, ok := reservedSlots[name]; ok {
+		return fmt.Errorf("slot %s is reserved for %s", name, usage)
+	}
+	if _, ok := dataSlotIndexes[name]; !ok {
+		return fmt.Errorf("unknown slot %s, must be one of i_2, i_3, v_2, v_3", name)
+	}
+	if _, ok := s[name]; ok {
+		return fmt.Errorf("slot %s is set more than once", name)
+	}
+	v, err := parseSlotValue(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for slot %s: %s", name, err)
+	}
+	if err := checkSlotValue(name, v); err != nil {
+		return err
+	}
+	s[name] = v
+	return nil
+}
+
+// checkSlotValue checks that an integer fits in a slot. A slot holds an element of the field that the
+// circuits work over, so larger values would be reduced modulo the field and no longer be the data
+// that was meant to be issued.
+func checkSlotValue(name string, v *big.Int) error {
+	if v.Sign() < 0 {
+		return fmt.Errorf("value %s for slot %s must not be negative", v, name)
+	}
+	if v.Cmp(constants.Q) >= 0 {
+		return fmt.Errorf("value %s for slot %s is too large, the maximum is %s", v, name, new(big.Int).Sub(constants.Q, big.NewInt(1)))
+	}
+	return nil
+}
+
+// names returns the populated slots, in the order of the slots in the claim
+func (s slotValues) names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return dataSlotIndexes[names[i]] < dataSlotIndexes[names[j]]
+	})
+	return names
+}
+
+// options returns the claim options that populate the data slots, unset slots are left as zero
+func (s slotValues) options() []core.Option {
+	return []core.Option{
+		core.WithIndexDataInts(s["i_2"], s["i_3"]),
+		core.WithValueDataInts(s["v_2"], s["v_3"]),
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// stateTransitionCommand handles the "state-transition" command, that writes the inputs of the state
+// transition of a stored issuer identity from its published state, covering the changes pending since
+func stateTransitionCommand(args []string) error {
+	fs := flag.NewFlagSet("state-transition", flag.ExitOnError)
+	readOnly.register(fs, false)
+	var stored storedIdentityFlags
+	stored.register(fs)
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	operator, err := operators.authorize(roleIssue)
+	if err != nil {
+		return fmt.Errorf("not authorized to change the state: %w", err)
+	}
+
+	ctx, cancel := newCommandContext(stored.timeout)
+	defer cancel()
+	o, err := stored.open(ctx, operator)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+	pending := o.identity.PendingChanges()
+	if len(pending.Claims) == 0 && len(pending.Revocations) == 0 {
+		return withCode(errCodeConflict, fmt.Errorf("the identity %s has no changes since the published state %s", stored.issuer, o.publishedState()), "issuer", stored.issuer)
+	}
+	fmt.Printf("-> The transition covers the %d claims and %d revocations since the published state\n", len(pending.Claims), len(pending.Revocations))
+	return o.finish(ctx, "state-transition", o.publishedState())
+}
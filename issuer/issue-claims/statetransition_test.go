@@ -0,0 +1,93 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStateTransitionCoversThePendingChanges(t *testing.T) {
+	testHome(t)
+	key := strings.Repeat("07", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+
+	t.Setenv(issuerKeyEnv, key)
+	printed = captureOutput(t, func() {
+		if err := stateTransitionCommand([]string{"--issuer", id, "--abandon-pending"}); err != nil {
+			t.Fatalf("failed to write the state transition: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "-> The transition covers the 3 claims and 0 revocations since the published state") {
+		t.Errorf("expected the transition to cover the claims of the walkthrough, got: %s", printed)
+	}
+
+	captureOutput(t, func() {
+		if err := transitionCommand([]string{"published", "--issuer", id, "--tx", "0x01"}); err != nil {
+			t.Fatalf("failed to mark the transition published: %s", err)
+		}
+	})
+	t.Setenv(issuerKeyEnv, key)
+	var err error
+	captureOutput(t, func() { err = stateTransitionCommand([]string{"--issuer", id}) })
+	if err == nil || classifyError(err).code != errCodeConflict {
+		t.Errorf("expected an identity without pending changes to be refused, got %v", err)
+	}
+}
+
+func TestReplayAddsTheClaimsRootOfAPublishedState(t *testing.T) {
+	testHome(t)
+	key := strings.Repeat("11", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+	printed = captureOutput(t, func() {
+		if err := transitionCommand([]string{"published", "--issuer", id, "--tx", "0x01"}); err != nil {
+			t.Fatalf("failed to mark the transition published: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "-> The claims root of the published state is added to the roots tree") {
+		t.Errorf("expected the claims root to be added to the roots tree, got: %s", printed)
+	}
+	t.Setenv(issuerKeyEnv, key)
+	captureOutput(t, func() {
+		if err := revokeCommand([]string{"--nonce", "2", "--issuer", id}); err != nil {
+			t.Fatalf("failed to revoke after the publication: %s", err)
+		}
+	})
+	stored, err := findIdentity(defaultIdentitiesPath(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	printed = captureOutput(t, func() {
+		if err := replayCommand([]string{"--issuer", id}); err != nil {
+			t.Fatalf("failed to replay the audit log: %s", err)
+		}
+	})
+	if state := printedValue(printed, "-> State:"); state != stored.State {
+		t.Errorf("expected the replay to reach the stored state %s, got: %s", stored.State, printed)
+	}
+}
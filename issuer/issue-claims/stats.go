@@ -0,0 +1,188 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// issuanceStats summarizes the audit log. The trees themselves are in memory and don't outlive a run, so
+// their sizes are counted from the operations that added to them: every identity starts with its auth
+// claim, and every completed issue-claim or update-claim adds a leaf to the claims tree.
+type issuanceStats struct {
+	AuditLog         string                    `json:"auditLog"`
+	AuditLogBytes    int64                     `json:"auditLogBytes"`
+	Entries          int                       `json:"entries"`
+	Identities       int                       `json:"identities"`
+	Operations       map[string]*operationStat `json:"operations"`
+	ClaimsBySchema   map[string]int            `json:"claimsBySchema"`
+	ClaimsTreeLeaves map[string]int            `json:"claimsTreeLeaves"`
+	Signatures       int                       `json:"signatures"`
+	SignaturesByDay  map[string]int            `json:"signaturesByDay"`
+	Last             []*timedEntry             `json:"last"`
+}
+
+// operationStat counts the entries of an operation by status
+type operationStat struct {
+	Completed int `json:"completed"`
+	Aborted   int `json:"aborted"`
+}
+
+// timedEntry is an audit entry with the time since the entry before it for the same issuer
+type timedEntry struct {
+	*auditEntry
+	Elapsed time.Duration `json:"elapsed,omitempty"`
+}
+
+func newIssuanceStats(path string, entries []*auditEntry, last int) *issuanceStats {
+	s := &issuanceStats{
+		AuditLog:         path,
+		Entries:          len(entries),
+		Operations:       map[string]*operationStat{},
+		ClaimsBySchema:   map[string]int{},
+		ClaimsTreeLeaves: map[string]int{},
+		SignaturesByDay:  map[string]int{},
+	}
+	if info, err := os.Stat(path); err == nil {
+		s.AuditLogBytes = info.Size()
+	}
+
+	timed := make([]*timedEntry, len(entries))
+	previous := map[string]time.Time{}
+	for i, e := range entries {
+		op := s.Operations[e.Operation]
+		if op == nil {
+			op = &operationStat{}
+			s.Operations[e.Operation] = op
+		}
+		issuer := e.Params["issuer"]
+		timed[i] = &timedEntry{auditEntry: e}
+		if t, ok := previous[issuer]; ok {
+			timed[i].Elapsed = e.Time.Sub(t)
+		}
+		previous[issuer] = e.Time
+		if signed, _ := strconv.Atoi(e.Params["signatures"]); signed > 0 {
+			s.Signatures += signed
+			s.SignaturesByDay[e.Time.UTC().Format("2006-01-02")] += signed
+		}
+		if e.Status != auditCompleted {
+			op.Aborted++
+			continue
+		}
+		op.Completed++
+		switch e.Operation {
+		case "create-identity":
+			s.Identities++
+			s.ClaimsTreeLeaves[issuer]++
+		case "issue-claim", "update-claim":
+			s.ClaimsBySchema[e.Params["schemaHash"]]++
+			s.ClaimsTreeLeaves[issuer]++
+		}
+	}
+	if last > len(timed) {
+		last = len(timed)
+	}
+	s.Last = timed[len(timed)-last:]
+	return s
+}
+
+func (s *issuanceStats) print() {
+	fmt.Printf("Statistics of the audit log %s (%d entries, %d bytes)\n", s.AuditLog, s.Entries, s.AuditLogBytes)
+	fmt.Println("-> Identities created:", s.Identities)
+	fmt.Println("-> Operations:")
+	names := make([]string, 0, len(s.Operations))
+	for name := range s.Operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("   -> %s: %d completed, %d aborted\n", name, s.Operations[name].Completed, s.Operations[name].Aborted)
+	}
+	fmt.Println("-> Claims issued by schema hash:")
+	for _, schemaHash := range sortedKeys(s.ClaimsBySchema) {
+		fmt.Printf("   -> %s: %d\n", schemaHash, s.ClaimsBySchema[schemaHash])
+	}
+	fmt.Println("-> Signatures by the issuer keys:", s.Signatures)
+	for _, day := range sortedKeys(s.SignaturesByDay) {
+		fmt.Printf("   -> %s: %d\n", day, s.SignaturesByDay[day])
+	}
+	fmt.Println("-> Leaves in the claims tree by issuer:")
+	for _, issuer := range sortedKeys(s.ClaimsTreeLeaves) {
+		fmt.Printf("   -> %s: %d\n", issuer, s.ClaimsTreeLeaves[issuer])
+	}
+	fmt.Printf("-> Last %d operations:\n", len(s.Last))
+	for _, e := range s.Last {
+		fmt.Printf("   -> %d %s %s (%s)", e.Seq, e.Time.Format(time.RFC3339), e.Operation, e.Status)
+		if e.Elapsed > 0 {
+			fmt.Printf(" +%s", e.Elapsed)
+		}
+		fmt.Println()
+	}
+}
+
+// signaturesSince counts the signatures of an issuer's key that the audit log records since a time
+func signaturesSince(entries []*auditEntry, issuerID string, since time.Time) int {
+	n := 0
+	for _, e := range entries {
+		if e.Params["issuer"] == issuerID && !e.Time.Before(since) {
+			signed, _ := strconv.Atoi(e.Params["signatures"])
+			n += signed
+		}
+	}
+	return n
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statsCommand handles the "stats" command that summarizes the issuance recorded in the audit log
+func statsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	pathFlag := fs.String("audit-log", defaultAuditLogPath(), "path of the audit log")
+	lastFlag := fs.Int("last", 10, "number of the most recent operations to list")
+	jsonFlag := fs.Bool("json", false, "print the statistics as JSON")
+	readOnly.register(fs, true)
+	fs.Parse(args)
+
+	if *lastFlag < 0 {
+		return usageError("--last can't be negative")
+	}
+	entries, err := readAuditLog(*pathFlag)
+	if err != nil {
+		return err
+	}
+	s := newIssuanceStats(*pathFlag, entries, *lastFlag)
+	if *jsonFlag {
+		out, _ := json.MarshalIndent(s, "", "  ")
+		fmt.Println(string(out))
+		return nil
+	}
+	s.print()
+	return nil
+}
@@ -0,0 +1,411 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+// The statuses of a state transition. A transition is pending from when its inputs are written until it is
+// marked published, or abandoned to start a different transition from the same old state.
+const (
+	transitionPending   = "pending"
+	transitionPublished = "published"
+	transitionAbandoned = "abandoned"
+)
+
+// stateTransition records the inputs of a state transition when they are written, so that a failed proof
+// generation or publication can be retried with the same inputs rather than a different transition
+type stateTransition struct {
+	Issuer      string          `json:"issuer"`
+	Status      string          `json:"status"`
+	OldState    string          `json:"oldState"`
+	NewState    string          `json:"newState"`
+	InputsHash  string          `json:"inputsHash"`
+	Inputs      json.RawMessage `json:"inputs"`
+	Claims      []string        `json:"claims"`
+	Revocations []uint64        `json:"revocations,omitempty"`
+	Created     time.Time       `json:"created"`
+	Operator    string          `json:"operator,omitempty"`
+	TxHash      string          `json:"txHash,omitempty"`
+	Decided     *time.Time      `json:"decided,omitempty"`
+	// TreeDepth is the depth of the trees that the proofs in the inputs are padded to, 32 if not set
+	TreeDepth int `json:"treeDepth,omitempty"`
+	// OldStateGenesis tells that the old state is the genesis state of the issuer
+	OldStateGenesis bool `json:"oldStateGenesis,omitempty"`
+	// The roots of the trees of the new state, which the transitions recorded before them don't have
+	ClaimsRoot     string `json:"claimsRoot,omitempty"`
+	RevocationRoot string `json:"revocationRoot,omitempty"`
+	RootOfRoots    string `json:"rootOfRoots,omitempty"`
+}
+
+// treeDepth is the depth of the trees that the inputs were written for
+func (t *stateTransition) treeDepth() int {
+	if t.TreeDepth == 0 {
+		return 32
+	}
+	return t.TreeDepth
+}
+
+func defaultTransitionsPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, "iden3_transitions.json")
+}
+
+func inputsHash(inputs []byte) string {
+	h := sha256.Sum256(inputs)
+	return hex.EncodeToString(h[:])
+}
+
+func readTransitions(path string) ([]*stateTransition, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var transitions []*stateTransition
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var t stateTransition
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil || t.Issuer == "" {
+			return nil, fmt.Errorf("line %d of the transitions file is not a valid transition: %v", line, err)
+		}
+		transitions = append(transitions, &t)
+	}
+	return transitions, scanner.Err()
+}
+
+// writeTransitions replaces the transitions file, through a temporary file so that an interrupted write
+// leaves the previous file in place
+func writeTransitions(path string, transitions []*stateTransition) error {
+	if err := readOnly.check(path); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, t := range transitions {
+		line, _ := json.Marshal(t)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pendingTransition returns the pending transition of the issuer, or nil if there is none. An issuer has at
+// most one.
+func pendingTransition(path, issuerID string) (*stateTransition, error) {
+	transitions, err := readTransitions(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range transitions {
+		if t.Issuer == issuerID && t.Status == transitionPending {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// recordTransition records the transition as pending
+func recordTransition(path string, t *stateTransition) error {
+	transitions, err := readTransitions(path)
+	if err != nil {
+		return err
+	}
+	for _, other := range transitions {
+		if other.Issuer == t.Issuer && other.Status == transitionPending {
+			return withCode(errCodeConflict, fmt.Errorf("the transition of %s from %s to %s is already pending", t.Issuer, other.OldState, other.NewState), "issuer", t.Issuer)
+		}
+	}
+	return writeTransitions(path, append(transitions, t))
+}
+
+// decideTransition marks the pending transition of the issuer as published or abandoned
+func decideTransition(path, issuerID string, change func(t *stateTransition)) (*stateTransition, error) {
+	transitions, err := readTransitions(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range transitions {
+		if t.Issuer == issuerID && t.Status == transitionPending {
+			decided := now().UTC()
+			t.Decided = &decided
+			change(t)
+			return t, writeTransitions(path, transitions)
+		}
+	}
+	return nil, withCode(errCodeNotFound, fmt.Errorf("no transition of %s is pending", issuerID), "issuer", issuerID)
+}
+
+// recordPublication moves the stored identity of the issuer to the state that the transition published
+func recordPublication(ctx context.Context, identitiesPath string, t *stateTransition) error {
+	stored, err := storedIdentityPublished(ctx, identitiesPath, t)
+	if err != nil {
+		return fmt.Errorf("failed to record the publication in the stored identity: %w", err)
+	} else if stored == nil {
+		return nil
+	}
+	fmt.Printf("-> The stored identity is at the published state %s\n", t.NewState)
+	if stored.State != t.NewState {
+		fmt.Printf("-> The claims root of the published state is added to the roots tree, the stored identity is at the state %s\n", stored.State)
+	}
+	return nil
+}
+
+// stateLineage follows the states of an issuer from its genesis state: each transition starts from the new
+// state of the one before it. Abandoned transitions are left out, and where a state has more than one
+// transition out of it, the published one is followed.
+func stateLineage(transitions []*stateTransition, issuerID string) []*stateTransition {
+	// the transitions recorded before the genesis flag start from a state that no transition ends in
+	ends := map[string]bool{}
+	for _, t := range transitions {
+		if t.Issuer == issuerID {
+			ends[t.NewState] = true
+		}
+	}
+	var lineage []*stateTransition
+	from := ""
+	for {
+		var next *stateTransition
+		for _, t := range transitions {
+			if t.Issuer != issuerID || t.Status == transitionAbandoned {
+				continue
+			}
+			if (from == "" && (t.OldStateGenesis || !ends[t.OldState])) || (from != "" && t.OldState == from) {
+				if next == nil || (next.Status != transitionPublished && t.Status == transitionPublished) {
+					next = t
+				}
+			}
+		}
+		if next == nil {
+			return lineage
+		}
+		lineage = append(lineage, next)
+		from = next.NewState
+		if len(lineage) > len(transitions) {
+			// a transition back to an earlier state would loop
+			return lineage
+		}
+	}
+}
+
+// transitionStates resolves the states that the issuers published from the recorded transitions, for a
+// verifier that runs alongside the issuer. The state replaced by a transition was replaced when the
+// transition was marked published.
+type transitionStates struct {
+	path string
+}
+
+// published returns the published transitions of the lineage of the issuer, in the order they were published
+func (s transitionStates) published(id *core.ID) ([]*stateTransition, error) {
+	transitions, err := readTransitions(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var published []*stateTransition
+	for _, t := range stateLineage(transitions, id.String()) {
+		if t.Status == transitionPublished {
+			published = append(published, t)
+		}
+	}
+	return published, nil
+}
+
+// LatestState implements verifier.StateResolver
+func (s transitionStates) LatestState(ctx context.Context, id *core.ID) (*merkletree.Hash, error) {
+	published, err := s.published(id)
+	if err != nil || len(published) == 0 {
+		return nil, err
+	}
+	return merkletree.NewHashFromString(published[len(published)-1].NewState)
+}
+
+// ReplacedAt implements verifier.StateHistoryResolver
+func (s transitionStates) ReplacedAt(ctx context.Context, id *core.ID, state *merkletree.Hash) (time.Time, bool, error) {
+	published, err := s.published(id)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	for i, t := range published {
+		if t.NewState != state.BigInt().String() {
+			continue
+		}
+		if i == len(published)-1 {
+			return time.Time{}, true, nil
+		}
+		next := published[i+1]
+		if next.Decided != nil {
+			return *next.Decided, true, nil
+		}
+		return next.Created, true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// printLineage prints the states of the lineage, genesis -> s1 -> s2 ...
+func printLineage(issuerID string, lineage []*stateTransition) {
+	if len(lineage) == 0 {
+		fmt.Printf("No transition of %s out of its genesis state is recorded\n", issuerID)
+		return
+	}
+	fmt.Printf("States of %s:\n", issuerID)
+	fmt.Printf("   genesis  %s\n", lineage[0].OldState)
+	for i, t := range lineage {
+		fmt.Printf("-> s%-7d %s (%s", i+1, t.NewState, t.Status)
+		if t.TxHash != "" {
+			fmt.Printf(", tx %s", t.TxHash)
+		}
+		fmt.Printf(", %d claims, %d revocations)\n", len(t.Claims), len(t.Revocations))
+		if t.ClaimsRoot != "" {
+			fmt.Printf("            claims root %s, revocation root %s, roots root %s\n", t.ClaimsRoot, t.RevocationRoot, t.RootOfRoots)
+		}
+	}
+}
+
+// transitionCommand handles the "transition" subcommands, that show the pending state transitions and the
+// lineage of the states, emit their inputs again, and mark them published or abandoned
+func transitionCommand(args []string) error {
+	usage := usageError("usage: transition list [--pending] [--json] | transition history --issuer <id> [--json] | transition inputs --issuer <id> | transition published --issuer <id> --tx <hash> | transition abandon --issuer <id>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("transition "+args[0], flag.ExitOnError)
+	transitionsFlag := fs.String("transitions", defaultTransitionsPath(), "path of the file that the state transitions are recorded in")
+	issuerFlag := fs.String("issuer", "", "base58 ID of the issuer of the pending transition")
+	identitiesFlag := fs.String("identities", defaultIdentitiesPath(), "path of the file of the stored identities, whose pending changes a published transition covers")
+	readOnly.register(fs, args[0] == "list" || args[0] == "history" || args[0] == "inputs")
+	var operators operatorFlags
+	operators.register(fs)
+	switch args[0] {
+	case "list":
+		pendingFlag := fs.Bool("pending", false, "only list the pending transitions")
+		jsonFlag := fs.Bool("json", false, "print the transitions as JSON lines, with their inputs")
+		fs.Parse(args[1:])
+		transitions, err := readTransitions(*transitionsFlag)
+		if err != nil {
+			return err
+		}
+		for _, t := range transitions {
+			if *pendingFlag && t.Status != transitionPending {
+				continue
+			}
+			if *jsonFlag {
+				line, _ := json.Marshal(t)
+				fmt.Println(string(line))
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\t%s -> %s\t%d claims, %d revocations", t.Issuer, t.Status, t.Created.Format(time.RFC3339), t.OldState, t.NewState, len(t.Claims), len(t.Revocations))
+			if t.TxHash != "" {
+				fmt.Printf("\ttx %s", t.TxHash)
+			}
+			fmt.Println()
+		}
+	case "history":
+		jsonFlag := fs.Bool("json", false, "print the transitions of the lineage as JSON lines, without their inputs")
+		fs.Parse(args[1:])
+		if *issuerFlag == "" {
+			return usage
+		}
+		transitions, err := readTransitions(*transitionsFlag)
+		if err != nil {
+			return err
+		}
+		lineage := stateLineage(transitions, *issuerFlag)
+		if !*jsonFlag {
+			printLineage(*issuerFlag, lineage)
+			return nil
+		}
+		for _, t := range lineage {
+			summary := *t
+			summary.Inputs = nil
+			line, _ := json.Marshal(&summary)
+			fmt.Println(string(line))
+		}
+	case "inputs":
+		fs.Parse(args[1:])
+		if *issuerFlag == "" {
+			return usage
+		}
+		t, err := pendingTransition(*transitionsFlag, *issuerFlag)
+		if err != nil {
+			return err
+		} else if t == nil {
+			return withCode(errCodeNotFound, fmt.Errorf("no transition of %s is pending", *issuerFlag), "issuer", *issuerFlag)
+		}
+		fmt.Println(string(t.Inputs))
+	case "published", "abandon":
+		txFlag := fs.String("tx", "", "hash of the transaction that published the new state")
+		fs.Parse(args[1:])
+		if *issuerFlag == "" || (args[0] == "published" && *txFlag == "") {
+			return usage
+		}
+		role := roleIssue
+		if args[0] == "published" {
+			role = rolePublish
+		}
+		if _, err := operators.authorize(role); err != nil {
+			return fmt.Errorf("not authorized to mark the transition %s: %w", args[0], err)
+		}
+		t, err := decideTransition(*transitionsFlag, *issuerFlag, func(t *stateTransition) {
+			if args[0] == "published" {
+				t.Status = transitionPublished
+				t.TxHash = *txFlag
+			} else {
+				t.Status = transitionAbandoned
+			}
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Marked the transition of %s from %s to %s as %s\n", t.Issuer, t.OldState, t.NewState, t.Status)
+		if t.Status == transitionPublished {
+			return recordPublication(context.Background(), *identitiesFlag, t)
+		}
+	default:
+		return usage
+	}
+	return nil
+}
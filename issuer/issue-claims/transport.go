@@ -0,0 +1,113 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The encodings of the files for the holder. The base64url encodings turn a file into a single-line token
+// that fits in a URL or a QR code, with a prefix that lets the receiving commands detect it.
+const (
+	encodingJSON          = "json"
+	encodingBase64URL     = "base64url"
+	encodingBase64URLGzip = "base64url+gzip"
+
+	tokenPrefix     = "iden3:b64u:"
+	tokenPrefixGzip = "iden3:b64uz:"
+)
+
+// qrCodeCapacity is the number of bytes that the largest QR code (version 40) holds in byte mode, with the
+// lowest level of error correction
+const qrCodeCapacity = 2953
+
+// encodeTransport encodes a JSON file with one of the encodings. The white space is removed from the JSON
+// of a token, to keep it short.
+func encodeTransport(data []byte, encoding string) ([]byte, error) {
+	if encoding == encodingJSON {
+		return data, nil
+	}
+	var compact bytes.Buffer
+	if len(data) > 0 {
+		if err := json.Compact(&compact, data); err != nil {
+			return nil, err
+		}
+	}
+	switch encoding {
+	case encodingBase64URL:
+		return []byte(tokenPrefix + base64.RawURLEncoding.EncodeToString(compact.Bytes())), nil
+	case encodingBase64URLGzip:
+		var buf bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if _, err := w.Write(compact.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return []byte(tokenPrefixGzip + base64.RawURLEncoding.EncodeToString(buf.Bytes())), nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q, must be one of %s, %s, %s", encoding, encodingJSON, encodingBase64URL, encodingBase64URLGzip)
+}
+
+// decodeTransport detects a file encoded as a token and decodes it, other files are returned unchanged
+func decodeTransport(data []byte) ([]byte, error) {
+	token := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(token, []byte(tokenPrefix)):
+		b, err := base64.RawURLEncoding.DecodeString(string(token[len(tokenPrefix):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64url token: %s", err)
+		}
+		return b, nil
+	case bytes.HasPrefix(token, []byte(tokenPrefixGzip)):
+		compressed, err := base64.RawURLEncoding.DecodeString(string(token[len(tokenPrefixGzip):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64url token: %s", err)
+		}
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("invalid compressed token: %s", err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compressed token: %s", err)
+		}
+		return b, nil
+	}
+	return data, nil
+}
+
+// reportTokenSize prints the size of a token, and whether it fits in a QR code. A token that doesn't is
+// offered by the URL it was posted to, or as the file it was written to.
+func reportTokenSize(output outputSink, name string, token []byte) {
+	if len(token) <= qrCodeCapacity {
+		fmt.Printf("   -> Token of %d bytes, fits in a QR code (up to %d bytes)\n", len(token), qrCodeCapacity)
+		return
+	}
+	fmt.Printf("   -> Token of %d bytes, too large for a QR code (up to %d bytes)\n", len(token), qrCodeCapacity)
+	if _, ok := output.(*httpSink); ok {
+		fmt.Printf("   -> Offer the URL to fetch it from instead: %s\n", output.location(name))
+	} else {
+		fmt.Printf("   -> Hand over the file instead, or use --output with an http(s) URL to offer a URL to fetch it from\n")
+	}
+}
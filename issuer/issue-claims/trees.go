@@ -0,0 +1,278 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/iden3/go-circuits"
+	merkletree "github.com/iden3/go-merkletree-sql"
+)
+
+// issuerTrees are the 3 merkle trees that make up the state of an identity
+type issuerTrees struct {
+	claims      *merkletree.MerkleTree
+	revocations *merkletree.MerkleTree
+	roots       *merkletree.MerkleTree
+}
+
+// state is the hash of the roots of the 3 trees
+func (t *issuerTrees) state() (*merkletree.Hash, error) {
+	return merkletree.HashElems(t.claims.Root().BigInt(), t.revocations.Root().BigInt(), t.roots.Root().BigInt())
+}
+
+func (t *issuerTrees) byName(name string) (*merkletree.MerkleTree, error) {
+	switch name {
+	case "claims":
+		return t.claims, nil
+	case "revocations":
+		return t.revocations, nil
+	case "roots":
+		return t.roots, nil
+	default:
+		return nil, fmt.Errorf("unknown tree %q, must be one of claims, revocations, roots", name)
+	}
+}
+
+// treeProof is a proof for a key of one of the trees at its current root, in the standard iden3 JSON format
+// of the merkle tree library, and in the padded format that the circuits take as inputs. Either format can
+// be left out.
+type treeProof struct {
+	Tree    string              `json:"tree"`
+	Root    string              `json:"root"`
+	Key     string              `json:"key"`
+	Value   string              `json:"value"`
+	Proof   *merkletree.Proof   `json:"proof,omitempty"`
+	Circuit *circuitProofFormat `json:"circuit,omitempty"`
+}
+
+// circuitProofFormat is a proof as the circuits take it: the siblings padded with zeros to the depth of
+// the tree, and the auxiliary node of a proof of exclusion. Fnc is 0 for a proof of inclusion and 1 for a
+// proof of exclusion, as in the circom verifier of the merkle tree library.
+type circuitProofFormat struct {
+	Siblings []string `json:"siblings"`
+	AuxKey   string   `json:"auxKey"`
+	AuxValue string   `json:"auxValue"`
+	NoAux    string   `json:"noAux"`
+	Fnc      string   `json:"fnc"`
+}
+
+// The formats that --tree-proof prints the proofs in
+const (
+	proofFormatStandard = "standard"
+	proofFormatCircuit  = "circuit"
+	proofFormatBoth     = "both"
+)
+
+// toCircuitProof converts a proof to the circuit format for a tree of the given depth
+func toCircuitProof(proof *merkletree.Proof, levels int) *circuitProofFormat {
+	c := &circuitProofFormat{
+		Siblings: circuits.PrepareSiblingsStr(proof.AllSiblings(), levels),
+		AuxKey:   "0",
+		AuxValue: "0",
+		NoAux:    "1",
+		Fnc:      "0",
+	}
+	if proof.NodeAux != nil {
+		c.AuxKey = proof.NodeAux.Key.BigInt().String()
+		c.AuxValue = proof.NodeAux.Value.BigInt().String()
+		c.NoAux = "0"
+	}
+	if !proof.Existence {
+		c.Fnc = "1"
+	}
+	return c
+}
+
+// fromCircuitProof converts a proof in the circuit format back to the standard format. The padding is
+// removed from the siblings, since the last sibling on the path of a key is never empty, which restores
+// the depth of the original proof.
+func fromCircuitProof(c *circuitProofFormat) (*merkletree.Proof, error) {
+	siblings := make([]*merkletree.Hash, len(c.Siblings))
+	depth := 0
+	for i, s := range c.Siblings {
+		h, err := merkletree.NewHashFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sibling %q: %s", s, err)
+		}
+		siblings[i] = h
+		if !h.Equals(&merkletree.HashZero) {
+			depth = i + 1
+		}
+	}
+
+	var existence bool
+	switch c.Fnc {
+	case "0":
+		existence = true
+	case "1":
+	default:
+		return nil, fmt.Errorf("invalid fnc %q, must be 0 for inclusion or 1 for exclusion", c.Fnc)
+	}
+	var nodeAux *merkletree.NodeAux
+	switch c.NoAux {
+	case "1":
+	case "0":
+		key, err := merkletree.NewHashFromString(c.AuxKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auxKey %q: %s", c.AuxKey, err)
+		}
+		value, err := merkletree.NewHashFromString(c.AuxValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auxValue %q: %s", c.AuxValue, err)
+		}
+		nodeAux = &merkletree.NodeAux{Key: key, Value: value}
+	default:
+		return nil, fmt.Errorf("invalid noAux %q, must be 0 or 1", c.NoAux)
+	}
+	if existence && nodeAux != nil {
+		return nil, fmt.Errorf("a proof of inclusion can't have an auxiliary node")
+	}
+	return merkletree.NewProofFromData(existence, siblings[:depth], nodeAux)
+}
+
+// generateProof generates the proof of inclusion, or exclusion, of a key in the named tree at its current
+// root, in the given format
+func (t *issuerTrees) generateProof(ctx context.Context, name string, key *big.Int, format string) (*treeProof, error) {
+	tree, err := t.byName(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.generateProofAt(ctx, name, key, tree.Root(), format)
+}
+
+// generateProofAt generates the proof of a key in the named tree at one of its past roots. The storage of a
+// tree keeps the nodes of every root it had, so the proof is the one the tree gave at that root.
+func (t *issuerTrees) generateProofAt(ctx context.Context, name string, key *big.Int, root *merkletree.Hash, format string) (*treeProof, error) {
+	tree, err := t.byName(name)
+	if err != nil {
+		return nil, err
+	}
+	proof, value, err := tree.GenerateProof(ctx, key, root)
+	if err != nil {
+		return nil, err
+	}
+	if !proof.Existence {
+		value = big.NewInt(0)
+	}
+	p := &treeProof{
+		Tree:  name,
+		Root:  root.BigInt().String(),
+		Key:   key.String(),
+		Value: value.String(),
+	}
+	if format != proofFormatCircuit {
+		p.Proof = proof
+	}
+	if format != proofFormatStandard {
+		p.Circuit = toCircuitProof(proof, tree.MaxLevels())
+	}
+	return p, nil
+}
+
+type treeProofRequest struct {
+	tree string
+	key  *big.Int
+}
+
+// treeProofRequests collects the proofs to generate from repeated "--tree-proof tree:key" options
+type treeProofRequests []treeProofRequest
+
+func (r *treeProofRequests) String() string {
+	parts := make([]string, len(*r))
+	for i, req := range *r {
+		parts[i] = req.tree + ":" + req.key.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *treeProofRequests) Set(arg string) error {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected <tree>:<key>, e.g. revocations:2")
+	}
+	if _, err := (&issuerTrees{}).byName(parts[0]); err != nil {
+		return err
+	}
+	key, ok := new(big.Int).SetString(parts[1], 10)
+	if !ok {
+		return fmt.Errorf("key %q is not an integer", parts[1])
+	}
+	*r = append(*r, treeProofRequest{parts[0], key})
+	return nil
+}
+
+// treeVerifyCommand handles the "tree-verify" command that checks a proof generated with --tree-proof
+func treeVerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("tree-verify", flag.ExitOnError)
+	proofFlag := fs.String("proof", "", "path of a file with the proof as printed by --tree-proof, in either format")
+	rootFlag := fs.String("root", "", "the root to verify the proof against, the root in the proof file by default")
+	fs.Parse(args)
+	if *proofFlag == "" {
+		return usageError("usage: tree-verify --proof <file> [--root <root>]")
+	}
+
+	b, err := os.ReadFile(*proofFlag)
+	if err != nil {
+		return err
+	}
+	var p treeProof
+	if err := json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("invalid proof: %s", err)
+	}
+	if p.Proof == nil {
+		if p.Circuit == nil {
+			return fmt.Errorf("invalid proof: the file has no proof")
+		}
+		if p.Proof, err = fromCircuitProof(p.Circuit); err != nil {
+			return fmt.Errorf("invalid proof: %s", err)
+		}
+	}
+	if p.Circuit != nil && !reflect.DeepEqual(toCircuitProof(p.Proof, len(p.Circuit.Siblings)), p.Circuit) {
+		return fmt.Errorf("invalid proof: the standard and the circuit formats of the proof don't match")
+	}
+	if *rootFlag != "" {
+		p.Root = *rootFlag
+	}
+	values := make([]*big.Int, 3)
+	for i, v := range []string{p.Root, p.Key, p.Value} {
+		var ok bool
+		if values[i], ok = new(big.Int).SetString(v, 10); !ok {
+			return fmt.Errorf("invalid proof: %q is not an integer", v)
+		}
+	}
+	root, err := merkletree.NewHashFromBigInt(values[0])
+	if err != nil {
+		return err
+	}
+	if !merkletree.VerifyProof(root, p.Proof, values[1], values[2]) {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the proof doesn't verify against the root %s", p.Root), "root", p.Root)
+	}
+	if p.Proof.Existence {
+		fmt.Printf("Verified the inclusion of the key %s with the value %s under the root %s\n", p.Key, p.Value, p.Root)
+	} else {
+		fmt.Printf("Verified the exclusion of the key %s under the root %s\n", p.Key, p.Root)
+	}
+	return nil
+}
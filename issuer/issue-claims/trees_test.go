@@ -0,0 +1,87 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	merkletree "github.com/iden3/go-merkletree-sql"
+	"github.com/iden3/go-merkletree-sql/db/memory"
+)
+
+func TestProofFormatRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	const levels = 32
+	tree, err := merkletree.NewMerkleTree(ctx, memory.NewMemoryStorage(), levels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	var keys []*big.Int
+	for i := 0; i < 50; i++ {
+		key := new(big.Int).SetUint64(r.Uint64())
+		if err := tree.Add(ctx, key, big.NewInt(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// the keys in the tree have proofs of inclusion, the others proofs of exclusion with or without an
+	// auxiliary node
+	for i := 0; i < 50; i++ {
+		keys = append(keys, new(big.Int).SetUint64(r.Uint64()))
+	}
+
+	for _, key := range keys {
+		proof, _, err := tree.GenerateProof(ctx, key, tree.Root())
+		if err != nil {
+			t.Fatal(err)
+		}
+		back, err := fromCircuitProof(toCircuitProof(proof, levels))
+		if err != nil {
+			t.Fatalf("key %s: %s", key, err)
+		}
+		expected, _ := json.Marshal(proof)
+		converted, _ := json.Marshal(back)
+		if string(expected) != string(converted) {
+			t.Errorf("key %s: expected the proof %s, got %s", key, expected, converted)
+		}
+		if string(proof.Bytes()) != string(back.Bytes()) {
+			t.Errorf("key %s: expected the same bytes after the round trip", key)
+		}
+	}
+}
+
+func TestFromCircuitProofRefusesInvalidProofs(t *testing.T) {
+	zeros := make([]string, 4)
+	for i := range zeros {
+		zeros[i] = "0"
+	}
+	for name, c := range map[string]*circuitProofFormat{
+		"fnc":              {Siblings: zeros, AuxKey: "0", AuxValue: "0", NoAux: "1", Fnc: "2"},
+		"noAux":            {Siblings: zeros, AuxKey: "0", AuxValue: "0", NoAux: "2", Fnc: "1"},
+		"sibling":          {Siblings: []string{"x"}, AuxKey: "0", AuxValue: "0", NoAux: "1", Fnc: "0"},
+		"inclusion of aux": {Siblings: zeros, AuxKey: "1", AuxValue: "2", NoAux: "0", Fnc: "0"},
+	} {
+		if _, err := fromCircuitProof(c); err == nil {
+			t.Errorf("%s: expected the proof to be refused", name)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+
+	core "github.com/iden3/go-iden3-core"
+)
+
+// updatedSlots returns the data slots of the claim with the given slots replaced
+func updatedSlots(claim *core.Claim, slots slotValues) slotValues {
+	raw := claim.RawSlotsAsInts()
+	merged := slotValues{}
+	for name, index := range dataSlotIndexes {
+		merged[name] = raw[index]
+		if v, ok := slots[name]; ok {
+			merged[name] = v
+		}
+	}
+	return merged
+}
+
+// updateClaimCommand handles the "update-claim" command, that issues the next version of an updatable
+// claim of a stored identity with new data. The versions share the revocation nonce, unless
+// --revoke-previous revokes the previous version, which takes a new nonce for the new one, as revoking the
+// shared nonce would revoke every version. The new version links to the claim it supersedes in its receipt.
+func updateClaimCommand(args []string) error {
+	fs := flag.NewFlagSet("update-claim", flag.ExitOnError)
+	readOnly.register(fs, false)
+	nonceFlag := fs.String("nonce", "", "revocation nonce of the claim to update, whose latest version is updated")
+	slots := slotValues{}
+	fs.Var(slots, "slot", "new integer data for a slot of the claim, as <slot>=<value> with the slot one of i_2, i_3, v_2, v_3 (repeatable), the other slots keep their data")
+	revokePreviousFlag := fs.Bool("revoke-previous", false, "revoke the previous version, and give the new version a new revocation nonce")
+	receiptsFlag := fs.String("receipts", defaultReceiptsPath(), "path of the receipts file, which the claim is looked up in and the receipt of the new version is appended to")
+	schemasFlag := fs.String("schemas", defaultSchemasPath(), "path of the file of the registered schemas, whose nonce ranges the new nonce is taken from")
+	holderPayloadFlag := fs.String("holder-payload", "iden3_holder_payload.json", "name of the payload of the new version for the holder in the output")
+	encryptToFlag := fs.String("encrypt-to", "", "compressed babyjubjub public key of the holder, to encrypt the payload to")
+	var stored storedIdentityFlags
+	stored.register(fs)
+	receiptKeys.register(fs)
+	sensitive.register(fs)
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	if *nonceFlag == "" || len(slots) == 0 {
+		return usageError("usage: update-claim --nonce <revocation nonce> --slot <slot>=<value>... [--issuer <id>] [--revoke-previous] [--dry-run]")
+	}
+	revNonce, err := strconv.ParseUint(*nonceFlag, 10, 64)
+	if err != nil {
+		return usageError("invalid --nonce %q: %s", *nonceFlag, err)
+	}
+	if *encryptToFlag != "" {
+		if _, err := parsePublicKey(*encryptToFlag); err != nil {
+			return usageError("invalid --encrypt-to key: %s", err)
+		}
+	}
+	operator, err := operators.authorize(roleIssue)
+	if err != nil {
+		return fmt.Errorf("not authorized to update the claim: %w", err)
+	}
+	if *revokePreviousFlag {
+		if _, err := operators.authorize(roleRevoke); err != nil {
+			return fmt.Errorf("not authorized to revoke the previous version: %w", err)
+		}
+	}
+
+	receipt, err := findReceipt(*receiptsFlag, stored.issuer, revNonce)
+	if err != nil {
+		return err
+	}
+	prev, err := claimFromHex(receipt.Claim)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid claim in the receipt: %s", err))
+	}
+	stored.issuer = receipt.Issuer
+	ctx, cancel := newCommandContext(stored.timeout)
+	defer cancel()
+	o, err := stored.open(ctx, operator)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+	if err := verifyClaimInTree(ctx, o.identity.ClaimsTree(), prev); err != nil {
+		return withCode(errCodeConflict, fmt.Errorf("the claim with the revocation nonce %d is not in the claims tree of the stored identity: %s", revNonce, err), "revocationNonce", *nonceFlag)
+	}
+	if revoked, _, err := o.identity.RevocationStatus(ctx, revNonce); err != nil {
+		return err
+	} else if revoked {
+		return withCode(errCodeClaimRevoked, fmt.Errorf("the claim with the revocation nonce %d is revoked", revNonce), "revocationNonce", *nonceFlag)
+	}
+
+	fmt.Printf("Update the claim with the revocation nonce %d, at version %d\n", revNonce, prev.GetVersion())
+	next, err := updateClaim(prev, updatedSlots(prev, slots).options()...)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("failed to update the claim: %s", err))
+	}
+	for _, name := range slots.names() {
+		fmt.Printf("-> Slot %s (slot index %d): %s\n", name, dataSlotIndexes[name], sensitive.value(slots[name]))
+	}
+	if *revokePreviousFlag {
+		nonces, err := newNonceAllocator(o.identity, "0", rand.Reader)
+		if err != nil {
+			return err
+		}
+		registered, err := readSchemas(*schemasFlag)
+		if err != nil {
+			return err
+		}
+		if err := nonces.reserve(ctx, o.identity.AuthClaim.GetRevocationNonce(), "", "auth claim"); err != nil {
+			return err
+		}
+		if err := nonces.useRanges(registered); err != nil {
+			return err
+		}
+		nonces.useIssued(o.identity)
+		sHashText, _ := next.GetSchemaHash().MarshalText()
+		nonce, err := nonces.allocate(ctx, string(sHashText), "new version")
+		if err != nil {
+			return err
+		}
+		next.SetRevocationNonce(nonce)
+		fmt.Printf("-> The new version takes the revocation nonce %d, as the previous one is revoked\n", nonce)
+	}
+	fmt.Printf("-> Issued version %d: %s\n", next.GetVersion(), sensitive.claimJSON(next))
+	printClaimHex("   ", next)
+
+	oldState, _ := o.identity.State()
+	_, addErr := o.identity.IssueClaim(ctx, next)
+	newState, _ := o.identity.State()
+	if err := o.auditLog.recordClaim("update-claim", o.identity.ID, next, oldState, newState, addErr); err != nil {
+		return fmt.Errorf("failed to record the operation in the audit log: %s", err)
+	}
+	if addErr != nil {
+		return fmt.Errorf("failed to add the claim: %w", addErr)
+	}
+	fmt.Println("-> Added the new version to the claims tree")
+	r, err := newIssuanceReceipt(ctx, o.signer, o.identity.ID, next, oldState, o.trees)
+	if err != nil {
+		return fmt.Errorf("failed to sign the issuance receipt: %s", err)
+	}
+	r.Supersedes = &issuedClaimRef{Issuer: receipt.Issuer, RevocationNonce: revNonce}
+	o.events = append(o.events, receiptEvent(eventClaimUpdated, r))
+	if *revokePreviousFlag {
+		if err := o.revoke(ctx, revNonce); err != nil {
+			return fmt.Errorf("failed to revoke the previous version: %w", err)
+		}
+		fmt.Printf("-> Revoked the revocation nonce %d of the previous versions\n", revNonce)
+	}
+
+	newStateText := newState.BigInt().String()
+	if s, err := o.identity.State(); err == nil {
+		newStateText = s.BigInt().String()
+	}
+	artifacts := newManifest("update-claim", o.identity.ID.String(), o.publishedState(), newStateText)
+	if err := o.commit(ctx, artifacts); err != nil {
+		return err
+	}
+	if stored.dryRun {
+		receiptBytes, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Printf("-> Dry run, the receipt would have been appended to the file: %s\n%s\n", *receiptsFlag, receiptBytes)
+		return nil
+	}
+	if err := writeReceipts(*receiptsFlag, []*issuanceReceipt{r}); err != nil {
+		return fmt.Errorf("failed to write the receipt: %s", err)
+	}
+	fmt.Printf("-> Receipt for the new version written to the file: %s\n", *receiptsFlag)
+	if _, err := next.GetID(); err == nil || *encryptToFlag != "" {
+		payload, err := encodeHolderPayload(&holderPayload{Receipts: []*issuanceReceipt{r}}, *encryptToFlag)
+		if err == nil {
+			err = o.output.Write(*holderPayloadFlag, payload)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write the payload for the holder: %s", err)
+		}
+		fmt.Printf("-> Payload for the holder written to %s\n", o.output.describe(*holderPayloadFlag))
+		artifacts.add(*holderPayloadFlag, payload, formatHolderPayload, encodingJSON, []uint64{next.GetRevocationNonce()}).Encrypted = *encryptToFlag != ""
+	}
+	if err := o.output.Write(manifestName, artifacts.encode()); err != nil {
+		return fmt.Errorf("failed to write the manifest of the artifacts: %s", err)
+	}
+	fmt.Printf("-> Manifest of the artifacts written to %s\n", o.output.describe(manifestName))
+	return nil
+}
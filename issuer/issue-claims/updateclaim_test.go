@@ -0,0 +1,121 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdateClaimBumpsTheVersion(t *testing.T) {
+	home := testHome(t)
+	key := strings.Repeat("04", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+
+	t.Setenv(issuerKeyEnv, key)
+	printed = captureOutput(t, func() {
+		if err := updateClaimCommand([]string{"--nonce", "4", "--slot", "v_2=99", "--abandon-pending"}); err != nil {
+			t.Fatalf("failed to update the claim: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "-> Issued version 1:") {
+		t.Errorf("expected the version 1 of the claim, got: %s", printed)
+	}
+	latest, err := findReceipt(filepath.Join(home, "iden3_receipts.json"), id, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Supersedes == nil || latest.Supersedes.RevocationNonce != 4 || latest.Supersedes.Issuer != id {
+		t.Errorf("expected the receipt to supersede the nonce 4 of %s, got %+v", id, latest.Supersedes)
+	}
+	claim, err := claimFromHex(latest.Claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.GetVersion() != 1 || claim.GetRevocationNonce() != 4 {
+		t.Errorf("expected the version 1 on the nonce 4, got the version %d on the nonce %d", claim.GetVersion(), claim.GetRevocationNonce())
+	}
+
+	t.Setenv(issuerKeyEnv, key)
+	printed = captureOutput(t, func() {
+		if err := updateClaimCommand([]string{"--nonce", "4", "--slot", "v_3=7", "--revoke-previous", "--abandon-pending"}); err != nil {
+			t.Fatalf("failed to update the claim with --revoke-previous: %s", err)
+		}
+	})
+	if nonce := printedValue(printed, "-> The new version takes the revocation nonce"); !strings.HasPrefix(nonce, "5,") {
+		t.Errorf("expected the next free nonce 5 for the new version, got: %s", printed)
+	}
+	stored, err := findIdentity(filepath.Join(home, "iden3_identities.json"), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Pending.Revocations) != 1 || stored.Pending.Revocations[0] != 4 {
+		t.Errorf("expected the stored identity to have the nonce 4 revoked, got %v", stored.Pending.Revocations)
+	}
+
+	// the previous version is revoked, so it can't be updated again
+	t.Setenv(issuerKeyEnv, key)
+	var updateErr error
+	captureOutput(t, func() {
+		updateErr = updateClaimCommand([]string{"--nonce", "4", "--slot", "v_2=1", "--abandon-pending"})
+	})
+	if updateErr == nil || classifyError(updateErr).code != errCodeClaimRevoked {
+		t.Errorf("expected the revoked claim to be refused, got %v", updateErr)
+	}
+
+	printed = captureOutput(t, func() {
+		if err := replayCommand([]string{"--issuer", id}); err != nil {
+			t.Fatalf("failed to replay the audit log: %s", err)
+		}
+	})
+	if !strings.Contains(printed, "every state matches the audit log") {
+		t.Errorf("expected the replay to match, got: %s", printed)
+	}
+}
+
+func TestWalkthroughKeepsAStoredIdentityWithPublishedStates(t *testing.T) {
+	testHome(t)
+	key := strings.Repeat("06", 32)
+	t.Setenv(issuerKeyEnv, key)
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+	captureOutput(t, func() {
+		if err := transitionCommand([]string{"published", "--issuer", id, "--tx", "0x01"}); err != nil {
+			t.Fatalf("failed to mark the transition published: %s", err)
+		}
+	})
+
+	t.Setenv(issuerKeyEnv, key)
+	code, printed = runWalkthrough(t)
+	if code != errCodeConflict.ExitCode || !strings.Contains(printed, "pass --replace-identity") {
+		t.Fatalf("expected the stored identity with a published state to be kept, got %d: %s", code, printed)
+	}
+	t.Setenv(issuerKeyEnv, key)
+	code, printed = runWalkthrough(t, "--replace-identity")
+	if code != 0 || !strings.Contains(printed, "-> Replace the stored identity at the published state") {
+		t.Errorf("expected --replace-identity to replace the stored identity, got %d: %s", code, printed)
+	}
+}
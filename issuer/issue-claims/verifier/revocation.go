@@ -0,0 +1,349 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	merkletree "github.com/iden3/go-merkletree-sql"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// RevocationStatus is the revocation status of a nonce as an issuer's status endpoint returns it: the
+// roots of the issuer's state, and the proof of the inclusion or exclusion of the nonce in its revocation
+// tree. The roots are decimal strings.
+type RevocationStatus struct {
+	Issuer struct {
+		State              *merkletree.Hash `json:"state"`
+		ClaimsTreeRoot     *merkletree.Hash `json:"claimsTreeRoot"`
+		RevocationTreeRoot *merkletree.Hash `json:"revocationTreeRoot"`
+		RootOfRoots        *merkletree.Hash `json:"rootOfRoots"`
+	} `json:"issuer"`
+	MTP *merkletree.Proof `json:"mtp"`
+}
+
+// RevocationChecker fetches the current revocation status of a nonce from its issuer
+type RevocationChecker interface {
+	RevocationStatus(ctx context.Context, issuerID *core.ID, revNonce uint64) (*RevocationStatus, error)
+}
+
+// ErrRevoked is reported by the revocation status check of a claim that the issuer revoked
+var ErrRevoked = errors.New("the claim is revoked")
+
+// checkRevocationStatus fetches the revocation status of the nonce and verifies it: the proof against the
+// revocation root, the roots against the state, and the state against the latest state of the issuer. The
+// status is unavailable when it can't be fetched, which is told apart from a status that doesn't verify.
+func checkRevocationStatus(ctx context.Context, options Options, issuerID *core.ID, latest *merkletree.Hash) (unavailable bool, err error) {
+	status, err := options.Revocation.RevocationStatus(ctx, issuerID, *options.RevocationNonce)
+	if err != nil {
+		return true, fmt.Errorf("failed to fetch the revocation status: %s", err)
+	}
+	if err := status.checkRoots(); err != nil {
+		return false, err
+	}
+	if options.States != nil {
+		if err := checkLatestState(issuerID, status.Issuer.State, latest); err != nil {
+			return false, fmt.Errorf("the revocation status is outdated: %s", err)
+		}
+	}
+	return false, status.checkProof(*options.RevocationNonce)
+}
+
+// Verify checks the revocation status of a nonce on its own: that the roots make up the state, and that the
+// proof verifies against the revocation root. It returns an error that wraps ErrRevoked if the nonce is
+// revoked. It doesn't check that the state is the latest state of the issuer.
+func (status *RevocationStatus) Verify(revNonce uint64) error {
+	if err := status.checkRoots(); err != nil {
+		return err
+	}
+	return status.checkProof(revNonce)
+}
+
+func (status *RevocationStatus) checkRoots() error {
+	s := status.Issuer
+	if s.State == nil || s.ClaimsTreeRoot == nil || s.RevocationTreeRoot == nil || s.RootOfRoots == nil || status.MTP == nil {
+		return fmt.Errorf("the revocation status is incomplete")
+	}
+	state, err := merkletree.HashElems(s.ClaimsTreeRoot.BigInt(), s.RevocationTreeRoot.BigInt(), s.RootOfRoots.BigInt())
+	if err != nil {
+		return err
+	}
+	if !state.Equals(s.State) {
+		return fmt.Errorf("the roots of the revocation status don't make up its state %s", s.State.BigInt())
+	}
+	return nil
+}
+
+func (status *RevocationStatus) checkProof(revNonce uint64) error {
+	s := status.Issuer
+	if !merkletree.VerifyProof(s.RevocationTreeRoot, status.MTP, new(big.Int).SetUint64(revNonce), big.NewInt(0)) {
+		return fmt.Errorf("the proof of the revocation status doesn't verify against the revocation root %s", s.RevocationTreeRoot.BigInt())
+	}
+	if status.MTP.Existence {
+		return fmt.Errorf("%w, its revocation nonce %d is in the revocation tree of the state %s", ErrRevoked, revNonce, s.State.BigInt())
+	}
+	return nil
+}
+
+// ClaimNonRevStatus returns the status as the proof of non-revocation of a claim, which is what a holder
+// proves the claim's status with in the credentialAtomicQuerySig circuit
+func (status *RevocationStatus) ClaimNonRevStatus() circuits.ClaimNonRevStatus {
+	return circuits.ClaimNonRevStatus{
+		TreeState: circuits.TreeState{
+			State:          status.Issuer.State,
+			ClaimsRoot:     status.Issuer.ClaimsTreeRoot,
+			RevocationRoot: status.Issuer.RevocationTreeRoot,
+			RootOfRoots:    status.Issuer.RootOfRoots,
+		},
+		Proof: status.MTP,
+	}
+}
+
+// HTTPRevocationChecker fetches the revocation status of a nonce from the status endpoint of the issuer, with
+// a GET request to the URL followed by the nonce
+type HTTPRevocationChecker struct {
+	URL    string
+	Client *http.Client
+}
+
+// RevocationStatus implements RevocationChecker
+func (h *HTTPRevocationChecker) RevocationStatus(ctx context.Context, issuerID *core.ID, revNonce uint64) (*RevocationStatus, error) {
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(h.URL, "/")+"/"+strconv.FormatUint(revNonce, 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the status endpoint responded with %s", res.Status)
+	}
+	var status RevocationStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("invalid revocation status: %s", err)
+	}
+	return &status, nil
+}
+
+// LocalRevocationChecker reads the revocation status from issuer identities in the same process, at their
+// published state
+type LocalRevocationChecker []*issuer.Identity
+
+// RevocationStatus implements RevocationChecker
+func (l LocalRevocationChecker) RevocationStatus(ctx context.Context, issuerID *core.ID, revNonce uint64) (*RevocationStatus, error) {
+	for _, identity := range l {
+		if *identity.ID != *issuerID {
+			continue
+		}
+		treeState, proof, err := identity.PublishedRevocationStatus(ctx, revNonce)
+		if err != nil {
+			return nil, err
+		}
+		var status RevocationStatus
+		status.Issuer.State = treeState.State
+		status.Issuer.ClaimsTreeRoot = treeState.ClaimsRoot
+		status.Issuer.RevocationTreeRoot = treeState.RevocationRoot
+		status.Issuer.RootOfRoots = treeState.RootOfRoots
+		status.MTP = proof
+		return &status, nil
+	}
+	return nil, fmt.Errorf("unknown issuer %s", issuerID)
+}
+
+// RevocationStatusCache serves the revocation statuses of issuer identities in the same process like
+// LocalRevocationChecker, and keeps the statuses it generates by issuer, nonce and revocation root of the
+// published state. The cache is dropped whenever a revocation or a state transition of one of the
+// identities changes the revocation tree, rather than after a time to live, so a status is never served
+// for a root that is no longer published.
+type RevocationStatusCache struct {
+	identities LocalRevocationChecker
+	mux        sync.Mutex
+	statuses   map[revocationStatusKey]*RevocationStatus
+	hits       uint64
+	misses     uint64
+	// precomputing holds the cancel function of the background precomputation of each issuer
+	precomputing map[core.ID]context.CancelFunc
+}
+
+// PrecomputeProgress reports how far the precomputation of the revocation statuses of an issuer got. Err is
+// set when the precomputation stopped before it was done.
+type PrecomputeProgress struct {
+	Issuer *core.ID
+	Done   int
+	Total  int
+	Err    error
+}
+
+type revocationStatusKey struct {
+	issuer   core.ID
+	revNonce uint64
+	root     merkletree.Hash
+}
+
+// NewRevocationStatusCache creates a cache of the revocation statuses of the identities, and registers it to
+// be invalidated when their revocation trees change
+func NewRevocationStatusCache(identities ...*issuer.Identity) *RevocationStatusCache {
+	c := &RevocationStatusCache{identities: identities, statuses: map[revocationStatusKey]*RevocationStatus{}, precomputing: map[core.ID]context.CancelFunc{}}
+	for _, identity := range identities {
+		identity.OnRevocationsChanged(c.Invalidate)
+	}
+	return c
+}
+
+// RevocationStatus implements RevocationChecker
+func (c *RevocationStatusCache) RevocationStatus(ctx context.Context, issuerID *core.ID, revNonce uint64) (*RevocationStatus, error) {
+	for _, identity := range c.identities {
+		if *identity.ID != *issuerID {
+			continue
+		}
+		auth, err := identity.AuthClaimProof(ctx)
+		if err != nil {
+			return nil, err
+		}
+		key := revocationStatusKey{issuer: *issuerID, revNonce: revNonce, root: *auth.TreeState.RevocationRoot}
+		c.mux.Lock()
+		status, ok := c.statuses[key]
+		if ok {
+			c.hits++
+		} else {
+			c.misses++
+		}
+		c.mux.Unlock()
+		if ok {
+			return status, nil
+		}
+		// the status is generated outside of the lock, and kept by the root it was generated against, which
+		// differs from the looked up root if a state transition happened in between
+		status, err = LocalRevocationChecker{identity}.RevocationStatus(ctx, issuerID, revNonce)
+		if err != nil {
+			return nil, err
+		}
+		key.root = *status.Issuer.RevocationTreeRoot
+		c.mux.Lock()
+		c.statuses[key] = status
+		c.mux.Unlock()
+		return status, nil
+	}
+	return nil, fmt.Errorf("unknown issuer %s", issuerID)
+}
+
+// Precompute generates the statuses of all the active claims of the issuer against its published revocation
+// root, so that the requests that follow a revocation or a state transition are served from the cache. The
+// statuses that are cached already are skipped, so a precomputation that was interrupted resumes where it
+// stopped. progress, if not nil, is called after each status.
+func (c *RevocationStatusCache) Precompute(ctx context.Context, issuerID *core.ID, progress func(PrecomputeProgress)) error {
+	var identity *issuer.Identity
+	for _, i := range c.identities {
+		if *i.ID == *issuerID {
+			identity = i
+		}
+	}
+	if identity == nil {
+		return fmt.Errorf("unknown issuer %s", issuerID)
+	}
+	nonces := identity.ActiveRevocationNonces()
+	report := func(done int, err error) error {
+		if progress != nil {
+			progress(PrecomputeProgress{Issuer: issuerID, Done: done, Total: len(nonces), Err: err})
+		}
+		return err
+	}
+	for n, revNonce := range nonces {
+		if err := ctx.Err(); err != nil {
+			return report(n, err)
+		}
+		auth, err := identity.AuthClaimProof(ctx)
+		if err != nil {
+			return report(n, err)
+		}
+		c.mux.Lock()
+		_, ok := c.statuses[revocationStatusKey{issuer: *issuerID, revNonce: revNonce, root: *auth.TreeState.RevocationRoot}]
+		c.mux.Unlock()
+		if !ok {
+			status, err := LocalRevocationChecker{identity}.RevocationStatus(ctx, issuerID, revNonce)
+			if err != nil {
+				return report(n, err)
+			}
+			c.mux.Lock()
+			c.statuses[revocationStatusKey{issuer: *issuerID, revNonce: revNonce, root: *status.Issuer.RevocationTreeRoot}] = status
+			c.mux.Unlock()
+		}
+		report(n+1, nil)
+	}
+	return nil
+}
+
+// PrecomputeOnChange precomputes the statuses of an issuer in the background whenever a revocation or a state
+// transition changes its revocation tree, until the context is done. A change that happens while the
+// statuses are precomputed cancels that precomputation and starts over against the new root. progress, if not nil, is called from the background goroutines.
+func (c *RevocationStatusCache) PrecomputeOnChange(ctx context.Context, progress func(PrecomputeProgress)) {
+	for _, identity := range c.identities {
+		issuerID := identity.ID
+		identity.OnRevocationsChanged(func() {
+			if ctx.Err() != nil {
+				return
+			}
+			run, cancel := context.WithCancel(ctx)
+			c.mux.Lock()
+			if previous := c.precomputing[*issuerID]; previous != nil {
+				previous()
+			}
+			c.precomputing[*issuerID] = cancel
+			c.mux.Unlock()
+			go func() {
+				defer cancel()
+				c.Precompute(run, issuerID, progress)
+			}()
+		})
+	}
+}
+
+// Invalidate drops every cached status
+func (c *RevocationStatusCache) Invalidate() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.statuses = map[revocationStatusKey]*RevocationStatus{}
+}
+
+// Stats returns the number of statuses served from the cache, and the number that were generated
+func (c *RevocationStatusCache) Stats() (hits, misses uint64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.hits, c.misses
+}
@@ -0,0 +1,122 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verifier
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/iden3/go-iden3-crypto/babyjub"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+func TestRevocationStatusCacheUnderLoad(t *testing.T) {
+	ctx := context.Background()
+	var key babyjub.PrivateKey
+	key[0] = 1
+	identity, err := issuer.New(ctx, issuer.NewMemoryStorage(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewRevocationStatusCache(identity)
+
+	// 8 verifiers check the statuses of 10 nonces 100 times each, so only the first check of each nonce
+	// generates its status
+	const nonces, rounds, workers = 10, 100, 8
+	lookup := func() {
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for r := 0; r < rounds; r++ {
+					for n := uint64(2); n < nonces+2; n++ {
+						if _, err := cache.RevocationStatus(ctx, identity.ID, n); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+	}
+	lookup()
+	if hits, misses := cache.Stats(); misses != nonces || hits != workers*rounds*nonces-nonces {
+		t.Errorf("expected %d misses and %d hits, got %d and %d", nonces, workers*rounds*nonces-nonces, misses, hits)
+	}
+
+	// the publication of a revocation drops the cache, and the status of the nonce is then generated again
+	// at the new published state
+	if err := identity.Revoke(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := identity.StatePublished(ctx, issuer.Publication{TxHash: "0x01"}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := cache.RevocationStatus(ctx, identity.ID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.MTP.Existence {
+		t.Errorf("expected the status of the nonce 3 at the published state to be revoked")
+	}
+	if _, misses := cache.Stats(); misses != nonces+1 {
+		t.Errorf("expected the invalidated status to be generated again, got %d misses", misses)
+	}
+	lookup()
+	if _, misses := cache.Stats(); misses != 2*nonces {
+		t.Errorf("expected each status to be generated once more after the publication, got %d misses", misses)
+	}
+
+	key[0] = 2
+	other, err := issuer.New(ctx, issuer.NewMemoryStorage(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.RevocationStatus(ctx, other.ID, 2); err == nil {
+		t.Errorf("expected no status for an unknown issuer")
+	}
+}
+
+func BenchmarkRevocationStatusCache(b *testing.B) {
+	ctx := context.Background()
+	var key babyjub.PrivateKey
+	key[0] = 1
+	identity, err := issuer.New(ctx, issuer.NewMemoryStorage(), &key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cache := NewRevocationStatusCache(identity)
+	b.RunParallel(func(pb *testing.PB) {
+		n := uint64(0)
+		for pb.Next() {
+			if _, err := cache.RevocationStatus(ctx, identity.ID, 2+n%10); err != nil {
+				b.Error(err)
+				return
+			}
+			n++
+		}
+	})
+}
@@ -0,0 +1,300 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verifier verifies the proofs of the credentialAtomicQuerySig circuit: the zero knowledge proof
+// itself, that its public signals match the query of the verifier, and that the issuer states the proof
+// was generated against are the states of the issuer.
+package verifier
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	merkletree "github.com/iden3/go-merkletree-sql"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// ProofVerifier verifies a zero knowledge proof against its public signals, both in the JSON format that
+// snarkjs writes. There is no Go implementation of the groth16 verification in this module, so it is
+// left to the caller, for example by running snarkjs with the verification key of the circuit.
+type ProofVerifier interface {
+	VerifyProof(ctx context.Context, proof, pubSignals []byte) error
+}
+
+// StateResolver resolves the latest published state of an identity. It returns a nil state for an
+// identity that has never published a state, whose only valid state is its genesis state.
+type StateResolver interface {
+	LatestState(ctx context.Context, id *core.ID) (*merkletree.Hash, error)
+}
+
+// StateHistoryResolver also resolves the states an identity published before its latest state, such as
+// the state history of the state contract
+type StateHistoryResolver interface {
+	StateResolver
+	// ReplacedAt returns when a state of the identity was replaced by the next one, a zero time for the
+	// latest state, and false for a state the identity never published
+	ReplacedAt(ctx context.Context, id *core.ID, state *merkletree.Hash) (time.Time, bool, error)
+}
+
+// Options configures the checks of a verification. The checks whose option is not set are skipped, and a
+// skipped check fails the verification unless it is Optional.
+type Options struct {
+	// Proof verifies the zero knowledge proof
+	Proof ProofVerifier
+	// States resolves the states of the issuers
+	States StateResolver
+	// StateGracePeriod is how long after an issuer state was replaced a proof against it is still
+	// accepted, since a holder can't learn of a new state and prove against it instantly. It requires
+	// States to be a StateHistoryResolver. Only the latest state is accepted without it.
+	StateGracePeriod time.Duration
+	// Challenge is the challenge the holder was asked to sign
+	Challenge *big.Int
+	// Schema is the schema hash of the claims the verifier accepts
+	Schema *core.SchemaHash
+	// Revocation fetches the current revocation status of the claim's RevocationNonce from its issuer,
+	// since the proof only shows the claim was not revoked in the state it was generated against. The
+	// nonce is not in the public signals, the holder discloses it along with the proof.
+	Revocation      RevocationChecker
+	RevocationNonce *uint64
+	// RevocationFailOpen passes the revocation status check when the status can't be fetched, which
+	// otherwise fails it. A status that doesn't verify always fails the check.
+	RevocationFailOpen bool
+	// Optional names the checks that the verification passes without, such as "proof" for a verifier
+	// that trusts the holder to have generated the proof. A check is skipped when its option is not set.
+	Optional []string
+}
+
+// Check is the outcome of one of the checks of a verification
+type Check struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped,omitempty"`
+	// Optional is set for a skipped check that the verification passes without
+	Optional bool `json:"optional,omitempty"`
+	// Unavailable is set when the check couldn't be run, because a service it depends on failed
+	Unavailable bool   `json:"unavailable,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Result lists the checks of a verification, and the public signals they were run against
+type Result struct {
+	Checks     []Check                            `json:"checks"`
+	PubSignals *circuits.AtomicQuerySigPubSignals `json:"pubSignals"`
+	optional   map[string]bool
+}
+
+// Passed returns whether every check passed. A skipped check fails the verification unless it is optional,
+// as a proof verified without it is not shown to hold what the verifier asked for.
+func (r *Result) Passed() bool {
+	for _, c := range r.Checks {
+		if c.Skipped {
+			if !c.Optional {
+				return false
+			}
+		} else if !c.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Result) add(name string, err error) {
+	c := Check{Name: name, Passed: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+func (r *Result) skip(name string) {
+	r.Checks = append(r.Checks, Check{Name: name, Skipped: true, Optional: r.optional[name]})
+}
+
+// Verify runs the checks of a proof of the credentialAtomicQuerySig circuit. The error is only set when the
+// public signals can't be parsed, a failed check is reported in the result.
+func Verify(ctx context.Context, proof, pubSignals []byte, query circuits.Query, options Options) (*Result, error) {
+	var signals circuits.AtomicQuerySigPubSignals
+	if err := signals.PubSignalsUnmarshal(pubSignals); err != nil {
+		return nil, fmt.Errorf("invalid public signals: %s", err)
+	}
+	r := &Result{PubSignals: &signals, optional: map[string]bool{}}
+	for _, name := range options.Optional {
+		r.optional[name] = true
+	}
+
+	if options.Proof != nil {
+		r.add("proof", options.Proof.VerifyProof(ctx, proof, pubSignals))
+	} else {
+		r.skip("proof")
+	}
+
+	r.add("query", checkQuery(&signals, query))
+
+	if options.Challenge != nil {
+		var err error
+		if signals.Challenge.Cmp(options.Challenge) != 0 {
+			err = fmt.Errorf("the proof signs the challenge %s, expected %s", signals.Challenge, options.Challenge)
+		}
+		r.add("challenge", err)
+	} else {
+		r.skip("challenge")
+	}
+
+	if options.Schema != nil {
+		var err error
+		if signals.ClaimSchema != *options.Schema {
+			got, _ := signals.ClaimSchema.MarshalText()
+			want, _ := options.Schema.MarshalText()
+			err = fmt.Errorf("the claim has the schema hash %s, expected %s", got, want)
+		}
+		r.add("schema", err)
+	} else {
+		r.skip("schema")
+	}
+
+	// a genesis state is checked against the issuer ID, without a lookup of the state contract
+	genesis := isGenesisState(signals.IssuerID, signals.IssuerAuthState)
+	var latest *merkletree.Hash
+	if options.States != nil {
+		var err error
+		if latest, err = options.States.LatestState(ctx, signals.IssuerID); err != nil {
+			return nil, fmt.Errorf("failed to resolve the state of the issuer %s: %s", signals.IssuerID, err)
+		}
+	}
+	switch {
+	case genesis:
+		r.add("issuerState", nil)
+	case options.States != nil:
+		err := checkState(signals.IssuerID, signals.IssuerAuthState, latest)
+		if err != nil {
+			err = checkReplacedState(ctx, options, signals.IssuerID, signals.IssuerAuthState, err)
+		}
+		r.add("issuerState", err)
+	default:
+		r.skip("issuerState")
+	}
+	if options.States != nil {
+		// the non-revocation of the claim must be proven against the latest state, a claim revoked
+		// since an older state would otherwise still pass, unless it was replaced within the grace period
+		err := checkLatestState(signals.IssuerID, signals.IssuerClaimNonRevState, latest)
+		if err != nil {
+			err = checkReplacedState(ctx, options, signals.IssuerID, signals.IssuerClaimNonRevState, err)
+		}
+		r.add("revocation", err)
+	} else {
+		r.skip("revocation")
+	}
+
+	if options.Revocation != nil && options.RevocationNonce != nil {
+		unavailable, err := checkRevocationStatus(ctx, options, signals.IssuerID, latest)
+		c := Check{Name: "revocationStatus", Passed: err == nil || (unavailable && options.RevocationFailOpen), Unavailable: unavailable}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		r.Checks = append(r.Checks, c)
+	} else {
+		r.skip("revocationStatus")
+	}
+	return r, nil
+}
+
+// checkReplacedState accepts a state that isn't the latest state of the issuer if it was replaced within the
+// grace period, and otherwise returns the error of the check that refused it
+func checkReplacedState(ctx context.Context, options Options, id *core.ID, state *merkletree.Hash, notLatest error) error {
+	history, ok := options.States.(StateHistoryResolver)
+	if !ok || options.StateGracePeriod <= 0 {
+		return notLatest
+	}
+	replacedAt, published, err := history.ReplacedAt(ctx, id, state)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the history of the state %s: %s", state.BigInt(), err)
+	}
+	if !published || replacedAt.IsZero() {
+		return notLatest
+	}
+	now := time.Now()
+	if deadline := replacedAt.Add(options.StateGracePeriod); now.After(deadline) {
+		return fmt.Errorf("the state %s of the issuer %s was replaced at %s, and the grace period of %s ended at %s, it is now %s",
+			state.BigInt(), id, replacedAt.UTC().Format(time.RFC3339), options.StateGracePeriod, deadline.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkQuery checks the query that the proof was generated for. The circuit pads the values with zeros.
+func checkQuery(signals *circuits.AtomicQuerySigPubSignals, query circuits.Query) error {
+	if signals.SlotIndex != query.SlotIndex {
+		return fmt.Errorf("the proof is for the slot index %d, expected %d", signals.SlotIndex, query.SlotIndex)
+	}
+	if signals.Operator != query.Operator {
+		return fmt.Errorf("the proof is for the operator %d, expected %d", signals.Operator, query.Operator)
+	}
+	values, err := circuits.PrepareCircuitArrayValues(query.Values, len(signals.Values))
+	if err != nil {
+		return err
+	}
+	for i, v := range values {
+		if v.Cmp(signals.Values[i]) != 0 {
+			return fmt.Errorf("the proof is for the value %s at position %d, expected %s", signals.Values[i], i, v)
+		}
+	}
+	return nil
+}
+
+// isGenesisState returns whether a state is the genesis state of an identity, which its ID is derived from
+func isGenesisState(id *core.ID, state *merkletree.Hash) bool {
+	var typ [2]byte
+	copy(typ[:], id[:2])
+	genesisID, err := core.IdGenesisFromIdenState(typ, state.BigInt())
+	return err == nil && genesisID.Equal(id)
+}
+
+// checkState checks that a state is the latest state of the issuer, or its genesis state
+func checkState(id *core.ID, state, latest *merkletree.Hash) error {
+	if (latest != nil && state.Equals(latest)) || isGenesisState(id, state) {
+		return nil
+	}
+	return fmt.Errorf("the state %s is neither the latest nor the genesis state of the issuer %s", state.BigInt(), id)
+}
+
+// checkLatestState checks that a state is the latest state of the issuer. The genesis state is only
+// the latest state of an issuer that has never published a state.
+func checkLatestState(id *core.ID, state, latest *merkletree.Hash) error {
+	if latest != nil {
+		if !state.Equals(latest) {
+			return fmt.Errorf("the state %s is not the latest state of the issuer %s", state.BigInt(), id)
+		}
+		return nil
+	}
+	return checkState(id, state, nil)
+}
+
+// LocalStateResolver resolves the published states of issuer identities in the same process
+type LocalStateResolver []*issuer.Identity
+
+// LatestState implements StateResolver
+func (l LocalStateResolver) LatestState(ctx context.Context, id *core.ID) (*merkletree.Hash, error) {
+	for _, identity := range l {
+		if *identity.ID == *id {
+			return identity.PublishedState(), nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,169 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+	merkletree "github.com/iden3/go-merkletree-sql"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// The contexts of a W3C credential with iden3 proofs, ahead of the JSON-LD schema of the credential type
+var w3cContexts = []string{
+	"https://www.w3.org/2018/credentials/v1",
+	"https://schema.iden3.io/core/jsonld/iden3proofs.jsonld",
+}
+
+// w3cCredential is a claim rendered as a W3C verifiable credential, in the structure that the PolygonID
+// wallet stores a fetched credential in. The data of the claim is in the credential subject, by the field
+// names that the schema declares, and the proof carries the claim itself, the core claim, with the
+// issuer's signature over it.
+type w3cCredential struct {
+	ID                string                 `json:"id"`
+	Context           []string               `json:"@context"`
+	Type              []string               `json:"type"`
+	ExpirationDate    *time.Time             `json:"expirationDate,omitempty"`
+	IssuanceDate      time.Time              `json:"issuanceDate"`
+	CredentialSubject map[string]interface{} `json:"credentialSubject"`
+	CredentialStatus  *w3cCredentialStatus   `json:"credentialStatus"`
+	Issuer            string                 `json:"issuer"`
+	CredentialSchema  w3cCredentialSchema    `json:"credentialSchema"`
+	Proof             []*bjjSignatureProof   `json:"proof"`
+}
+
+// w3cCredentialStatus is where the wallet checks whether the claim of the revocation nonce is revoked
+type w3cCredentialStatus struct {
+	ID              string `json:"id"`
+	RevocationNonce uint64 `json:"revocationNonce"`
+	Type            string `json:"type"`
+}
+
+type w3cCredentialSchema struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// bjjSignatureProof is the BJJSignature2021 proof of a credential: the signature of the issuer's key over
+// the core claim, and the proof that the auth claim of the key is in the issuer's claims tree
+type bjjSignatureProof struct {
+	Type       string        `json:"type"`
+	IssuerData w3cIssuerData `json:"issuerData"`
+	CoreClaim  string        `json:"coreClaim"`
+	Signature  string        `json:"signature"`
+}
+
+type w3cIssuerData struct {
+	ID               string               `json:"id"`
+	State            w3cIssuerState       `json:"state"`
+	AuthCoreClaim    string               `json:"authCoreClaim"`
+	MTP              *merkletree.Proof    `json:"mtp"`
+	CredentialStatus *w3cCredentialStatus `json:"credentialStatus"`
+}
+
+// w3cIssuerState is the state of the issuer that the auth claim proof is against, with the roots in hex
+type w3cIssuerState struct {
+	ClaimsTreeRoot     string `json:"claimsTreeRoot"`
+	RevocationTreeRoot string `json:"revocationTreeRoot"`
+	RootOfRoots        string `json:"rootOfRoots"`
+	Value              string `json:"value"`
+	TxID               string `json:"txId,omitempty"`
+	BlockNumber        uint64 `json:"blockNumber,omitempty"`
+}
+
+// revocationStatus is the credential status of a revocation nonce at the revocation endpoint of the issuer
+func revocationStatus(endpoint string, nonce uint64) *w3cCredentialStatus {
+	return &w3cCredentialStatus{
+		ID:              fmt.Sprintf("%s/%d", strings.TrimSuffix(endpoint, "/"), nonce),
+		RevocationNonce: nonce,
+		Type:            "SparseMerkleTreeProof",
+	}
+}
+
+// newW3CCredential renders a signed credential as a W3C credential of the credential type, whose JSON-LD
+// schema is at schemaURL. The fields that the schema declares are read from their slots of the claim.
+func newW3CCredential(rnd io.Reader, cred *issuer.Credential, credentialType, schemaURL string, fields map[string]string, revocationEndpoint string) (*w3cCredential, error) {
+	uuid, err := newUUID(rnd)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := cred.Claim.GetID()
+	if err != nil {
+		return nil, fmt.Errorf("the claim has no subject to issue a credential to: %s", err)
+	}
+	issuerDID := (&core.DID{ID: *cred.IssuerID}).String()
+	credentialSubject := map[string]interface{}{
+		"id":   (&core.DID{ID: subject}).String(),
+		"type": credentialType,
+	}
+	slots := cred.Claim.RawSlotsAsInts()
+	for slot, name := range fields {
+		credentialSubject[name] = json.Number(slots[dataSlotIndexes[slot]].String())
+	}
+	coreClaim, err := claimToHex(cred.Claim)
+	if err != nil {
+		return nil, err
+	}
+	sp := cred.SignatureProof
+	authCoreClaim, err := claimToHex(sp.IssuerAuthClaim)
+	if err != nil {
+		return nil, err
+	}
+	signature := sp.Signature.Compress()
+	state := w3cIssuerState{
+		ClaimsTreeRoot:     sp.IssuerTreeState.ClaimsRoot.Hex(),
+		RevocationTreeRoot: sp.IssuerTreeState.RevocationRoot.Hex(),
+		RootOfRoots:        sp.IssuerTreeState.RootOfRoots.Hex(),
+		Value:              sp.IssuerTreeState.State.Hex(),
+		TxID:               cred.IssuerState.TxHash,
+		BlockNumber:        cred.IssuerState.BlockNumber,
+	}
+	vc := &w3cCredential{
+		ID:                "urn:uuid:" + uuid,
+		Context:           append(append([]string{}, w3cContexts...), schemaURL),
+		Type:              []string{"VerifiableCredential", credentialType},
+		IssuanceDate:      now().UTC().Truncate(time.Second),
+		CredentialSubject: credentialSubject,
+		CredentialStatus:  revocationStatus(revocationEndpoint, cred.Claim.GetRevocationNonce()),
+		Issuer:            issuerDID,
+		CredentialSchema:  w3cCredentialSchema{ID: schemaURL, Type: "JsonSchemaValidator2018"},
+		Proof: []*bjjSignatureProof{{
+			Type: "BJJSignature2021",
+			IssuerData: w3cIssuerData{
+				ID:               issuerDID,
+				State:            state,
+				AuthCoreClaim:    authCoreClaim,
+				MTP:              sp.IssuerAuthClaimMTP,
+				CredentialStatus: revocationStatus(revocationEndpoint, sp.IssuerAuthClaim.GetRevocationNonce()),
+			},
+			CoreClaim: coreClaim,
+			Signature: hex.EncodeToString(signature[:]),
+		}},
+	}
+	if expiration, ok := cred.Claim.GetExpirationDate(); ok {
+		expiration = expiration.UTC()
+		vc.ExpirationDate = &expiration
+	}
+	return vc, nil
+}
@@ -0,0 +1,121 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// matchShape lists the fields of the fixture that the credential lacks or holds as another JSON type. The
+// fields that only the credential has are left alone, as the wallet ignores the fields it doesn't read.
+func matchShape(path string, fixture, credential interface{}) []string {
+	switch f := fixture.(type) {
+	case map[string]interface{}:
+		c, ok := credential.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s is %T, the fixture has an object", path, credential)}
+		}
+		var mismatches []string
+		for key, value := range f {
+			if _, ok := c[key]; !ok {
+				mismatches = append(mismatches, fmt.Sprintf("%s.%s is missing", path, key))
+				continue
+			}
+			mismatches = append(mismatches, matchShape(path+"."+key, value, c[key])...)
+		}
+		return mismatches
+	case []interface{}:
+		c, ok := credential.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s is %T, the fixture has an array", path, credential)}
+		}
+		if len(f) > 0 && len(c) > 0 {
+			return matchShape(path+"[0]", f[0], c[0])
+		}
+		return nil
+	}
+	if reflect.TypeOf(fixture) != reflect.TypeOf(credential) {
+		return []string{fmt.Sprintf("%s is %T, the fixture has %T", path, credential, fixture)}
+	}
+	return nil
+}
+
+// TestW3CCredentialMatchesTheIssuerNodeFixture compares a credential of the walkthrough with
+// testdata/issuer-node-credential.json, a KYCAgeCredential in the structure that the issuer node returns a
+// credential in. The fixture was written from that structure, not captured from a node, and its hashes,
+// claims and signature are random values of the right lengths, so only the fields, their JSON types and
+// the names of the proof, status and schema types are compared.
+func TestW3CCredentialMatchesTheIssuerNodeFixture(t *testing.T) {
+	home := testHome(t)
+	t.Setenv(issuerKeyEnv, strings.Repeat("13", 32))
+	code, printed := runWalkthrough(t, "--holder-id", testHolderID, "--w3c-credentials", "credentials.json", "--revocation-endpoint", "http://localhost:8080/revocations", "--schema-url", "http://localhost:8080/schema.json")
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+
+	b, err := os.ReadFile(filepath.Join("testdata", "issuer-node-credential.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture map[string]interface{}
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = os.ReadFile(filepath.Join(home, "credentials.json")); err != nil {
+		t.Fatal(err)
+	}
+	var credentials []map[string]interface{}
+	if err := json.Unmarshal(b, &credentials); err != nil {
+		t.Fatal(err)
+	}
+	var credential map[string]interface{}
+	for _, c := range credentials {
+		if reflect.DeepEqual(c["type"], fixture["type"]) {
+			credential = c
+		}
+	}
+	if credential == nil {
+		t.Fatalf("expected a credential of the type %v among %d credentials", fixture["type"], len(credentials))
+	}
+
+	for _, mismatch := range matchShape("credential", fixture, credential) {
+		t.Error(mismatch)
+	}
+	fixtureProof := fixture["proof"].([]interface{})[0].(map[string]interface{})
+	proof := credential["proof"].([]interface{})[0].(map[string]interface{})
+	for _, field := range []struct {
+		name             string
+		fixture, current interface{}
+	}{
+		{"proof type", fixtureProof["type"], proof["type"]},
+		{"credential status type", fixture["credentialStatus"].(map[string]interface{})["type"], credential["credentialStatus"].(map[string]interface{})["type"]},
+		{"credential schema type", fixture["credentialSchema"].(map[string]interface{})["type"], credential["credentialSchema"].(map[string]interface{})["type"]},
+		{"first two contexts", fixture["@context"].([]interface{})[:2], credential["@context"].([]interface{})[:2]},
+		{"length of the core claim", len(fixtureProof["coreClaim"].(string)), len(proof["coreClaim"].(string))},
+		{"length of the signature", len(fixtureProof["signature"].(string)), len(proof["signature"].(string))},
+	} {
+		if !reflect.DeepEqual(field.fixture, field.current) {
+			t.Errorf("the %s is %v, the fixture has %v", field.name, field.current, field.fixture)
+		}
+	}
+}
@@ -0,0 +1,1210 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/iden3/go-circuits"
+	core "github.com/iden3/go-iden3-core"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+	merkletree "github.com/iden3/go-merkletree-sql"
+
+	"kaleido.io/iden3-tutorial/issuer"
+)
+
+// inputsName is the name of the inputs of the state transition in the output
+const inputsName = "iden3_input.json"
+
+// walkthroughFlags are the options of the issuance walkthrough
+type walkthroughFlags struct {
+	holderID             string
+	holderFile           string
+	self                 bool
+	slots                slotValues
+	legacyAge            bool
+	skipValidation       bool
+	skipSelfCheck        bool
+	expectedRoot         string
+	receipts             string
+	notifiers            notifierList
+	notifyTimeout        time.Duration
+	auditLog             string
+	auditPlaintext       bool
+	country              string
+	countryDocType       int64
+	countryDoc           string
+	treeProofs           treeProofRequests
+	treeDepth            int
+	treeProofFormat      string
+	fromFile             string
+	merklizedRoot        string
+	fromRequest          string
+	claimRequests        string
+	schemas              string
+	operators            operatorFlags
+	transitions          string
+	identities           string
+	replaceIdentity      bool
+	abandonPending       bool
+	authNonce            string
+	nonce                string
+	timeout              time.Duration
+	keyStdin             bool
+	signingLimit         int
+	signingWindow        time.Duration
+	overrideSigningLimit bool
+	lockKey              bool
+	summaryJSON          bool
+	verbose              bool
+	dryRun               bool
+	deterministic        bool
+	seed                 string
+	issuanceTime         string
+	encryptTo            string
+	encoding             string
+	holderPayload        string
+	output               string
+	w3cCredentials       string
+	revocationEndpoint   string
+	schemaURL            string
+	holders              string
+	requireOnboarded     bool
+}
+
+func (f *walkthroughFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.holderID, "holder-id", "", "base58 ID of the holder identity the KYC claims are issued to")
+	fs.StringVar(&f.holderFile, "holder-file", "", "path of an identity file or circuit inputs of the holder to take the holder ID from")
+	fs.BoolVar(&f.self, "self", false, "issue the KYC claims about the issuer's own identity")
+	fs.Var(f.slots, "slot", "integer data for a slot of the KYC age claim, as <slot>=<value> with the slot one of i_2, i_3, v_2, v_3 (repeatable)")
+	fs.BoolVar(&f.legacyAge, "legacy-age", false, "allow the KYC age claim to hold a precomputed age instead of the birthday, an age of 25 without --slot")
+	fs.BoolVar(&f.skipValidation, "skip-validation", false, "don't validate the slot data against the fields declared by the schema")
+	fs.BoolVar(&f.skipSelfCheck, "skip-self-check", false, "don't verify the signature and merkle proofs before writing the inputs")
+	fs.StringVar(&f.expectedRoot, "expected-root", "", "fail before writing the inputs if the claims root, in decimal, isn't this precomputed value")
+	fs.StringVar(&f.receipts, "receipts", defaultReceiptsPath(), "path of the file that the signed receipts of the issued claims are appended to")
+	fs.Var(&f.notifiers, "notify", "notify another system of the issued claims and the state transition, with webhook:<url>, jsonl:<path> (jsonl:- for stdout) or exec:<command> (repeatable)")
+	fs.DurationVar(&f.notifyTimeout, "notify-timeout", 5*time.Second, "how long the issuance waits for the notifiers of each event, retries included")
+	fs.StringVar(&f.auditLog, "audit-log", defaultAuditLogPath(), "path of the audit log that records the issuer operations")
+	fs.BoolVar(&f.auditPlaintext, "audit-plaintext", false, "record the subjects and the data of the claims in the audit log, instead of their SHA-256 hashes")
+	fs.StringVar(&f.country, "country", "US", "ISO 3166-1 alpha-2 code of the country of residence in the KYC country claim")
+	fs.Int64Var(&f.countryDocType, "country-document-type", 1, "integer code of the type of document that proves the country of residence")
+	fs.StringVar(&f.countryDoc, "country-document", "", "path of the document that proves the country of residence, its hash is stored in the KYC country claim")
+	fs.Var(&f.treeProofs, "tree-proof", "print the proof for a key of a tree at the end of the run, as <tree>:<key> with the tree one of claims, revocations, roots (repeatable)")
+	fs.IntVar(&f.treeDepth, "tree-depth", 32, "depth of the trees, which must match the depth the state transition circuit is compiled for")
+	fs.StringVar(&f.treeProofFormat, "tree-proof-format", proofFormatBoth, "format of the proofs printed by --tree-proof: standard (the iden3 JSON format), circuit (padded for the circuit inputs) or both")
+	fs.StringVar(&f.fromFile, "from-file", "", "path of a JSON descriptor of an additional claim to issue")
+	fs.StringVar(&f.merklizedRoot, "merklized-root", "", "merklized root of an externally merklized credentialSubject, in decimal or hex, for the slot of type merklized of the described claim")
+	fs.StringVar(&f.fromRequest, "from-request", "", "ID of an approved claim request to issue the described claim of, or \"next\" for the oldest one in the queue, see the request and queue commands")
+	fs.StringVar(&f.claimRequests, "claim-requests", defaultClaimRequestsPath(), "path of the file of the claim requests recorded with request create")
+	fs.StringVar(&f.schemas, "schemas", defaultSchemasPath(), "path of the file of the schemas registered with schema add, that a descriptor can name")
+	contexts.register(fs)
+	f.operators.register(fs)
+	sensitive.register(fs)
+	readOnly.register(fs, false)
+	receiptKeys.register(fs)
+	fs.StringVar(&f.transitions, "transitions", defaultTransitionsPath(), "path of the file that the state transitions are recorded in until they are published")
+	fs.StringVar(&f.identities, "identities", defaultIdentitiesPath(), "path of the file that the issuer identity is stored in, for the commands that change it later")
+	fs.BoolVar(&f.replaceIdentity, "replace-identity", false, "replace a stored identity that has published states with the identity of this run, which starts from the genesis state")
+	fs.BoolVar(&f.abandonPending, "abandon-pending", false, "abandon the pending state transition of the issuer, to write the inputs of a different one")
+	fs.StringVar(&f.authNonce, "auth-nonce", "", "revocation nonce of the issuer's auth claim, which the ID of the issuer derives from, or \"random\" to draw it at random. By default, the nonce that the audit log recorded for the key, or a random one for a new key, so that the same key always has the same ID")
+	fs.StringVar(&f.nonce, "nonce", "2", "revocation nonce of the first KYC claim, the claims that follow take the next nonces, or \"random\" to draw each nonce at random")
+	fs.DurationVar(&f.timeout, "timeout", 0, "give up on the issuance after this long, for example 30s (no timeout by default)")
+	fs.BoolVar(&f.keyStdin, "key-stdin", false, "read the issuer's private key from stdin, as 32 bytes in hex or base64, instead of generating one. The key can also be given in "+issuerKeyEnv)
+	fs.IntVar(&f.signingLimit, "signing-limit", 0, "refuse to sign once the issuer key signed this many times within --signing-window, as recorded in the audit log, 0 for no limit")
+	fs.DurationVar(&f.signingWindow, "signing-window", 24*time.Hour, "the rolling window of the --signing-limit")
+	fs.BoolVar(&f.overrideSigningLimit, "override-signing-limit", false, "sign even though the issuer key reached the --signing-limit")
+	fs.BoolVar(&f.lockKey, "lock-key", false, "lock the memory of the signing key, so that it is never swapped to disk, where the platform supports it")
+	fs.BoolVar(&f.summaryJSON, "summary-json", false, "print the summary of --verbose as JSON, with the durations in nanoseconds")
+	fs.BoolVar(&f.verbose, "verbose", false, "print a summary of the operations and their timings at the end of the run")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "run through the issuance without writing the inputs file or the audit log, and print the would-be inputs")
+	fs.BoolVar(&f.deterministic, "deterministic", false, "derive the key and the random nonces from --seed and stamp --issuance-time, for reproducible demos only")
+	fs.StringVar(&f.seed, "seed", "", "hex seed of at least 16 bytes for the --deterministic mode")
+	fs.StringVar(&f.issuanceTime, "issuance-time", "", "time stamped on the audit log and the receipts in the --deterministic mode, in RFC 3339 format")
+	fs.StringVar(&f.encryptTo, "encrypt-to", "", "compressed babyjubjub public key of the holder, to encrypt the payload of the claims to")
+	fs.StringVar(&f.encoding, "encoding", encodingJSON, "encoding of the inputs and the payload for the holder: json, or a single-line token with base64url or base64url+gzip")
+	fs.StringVar(&f.holderPayload, "holder-payload", "iden3_holder_payload.json", "name of the payload of the claims for the holder in the output, written when issuing to --holder-id or with --encrypt-to")
+	fs.StringVar(&f.output, "output", defaultOutput(), "where the inputs and the payload for the holder are written, dir:<path> for a local directory or an http(s) URL to post them to")
+	fs.StringVar(&f.w3cCredentials, "w3c-credentials", "", "name of the W3C credentials of the holder's claims in the output, for the PolygonID wallet, not written by default")
+	fs.StringVar(&f.revocationEndpoint, "revocation-endpoint", "", "URL of the revocation status service of the issuer, that the W3C credentials point to")
+	fs.StringVar(&f.schemaURL, "schema-url", "", "URL of the JSON-LD schema of the KYC claims, that the W3C credentials point to")
+	fs.StringVar(&f.holders, "holders", defaultHoldersPath(), "path of the file of the holders onboarded with onboard-holder")
+	fs.BoolVar(&f.requireOnboarded, "require-onboarded", false, "refuse to issue to a --holder-id that was not onboarded with onboard-holder")
+}
+
+// issuanceRun is the state of a walkthrough, that each phase hands on to the next
+type issuanceRun struct {
+	flags   *walkthroughFlags
+	rnd     io.Reader
+	metrics *issuanceMetrics
+
+	subject          *core.ID
+	onboardedKey     string
+	countryData      slotValues
+	descriptor       *claimDescriptor
+	descriptorSource string
+	claimReq         *claimRequest
+
+	operator string
+	auditLog *auditLog
+	signer   *keySigner
+	output   *timedSink
+
+	identity *issuer.Identity
+	trees    *issuerTrees
+	nonces   *nonceAllocator
+	receipts []*issuanceReceipt
+
+	schemaBytes     []byte
+	ageClaim        *core.Claim
+	countryClaim    *core.Claim
+	kycClaim        *core.Claim
+	descriptorClaim *core.Claim
+
+	newState *merkletree.Hash
+	pending  issuer.Changes
+	inputs   *circuits.StateTransitionInputs
+	resumed  *stateTransition
+	manifest *manifest
+}
+
+// walkthrough issues the KYC claims, and writes the inputs of the state transition that adds them. Each
+// phase refuses what it can before the next one changes anything.
+func walkthrough(args []string) error {
+	f := &walkthroughFlags{slots: slotValues{}}
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	f.register(fs)
+	fs.Parse(args)
+
+	w := &issuanceRun{flags: f, metrics: newIssuanceMetrics()}
+	if err := w.checkOptions(); err != nil {
+		return err
+	}
+	if err := w.resolveSubject(); err != nil {
+		return err
+	}
+	if err := w.loadClaimData(); err != nil {
+		return err
+	}
+	if err := w.authorize(); err != nil {
+		return err
+	}
+	if err := w.openSigner(); err != nil {
+		return err
+	}
+	defer w.signer.Close()
+
+	// an interrupted or timed out walkthrough stops before its next change, and never writes the inputs
+	ctx, cancel := newCommandContext(f.timeout)
+	defer cancel()
+
+	if err := w.createIdentity(ctx); err != nil {
+		return err
+	}
+	if err := w.issueKYCClaims(ctx); err != nil {
+		return err
+	}
+	if w.descriptor != nil {
+		if err := w.issueDescribedClaim(ctx); err != nil {
+			return err
+		}
+	}
+	if err := w.prepareTransition(ctx); err != nil {
+		return err
+	}
+	if err := w.selfCheck(ctx); err != nil {
+		return err
+	}
+	if err := w.printTreeProofs(ctx); err != nil {
+		return err
+	}
+	inputBytes, err := w.transitionInputs(ctx)
+	if err != nil {
+		return err
+	}
+	if f.dryRun {
+		w.printDryRun(inputBytes)
+		if f.verbose {
+			w.printSummary()
+		}
+		return nil
+	}
+	if err := w.writeInputs(ctx, inputBytes); err != nil {
+		return err
+	}
+	if err := w.writeHolderArtifacts(ctx); err != nil {
+		return err
+	}
+	if w.claimReq != nil {
+		if err := w.markRequestIssued(); err != nil {
+			return err
+		}
+	}
+	if f.verbose {
+		w.printSummary()
+	}
+	return nil
+}
+
+// checkOptions refuses the options that can't be given together, and sets up the deterministic mode
+func (w *issuanceRun) checkOptions() error {
+	f := w.flags
+	if f.self && f.holderID != "" {
+		return usageError("the --self and --holder-id options are mutually exclusive")
+	}
+	if _, err := encodeTransport(nil, f.encoding); err != nil {
+		return withCode(errCodeUsage, fmt.Errorf("invalid --encoding: %w", err))
+	}
+	switch f.treeProofFormat {
+	case proofFormatStandard, proofFormatCircuit, proofFormatBoth:
+	default:
+		return usageError("invalid --tree-proof-format %q, must be one of standard, circuit, both", f.treeProofFormat)
+	}
+
+	// the key and the random nonces are read from the system's secure source of randomness, unless the
+	// deterministic mode derives them from a seed
+	w.rnd = rand.Reader
+	if f.deterministic {
+		if f.seed == "" || f.issuanceTime == "" {
+			return usageError("the --deterministic mode requires the --seed and --issuance-time options")
+		}
+		seeded, err := newSeededReader(f.seed)
+		if err != nil {
+			return withCode(errCodeUsage, fmt.Errorf("invalid seed: %w", err))
+		}
+		issuanceTime, err := time.Parse(time.RFC3339, f.issuanceTime)
+		if err != nil {
+			return withCode(errCodeUsage, fmt.Errorf("invalid issuance time: %w", err))
+		}
+		w.rnd = seeded
+		now = func() time.Time { return issuanceTime }
+		fmt.Println("********************************************************************************")
+		fmt.Println("WARNING: deterministic mode. The issuer key is derived from the seed, anyone who")
+		fmt.Println("knows the seed can sign as the issuer. Use this mode for demos and tutorials only.")
+		fmt.Print("********************************************************************************\n\n")
+	} else if f.seed != "" || f.issuanceTime != "" {
+		return usageError("the --seed and --issuance-time options require --deterministic")
+	}
+	return nil
+}
+
+// resolveSubject takes the holder that the claims are issued to from --holder-id or --holder-file, none for
+// self claims
+func (w *issuanceRun) resolveSubject() error {
+	f := w.flags
+	// Self claims, where the issuer is the subject, leave the subject out of the claim as it's implied by
+	// the issuer. Claims for a holder carry the holder's ID in the index slots.
+	if f.self && f.holderFile != "" {
+		return usageError("the --self and --holder-file options are mutually exclusive")
+	}
+	if f.holderID != "" || f.holderFile != "" {
+		var holderID *core.ID
+		if f.holderID != "" {
+			var err error
+			if holderID, err = parseHolderID(f.holderID); err != nil {
+				return fmt.Errorf("invalid holder ID: %w", err)
+			}
+		}
+		if f.holderFile != "" {
+			fileID, field, err := holderIDFromFile(f.holderFile)
+			if err != nil {
+				return fmt.Errorf("invalid holder file: %w", err)
+			}
+			if holderID != nil && !holderID.Equal(fileID) {
+				return withCode(errCodeInvalidInput, fmt.Errorf("the --holder-id %s doesn't match the ID %s in the %q field of %s", sensitive.id(holderID.String()), sensitive.id(fileID.String()), field, f.holderFile))
+			}
+			fmt.Printf("Holder ID taken from the %q field of %s: %s\n\n", field, f.holderFile, sensitive.id(fileID.String()))
+			holderID = fileID
+		}
+		w.subject = holderID
+
+		// a holder onboarded by the issuer has a known key, which the ID was derived from
+		onboarded, err := findHolder(f.holders, holderID)
+		if err != nil {
+			return fmt.Errorf("failed to read the onboarded holders: %w", err)
+		}
+		if onboarded == nil && f.requireOnboarded {
+			return withCode(errCodeNotFound, fmt.Errorf("the holder %s was not onboarded, onboard the holder with onboard-holder first", sensitive.id(holderID.String())), "holder", sensitive.id(holderID.String()))
+		}
+		if onboarded != nil {
+			w.onboardedKey = onboarded.PublicKey
+		}
+	} else if f.requireOnboarded {
+		return usageError("the --require-onboarded option requires --holder-id")
+	}
+
+	if f.encryptTo != "" {
+		if _, err := parsePublicKey(f.encryptTo); err != nil {
+			return withCode(errCodeUsage, fmt.Errorf("invalid --encrypt-to key: %w", err))
+		}
+	}
+
+	return nil
+}
+
+// loadClaimData reads the data of the country claim, and the described claim of --from-file or --from-request
+func (w *issuanceRun) loadClaimData() error {
+	f := w.flags
+	var err error
+	w.countryData, err = countrySlots(f.country, f.countryDocType, f.countryDoc)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid country claim data: %w", err))
+	}
+
+	w.descriptorSource = f.fromFile
+	if f.fromFile != "" && f.fromRequest != "" {
+		return usageError("the --from-file and --from-request options are mutually exclusive")
+	} else if f.fromFile != "" {
+		if approvalRequired() {
+			return withCode(errCodeUnauthorized, fmt.Errorf("claims are only issued from approved requests, as %s is set, use request create and --from-request", requireApprovalEnv))
+		}
+		if w.descriptor, err = loadClaimDescriptor(f.fromFile, f.schemas); err != nil {
+			return fmt.Errorf("invalid claim descriptor: %w", err)
+		}
+	} else if f.fromRequest != "" {
+		if f.fromRequest == queueNext {
+			w.claimReq, err = nextQueuedRequest(f.claimRequests)
+		} else {
+			w.claimReq, err = approvedClaimRequest(f.claimRequests, f.fromRequest)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load the claim request: %w", err)
+		}
+		if w.descriptor, err = parseClaimDescriptor(w.claimReq.Descriptor, f.schemas); err != nil {
+			return fmt.Errorf("invalid claim descriptor: %w", err)
+		}
+		w.descriptorSource = fmt.Sprintf("the claim request %s, approved by %s", w.claimReq.ID, w.claimReq.Approver)
+	}
+	if f.merklizedRoot != "" {
+		if w.descriptor == nil {
+			return usageError("the --merklized-root option requires a described claim, with --from-file or --from-request")
+		}
+		root, err := parseMerklizedRoot(f.merklizedRoot)
+		if err == nil {
+			err = w.descriptor.useMerklizedRoot(root)
+		}
+		if err != nil {
+			return withCode(errCodeInvalidInput, fmt.Errorf("invalid merklized root: %w", err))
+		}
+	}
+	if d := w.descriptor; d != nil && d.merklizedSlot != "" && d.merklizedRoot == nil {
+		return usageError("the slot %s of the described claim carries a merklized root, give it with --merklized-root", d.merklizedSlot)
+	}
+
+	return nil
+}
+
+// authorize checks that the operator may issue, and opens the audit log that records the operations of the
+// operator
+func (w *issuanceRun) authorize() error {
+	f := w.flags
+	// the operator is authorized before the signing key is even created
+	var err error
+	if w.operator, err = f.operators.authorize(roleIssue); err != nil {
+		return fmt.Errorf("not authorized to issue: %w", err)
+	}
+
+	if w.auditLog, err = openAuditLog(f.auditLog); err != nil {
+		return fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	w.auditLog.operator = w.operator
+	w.auditLog.plaintext = f.auditPlaintext
+	if f.dryRun {
+		fmt.Print("Dry run, nothing will be written to the filesystem\n\n")
+		w.auditLog.dryRun = true
+	} else if w.claimReq != nil {
+		if err := attemptClaimRequest(f.claimRequests, w.claimReq.ID); err != nil {
+			return fmt.Errorf("not issuing: %w", err)
+		}
+	}
+
+	if f.w3cCredentials != "" && (w.subject == nil || f.revocationEndpoint == "" || f.schemaURL == "") {
+		return usageError("the --w3c-credentials option requires a holder, the --revocation-endpoint and the --schema-url options")
+	}
+
+	return nil
+}
+
+// openSigner reads the injected issuer key, or generates a new one. Once it returns the signer, the caller
+// closes it, which wipes the key.
+func (w *issuanceRun) openSigner() error {
+	f := w.flags
+	signer, keySource, err := injectedKeySigner(f.keyStdin)
+	if err != nil {
+		return fmt.Errorf("failed to read the signing key: %w", err)
+	}
+	if signer != nil {
+		if f.deterministic {
+			signer.Close()
+			return usageError("the --deterministic mode derives the key from the seed, it can't be given with --key-stdin or %s", issuerKeyEnv)
+		}
+		fmt.Printf("Read the signing key on the \"babyjubjub\" curve from %s\n", keySource)
+	} else {
+		fmt.Println("Generating new signing key from the \"babyjubjub\" curve")
+		if signer, err = newKeySigner(w.rnd); err != nil {
+			return fmt.Errorf("failed to generate the signing key: %w", err)
+		}
+	}
+	w.signer = signer
+	if f.lockKey {
+		if err := signer.lock(); err != nil {
+			return fmt.Errorf("failed to lock the signing key in memory: %w", err)
+		}
+		fmt.Println("-> Signing key locked in memory")
+	}
+	w.auditLog.signatures = signer.signatures
+	signer.observe = func(elapsed time.Duration) { w.metrics.observePhase(phaseSigning, elapsed) }
+	fmt.Printf("-> Public key: %s\n\n", signer.Public())
+
+	return nil
+}
+
+// createIdentity creates the issuer identity of the key, with its genesis state
+func (w *issuanceRun) createIdentity(ctx context.Context) error {
+	f := w.flags
+	sink, err := newOutputSink(ctx, f.output)
+	if err != nil {
+		return withCode(errCodeUsage, fmt.Errorf("invalid output: %w", err))
+	}
+	w.output = &timedSink{outputSink: sink, metrics: w.metrics}
+
+	// The issuer package creates the 3 trees that make up an iden3 state, and the genesis state:
+	// - issue an auth claim based on the public key and revocation nounce, this will determine the identity's ID
+	// - add the auth claim to the claim tree
+	// - add the claim tree root at this point in time to the roots tree
+	// A random revocation nonce keeps the auth claim from being revoked by someone who guesses it, but it
+	// changes the ID, so a new key draws one and the nonce that the audit log recorded for a key is taken
+	// again by default. The random nonce is drawn in every case, so that a seeded run reads the same bytes
+	// from the seed whichever nonce it ends up with.
+	authRevocationNonce, err := authNonce("random", w.rnd)
+	if err != nil {
+		return fmt.Errorf("failed to draw the revocation nonce of the auth claim: %w", err)
+	}
+	switch f.authNonce {
+	case "random":
+		// the nonce drawn above
+	case "":
+		entries, err := readAuditLog(f.auditLog)
+		if err != nil {
+			return fmt.Errorf("failed to read the audit log: %w", err)
+		}
+		if recorded, ok := recordedAuthNonce(entries, w.signer.Public()); ok {
+			authRevocationNonce = recorded
+			fmt.Print("-> Revocation nonce of the auth claim taken from the identity of the key in the audit log\n\n")
+		} else {
+			fmt.Print("-> Random revocation nonce drawn for the auth claim of the new key, the audit log records it\n\n")
+		}
+	default:
+		if authRevocationNonce, err = authNonce(f.authNonce, w.rnd); err != nil {
+			return withCode(errCodeUsage, fmt.Errorf("invalid revocation nonce of the auth claim: %w", err))
+		}
+	}
+	identity, err := issuer.New(ctx, issuer.NewMemoryStorage(), w.signer, issuer.WithTreeObserver(w.metrics.observeTreeAdd), issuer.WithTreeDepth(f.treeDepth), issuer.WithAuthNonce(authRevocationNonce))
+	if err != nil {
+		return fmt.Errorf("failed to create the issuer identity: %w", err)
+	}
+	fmt.Println("Generating genesis state for the issuer")
+	fmt.Println("-> Create the empty claims merkle tree")
+	fmt.Println("-> Create the empty revocations merkle tree")
+	fmt.Print("-> Create the empty roots merkle tree\n\n")
+	w.identity = identity
+	w.trees = &issuerTrees{claims: identity.ClaimsTree(), revocations: identity.RevocationsTree(), roots: identity.RootsTree()}
+	if w.nonces, err = newNonceAllocator(identity, f.nonce, w.rnd); err != nil {
+		return withCode(errCodeUsage, fmt.Errorf("invalid revocation nonce: %w", err))
+	}
+	registered, err := readSchemas(f.schemas)
+	if err != nil {
+		return fmt.Errorf("failed to read the registered schemas: %w", err)
+	}
+
+	// A schema is registered using its hash. The hash is used to coordinate the validation by offline processes.
+	// There is no schema validation by the protocol.
+	fmt.Println("-> Issue the authentication claim for the issuer's identity")
+	authClaim := identity.AuthClaim
+	if err := w.nonces.reserve(ctx, authClaim.GetRevocationNonce(), "", "auth claim"); err != nil {
+		return fmt.Errorf("failed to reserve the revocation nonce: %w", err)
+	}
+	if err := w.nonces.useRanges(registered); err != nil {
+		return fmt.Errorf("failed to apply the nonce ranges of the registered schemas: %w", err)
+	}
+	fmt.Printf("   -> Issued auth claim: encoded=%s\n", sensitive.claimJSON(authClaim))
+	fmt.Printf("      -> Revocation nonce: %d\n", authClaim.GetRevocationNonce())
+	printClaimHex("      ", authClaim)
+	fmt.Print("   -> Add the new auth claim to the claims tree\n\n")
+
+	// print the genesis state
+	state := identity.GenesisState
+	fmt.Printf("-> Genesis State: %s\n", state.BigInt())
+
+	// print the ID
+	id := identity.ID
+	fmt.Printf("-> ID of the issuer identity: %s\n\n", id)
+	// the full auth claim is kept with the identity, later commands load it rather than rebuild it from the key
+	authLeaf, _ := claimLeaf(authClaim)
+	authClaimHex, _ := claimToHex(authClaim)
+	if err := w.auditLog.record("create-identity", auditCompleted, map[string]string{"issuer": id.String(), "leaf": authLeaf, "authClaim": authClaimHex}, nil, state); err != nil {
+		return fmt.Errorf("failed to record the operation in the audit log: %w", err)
+	}
+	if f.signingLimit > 0 {
+		// a runaway script shows as an issuer key that signs far more often than the issuance needs
+		entries, err := readAuditLog(f.auditLog)
+		if err != nil {
+			return fmt.Errorf("failed to read the audit log: %w", err)
+		}
+		signed := signaturesSince(entries, id.String(), now().Add(-f.signingWindow))
+		switch {
+		case signed >= f.signingLimit && !f.overrideSigningLimit:
+			return withCode(errCodeUnauthorized, fmt.Errorf("the issuer key signed %d times in the last %s, which reaches the --signing-limit of %d, use --override-signing-limit to sign anyway", signed, f.signingWindow, f.signingLimit))
+		case signed >= f.signingLimit:
+			fmt.Printf("WARNING: the issuer key signed %d times in the last %s, which reaches the --signing-limit of %d, signing anyway as --override-signing-limit is set\n\n", signed, f.signingWindow, f.signingLimit)
+		case signed*5 >= f.signingLimit*4:
+			fmt.Printf("WARNING: the issuer key signed %d times in the last %s, close to the --signing-limit of %d\n\n", signed, f.signingWindow, f.signingLimit)
+		}
+	}
+
+	// the genesis state snapshot is used as input to the ZKP for the state transition
+	fmt.Println("Construct the state snapshot (later as input to the ZK proof generation)")
+	fmt.Println("-> Generate a merkle proof of the inclusion of the auth claim in the claims tree")
+	fmt.Print("-> Generate a merkle proof of the exclusion of the revocation nonce in the revocation tree\n\n\n")
+
+	// before updating the claims tree, the claims tree root at this point is added to the roots tree
+	fmt.Print("Add the current claim tree root to the roots tree\n\n")
+
+	if subject := w.subject; subject != nil {
+		if subject.Equal(id) {
+			return usageError("the holder ID is the issuer's own ID, use --self to issue self claims")
+		}
+		fmt.Printf("Issue the KYC claims to the holder identity: %s\n", sensitive.id(subject.String()))
+		fmt.Printf("-> DID of the holder identity: %s\n", sensitive.id((&core.DID{ID: *subject}).String()))
+		if w.onboardedKey != "" {
+			fmt.Printf("-> Onboarded holder with the public key: %s\n", w.onboardedKey)
+		}
+		fmt.Println()
+	} else {
+		fmt.Printf("Issue the KYC claims as self claims, about the issuer identity: %s\n\n", id)
+	}
+
+	return nil
+}
+
+// issueClaim adds a claim to the claims tree, records the operation with the states before and
+// after it in the audit log, and signs a receipt for the issued claim
+func (w *issuanceRun) issueClaim(ctx context.Context, operation string, claim *core.Claim) error {
+	if err := checkCancelled(ctx); err != nil {
+		return err
+	}
+	start := time.Now()
+	oldState, _ := w.identity.State()
+	_, addErr := w.identity.IssueClaim(ctx, claim)
+	newState, _ := w.identity.State()
+	if err := w.metrics.timePhase(phaseAuditLog, func() error {
+		return w.auditLog.recordClaim(operation, w.identity.ID, claim, oldState, newState, addErr)
+	}); err != nil {
+		return fmt.Errorf("failed to record the operation in the audit log: %w", err)
+	}
+	if addErr != nil {
+		return addErr
+	}
+	receipt, err := newIssuanceReceipt(ctx, w.signer, w.identity.ID, claim, oldState, w.trees)
+	if err != nil {
+		return fmt.Errorf("failed to sign the issuance receipt: %w", err)
+	}
+	w.receipts = append(w.receipts, receipt)
+	w.metrics.observeIssuance(operation, time.Since(start))
+	if f := w.flags; !f.dryRun {
+		eventType := eventClaimIssued
+		if operation == "update-claim" {
+			eventType = eventClaimUpdated
+		}
+		f.notifiers.notifyAll(ctx, f.notifyTimeout, receiptEvent(eventType, receipt))
+	}
+	return nil
+}
+
+// issueKYCClaims issues the KYC age, country and creds claims of the walkthrough, and updates the creds claim
+func (w *issuanceRun) issueKYCClaims(ctx context.Context) error {
+	f := w.flags
+	fmt.Println("Issue the KYC age claim")
+	// Load the schema for the KYC claims
+	schemaBytes, err := os.ReadFile("./schemas/test.json-ld")
+	if err != nil {
+		return fmt.Errorf("failed to load the schema: %w", err)
+	}
+
+	// issue the age claim
+	kycAgeSchema := schemaHash(schemaBytes, "KYCAgeCredential")
+	sHashText, _ := kycAgeSchema.MarshalText()
+	fmt.Println("-> Schema hash for 'KYCAgeCredential':", string(sHashText))
+
+	ageNonce, err := w.nonces.allocate(ctx, string(sHashText), "age claim")
+	if err != nil {
+		return fmt.Errorf("failed to allocate the revocation nonce: %w", err)
+	}
+	ageOptions := []core.Option{withSubject(w.subject), core.WithRevocationNonce(ageNonce)}
+	// the claim holds the birthday, and the verifier asks for a birthday before a cutoff date, since an
+	// age stored in the claim goes stale
+	if len(f.slots) == 0 && !f.legacyAge {
+		f.slots["i_2"] = big.NewInt(defaultBirthday)
+		f.slots["i_3"] = big.NewInt(defaultDocumentType)
+	}
+	if birthday, ok := f.slots["i_2"]; ok && !f.legacyAge {
+		if _, err := formatSlotValue(birthday, slotTypeDate); err != nil {
+			return withCode(errCodeInvalidInput, fmt.Errorf("the birthday slot i_2 holds %s, which is not a YYYYMMDD date. An age in the claim goes stale, issue the birthday and query it with query-spec --min-age, or pass --legacy-age", sensitive.value(birthday)))
+		}
+	}
+	if len(f.slots) > 0 {
+		// the schema declares which fields the credential type holds, and in which slots
+		if f.skipValidation {
+			fmt.Println("-> Skipping the validation of the slot data against the schema")
+		} else {
+			fmt.Println("-> Validate the slot data against the schema")
+			fields, err := schemaFields(schemaBytes, "KYCAgeCredential")
+			if err == nil {
+				err = f.slots.validate(fields, "KYCAgeCredential")
+			}
+			if err != nil {
+				return withCode(errCodeInvalidInput, fmt.Errorf("failed to validate claim data: %w", err))
+			}
+		}
+		ageOptions = append(ageOptions, f.slots.options()...)
+	} else {
+		age := big.NewInt(25)
+		ageOptions = append(ageOptions, core.WithIndexDataInts(age, nil))
+	}
+	ageClaim, err := core.NewClaim(kycAgeSchema, ageOptions...)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("failed to create claim: %w", err))
+	}
+	fmt.Printf("-> Issued age claim: %s\n", sensitive.claimJSON(ageClaim))
+	printClaimHex("   ", ageClaim)
+	// a query against the claim selects the slot to compare by its index among the 8 slots
+	for _, name := range f.slots.names() {
+		fmt.Printf("   -> Slot %s (slot index %d): %s\n", name, dataSlotIndexes[name], sensitive.value(f.slots[name]))
+	}
+
+	// add the age claim to the claim tree
+	fmt.Print("-> Add the age claim to the claims tree\n\n\n")
+	if err := w.issueClaim(ctx, "issue-claim", ageClaim); err != nil {
+		return fmt.Errorf("failed to add the claim: %w", err)
+	}
+
+	// issue the country claim
+	fmt.Println("Issue the KYC country claim")
+	kycCountrySchema := schemaHash(schemaBytes, "KYCCountryOfResidenceCredential")
+	sHashText, _ = kycCountrySchema.MarshalText()
+	fmt.Println("-> Schema hash for 'KYCCountryOfResidenceCredential':", string(sHashText))
+
+	if f.skipValidation {
+		fmt.Println("-> Skipping the validation of the slot data against the schema")
+	} else {
+		fmt.Println("-> Validate the slot data against the schema")
+		fields, err := schemaFields(schemaBytes, "KYCCountryOfResidenceCredential")
+		if err == nil {
+			err = w.countryData.validate(fields, "KYCCountryOfResidenceCredential")
+		}
+		if err != nil {
+			return withCode(errCodeInvalidInput, fmt.Errorf("failed to validate claim data: %w", err))
+		}
+	}
+	countryNonce, err := w.nonces.allocate(ctx, string(sHashText), "country claim")
+	if err != nil {
+		return fmt.Errorf("failed to allocate the revocation nonce: %w", err)
+	}
+	countryOptions := append([]core.Option{withSubject(w.subject), core.WithRevocationNonce(countryNonce)}, w.countryData.options()...)
+	countryClaim, err := core.NewClaim(kycCountrySchema, countryOptions...)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("failed to create claim: %w", err))
+	}
+	fmt.Printf("-> Issued country claim: %s\n", sensitive.claimJSON(countryClaim))
+	printClaimHex("   ", countryClaim)
+	for _, name := range w.countryData.names() {
+		fmt.Printf("   -> Slot %s (slot index %d): %s\n", name, dataSlotIndexes[name], sensitive.value(w.countryData[name]))
+	}
+
+	fmt.Print("-> Add the country claim to the claims tree\n\n\n")
+	if err := w.issueClaim(ctx, "issue-claim", countryClaim); err != nil {
+		return fmt.Errorf("failed to add the claim: %w", err)
+	}
+
+	// issue the full KYC claim
+	fmt.Println("Issue the KYC creds claim")
+	kycSchema := schemaHash(schemaBytes, "KYCCredential")
+	sHashText, _ = kycSchema.MarshalText()
+	fmt.Println("-> Schema hash for 'KYCCredential':", string(sHashText))
+
+	// the claim is flagged as updatable, so that it can be superseded later by a new version of
+	// the claim, without changing its revocation nonce
+	kycNonce, err := w.nonces.allocate(ctx, string(sHashText), "KYC creds claim")
+	if err != nil {
+		return fmt.Errorf("failed to allocate the revocation nonce: %w", err)
+	}
+	kycClaim, err := core.NewClaim(kycSchema, withSubject(w.subject), core.WithRevocationNonce(kycNonce), core.WithIndexDataBytes([]byte("Ben Chodroff"), []byte("ACCOUNT1234567890")), core.WithValueDataBytes([]byte("US"), []byte("295816c03b74e65ac34e5c6dda3c75")), core.WithFlagUpdatable(true))
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("failed to create claim: %w", err))
+	}
+	fmt.Printf("-> Issued full KYC claim: %s\n", sensitive.claimJSON(kycClaim))
+	printClaimHex("   ", kycClaim)
+
+	fmt.Print("-> Add the KYC creds claim to the claims tree\n\n\n")
+	if err := w.issueClaim(ctx, "issue-claim", kycClaim); err != nil {
+		return fmt.Errorf("failed to add the claim: %w", err)
+	}
+
+	w.schemaBytes, w.ageClaim, w.countryClaim, w.kycClaim = schemaBytes, ageClaim, countryClaim, kycClaim
+	return nil
+}
+
+// issueDescribedClaim issues the claim of the descriptor of --from-file or --from-request
+func (w *issuanceRun) issueDescribedClaim(ctx context.Context) error {
+	f, descriptor := w.flags, w.descriptor
+	fmt.Printf("Issue the claim described in %s\n", w.descriptorSource)
+	descriptorSchema := schemaHash(descriptor.schemaBytes, descriptor.Type)
+	sHashText, _ := descriptorSchema.MarshalText()
+	fmt.Printf("-> Schema hash for '%s': %s\n", descriptor.Type, sHashText)
+	if descriptor.subject != nil && descriptor.subject.Equal(w.identity.ID) {
+		return withCode(errCodeInvalidInput, fmt.Errorf("the subject of the described claim is the issuer's own ID, leave it out to issue a self claim"))
+	}
+	if f.skipValidation {
+		fmt.Println("-> Skipping the validation of the slot data against the schema")
+	} else {
+		fmt.Println("-> Validate the slot data against the schema")
+		fields, err := schemaFields(descriptor.schemaBytes, descriptor.Type)
+		if err == nil {
+			// the merklized root stands for the fields of the credentialSubject, whatever the slot declares
+			delete(fields, descriptor.merklizedSlot)
+			err = descriptor.slots.validate(fields, descriptor.Type)
+		}
+		if err != nil {
+			return withCode(errCodeInvalidInput, fmt.Errorf("failed to validate claim data: %w", err))
+		}
+	}
+	var nonce uint64
+	var err error
+	switch descriptor.RevocationNonce {
+	case "", "next":
+		nonce, err = w.nonces.allocate(ctx, string(sHashText), "described claim")
+	case "random":
+		nonce, err = w.nonces.allocateRandom(ctx, string(sHashText), "described claim")
+	default:
+		if nonce, err = strconv.ParseUint(descriptor.RevocationNonce, 10, 64); err != nil {
+			return usageError("the revocation nonce of the descriptor must be \"next\", \"random\" or an integer between 0 and %d, got %q", uint64(1<<64-1), descriptor.RevocationNonce)
+		}
+		err = w.nonces.reserve(ctx, nonce, string(sHashText), "described claim")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to allocate the revocation nonce: %w", err)
+	}
+	descriptorOptions := append(descriptor.options(), core.WithRevocationNonce(nonce))
+	descriptorClaim, err := core.NewClaim(descriptorSchema, descriptorOptions...)
+	if err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("failed to create claim: %w", err))
+	}
+	fmt.Printf("-> Issued %s claim: %s\n", descriptor.Type, sensitive.claimJSON(descriptorClaim))
+	printClaimHex("   ", descriptorClaim)
+	for _, name := range descriptor.slots.names() {
+		fmt.Printf("   -> Slot %s (slot index %d): %s\n", name, dataSlotIndexes[name], sensitive.value(descriptor.slots[name]))
+	}
+	if descriptor.merklizedRoot != nil {
+		fmt.Printf("   -> Merklized root in slot %s (slot index %d): %s\n", descriptor.merklizedSlot, dataSlotIndexes[descriptor.merklizedSlot], sensitive.value(descriptor.merklizedRoot))
+	}
+	fmt.Print("-> Add the described claim to the claims tree\n\n\n")
+	if err := w.issueClaim(ctx, "issue-claim", descriptorClaim); err != nil {
+		return fmt.Errorf("failed to add the claim: %w", err)
+	}
+	w.descriptorClaim = descriptorClaim
+	if req := w.claimReq; req != nil && req.Supersedes != nil {
+		w.receipts[len(w.receipts)-1].Supersedes = req.Supersedes
+		fmt.Printf("-> The claim supersedes the claim of %s with the revocation nonce %d\n\n", req.Supersedes.Issuer, req.Supersedes.RevocationNonce)
+	}
+	return nil
+}
+
+// prepareTransition computes the state transition to the new state, and checks it against the pending
+// transition and the stored identity of the issuer
+func (w *issuanceRun) prepareTransition(ctx context.Context) error {
+	f, identity, id := w.flags, w.identity, w.identity.ID
+	// construct the new identity state
+	fmt.Print("Calculate the new state\n\n")
+	newState, _ := identity.State()
+
+	// construct the inputs to feed to the proof generation for the state transition, with the
+	// [genesis state + new state] signed using the identity key
+	fmt.Println("-> state transition from old to new")
+	// the root of a sparse merkle tree only depends on the claims in it, not on the order they were added in,
+	// but the sequence of revocation nonces follows the order of the claims
+	if f.expectedRoot != "" {
+		claimsRoot := w.trees.claims.Root().BigInt().String()
+		if claimsRoot != f.expectedRoot {
+			return withCode(errCodeVerificationFailed, fmt.Errorf("the claims root %s doesn't match the --expected-root %s, different claims were issued", claimsRoot, f.expectedRoot))
+		}
+		fmt.Printf("-> The claims root matches the expected root %s\n", claimsRoot)
+	}
+	pending := identity.PendingChanges()
+	fmt.Printf("-> The transition covers the %d claims and %d revocations since the published state\n", len(pending.Claims), len(pending.Revocations))
+	var stateTransitionInputs *circuits.StateTransitionInputs
+	err := w.metrics.timePhase(phaseInputs, func() (err error) {
+		stateTransitionInputs, err = identity.StateTransition(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to construct the state transition: %w", err)
+	}
+	genesisTreeState := stateTransitionInputs.OldTreeState
+
+	// a transition whose inputs were written but not published is emitted again, rather than replaced by a
+	// different transition from the same old state
+	oldStateText, newStateText := genesisTreeState.State.BigInt().String(), stateTransitionInputs.NewState.BigInt().String()
+	resumed, err := pendingTransition(f.transitions, id.String())
+	if err != nil {
+		return fmt.Errorf("failed to read the pending transitions: %w", err)
+	}
+	if resumed != nil && (resumed.OldState != oldStateText || resumed.NewState != newStateText) {
+		if !f.abandonPending {
+			return withCode(errCodeConflict, fmt.Errorf("not writing a new transition: the transition from %s to %s, written at %s, is pending, mark it with transition published, or pass --abandon-pending to replace it", resumed.OldState, resumed.NewState, resumed.Created.Format(time.RFC3339)))
+		}
+		fmt.Printf("-> Abandon the pending transition from %s to %s\n", resumed.OldState, resumed.NewState)
+		if !f.dryRun {
+			if _, err := decideTransition(f.transitions, id.String(), func(t *stateTransition) { t.Status = transitionAbandoned }); err != nil {
+				return fmt.Errorf("failed to abandon the pending transition: %w", err)
+			}
+		}
+		resumed = nil
+	} else if resumed != nil && resumed.treeDepth() != f.treeDepth {
+		// the same transition at another depth has proofs of another length, which the circuit rejects
+		fmt.Printf("-> Abandon the pending transition written for trees of depth %d, to write its inputs for the depth %d\n", resumed.treeDepth(), f.treeDepth)
+		if !f.dryRun {
+			if _, err := decideTransition(f.transitions, id.String(), func(t *stateTransition) { t.Status = transitionAbandoned }); err != nil {
+				return fmt.Errorf("failed to abandon the pending transition: %w", err)
+			}
+		}
+		resumed = nil
+	} else if resumed != nil {
+		fmt.Printf("-> Resume the pending transition written at %s, with the same inputs\n", resumed.Created.Format(time.RFC3339))
+	}
+	// every run starts the identity from its genesis state, as replay does, so the identity of the run
+	// replaces the stored one, that the revoke and update-claim commands change. A stored identity that has
+	// published states since is only replaced on request, as its later claims and revocations would be lost.
+	replaced, err := findIdentity(f.identities, id.String())
+	if err != nil {
+		return fmt.Errorf("failed to read the stored identities: %w", err)
+	}
+	if replaced != nil && len(replaced.Published) > 0 {
+		if !f.replaceIdentity {
+			return withCode(errCodeConflict, fmt.Errorf("not replacing the stored identity: the stored identity is at the published state %s, change it with revoke or update-claim, or pass --replace-identity to replace it with this run from the genesis state", replaced.Published[len(replaced.Published)-1].State))
+		}
+		fmt.Printf("-> Replace the stored identity at the published state %s with this run from the genesis state\n", replaced.Published[len(replaced.Published)-1].State)
+	}
+	w.newState, w.pending, w.inputs, w.resumed = newState, pending, stateTransitionInputs, resumed
+	return nil
+}
+
+// selfCheck verifies the signature of the transition and the merkle proofs of the claims, before the inputs
+// are written
+func (w *issuanceRun) selfCheck(ctx context.Context) error {
+	f, identity, stateTransitionInputs := w.flags, w.identity, w.inputs
+	authClaim, pubKey := identity.AuthClaim, w.signer.Public()
+	genesisTreeState := stateTransitionInputs.OldTreeState
+	signature := stateTransitionInputs.Signature
+	hashOldAndNewState, _ := poseidon.Hash([]*big.Int{genesisTreeState.State.BigInt(), stateTransitionInputs.NewState.BigInt()})
+
+	if f.skipSelfCheck {
+		fmt.Println("-> Skipping the verification of the signature and the merkle proofs")
+	} else {
+		fmt.Println("-> Verify the signature and the merkle proofs before writing the inputs")
+		checks := []selfCheck{
+			{"issuer key against the issuer identity", func() error {
+				return identity.CheckSigner(ctx)
+			}},
+			{"signature of the old and new states by the issuer key", func() error {
+				if !pubKey.VerifyPoseidon(hashOldAndNewState, signature) {
+					return fmt.Errorf("the signature doesn't verify with the public key %s", pubKey)
+				}
+				return nil
+			}},
+			{"inclusion of the auth claim in the genesis claims tree", func() error {
+				return verifyInclusion(genesisTreeState.ClaimsRoot, stateTransitionInputs.AuthClaim.Proof, authClaim)
+			}},
+			{"non-revocation of the auth claim in the genesis revocation tree", func() error {
+				return verifyNonRevocation(genesisTreeState.RevocationRoot, stateTransitionInputs.AuthClaim.NonRevProof.Proof, authClaim.GetRevocationNonce())
+			}},
+			{"inclusion of the age claim in the new claims tree", func() error {
+				return verifyClaimInTree(ctx, identity.ClaimsTree(), w.ageClaim)
+			}},
+			{"inclusion of the country claim in the new claims tree", func() error {
+				return verifyClaimInTree(ctx, identity.ClaimsTree(), w.countryClaim)
+			}},
+			{"inclusion of the KYC creds claim in the new claims tree", func() error {
+				return verifyClaimInTree(ctx, identity.ClaimsTree(), w.kycClaim)
+			}},
+		}
+		if w.descriptorClaim != nil {
+			checks = append(checks, selfCheck{"inclusion of the described claim in the new claims tree", func() error {
+				return verifyClaimInTree(ctx, identity.ClaimsTree(), w.descriptorClaim)
+			}})
+		}
+		for _, c := range checks {
+			if err := w.metrics.timePhase(phaseSelfCheck, c.check); err != nil {
+				err = fmt.Errorf("failed to verify the %s: %w", c.name, err)
+				// a failed check is a verification failure, unless it has a class of its own
+				if classifyError(err).code == errCodeInternal {
+					err = withCode(errCodeVerificationFailed, err)
+				}
+				return err
+			}
+			fmt.Printf("   -> Verified the %s\n", c.name)
+		}
+	}
+	return nil
+}
+
+// printTreeProofs prints the proofs that --tree-proof asks for
+func (w *issuanceRun) printTreeProofs(ctx context.Context) error {
+	f := w.flags
+	for _, req := range f.treeProofs {
+		fmt.Printf("-> Proof for the key %s of the %s tree\n", req.key, req.tree)
+		proof, err := w.trees.generateProof(ctx, req.tree, req.key, f.treeProofFormat)
+		if err != nil {
+			return fmt.Errorf("failed to generate the proof: %w", err)
+		}
+		out, _ := json.MarshalIndent(proof, "", "  ")
+		fmt.Println(string(out))
+	}
+	return nil
+}
+
+// transitionInputs are the inputs of the state transition, those of the pending transition when it is resumed
+func (w *issuanceRun) transitionInputs(ctx context.Context) ([]byte, error) {
+	if err := checkCancelled(ctx); err != nil {
+		return nil, fmt.Errorf("failed to write the inputs: %w", err)
+	}
+	inputBytes, _ := w.inputs.InputsMarshal()
+	if w.resumed != nil {
+		inputBytes = w.resumed.Inputs
+	}
+	w.metrics.inputsGenerated++
+	return inputBytes, nil
+}
+
+// printDryRun prints the inputs that a dry run would have written
+func (w *issuanceRun) printDryRun(inputBytes []byte) {
+	output := w.output
+	dryRunOutput, _ := json.MarshalIndent(map[string]interface{}{
+		"dryRun": true,
+		"file":   output.location(inputsName),
+		"inputs": json.RawMessage(inputBytes),
+	}, "", "  ")
+	fmt.Printf("-> Dry run, the inputs would have been written to %s\n%s\n", output.describe(inputsName), dryRunOutput)
+}
+
+// writeInputs writes the inputs of the state transition with their signature, records the transition as
+// pending, and stores the identity for the commands that change it later
+func (w *issuanceRun) writeInputs(ctx context.Context, inputBytes []byte) error {
+	f, identity, id, output := w.flags, w.identity, w.identity.ID, w.output
+	encodedInputs, err := encodeTransport(inputBytes, f.encoding)
+	if err == nil {
+		err = output.Write(inputsName, encodedInputs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the inputs: %w", err)
+	}
+	fmt.Printf("-> Input bytes written to %s\n", output.describe(inputsName))
+	w.manifest = newManifest("issue-claims", id.String(), w.inputs.OldTreeState.State.BigInt().String(), w.inputs.NewState.BigInt().String())
+	var transitionNonces []uint64
+	for _, c := range w.pending.Claims {
+		transitionNonces = append(transitionNonces, c.GetRevocationNonce())
+	}
+	w.manifest.add(inputsName, encodedInputs, formatInputs, f.encoding, transitionNonces)
+	if f.encoding != encodingJSON {
+		reportTokenSize(output, inputsName, encodedInputs)
+	}
+	// the inputs are handed over by email or chat in the demos, the holder verifies the signature before use
+	sigBytes, err := signPayload(w.signer, id, inputsName, inputBytes)
+	if err == nil {
+		err = output.Write(payloadSignaturePath(inputsName), sigBytes)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sign the inputs: %w", err)
+	}
+	fmt.Printf("-> Detached signature of the inputs written to %s\n", output.describe(payloadSignaturePath(inputsName)))
+	w.manifest.add(payloadSignaturePath(inputsName), sigBytes, formatSignature, encodingJSON, transitionNonces)
+	if w.resumed == nil {
+		transition := newTransitionRecord(identity, w.inputs, inputBytes, w.pending, w.operator, f.treeDepth)
+		if err := recordTransition(f.transitions, transition); err != nil {
+			return fmt.Errorf("failed to record the pending transition: %w", err)
+		}
+		fmt.Printf("-> Transition recorded as pending in the file: %s, mark it with transition published once it is on-chain\n", f.transitions)
+	}
+	stored, err := newStoredIdentity(identity, f.treeDepth, nil)
+	if err == nil {
+		err = saveIdentity(f.identities, stored)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store the identity: %w", err)
+	}
+	fmt.Printf("-> Identity stored in the file: %s, for the revoke and update-claim commands\n", f.identities)
+	if f.verbose {
+		if transitions, err := readTransitions(f.transitions); err == nil {
+			printLineage(id.String(), stateLineage(transitions, id.String()))
+		}
+	}
+	if err := w.metrics.timePhase(phaseAuditLog, func() error {
+		return w.auditLog.record("state-transition", auditCompleted, map[string]string{"issuer": id.String(), "inputs": output.location(inputsName)}, identity.GenesisState, w.newState)
+	}); err != nil {
+		return fmt.Errorf("failed to record the operation in the audit log: %w", err)
+	}
+	f.notifiers.notifyAll(ctx, f.notifyTimeout, &issuanceEvent{
+		Type:     eventStateTransition,
+		Time:     now().UTC().Truncate(time.Second),
+		Issuer:   id.String(),
+		OldState: identity.GenesisState.BigInt().String(),
+		NewState: w.newState.BigInt().String(),
+		Inputs:   output.location(inputsName),
+	})
+	return nil
+}
+
+// writeHolderArtifacts writes the receipts, the payload and the W3C credentials for the holder, and the
+// manifest that lists the artifacts of the run
+func (w *issuanceRun) writeHolderArtifacts(ctx context.Context) error {
+	f, output := w.flags, w.output
+	if err := w.metrics.timePhase(phaseOutput, func() error {
+		return writeReceipts(f.receipts, w.receipts)
+	}); err != nil {
+		return fmt.Errorf("failed to write the receipts: %w", err)
+	}
+	fmt.Printf("-> Receipts for the %d issued claims written to the file: %s\n", len(w.receipts), f.receipts)
+	var receiptNonces []uint64
+	for _, r := range w.receipts {
+		receiptNonces = append(receiptNonces, r.RevocationNonce)
+	}
+	// the receipts file holds the receipts of every run, it is listed as it is after this one
+	if receiptsPath, err := filepath.Abs(f.receipts); err == nil {
+		if receiptsBytes, err := os.ReadFile(receiptsPath); err == nil {
+			w.manifest.add(receiptsPath, receiptsBytes, formatReceipts, encodingJSON, receiptNonces)
+		}
+	}
+	if w.subject != nil || f.encryptTo != "" {
+		payloadBytes, err := encodeHolderPayload(&holderPayload{Receipts: w.receipts}, f.encryptTo)
+		if err == nil {
+			payloadBytes, err = encodeTransport(payloadBytes, f.encoding)
+		}
+		if err == nil {
+			err = output.Write(f.holderPayload, payloadBytes)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write the payload for the holder: %w", err)
+		}
+		if f.encryptTo != "" {
+			fmt.Printf("-> Payload for the holder encrypted to %s and written to %s\n", f.encryptTo, output.describe(f.holderPayload))
+		} else {
+			fmt.Printf("-> Payload for the holder written to %s\n", output.describe(f.holderPayload))
+		}
+		if f.encoding != encodingJSON {
+			reportTokenSize(output, f.holderPayload, payloadBytes)
+		}
+		w.manifest.add(f.holderPayload, payloadBytes, formatHolderPayload, f.encoding, receiptNonces).Encrypted = f.encryptTo != ""
+	}
+	if f.w3cCredentials != "" {
+		// each claim of the holder is signed again as a credential, the claim of a descriptor by the URL
+		// of its registered schema
+		type w3cClaim struct {
+			claim          *core.Claim
+			schemaBytes    []byte
+			credentialType string
+			schemaURL      string
+		}
+		w3cClaims := []w3cClaim{
+			{w.ageClaim, w.schemaBytes, "KYCAgeCredential", f.schemaURL},
+			{w.countryClaim, w.schemaBytes, "KYCCountryOfResidenceCredential", f.schemaURL},
+			{w.kycClaim, w.schemaBytes, "KYCCredential", f.schemaURL},
+		}
+		if descriptor := w.descriptor; w.descriptorClaim != nil && descriptor.subject != nil {
+			url := f.schemaURL
+			if registered, _ := findSchema(f.schemas, descriptor.Schema); registered != nil {
+				url = registered.url()
+			}
+			w3cClaims = append(w3cClaims, w3cClaim{w.descriptorClaim, descriptor.schemaBytes, descriptor.Type, url})
+		}
+		var credentials []*w3cCredential
+		var credentialNonces []uint64
+		for _, c := range w3cClaims {
+			credentialNonces = append(credentialNonces, c.claim.GetRevocationNonce())
+			fields, err := schemaFields(c.schemaBytes, c.credentialType)
+			if err != nil {
+				return fmt.Errorf("failed to resolve the fields of the credential: %w", err)
+			}
+			cred, err := w.identity.Credential(ctx, c.claim)
+			if err != nil {
+				return fmt.Errorf("failed to sign the credential: %w", err)
+			}
+			vc, err := newW3CCredential(w.rnd, cred, c.credentialType, c.schemaURL, fields, f.revocationEndpoint)
+			if err != nil {
+				return fmt.Errorf("failed to render the W3C credential: %w", err)
+			}
+			credentials = append(credentials, vc)
+		}
+		out, _ := json.MarshalIndent(credentials, "", "  ")
+		if err := output.Write(f.w3cCredentials, out); err != nil {
+			return fmt.Errorf("failed to write the W3C credentials: %w", err)
+		}
+		fmt.Printf("-> %d W3C credentials for the holder written to %s\n", len(credentials), output.describe(f.w3cCredentials))
+		w.manifest.add(f.w3cCredentials, out, formatW3CCredentials, encodingJSON, credentialNonces)
+	}
+	if err := output.Write(manifestName, w.manifest.encode()); err != nil {
+		return fmt.Errorf("failed to write the manifest of the artifacts: %w", err)
+	}
+	fmt.Printf("-> Manifest of the artifacts written to %s\n", output.describe(manifestName))
+	return nil
+}
+
+// markRequestIssued marks the claim request of --from-request as issued, only once the claim is in the
+// inputs, so that a failed run leaves it approved
+func (w *issuanceRun) markRequestIssued() error {
+	claimHex, _ := claimToHex(w.descriptorClaim)
+	issued := now().UTC()
+	_, err := updateClaimRequest(w.flags.claimRequests, w.claimReq.ID, requestApproved, func(r *claimRequest) {
+		r.Status = requestIssued
+		r.Issuer = w.identity.ID.String()
+		r.Claim = claimHex
+		r.Issued = &issued
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark the claim request as issued: %w", err)
+	}
+	fmt.Printf("-> Claim request %s marked as issued\n", w.claimReq.ID)
+	return nil
+}
+
+// printSummary prints the operations of the run and their timings, for --verbose
+func (w *issuanceRun) printSummary() {
+	fmt.Println()
+	w.metrics.signatures = w.signer.signatures()
+	if w.flags.summaryJSON {
+		w.metrics.printJSON(w.newState)
+	} else {
+		w.metrics.print(w.newState)
+	}
+}
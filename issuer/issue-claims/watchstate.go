@@ -0,0 +1,328 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	core "github.com/iden3/go-iden3-core"
+	"golang.org/x/crypto/sha3"
+)
+
+// mumbaiStateContract is the address of the state contract on the mumbai network, the one the upload script
+// submits to
+const mumbaiStateContract = "0x46Fd04eEa588a3EA7e9F055dd691C688c4148ab3"
+
+// watchBlockRange is the number of blocks that one eth_getLogs call asks for, as nodes limit the range of
+// a query
+const watchBlockRange = 5000
+
+// stateUpdatedTopic is the first topic of the StateUpdated event of the state contract, the hash of its
+// signature. None of the parameters of the event is indexed, so the logs of every identity are fetched and
+// the ID is read from the data.
+var stateUpdatedTopic = func() string {
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte("StateUpdated(uint256,uint64,uint64,uint256)"))
+	return "0x" + hex.EncodeToString(h.Sum(nil))
+}()
+
+// stateUpdated is a StateUpdated event of the state contract
+type stateUpdated struct {
+	ID        *big.Int
+	BlockN    uint64
+	Timestamp uint64
+	State     *big.Int
+	TxHash    string
+	// Removed tells that the block of the event was dropped by a reorganization of the chain
+	Removed bool
+}
+
+// rpcLog is a log as eth_getLogs returns it
+type rpcLog struct {
+	Data            string `json:"data"`
+	TransactionHash string `json:"transactionHash"`
+	Removed         bool   `json:"removed"`
+}
+
+// decodeStateUpdated decodes the data of a StateUpdated log, the four parameters of the event in words of
+// 32 bytes
+func decodeStateUpdated(l *rpcLog) (*stateUpdated, error) {
+	data, err := hex.DecodeString(strings.TrimPrefix(l.Data, "0x"))
+	if err != nil || len(data) != 4*32 {
+		return nil, fmt.Errorf("the log of the transaction %s is not a StateUpdated event: %d bytes of data", l.TransactionHash, len(data))
+	}
+	word := func(n int) *big.Int { return new(big.Int).SetBytes(data[n*32 : (n+1)*32]) }
+	if !word(1).IsUint64() || !word(2).IsUint64() {
+		return nil, fmt.Errorf("the log of the transaction %s is not a StateUpdated event: the block or the timestamp is not a uint64", l.TransactionHash)
+	}
+	return &stateUpdated{ID: word(0), BlockN: word(1).Uint64(), Timestamp: word(2).Uint64(), State: word(3), TxHash: l.TransactionHash, Removed: l.Removed}, nil
+}
+
+// rpcClient calls the JSON-RPC API of an Ethereum node over HTTP
+type rpcClient struct {
+	url    string
+	client *http.Client
+	nextID int
+}
+
+func (c *rpcClient) call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	c.nextID++
+	b, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": c.nextID, "method": method, "params": params})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return withCode(errCodeUnavailable, err, "rpc", c.url)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return withCode(errCodeUnavailable, fmt.Errorf("%s responded with %s: %s", method, res.Status, strings.TrimSpace(string(b))), "rpc", c.url)
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("invalid response to %s: %s", method, err)
+	}
+	if response.Error != nil {
+		return withCode(errCodeUnavailable, fmt.Errorf("%s failed with the code %d: %s", method, response.Error.Code, response.Error.Message), "rpc", c.url)
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+func (c *rpcClient) blockNumber(ctx context.Context) (uint64, error) {
+	var n string
+	if err := c.call(ctx, "eth_blockNumber", nil, &n); err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimPrefix(n, "0x"), 16, 64)
+}
+
+// stateUpdates returns the StateUpdated events of the contract in the blocks from and to, both included
+func (c *rpcClient) stateUpdates(ctx context.Context, contract string, from, to uint64) ([]*stateUpdated, error) {
+	filter := map[string]interface{}{
+		"address":   contract,
+		"fromBlock": fmt.Sprintf("0x%x", from),
+		"toBlock":   fmt.Sprintf("0x%x", to),
+		"topics":    []string{stateUpdatedTopic},
+	}
+	var logs []*rpcLog
+	if err := c.call(ctx, "eth_getLogs", []interface{}{filter}, &logs); err != nil {
+		return nil, err
+	}
+	var events []*stateUpdated
+	for _, l := range logs {
+		e, err := decodeStateUpdated(l)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// stateContract returns the node URL and the state contract address of a hardhat network of the upload
+// script, kaleido with the contract of the deploy script, or mumbai
+func stateContract(network string) (string, string, error) {
+	switch network {
+	case "mumbai":
+		return os.Getenv("MUMBAI_NODE_URL"), mumbaiStateContract, nil
+	case "kaleido":
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		var deployed struct {
+			State string `json:"state"`
+		}
+		if b, err := os.ReadFile(filepath.Join(home, "iden3_deploy_output.json")); err == nil {
+			if err := json.Unmarshal(b, &deployed); err != nil {
+				return "", "", fmt.Errorf("the output of the deploy script is not valid: %s", err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", "", err
+		}
+		return os.Getenv("KALEIDO_NODE_URL"), deployed.State, nil
+	}
+	return "", "", usageError("unknown network %q, must be kaleido or mumbai, or give --rpc-url and --state-contract", network)
+}
+
+// stateWatcher records the states of an issuer that the state contract publishes in its transitions and
+// its stored identity
+type stateWatcher struct {
+	issuer      string
+	transitions string
+	identities  string
+	// unexpected counts the published states of the issuer that none of its transitions ends in
+	unexpected int
+}
+
+func (w *stateWatcher) observe(ctx context.Context, e *stateUpdated) error {
+	id, err := core.IDFromInt(e.ID)
+	if err != nil || id.String() != w.issuer {
+		return nil
+	}
+	state := e.State.String()
+	if e.Removed {
+		fmt.Printf("WARNING: the state %s of %s in the block %d was removed by a reorganization of the chain, check the transition that published it\n", state, w.issuer, e.BlockN)
+		w.unexpected++
+		return nil
+	}
+	transitions, err := readTransitions(w.transitions)
+	if err != nil {
+		return err
+	}
+	var known *stateTransition
+	for _, t := range transitions {
+		if t.Issuer == w.issuer && t.NewState == state && (known == nil || t.Status != transitionAbandoned) {
+			known = t
+		}
+	}
+	switch {
+	case known != nil && known.Status == transitionPublished:
+		fmt.Printf("-> The state %s in the block %d is the recorded publication of the transition from %s\n", state, e.BlockN, known.OldState)
+		return nil
+	case known != nil && known.Status == transitionPending:
+		t, err := decideTransition(w.transitions, w.issuer, func(t *stateTransition) {
+			t.Status = transitionPublished
+			t.TxHash = e.TxHash
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Marked the transition of %s from %s to %s as published by the transaction %s in the block %d\n", t.Issuer, t.OldState, t.NewState, t.TxHash, e.BlockN)
+		return recordPublication(ctx, w.identities, t)
+	case known != nil:
+		fmt.Printf("WARNING: the state contract has the state %s for %s, from the transaction %s in the block %d, which is the state of an abandoned transition from %s\n", state, w.issuer, e.TxHash, e.BlockN, known.OldState)
+	default:
+		fmt.Printf("WARNING: the state contract has the state %s for %s, from the transaction %s in the block %d, which none of the transitions of the issuer ends in, another key of the identity may have published it\n", state, w.issuer, e.TxHash, e.BlockN)
+	}
+	w.unexpected++
+	return nil
+}
+
+// watchStateCommand handles the "watch-state" command, which polls the state contract for the StateUpdated
+// events of an issuer. A pending transition whose new state is published is marked published, whoever
+// sent the transaction, and a state that none of the issuer's transitions ends in is reported.
+func watchStateCommand(args []string) error {
+	fs := flag.NewFlagSet("watch-state", flag.ExitOnError)
+	readOnly.register(fs, false)
+	issuerFlag := fs.String("issuer", "", "base58 ID of the issuer whose states are watched")
+	networkFlag := fs.String("network", "kaleido", "the hardhat network of the state contract, kaleido (KALEIDO_NODE_URL and the contract of the deploy script) or mumbai (MUMBAI_NODE_URL)")
+	rpcFlag := fs.String("rpc-url", "", "JSON-RPC URL of the Ethereum node, in place of the one of the network")
+	contractFlag := fs.String("state-contract", "", "address of the state contract, in place of the one of the network")
+	fromBlockFlag := fs.Uint64("from-block", 0, "the first block to read the events from")
+	intervalFlag := fs.Duration("interval", 15*time.Second, "how often the node is polled for new blocks")
+	onceFlag := fs.Bool("once", false, "read the events up to the latest block and stop, rather than watching for new ones")
+	transitionsFlag := fs.String("transitions", defaultTransitionsPath(), "path of the file that the state transitions are recorded in")
+	identitiesFlag := fs.String("identities", defaultIdentitiesPath(), "path of the file of the stored identities, whose pending changes a published transition covers")
+	timeoutFlag := fs.Duration("timeout", 0, "stop watching after this long, for example 1h (no timeout by default)")
+	var operators operatorFlags
+	operators.register(fs)
+	fs.Parse(args)
+	if *issuerFlag == "" {
+		return usageError("usage: watch-state --issuer <id> [--network kaleido|mumbai] [--rpc-url <url>] [--state-contract <address>] [--from-block <n>] [--once]")
+	}
+	if _, err := core.IDFromString(*issuerFlag); err != nil {
+		return withCode(errCodeInvalidInput, fmt.Errorf("invalid issuer ID %q: %s", *issuerFlag, err))
+	}
+	if _, err := operators.authorize(rolePublish); err != nil {
+		return fmt.Errorf("not authorized to record the published states: %w", err)
+	}
+	url, contract, err := stateContract(*networkFlag)
+	if err != nil {
+		return err
+	}
+	if *rpcFlag != "" {
+		url = *rpcFlag
+	}
+	if *contractFlag != "" {
+		contract = *contractFlag
+	}
+	if url == "" || contract == "" {
+		return usageError("the node URL or the state contract of the network %s is not known, give --rpc-url and --state-contract", *networkFlag)
+	}
+
+	ctx, cancel := newCommandContext(*timeoutFlag)
+	defer cancel()
+	client := &rpcClient{url: url, client: &http.Client{Timeout: 30 * time.Second}}
+	w := &stateWatcher{issuer: *issuerFlag, transitions: *transitionsFlag, identities: *identitiesFlag}
+	fmt.Printf("Watch the states of %s on the state contract %s, from the block %d\n", w.issuer, contract, *fromBlockFlag)
+	next := *fromBlockFlag
+	for {
+		latest, err := client.blockNumber(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		for from := next; err == nil && from <= latest; from += watchBlockRange {
+			to := from + watchBlockRange - 1
+			if to > latest {
+				to = latest
+			}
+			var events []*stateUpdated
+			if events, err = client.stateUpdates(ctx, contract, from, to); err == nil {
+				for _, e := range events {
+					if err = w.observe(ctx, e); err != nil {
+						break
+					}
+				}
+			}
+			if err == nil {
+				next = to + 1
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if *onceFlag || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(*intervalFlag):
+		}
+	}
+	if next > *fromBlockFlag {
+		fmt.Printf("-> Read the events up to the block %d, --from-block %d continues from there\n", next-1, next)
+	}
+	if w.unexpected > 0 {
+		return withCode(errCodeVerificationFailed, fmt.Errorf("the state contract has unexpected states of %s, %d in all, see the warnings", w.issuer, w.unexpected), "issuer", w.issuer)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	core "github.com/iden3/go-iden3-core"
+)
+
+// stateUpdatedLog encodes a StateUpdated event as eth_getLogs returns it
+func stateUpdatedLog(t *testing.T, id string, blockN uint64, state, txHash string) map[string]interface{} {
+	parsed, err := core.IDFromString(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := new(big.Int).SetString(state, 10)
+	var data []byte
+	for _, word := range []*big.Int{parsed.BigInt(), new(big.Int).SetUint64(blockN), big.NewInt(1654873445), s} {
+		data = append(data, word.FillBytes(make([]byte, 32))...)
+	}
+	return map[string]interface{}{"data": "0x" + hex.EncodeToString(data), "transactionHash": txHash}
+}
+
+func TestWatchStateRecordsThePublishedTransition(t *testing.T) {
+	testHome(t)
+	t.Setenv(issuerKeyEnv, strings.Repeat("12", 32))
+	code, printed := runWalkthrough(t)
+	if code != 0 {
+		t.Fatalf("the walkthrough failed with %d: %s", code, printed)
+	}
+	id := printedValue(printed, "-> ID of the issuer identity:")
+	pending, err := pendingTransition(defaultTransitionsPath(), id)
+	if err != nil || pending == nil {
+		t.Fatalf("expected a pending transition, got %v", err)
+	}
+
+	const contract = "0x1234567890123456789012345678901234567890"
+	var mu sync.Mutex
+	logs := []map[string]interface{}{
+		stateUpdatedLog(t, testHolderID, 7, "42", "0x01"),
+		stateUpdatedLog(t, id, 8, pending.NewState, "0x02"),
+		stateUpdatedLog(t, id, 9, "123", "0x03"),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call struct {
+			ID     int               `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+			t.Errorf("invalid JSON-RPC call: %s", err)
+		}
+		var result interface{}
+		switch call.Method {
+		case "eth_blockNumber":
+			result = "0xa"
+		case "eth_getLogs":
+			var filter struct {
+				Address string   `json:"address"`
+				Topics  []string `json:"topics"`
+			}
+			json.Unmarshal(call.Params[0], &filter)
+			if filter.Address != contract || len(filter.Topics) != 1 || filter.Topics[0] != "0x81c6f328b24014ef550c34a433275b52f3a8a0f32aa871adec069ab526a02390" {
+				t.Errorf("expected the logs of the StateUpdated event of the contract, got %+v", filter)
+			}
+			mu.Lock()
+			result = logs
+			mu.Unlock()
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": call.ID, "result": result})
+	}))
+	defer server.Close()
+
+	var watchErr error
+	printed = captureOutput(t, func() {
+		watchErr = watchStateCommand([]string{"--issuer", id, "--rpc-url", server.URL, "--state-contract", contract, "--once"})
+	})
+	if watchErr == nil || classifyError(watchErr).code != errCodeVerificationFailed {
+		t.Errorf("expected the unexpected state to fail the watch, got %v", watchErr)
+	}
+	if !strings.Contains(printed, "WARNING: the state contract has the state 123 for "+id+", from the transaction 0x03 in the block 9") {
+		t.Errorf("expected a warning about the unexpected state, got: %s", printed)
+	}
+	if strings.Contains(printed, "the state 42 ") {
+		t.Errorf("expected the state of another identity to be ignored, got: %s", printed)
+	}
+	if !strings.Contains(printed, "-> Read the events up to the block 10, --from-block 11 continues from there") {
+		t.Errorf("expected the next block to be printed, got: %s", printed)
+	}
+
+	transitions, err := readTransitions(defaultTransitionsPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := transitions[len(transitions)-1]
+	if last.Status != transitionPublished || last.TxHash != "0x02" {
+		t.Errorf("expected the transition published by the transaction 0x02, got %s by %q", last.Status, last.TxHash)
+	}
+	stored, err := findIdentity(defaultIdentitiesPath(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Published) != 1 || stored.Published[0].State != pending.NewState {
+		t.Errorf("expected the stored identity to be at the published state %s, got %+v", pending.NewState, stored.Published)
+	}
+
+	// the events read again only confirm the publication
+	mu.Lock()
+	logs = logs[:2]
+	mu.Unlock()
+	printed = captureOutput(t, func() {
+		watchErr = watchStateCommand([]string{"--issuer", id, "--rpc-url", server.URL, "--state-contract", contract, "--once", "--from-block", "8"})
+	})
+	if watchErr != nil {
+		t.Errorf("expected the recorded publication to pass, got %v", watchErr)
+	}
+	if !strings.Contains(printed, "is the recorded publication of the transition from "+pending.OldState) {
+		t.Errorf("expected the recorded publication to be recognized, got: %s", printed)
+	}
+}
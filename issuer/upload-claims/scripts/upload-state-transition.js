@@ -24,6 +24,9 @@ const path = require('path');
 
 const pathOutputJson = path.join(os.homedir(), './iden3_deploy_output.json');
 const zkinputJson = path.join(os.homedir(), './iden3_input.json');
+// a proof generated elsewhere is submitted as it is, after publish-state has checked its public signals
+const externalProofJson = process.env.IDEN3_PROOF;
+const externalPublicJson = process.env.IDEN3_PUBLIC;
 
 const { generateWitness } = require('./snark/generate_witness');
 const { prove } = require('./snark/prove');
@@ -44,17 +47,20 @@ async function main() {
 
   const contract = await ethers.getContractAt('State', stateContractAddress);
 
-  // gather the inputs for generating the proof
-  const content = JSON.parse(fs.readFileSync(zkinputJson));
-
-  const issuerId = content.userID;
-  const oldState = content.oldUserState;
-  const newState = content.newUserState;
-  const isOldStateGenesis = content.isOldStateGenesis;
+  let proof, publicSignals;
+  if (externalProofJson && externalPublicJson) {
+    proof = JSON.parse(fs.readFileSync(externalProofJson));
+    publicSignals = JSON.parse(fs.readFileSync(externalPublicJson));
+  } else {
+    // gather the inputs for generating the proof
+    const content = JSON.parse(fs.readFileSync(zkinputJson));
+    await generateWitness(content);
+    ({ proof, publicSignals } = await prove());
+    await verify(proof, publicSignals);
+  }
 
-  await generateWitness(content);
-  const { proof, publicSignals } = await prove();
-  await verify(proof, publicSignals);
+  // the public signals of the state transition circuit are in the order the contract takes them
+  const [issuerId, oldState, newState, isOldStateGenesis] = publicSignals;
 
   const result = await groth16ExportSolidityCallData(proof, publicSignals);
   const a = result[0];
@@ -64,8 +70,9 @@ async function main() {
   let identityState0 = await contract.getState(issuerId);
   console.log('State before transaction: ', identityState0);
 
-  const tx = await contract.transitState(issuerId, oldState, newState, isOldStateGenesis, a, b, c);
+  const tx = await contract.transitState(issuerId, oldState, newState, isOldStateGenesis === '1', a, b, c);
   await tx.wait();
+  console.log('Transaction hash: ', tx.hash);
   let identityState1 = await contract.getState(issuerId);
   console.log('State after transaction: ', identityState1);
 }